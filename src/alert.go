@@ -0,0 +1,358 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+    "math"
+    "os"
+    "sort"
+    "sync"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    AlertStatusPending  = "pending"
+    AlertStatusFiring   = "firing"
+    AlertStatusResolved = "resolved"
+)
+
+/*
+
+The alert manager keeps the state of an alert for each alert rule, client, and
+monitor key whose values meet the condition of the rule; see alertRule.go for
+the rules. The timestamps of the values drive the states, so delayed values are
+judged by when they were taken:
+
+(inactive) -- active --> pending -- active for the for of the rule --> firing
+firing -- resolving --> (inactive), sending a resolved event
+pending -- not active --> (inactive), sending nothing
+
+An alert fires right away when the for of the rule is empty. A firing alert is
+resolving when a value falls in the resolve range of the rule, or when it is no
+longer active if the resolve range is empty, so that a value wavering around
+the boundary does not resolve and fire the alert over and over. While an alert
+keeps firing, the firing event is sent again every alert.repeatInterval.
+Every change of the states is also appended to the alert history; see
+alertHistory.go.
+
+The states are written to alert.stateFile whenever they change, and read when
+the server starts, so that pending alerts keep counting and firing alerts are
+resolved after a restart:
+
+[
+  {
+    "rule": "fatalRange",
+    "clientId": "cl-1",
+    "key": "cpu-usage",
+    "status": "firing",
+    "value": 97.5,
+    "since": 1600000000,
+    "firedAt": 1600000300,
+    "notifiedAt": 1600000300
+  }
+]
+
+*/
+
+type alertKey struct {
+    rule, clId, mKey string
+}
+
+type alertState struct {
+    Rule       string  `json:"rule"`
+    ClientId   string  `json:"clientId"`
+    Key        string  `json:"key"`
+    Status     string  `json:"status"`
+    Value      float64 `json:"value"` // The latest value
+    Since      int64   `json:"since"` // When the values started to be active
+    FiredAt    int64   `json:"firedAt"`
+    NotifiedAt int64   `json:"notifiedAt"`
+    updated    int64 // The timestamp of the latest value
+}
+
+type alertEvent struct {
+    Status    string             `json:"status"` // Either firing or resolved
+    Rule      string             `json:"rule"`
+    ClientId  string             `json:"clientId"`
+    Key       string             `json:"key"`
+    Value     float64            `json:"value"`
+    Since     int64              `json:"since"`
+    Timestamp int64              `json:"timestamp"`
+    Repeated  bool               `json:"repeated"`
+    Severity  string             `json:"severity"`
+    Summary   string             `json:"summary"`
+    Labels    map[string] string `json:"labels"`
+    historyId string // The transition of the event in the alert history
+}
+
+// A value judged by an alert rule
+type alertObservation struct {
+    rule      AlertRule
+    key       alertKey
+    timestamp int64
+    value     float64
+    active    bool // Meets the condition of the rule
+    resolving bool // Resolves the alert if it is firing
+    rng       Range // The range of active values, for the alert history
+}
+
+type alertManager struct {
+    mu            sync.Mutex
+    states        map[alertKey] *alertState
+    statesChanged bool // Since the states were last written
+    entries       []AlertHistoryEntry // To append, in the order of the changes
+    writeMu       sync.Mutex // Serializes writing the states and the history
+}
+
+func newAlertManager() *alertManager {
+    return &alertManager{
+        states: make(map[alertKey] *alertState),
+    }
+}
+
+// Advances the alert of the observation, returning the event to send if any,
+// and whether the state has changed in a way worth persisting; the caller must
+// hold mu
+func(am *alertManager) observe(obs alertObservation, repeatSec int64) (ev *alertEvent, changed bool) {
+
+    k, val, ts := obs.key, obs.value, obs.timestamp
+    if math.IsNaN(val) || math.IsInf(val, 0) {
+        return nil, false
+    }
+
+    st := am.states[k]
+    if st != nil && ts <= st.updated {
+        // Older than what was judged
+        return nil, false
+    }
+
+    newEvent := func(status string, repeated bool) *alertEvent {
+        return &alertEvent{
+            Status:    status,
+            Rule:      k.rule,
+            ClientId:  k.clId,
+            Key:       k.mKey,
+            Value:     val,
+            Since:     st.Since,
+            Timestamp: ts,
+            Repeated:  repeated,
+        }
+    }
+
+    switch {
+    case st == nil:
+
+        if !obs.active {
+            return nil, false
+        }
+        st = &alertState{
+            Rule:     k.rule,
+            ClientId: k.clId,
+            Key:      k.mKey,
+            Status:   AlertStatusPending,
+            Since:    ts,
+        }
+        am.states[k] = st
+        changed = true
+        fallthrough
+
+    case st.Status == AlertStatusPending:
+
+        st.Value, st.updated = val, ts
+        if !obs.active {
+            delete(am.states, k)
+            return nil, true
+        }
+        forSec, _ := obs.rule.For.Seconds()
+        if ts - st.Since < forSec {
+            return nil, changed
+        }
+        st.Status     = AlertStatusFiring
+        st.FiredAt    = ts
+        st.NotifiedAt = ts
+        return newEvent(AlertStatusFiring, false), true
+
+    default: // Firing
+
+        st.Value, st.updated = val, ts
+        if obs.resolving {
+            delete(am.states, k)
+            return newEvent(AlertStatusResolved, false), true
+        }
+        if repeatSec > 0 && ts - st.NotifiedAt >= repeatSec {
+            st.NotifiedAt = ts
+            return newEvent(AlertStatusFiring, true), true
+        }
+        return nil, false
+
+    }
+
+}
+
+// Returns copies of the states sorted by client and key
+func(am *alertManager) States() []alertState {
+
+    am.mu.Lock()
+    defer am.mu.Unlock()
+
+    states := make([]alertState, 0, len(am.states))
+    for _, st := range am.states {
+        states = append(states, *st)
+    }
+    sort.Slice(states, func(i, j int) bool {
+        if states[i].ClientId != states[j].ClientId {
+            return states[i].ClientId < states[j].ClientId
+        }
+        return states[i].Key < states[j].Key
+    })
+    return states
+
+}
+
+// Returns whether the alert has a state, either pending or firing
+func(am *alertManager) Has(k alertKey) bool {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+    _, ok := am.states[k]
+    return ok
+}
+
+// Advances the alerts of the observations and returns the events to send; the
+// lock of the alert manager is held only while the alerts are advanced, and
+// the files are written after it is released
+func(srv *Server) advanceAlerts(observations []alertObservation) []alertEvent {
+
+    am         := srv.alertManager
+    repeatSec  := int64(srv.config.AlertRepeatInterval) * 60
+    events     := []alertEvent{}
+    anyChanged := false
+
+    am.mu.Lock()
+
+    statusOf := func(k alertKey) (string, int64) {
+        if st, ok := am.states[k]; ok {
+            return st.Status, st.Since
+        }
+        return alertHistoryStatusInactive, 0
+    }
+
+    entries := []AlertHistoryEntry{}
+    for _, obs := range observations {
+
+        before, since := statusOf(obs.key)
+        ev, changed   := am.observe(obs, repeatSec)
+        after, _      := statusOf(obs.key)
+        anyChanged   = anyChanged || changed
+
+        if ev != nil {
+            decorated := obs.rule.decorate(*ev)
+            entry     := newAlertTransitionEntry(decorated, obs.rng)
+            decorated.historyId = entry.Id
+            events  = append(events, decorated)
+            entries = append(entries, entry)
+            continue
+        }
+
+        // Pending, and pending alerts that are gone
+        if before != after {
+            if after == AlertStatusPending {
+                since = obs.timestamp
+            }
+            entries = append(entries, newAlertTransitionEntry(obs.rule.decorate(alertEvent{
+                Status:    after,
+                Rule:      obs.key.rule,
+                ClientId:  obs.key.clId,
+                Key:       obs.key.mKey,
+                Value:     obs.value,
+                Since:     since,
+                Timestamp: obs.timestamp,
+            }), obs.rng))
+        }
+
+    }
+
+    am.statesChanged = am.statesChanged || anyChanged
+    am.entries       = append(am.entries, entries...)
+    am.mu.Unlock()
+
+    if anyChanged || len(entries) > 0 {
+        srv.flushAlertRecords()
+    }
+
+    return events
+
+}
+
+// Writes the states, if changed, and appends the history entries that were
+// left by advancing alerts; the ones left by others in the meantime are
+// written as well, so that the history stays in the order of the changes
+func(srv *Server) flushAlertRecords() {
+
+    am := srv.alertManager
+    am.writeMu.Lock()
+    defer am.writeMu.Unlock()
+
+    am.mu.Lock()
+    changed, entries := am.statesChanged, am.entries
+    am.statesChanged, am.entries = false, nil
+    am.mu.Unlock()
+
+    if changed {
+        if err := srv.writeAlertStates(am.States()); err != nil {
+            EventLogger.Warnln("Failed to write the alert states:", err)
+        }
+    }
+    srv.appendAlertHistory(entries...)
+
+}
+
+// Judges the recorded values and returns the events to send
+func(srv *Server) evaluateAlerts(entries []monitorWalEntry) []alertEvent {
+    return srv.advanceAlerts(srv.observeRecordedValues(entries))
+}
+
+// Writes the copies of the alert states; the caller must hold writeMu of the
+// alert manager
+func(srv *Server) writeAlertStates(states []alertState) error {
+
+    p, err := json.MarshalIndent(states, "", "  ")
+    if err != nil {
+        return err
+    }
+    return rewriteFile(srv.config.AlertStateFile, bytes.NewReader(p))
+
+}
+
+func(srv *Server) readAlertStates() (err error) {
+
+    defer Catch(&err)
+
+    p, err := ioutil.ReadFile(srv.config.AlertStateFile)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    Try(err)
+
+    states := []*alertState{}
+    Try(json.Unmarshal(p, &states))
+
+    am := srv.alertManager
+    am.mu.Lock()
+    defer am.mu.Unlock()
+    for _, st := range states {
+        if st.Rule == "" {
+            // Written before there were alert rules
+            st.Rule = alertRuleNameFatalRange
+        }
+        st.updated = st.NotifiedAt
+        if st.Status == AlertStatusPending {
+            st.updated = st.Since
+        }
+        am.states[alertKey{st.Rule, st.ClientId, st.Key}] = st
+    }
+
+    return nil
+
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "io"
+    "os"
+    "time"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    AlertHistoryKindTransition   = "transition"
+    AlertHistoryKindNotification = "notification"
+
+    AlertHistoryOutcomeDelivered = "delivered"
+    AlertHistoryOutcomeFailed    = "failed"
+    AlertHistoryOutcomeSilenced  = "silenced"
+
+    alertHistoryStatusInactive = "inactive"
+    alertHistoryIdLength       = 16
+    alertHistoryMaxLineLength  = 1024 * 1024
+)
+
+/*
+
+The alert history is an append-only log of the alerts in alert.historyFile,
+which has a json object per line. Entries are only ever appended, and the ones
+of the same alert are tied by their rule, client, and key. Every retention
+cycle drops the entries recorded longer than alert.historyRetention ago by
+rewriting the file.
+
+Readers and the pruner scan the file up to its size at the time they open it,
+without holding the lock of appends, which is held only to open the file and
+to copy the entries appended while the pruner was scanning.
+
+A transition is written whenever an alert changes its state, which is one of
+pending, firing, resolved, and inactive, the last of which is a pending alert
+that is gone without firing; a repeated firing event is written as well:
+
+{"id":"Jd8Qm2xVw0aLr5Ty","kind":"transition","status":"firing","rule":"fatalRange",
+"clientId":"cl-1","key":"cpu-usage","value":97.5,"range":"90:","severity":"critical",
+"since":1600000000,"timestamp":1600000300,"recordedAt":1600000301}
+
+A notification is written for each channel that an event was delivered to, or
+failed to be, after the retries, and once for an event that was silenced. The
+eventId of a notification is the id of the transition of the event:
+
+{"id":"Pz4Kc9Rn1bYe7Hu2","kind":"notification","eventId":"Jd8Qm2xVw0aLr5Ty",
+"status":"firing","rule":"fatalRange","clientId":"cl-1","key":"cpu-usage",
+"value":97.5,"timestamp":1600000300,"channel":"ops","outcome":"delivered",
+"attempts":1,"recordedAt":1600000302}
+
+The timestamp of an entry is that of the value that caused the transition, and
+recordedAt is when the server wrote the entry.
+
+*/
+
+type AlertHistoryEntry struct {
+    Id         string  `json:"id"`
+    Kind       string  `json:"kind"`
+    EventId    string  `json:"eventId,omitempty"` // Notification
+    Status     string  `json:"status"`
+    Rule       string  `json:"rule"`
+    ClientId   string  `json:"clientId"`
+    Key        string  `json:"key"`
+    Value      float64 `json:"value"`
+    Range      Range   `json:"range,omitempty"` // Transition
+    Severity   string  `json:"severity,omitempty"`
+    Since      int64   `json:"since,omitempty"`
+    Timestamp  int64   `json:"timestamp"`
+    Repeated   bool    `json:"repeated,omitempty"`
+    Channel    string  `json:"channel,omitempty"` // Notification
+    Outcome    string  `json:"outcome,omitempty"`
+    Attempts   int     `json:"attempts,omitempty"`
+    Error      string  `json:"error,omitempty"`
+    RecordedAt int64   `json:"recordedAt"`
+}
+
+type AlertHistoryFilter struct {
+    From      int64 // Inclusive, 0 for the beginning
+    To        int64 // Inclusive, 0 for the end
+    ClientIds []string // Empty for all
+    Limit     int // The latest entries, 0 for all
+}
+
+func(filter AlertHistoryFilter) includes(entry AlertHistoryEntry) bool {
+
+    switch {
+    case filter.From > 0 && entry.Timestamp < filter.From,
+        filter.To > 0 && entry.Timestamp > filter.To:
+        return false
+    case len(filter.ClientIds) == 0:
+        return true
+    }
+    for _, clId := range filter.ClientIds {
+        if clId == entry.ClientId {
+            return true
+        }
+    }
+    return false
+
+}
+
+// Returns the transition entry of the decorated event
+func newAlertTransitionEntry(ev alertEvent, rng Range) AlertHistoryEntry {
+    return AlertHistoryEntry{
+        Id:        RandomAlphaNum(alertHistoryIdLength),
+        Kind:      AlertHistoryKindTransition,
+        Status:    ev.Status,
+        Rule:      ev.Rule,
+        ClientId:  ev.ClientId,
+        Key:       ev.Key,
+        Value:     ev.Value,
+        Range:     rng,
+        Severity:  ev.Severity,
+        Since:     ev.Since,
+        Timestamp: ev.Timestamp,
+        Repeated:  ev.Repeated,
+    }
+}
+
+// Returns the notification entry of the event
+func newAlertNotificationEntry(ev alertEvent, channel, outcome string, attempts int, err error) AlertHistoryEntry {
+    entry := AlertHistoryEntry{
+        Id:        RandomAlphaNum(alertHistoryIdLength),
+        Kind:      AlertHistoryKindNotification,
+        EventId:   ev.historyId,
+        Status:    ev.Status,
+        Rule:      ev.Rule,
+        ClientId:  ev.ClientId,
+        Key:       ev.Key,
+        Value:     ev.Value,
+        Timestamp: ev.Timestamp,
+        Repeated:  ev.Repeated,
+        Channel:   channel,
+        Outcome:   outcome,
+        Attempts:  attempts,
+    }
+    if err != nil {
+        entry.Error = err.Error()
+    }
+    return entry
+}
+
+// Appends the entries to the history; failures are only logged, as the
+// history must not hold back the alerts
+func(srv *Server) appendAlertHistory(entries ...AlertHistoryEntry) {
+
+    if len(entries) == 0 {
+        return
+    }
+
+    srv.alertHistoryMu.Lock()
+    defer srv.alertHistoryMu.Unlock()
+
+    f, err := os.OpenFile(srv.config.AlertHistoryFile, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+    if err != nil {
+        EventLogger.Warnln("Failed to open the alert history:", err)
+        return
+    }
+    defer f.Close()
+
+    // Each entry is written whole so that a torn write spoils only the last
+    // line
+    wr  := bufio.NewWriter(f)
+    now := time.Now().Unix()
+    for _, entry := range entries {
+        entry.RecordedAt = now
+        p, _ := json.Marshal(entry)
+        wr.Write(append(p, '\n'))
+    }
+    if err = wr.Flush(); err != nil {
+        EventLogger.Warnln("Failed to append to the alert history:", err)
+    }
+
+}
+
+// Opens the history and returns its size, up to which the entries are whole
+func(srv *Server) openAlertHistory() (*os.File, int64, error) {
+
+    srv.alertHistoryMu.Lock()
+    defer srv.alertHistoryMu.Unlock()
+
+    f, err := os.Open(srv.config.AlertHistoryFile)
+    if err != nil {
+        return nil, 0, err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return nil, 0, err
+    }
+    return f, info.Size(), nil
+
+}
+
+// Calls fn with each line of the history up to the size and the entry parsed
+// from it; the entry is nil for a line torn by a crash
+func scanAlertHistory(rd io.Reader, size int64, fn func(line []byte, entry *AlertHistoryEntry)) error {
+    sc := bufio.NewScanner(io.LimitReader(rd, size))
+    sc.Buffer(nil, alertHistoryMaxLineLength)
+    for sc.Scan() {
+        entry := &AlertHistoryEntry{}
+        if err := json.Unmarshal(sc.Bytes(), entry); err != nil {
+            entry = nil
+        }
+        fn(sc.Bytes(), entry)
+    }
+    return sc.Err()
+}
+
+// Returns the entries of the history that the filter and the permission
+// include, in the order that they were written
+func(srv *Server) ReadAlertHistory(filter AlertHistoryFilter, permitted func(clId, mKey string) bool) ([]AlertHistoryEntry, error) {
+
+    entries := []AlertHistoryEntry{}
+
+    f, size, err := srv.openAlertHistory()
+    switch {
+    case os.IsNotExist(err):
+        return entries, nil
+    case err != nil:
+        return nil, err
+    }
+    defer f.Close()
+
+    err = scanAlertHistory(f, size, func(_ []byte, entry *AlertHistoryEntry) {
+        if entry == nil || !filter.includes(*entry) ||
+            (permitted != nil && !permitted(entry.ClientId, entry.Key)) {
+            return
+        }
+        entries = append(entries, *entry)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if filter.Limit > 0 && len(entries) > filter.Limit {
+        entries = entries[len(entries) - filter.Limit:]
+    }
+    return entries, nil
+
+}
+
+// Drops the entries recorded before the retention of the history, along with
+// torn lines, and returns how many lines were dropped
+func(srv *Server) PruneAlertHistory(now int64) (removed int, err error) {
+
+    defer Catch(&err)
+
+    sec, err := srv.config.AlertHistoryRetention.Seconds()
+    Try(err)
+    if sec <= 0 {
+        return 0, nil
+    }
+
+    f, size, err := srv.openAlertHistory()
+    if os.IsNotExist(err) {
+        return 0, nil
+    }
+    Try(err)
+    defer f.Close()
+
+    // Keep the rest in a new file, scanning without the lock
+    path    := srv.config.AlertHistoryFile
+    tmpPath := path + ".tmp"
+    tmp, err := os.OpenFile(tmpPath, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0644)
+    Try(err)
+    defer func() {
+        // Gone unless the file was not replaced
+        tmp.Close()
+        os.Remove(tmpPath)
+    }()
+    wr := bufio.NewWriter(tmp)
+    Try(scanAlertHistory(f, size, func(line []byte, entry *AlertHistoryEntry) {
+        if entry == nil || entry.RecordedAt < now - sec {
+            removed++
+            return
+        }
+        wr.Write(line)
+        wr.WriteByte('\n')
+    }))
+    Try(wr.Flush())
+    if removed == 0 {
+        return 0, nil
+    }
+
+    // Carry over the entries appended in the meantime and replace the file
+    srv.alertHistoryMu.Lock()
+    defer srv.alertHistoryMu.Unlock()
+
+    _, err = f.Seek(size, io.SeekStart)
+    Try(err)
+    _, err = io.Copy(tmp, f)
+    Try(err)
+    Try(tmp.Close())
+    Try(os.Rename(tmpPath, path))
+
+    return removed, nil
+
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "./log"
+)
+
+func TestAlertHistory(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    hsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/down" {
+            w.WriteHeader(503)
+        }
+    }))
+    defer hsrv.Close()
+
+    srv.config.AlertRepeatInterval = 0
+    srv.config.AlertRetries        = 1
+    srv.config.AlertRetryBackoff   = 1
+    srv.config.AlertChannels       = []NotifierChannel{
+        {Name: "up", Type: NotifierTypeWebhook, Url: hsrv.URL + "/up"},
+        {Name: "down", Type: NotifierTypeWebhook, Url: hsrv.URL + "/down"},
+    }
+    srv.clientConfig.RuleMap["test"].MonitorConfigMap["load"] = MonitorConfig{
+        FatalRange: "8:",
+        AlertFor:   "2m",
+    }
+
+    record := func(clId string, ts int64, val float64) {
+        srv.notifyAlertEvents(srv.evaluateAlerts(srv.recordValueMap(clId, ts, map[string] interface{}{"load": val}, 60)))
+        srv.notifications.Wait()
+    }
+    record("cl-0", 60, 9) // Pending
+    record("cl-0", 120, 1) // Inactive
+    record("cl-0", 180, 9) // Pending
+    record("cl-0", 300, 9) // Firing
+    record("cl-0", 360, 1) // Resolved
+
+    now := time.Now().Unix()
+    _, err := srv.AddSilence(Silence{ClientId: "cl-1", StartsAt: now - 60, EndsAt: now + 3600})
+    if err != nil {
+        t.Fatal(err)
+    }
+    record("cl-1", 60, 9)
+    record("cl-1", 180, 9) // Firing, silenced
+
+    entries, err := srv.ReadAlertHistory(AlertHistoryFilter{ClientIds: []string{"cl-0"}}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := []string{}
+    for _, entry := range entries {
+        s := fmt.Sprintf("%s:%s:%d", entry.Kind, entry.Status, entry.Timestamp)
+        if entry.Kind == AlertHistoryKindNotification {
+            s += ":" + entry.Channel + ":" + entry.Outcome
+        }
+        got = append(got, s)
+    }
+    // The notifications are appended as they finish
+    for _, i := range []int{4, 7} {
+        if len(got) == 9 && strings.Contains(got[i], "down") {
+            got[i], got[i + 1] = got[i + 1], got[i]
+        }
+    }
+    expected := []string{
+        "transition:pending:60",
+        "transition:inactive:120",
+        "transition:pending:180",
+        "transition:firing:300",
+        "notification:firing:300:up:delivered",
+        "notification:firing:300:down:failed",
+        "transition:resolved:360",
+        "notification:resolved:360:up:delivered",
+        "notification:resolved:360:down:failed",
+    }
+    if strings.Join(got, " ") != strings.Join(expected, " ") {
+        t.Fatalf("Expected %v, got %v", expected, got)
+    }
+
+    firing := entries[3]
+    if firing.Range != "8:" || firing.Since != 180 || firing.Severity != "critical" || firing.RecordedAt == 0 {
+        t.Errorf("Unexpected transition %+v", firing)
+    }
+    if inactive := entries[1]; inactive.Since != 60 {
+        t.Errorf("Expected the inactive alert to have been pending since 60, got %+v", inactive)
+    }
+    for _, entry := range entries[4:6] {
+        if entry.EventId != firing.Id {
+            t.Errorf("Expected the notification of %s, got %+v", firing.Id, entry)
+        }
+        if entry.Channel == "down" && (entry.Attempts != 2 || entry.Error == "") {
+            t.Errorf("Expected the failed notification to be retried, got %+v", entry)
+        }
+    }
+
+    // Silenced
+    entries, _ = srv.ReadAlertHistory(AlertHistoryFilter{ClientIds: []string{"cl-1"}, From: 180}, nil)
+    if len(entries) != 2 || entries[1].Outcome != AlertHistoryOutcomeSilenced || entries[1].EventId != entries[0].Id {
+        t.Errorf("Expected the silenced notification, got %+v", entries)
+    }
+
+    // Filters
+    entries, _ = srv.ReadAlertHistory(AlertHistoryFilter{From: 120, To: 300, Limit: 2}, nil)
+    if len(entries) != 2 || entries[0].Timestamp != 180 || entries[1].ClientId != "cl-1" {
+        t.Errorf("Unexpected entries %+v", entries)
+    }
+
+    // A torn line is skipped
+    f, err := os.OpenFile(srv.config.AlertHistoryFile, os.O_APPEND | os.O_WRONLY, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Write([]byte(`{"id":"torn","kind":"tran`))
+    f.Close()
+    record("cl-2", 60, 9)
+    entries, _ = srv.ReadAlertHistory(AlertHistoryFilter{ClientIds: []string{"cl-2"}}, nil)
+    all, _    := srv.ReadAlertHistory(AlertHistoryFilter{}, nil)
+    if len(entries) != 0 || len(all) != 12 {
+        t.Errorf("Expected the torn line to spoil the next one only, got %d of %d", len(entries), len(all))
+    }
+
+}
+
+func TestAlertHistoryApi(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+    AccessLogger = &log.Logger{}
+
+    password := fmt.Sprintf("%x", Sha256Sum([]byte("password")))
+    srv.config.HttpUsers = []HttpUser{
+        {Name: "user", Password: password, Permissions: []string{"api/v1.get.alertHistory.cl-1.*"}},
+    }
+    srv.populateHttpRouter()
+    hsrv := httptest.NewServer(srv)
+    defer hsrv.Close()
+
+    srv.appendAlertHistory(
+        AlertHistoryEntry{Id: "a", Kind: AlertHistoryKindTransition, ClientId: "cl-0", Key: "load", Timestamp: 60},
+        AlertHistoryEntry{Id: "b", Kind: AlertHistoryKindTransition, ClientId: "cl-1", Key: "load", Timestamp: 60},
+        AlertHistoryEntry{Id: "c", Kind: AlertHistoryKindTransition, ClientId: "cl-1", Key: "load", Timestamp: 120},
+    )
+
+    request := func(query string) (int, []AlertHistoryEntry) {
+        req, _ := http.NewRequest("GET", hsrv.URL + "/api/v1/alertHistory" + query, nil)
+        req.SetBasicAuth("user", "password")
+        rsp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer rsp.Body.Close()
+        ret  := struct {
+            AlertHistory []AlertHistoryEntry `json:"alertHistory"`
+        }{}
+        p, _ := ioutil.ReadAll(rsp.Body)
+        json.Unmarshal(p, &ret)
+        return rsp.StatusCode, ret.AlertHistory
+    }
+
+    st, entries := request("")
+    if st != 200 || len(entries) != 2 || entries[0].Id != "b" {
+        t.Errorf("Expected the permitted entries, got %d %+v", st, entries)
+    }
+    st, entries = request("?from=100&client=cl-1")
+    if st != 200 || len(entries) != 1 || entries[0].Id != "c" {
+        t.Errorf("Unexpected response %d %+v", st, entries)
+    }
+    if st, _ = request("?to=x"); st != 400 {
+        t.Errorf("Expected 400, got %d", st)
+    }
+
+}
+
+func TestPruneAlertHistory(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.config.AlertHistoryRetention = "1h"
+    if removed, err := srv.PruneAlertHistory(7200); err != nil || removed != 0 {
+        t.Fatalf("Expected nothing to prune without a history, got %d %v", removed, err)
+    }
+
+    lines := []string{}
+    for i, recordedAt := range []int64{60, 3000, 3600, 5000, 7200} {
+        p, _ := json.Marshal(AlertHistoryEntry{Id: fmt.Sprint(i), Kind: AlertHistoryKindTransition, RecordedAt: recordedAt})
+        lines = append(lines, string(p))
+        if i == 2 {
+            lines = append(lines, `{"id":"torn","kind":"tran`)
+        }
+    }
+    if err := ioutil.WriteFile(srv.config.AlertHistoryFile, []byte(strings.Join(lines, "\n") + "\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    // Recorded before 3600 and torn
+    if removed, err := srv.PruneAlertHistory(7200); err != nil || removed != 3 {
+        t.Fatalf("Expected 3 lines to be removed, got %d %v", removed, err)
+    }
+    srv.appendAlertHistory(AlertHistoryEntry{Id: "5", Kind: AlertHistoryKindTransition})
+    entries, err := srv.ReadAlertHistory(AlertHistoryFilter{}, nil)
+    if err != nil || len(entries) != 4 || entries[0].Id != "2" || entries[3].Id != "5" {
+        t.Errorf("Expected the entries 2 to 5, got %+v %v", entries, err)
+    }
+    if _, err = os.Stat(srv.config.AlertHistoryFile + ".tmp"); !os.IsNotExist(err) {
+        t.Errorf("Expected the temporary file to be gone, got %v", err)
+    }
+
+    // Kept forever
+    srv.config.AlertHistoryRetention = ""
+    if removed, err := srv.PruneAlertHistory(1 << 40); err != nil || removed != 0 {
+        t.Errorf("Expected nothing to be pruned, got %d %v", removed, err)
+    }
+
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "text/template"
+)
+
+const (
+    alertRuleNameFatalRange = "fatalRange"
+    alertRuleNameClientDown = "clientDown"
+    alertRuleNameAbsent     = "absent"
+    alertSummaryDefault     = "{{.Key}} of {{.ClientId}} is {{.Value}}"
+)
+
+var alertRuleStatuses = map[string] int{
+    "warning": MonitorStatusWarning,
+    "fatal":   MonitorStatusFatal,
+}
+
+var alertRuleAggregates = map[string] bool{
+    "":                      true,
+    monitorAggregateKeyMean: true,
+    monitorAggregateKeyMin:  true,
+    monitorAggregateKeyMax:  true,
+    monitorAggregateKeySum:  true,
+}
+
+/*
+
+Alert rules are configured in the alertRules of the client config, which apply
+to every client, and in the alertRules of client rules, which apply to the
+clients of the rules; a rule of the same name overrides the earlier one.
+
+{
+  "name": "load-high",
+  "key": "load*",
+  "status": "warning",
+  "window": "10m",
+  "aggregate": "mean",
+  "for": "5m",
+  "severity": "warning",
+  "summary": "The load of {{.ClientId}} is {{.Value}}",
+  "labels": {"team": "infra"}
+}
+
+A rule of a key judges the recorded values of the monitor keys that match the
+key pattern, either by the status as per their monitor configs, or by range.
+When the window is set, the value judged is the aggregate of the values within
+the window up to the recorded value instead of the value itself, which is taken
+from the recent data kept in memory for the key, see monitorWindow.go.
+
+{
+  "name": "errors",
+  "expr": "rate(http_errors)",
+  "range": "5:",
+  "window": "5m"
+}
+
+A rule of an expression evaluates the query expression over the window, or
+alert.evaluationInterval when the window is empty, every
+alert.evaluationInterval, and judges the last value of each series by range.
+
+Besides the configured rules, every monitor config that has a fatal condition
+of values, see monitorCondition.go, has the fatalRange rule, whose for and
+resolve range are alertFor and resolveRange of the monitor config, and every
+monitor config that has absentFatalTime has the absent rule, which is checked
+every alert.evaluationInterval and whose value is the seconds without a value.
+
+The clientDown rule fires when a client has not connected for longer than its
+monitor interval times its batch length plus alert.clientDownGrace seconds,
+which is checked every alert.evaluationInterval. Its value is the seconds since
+the last record or hello of the client, and it is resolved by the next record
+or hello.
+
+*/
+
+type AlertRule struct {
+    Name         string             `json:"name"`
+    Key          string             `json:"key"` // The pattern of monitor keys
+    Expr         string             `json:"expr"` // A query expression, instead of a key
+    Status       string             `json:"status"` // Either warning or fatal
+    Range        Range              `json:"range"` // Instead of a status
+    Window       Retention          `json:"window"`
+    Aggregate    string             `json:"aggregate"` // For the window of a key; mean by default
+    For          Retention          `json:"for"`
+    ResolveRange Range              `json:"resolveRange"`
+    Severity     string             `json:"severity"`
+    Summary      string             `json:"summary"` // A text/template of alert events
+    Labels       map[string] string `json:"labels"`
+}
+
+var DefaultAlertRule = AlertRule{
+    Aggregate: monitorAggregateKeyMean,
+    Severity:  "warning",
+    Summary:   alertSummaryDefault,
+    Labels:    map[string] string{},
+}
+
+var clientDownAlertRule = AlertRule{
+    Name:     alertRuleNameClientDown,
+    Severity: "critical",
+    Summary:  `{{.ClientId}} {{if eq .Status "resolved"}}is back{{else}}has been silent for {{.Value}} seconds{{end}}`,
+}
+
+var absentAlertRule = AlertRule{
+    Name:     alertRuleNameAbsent,
+    Key:      "*",
+    Severity: "critical",
+    Summary:  `{{.Key}} of {{.ClientId}} {{if eq .Status "resolved"}}is back{{else}}has had no value for {{.Value}} seconds{{end}}`,
+}
+
+// The rule that every monitor config with a fatal condition has
+func fatalRangeAlertRule(mCfg MonitorConfig) AlertRule {
+    return AlertRule{
+        Name:         alertRuleNameFatalRange,
+        Key:          "*",
+        Status:       "fatal",
+        For:          mCfg.AlertFor,
+        ResolveRange: mCfg.ResolveRange,
+        Severity:     "critical",
+        Summary:      alertSummaryDefault,
+    }
+}
+
+func(rule AlertRule) Validate() error {
+
+    switch {
+    case rule.Name == "":
+        return fmt.Errorf("An alert rule must have a name")
+    case rule.Name == alertRuleNameFatalRange, rule.Name == alertRuleNameClientDown,
+        rule.Name == alertRuleNameAbsent:
+        return fmt.Errorf("The name of alert rule %s is reserved", rule.Name)
+    case (rule.Key == "") == (rule.Expr == ""):
+        return fmt.Errorf("Alert rule %s must have either a key or an expression", rule.Name)
+    case rule.Status != "" && rule.Range != "":
+        return fmt.Errorf("Alert rule %s must not have both a status and a range", rule.Name)
+    case rule.Status == "" && rule.Range == "":
+        return fmt.Errorf("Alert rule %s must have either a status or a range", rule.Name)
+    case rule.Expr != "" && rule.Status != "":
+        return fmt.Errorf("Alert rule %s of an expression must have a range instead of a status", rule.Name)
+    }
+    if _, ok := alertRuleStatuses[rule.Status]; rule.Status != "" && !ok {
+        return fmt.Errorf("Alert rule %s has an unknown status %q", rule.Name, rule.Status)
+    }
+    if !alertRuleAggregates[rule.Aggregate] {
+        return fmt.Errorf("Alert rule %s has an unknown aggregate %q", rule.Name, rule.Aggregate)
+    }
+    for _, rt := range []Retention{rule.Window, rule.For} {
+        if _, err := rt.Seconds(); err != nil {
+            return fmt.Errorf("Alert rule %s: %v", rule.Name, err)
+        }
+    }
+    for _, rng := range []Range{rule.Range, rule.ResolveRange} {
+        if err := rng.Validate(); rng != "" && err != nil {
+            return fmt.Errorf("Alert rule %s: %v", rule.Name, err)
+        }
+    }
+    if rule.Expr != "" {
+        if _, err := ParseQuery(rule.Expr); err != nil {
+            return fmt.Errorf("Alert rule %s: %v", rule.Name, err)
+        }
+    }
+    if _, err := parseAlertSummary(rule.Summary); err != nil {
+        return fmt.Errorf("Alert rule %s: %v", rule.Name, err)
+    }
+    return nil
+
+}
+
+// Returns whether the value meets the condition of the rule, and whether it
+// resolves the firing alert
+func(rule AlertRule) judge(val float64, status int) (active, resolving bool) {
+    if rule.Status != "" {
+        active = status >= alertRuleStatuses[rule.Status]
+    } else {
+        active = rule.Range.Includes(val)
+    }
+    resolving = !active
+    if rule.ResolveRange != "" {
+        resolving = rule.ResolveRange.Includes(val)
+    }
+    return
+}
+
+// Returns the range of the values that are active, as far as it is a range;
+// the values of the fatal range are active for the warning status as well
+func(rule AlertRule) rangeOf(mCfg MonitorConfig) Range {
+    switch rule.Status {
+    case "":
+        return rule.Range
+    case "fatal":
+        return mCfg.FatalRange
+    }
+    return mCfg.WarningRange
+}
+
+// Returns the event with the severity, the summary, and the labels of the rule
+func(rule AlertRule) decorate(ev alertEvent) alertEvent {
+
+    ev.Severity = rule.Severity
+    ev.Labels   = make(map[string] string)
+    for k, v := range rule.Labels {
+        ev.Labels[k] = v
+    }
+
+    ev.Summary = rule.Summary
+    tmpl, err := parseAlertSummary(rule.Summary)
+    if err == nil {
+        buf := bytes.NewBuffer(nil)
+        err  = tmpl.Execute(buf, ev)
+        if err == nil {
+            ev.Summary = buf.String()
+        }
+    }
+    if err != nil {
+        EventLogger.Warnln("Failed to execute the summary of alert rule", rule.Name, err)
+    }
+
+    return ev
+
+}
+
+var parsedAlertSummaries = make(map[string] *template.Template)
+var parsedAlertSummariesMu sync.Mutex
+
+func parseAlertSummary(text string) (*template.Template, error) {
+
+    parsedAlertSummariesMu.Lock()
+    defer parsedAlertSummariesMu.Unlock()
+
+    if tmpl, ok := parsedAlertSummaries[text]; ok {
+        return tmpl, nil
+    }
+    tmpl, err := template.New("summary").Option("missingkey=zero").Parse(text)
+    if err != nil {
+        return nil, err
+    }
+    parsedAlertSummaries[text] = tmpl
+    return tmpl, nil
+
+}
+
+// Returns the rules in which the later rules override the earlier ones of the
+// same name
+func mergeAlertRules(lhs, rhs []AlertRule) []AlertRule {
+    merged := make([]AlertRule, 0, len(lhs) + len(rhs))
+    for _, rules := range [][]AlertRule{lhs, rhs} {
+        for _, rule := range rules {
+            replaced := false
+            for i := range merged {
+                if merged[i].Name == rule.Name {
+                    merged[i], replaced = rule, true
+                }
+            }
+            if !replaced {
+                merged = append(merged, rule)
+            }
+        }
+    }
+    return merged
+}
+
+func(srv *Server) getClientAlertRules(clId string) []AlertRule {
+    clCfg  := srv.clientConfig
+    clRule := clCfg.RuleMap.Get(clCfg.InfoMap[clId].Tags)
+    return mergeAlertRules(clCfg.AlertRules, clRule.AlertRules)
+}
+
+// Judges the recorded values by the rules of keys
+func(srv *Server) observeRecordedValues(entries []monitorWalEntry) []alertObservation {
+
+    observations := []alertObservation{}
+    rulesOf      := make(map[string/* clId */] []AlertRule)
+
+    for _, entry := range entries {
+
+        clId, mKey := entry.clId, entry.mKey
+        mCfg, ok   := srv.getClientMonitorConfig(clId, mKey)
+        if !ok {
+            EventLogger.Warnln("Monitor config for", mKey, "was not found")
+            continue
+        }
+
+        rules, ok := rulesOf[clId]
+        if !ok {
+            rules = srv.getClientAlertRules(clId)
+            rulesOf[clId] = rules
+        }
+        if mCfg.hasFatalConditions() {
+            rules = append([]AlertRule{fatalRangeAlertRule(mCfg)}, rules...)
+        }
+
+        for _, rule := range rules {
+
+            if !matchQueryPattern(rule.Key, mKey) {
+                continue
+            }
+
+            val       := entry.datum.Value
+            window, _ := rule.Window.Seconds()
+            if window > 0 {
+                agrg := rule.Aggregate
+                if agrg == "" {
+                    agrg = monitorAggregateKeyMean
+                }
+                md := srv.getMonitorDataRecent(clId, mKey, window, entry.datum.Timestamp)
+                val = monitorAggregateTypesMap[agrg](md)
+            }
+
+            status := MonitorStatusNormal
+            if rule.Status != "" {
+                status = srv.statusOfMonitorValue(clId, mKey, mCfg, entry.datum.Timestamp, val)
+            }
+            active, resolving := rule.judge(val, status)
+            observations = append(observations, alertObservation{
+                rule:      rule,
+                key:       alertKey{rule.Name, clId, mKey},
+                timestamp: entry.datum.Timestamp,
+                value:     val,
+                active:    active,
+                resolving: resolving,
+                rng:       rule.rangeOf(mCfg),
+            })
+
+        }
+
+    }
+
+    return observations
+
+}
+
+// Judges the last values of the rules of expressions at the time
+func(srv *Server) observeAlertExpressions(now int64) []alertObservation {
+
+    // Group the clients by the rules, as a rule of the same name may differ
+    // among the client rules
+    type group struct {
+        rule  AlertRule
+        clIds []string
+    }
+    groups := make(map[string] *group)
+    for clId := range srv.clientConfig.InfoMap {
+        for _, rule := range srv.getClientAlertRules(clId) {
+            if rule.Expr == "" {
+                continue
+            }
+            j, _ := json.Marshal(rule)
+            g, ok := groups[string(j)]
+            if !ok {
+                g = &group{rule: rule}
+                groups[string(j)] = g
+            }
+            g.clIds = append(g.clIds, clId)
+        }
+    }
+
+    // Keep the order steady
+    keys := make([]string, 0, len(groups))
+    for k := range groups {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    observations := []alertObservation{}
+    for _, k := range keys {
+
+        rule      := groups[k].rule
+        window, _ := rule.Window.Seconds()
+        if window <= 0 {
+            window = int64(srv.config.AlertEvaluationInterval)
+        }
+        filter := QueryFilter{
+            ClientIds: groups[k].clIds,
+            From:      now - window,
+            To:        now,
+            Per:       window,
+        }
+        series, err := srv.EvaluateQuery(rule.Expr, filter, nil)
+        if err != nil {
+            EventLogger.Warnln("Failed to evaluate alert rule", rule.Name, err)
+            continue
+        }
+
+        for _, se := range series {
+            val := se.Points[len(se.Points) - 1].Value
+            active, resolving := rule.judge(val, MonitorStatusNormal)
+            observations = append(observations, alertObservation{
+                rule:      rule,
+                key:       alertKey{rule.Name, se.ClientId, strings.TrimSpace(se.Key)},
+                timestamp: now,
+                value:     val,
+                active:    active,
+                resolving: resolving,
+                rng:       rule.Range,
+            })
+        }
+
+    }
+
+    return observations
+
+}
+
+// Judges whether the clients have been silent at the time
+func(srv *Server) observeClientsDown(now int64) []alertObservation {
+
+    observations := []alertObservation{}
+    grace        := int64(srv.config.AlertClientDownGrace)
+    if grace <= 0 {
+        return observations
+    }
+
+    clCfg := srv.clientConfig
+    clIds := make([]string, 0, len(clCfg.InfoMap))
+    for clId := range clCfg.InfoMap {
+        clIds = append(clIds, clId)
+    }
+    sort.Strings(clIds)
+
+    for _, clId := range clIds {
+
+        // Clients that have never connected are not judged
+        lastConnection, ok1 := srv.GetClientMetaLastConnection(clId)
+        lastHello, ok2      := srv.GetClientMetaLastHello(clId)
+        if !ok1 && !ok2 {
+            continue
+        }
+        last := lastConnection
+        if lastHello > last {
+            last = lastHello
+        }
+
+        clRule    := clCfg.RuleMap.Get(clCfg.InfoMap[clId].Tags)
+        threshold := int64(clRule.MonitorInterval) * int64(clRule.BatchLength) + grace
+        active    := now - last > threshold
+        observations = append(observations, alertObservation{
+            rule:      clientDownAlertRule,
+            key:       alertKey{alertRuleNameClientDown, clId, ""},
+            timestamp: now,
+            value:     float64(now - last),
+            active:    active,
+            resolving: !active,
+            rng:       Range(fmt.Sprintf("%d:", threshold + 1)),
+        })
+
+    }
+
+    return observations
+
+}
+
+// Judges how long the keys with absentFatalTime have had no value as of the
+// latest value of each client
+func(srv *Server) observeAbsentValues() []alertObservation {
+
+    observations := []alertObservation{}
+    clIds        := srv.monitorDataStore.ClientIds()
+    sort.Strings(clIds)
+
+    for _, clId := range clIds {
+
+        latest, ok := srv.getClientLastTimestamp(clId)
+        if !ok {
+            continue
+        }
+        mKeys, _ := srv.monitorDataStore.Keys(clId)
+        sort.Strings(mKeys)
+
+        for _, mKey := range mKeys {
+            mCfg, ok := srv.getClientMonitorConfig(clId, mKey)
+            if !ok || mCfg.AbsentFatalTime == "" {
+                continue
+            }
+            fatalSec, _     := mCfg.AbsentFatalTime.Seconds()
+            absence, status := srv.absenceOfMonitorKey(clId, mKey, mCfg, latest)
+            active          := status == MonitorStatusFatal
+            observations = append(observations, alertObservation{
+                rule:      absentAlertRule,
+                key:       alertKey{alertRuleNameAbsent, clId, mKey},
+                timestamp: latest,
+                value:     float64(absence),
+                active:    active,
+                resolving: !active,
+                rng:       Range(fmt.Sprintf("%d:", fatalSec)),
+            })
+        }
+
+    }
+
+    return observations
+
+}
+
+// Resolves the clientDown alert of the client that has just connected
+func(srv *Server) recoverClientDown(clId string, now int64) {
+    // Most requests come while the client is up
+    k := alertKey{alertRuleNameClientDown, clId, ""}
+    if !srv.alertManager.Has(k) {
+        return
+    }
+    srv.notifyAlertEvents(srv.advanceAlerts([]alertObservation{{
+        rule:      clientDownAlertRule,
+        key:       k,
+        timestamp: now,
+        value:     0,
+        active:    false,
+        resolving: true,
+    }}))
+}
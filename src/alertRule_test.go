@@ -0,0 +1,244 @@
+package main
+
+import (
+    "testing"
+
+    "./config"
+)
+
+func TestParseAlertRules(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    cp, err := config.NewParser(&DefaultClientConfig)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = cp.ChildDefaults(
+        &DefaultClientInfo, &DefaultClientRule, &DefaultMonitorConfig, &DefaultAlertRule,
+    ); err != nil {
+        t.Fatal(err)
+    }
+    srv.clientConfigParser = cp
+    if err = srv.setClientConfigValidators(); err != nil {
+        t.Fatal(err)
+    }
+
+    clCfg := ClientConfig{}
+    err    = cp.Parse([]byte(`{
+        "alertRules": [{"name": "load", "key": "load", "status": "warning"}],
+        "ruleMap": {"test": {"alertRules": [{"name": "errors", "expr": "rate(errors)", "range": "1:", "labels": {"team": "web"}}]}}
+    }`), &clCfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rule := clCfg.AlertRules[0]
+    if rule.Aggregate != monitorAggregateKeyMean || rule.Severity != "warning" || rule.Summary != alertSummaryDefault {
+        t.Errorf("Expected the defaults, got %+v", rule)
+    }
+    if rule = clCfg.RuleMap["test"].AlertRules[0]; rule.Labels["team"] != "web" {
+        t.Errorf("Expected the labels, got %+v", rule)
+    }
+
+    for _, invalid := range []string{
+        `{"alertRules": [{"key": "load", "status": "warning"}]}`,
+        `{"alertRules": [{"name": "fatalRange", "key": "load", "status": "fatal"}]}`,
+        `{"alertRules": [{"name": "absent", "key": "load", "status": "fatal"}]}`,
+        `{"alertRules": [{"name": "a", "key": "load", "expr": "load", "range": "1:"}]}`,
+        `{"alertRules": [{"name": "a", "key": "load"}]}`,
+        `{"alertRules": [{"name": "a", "key": "load", "status": "critical"}]}`,
+        `{"alertRules": [{"name": "a", "expr": "load", "status": "fatal"}]}`,
+        `{"alertRules": [{"name": "a", "expr": "load +", "range": "1:"}]}`,
+        `{"alertRules": [{"name": "a", "key": "load", "status": "fatal", "window": "5x"}]}`,
+        `{"alertRules": [{"name": "a", "expr": "rate(errors)", "range": "> 5"}]}`,
+        `{"alertRules": [{"name": "a", "key": "load", "status": "fatal", "resolveRange": ":x"}]}`,
+        `{"alertRules": [{"name": "a", "key": "load", "status": "fatal", "summary": "{{.Key"}]}`,
+        `{"ruleMap": {"test": {"alertRules": [{"name": "a", "key": "load", "status": "fatal", "aggregate": "median"}]}}}`,
+        `{"ruleMap": {"test": {"monitorConfigMap": {"load": {"rateWindow": "1h", "rateFatalRange": "x:"}}}}}`,
+    } {
+        if err := cp.Parse([]byte(invalid), &clCfg); err == nil {
+            t.Errorf("%s: expected an error", invalid)
+        }
+    }
+
+}
+
+func TestAlertRuleEvents(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.config.AlertRepeatInterval = 0
+    srv.clientConfig.RuleMap["test"].MonitorConfigMap["load"] = MonitorConfig{
+        WarningRange: "4:",
+        FatalRange:   "8:",
+    }
+    srv.clientConfig.AlertRules = []AlertRule{
+        {
+            Name:     "load-warning",
+            Key:      "lo*",
+            Status:   "warning",
+            Window:   "3m",
+            Severity: "warning",
+            Summary:  "{{.Key}} of {{.ClientId}} averaged {{.Value}} ({{.Labels.team}})",
+            Labels:   map[string] string{"team": "infra"},
+        },
+        {
+            Name:  "cpu-max",
+            Key:   "cpu-usage",
+            Range: "90:",
+        },
+    }
+
+    // Values of load, events expected as rule:status
+    steps := []struct {
+        val      float64
+        expected []string
+    }{
+        {2, nil},
+        {5, nil}, // Averages 3.5
+        {8, []string{"fatalRange:firing", "load-warning:firing"}}, // Averages 5
+        {2, []string{"fatalRange:resolved"}}, // Averages 5
+        {2, nil}, // Averages 4
+        {1, []string{"load-warning:resolved"}},
+    }
+    var firing alertEvent
+    for i, step := range steps {
+        recorded := srv.recordValueMap("cl-0", int64(60 * (i + 1)), map[string] interface{}{
+            "load": step.val, "cpu-usage": 10.0,
+        }, 60)
+        events := srv.evaluateAlerts(recorded)
+        if len(events) != len(step.expected) {
+            t.Fatalf("Step %d: expected %v, got %+v", i, step.expected, events)
+        }
+        for j, ev := range events {
+            if got := ev.Rule + ":" + ev.Status; got != step.expected[j] {
+                t.Fatalf("Step %d: expected %v, got %+v", i, step.expected, events)
+            }
+            if ev.Rule == "load-warning" && ev.Status == AlertStatusFiring {
+                firing = ev
+            }
+        }
+    }
+
+    if firing.Severity != "warning" || firing.Labels["team"] != "infra" ||
+        firing.Summary != "load of cl-0 averaged 5 (infra)" {
+        t.Errorf("Unexpected event %+v", firing)
+    }
+
+}
+
+func TestAlertRuleExpressions(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.clientConfig.AlertRules = []AlertRule{
+        {
+            Name:   "load-sum",
+            Expr:   "sum(load)",
+            Range:  "10:",
+            Window: "2m",
+        },
+    }
+    clRule := srv.clientConfig.RuleMap["test"]
+    clRule.AlertRules = []AlertRule{
+        {
+            Name:   "load-high",
+            Expr:   "load * 2",
+            Range:  "10:",
+            Window: "2m",
+            For:    "1m",
+        },
+    }
+    srv.clientConfig.RuleMap["test"] = clRule
+
+    for ts := int64(60); ts <= 240; ts += 60 {
+        srv.recordValueMap("cl-0", ts, map[string] interface{}{"load": 4.0}, 60)
+        srv.recordValueMap("cl-1", ts, map[string] interface{}{"load": float64(ts / 60)}, 60)
+    }
+
+    // sum(load) is 4 + 2.5 at 180, load * 2 of cl-1 is 5
+    events := srv.advanceAlerts(srv.observeAlertExpressions(180))
+    if len(events) != 0 {
+        t.Fatalf("Expected no events, got %+v", events)
+    }
+    // sum(load) is 4 + 3.5 at 240, load * 2 of cl-1 is 7
+    events = srv.advanceAlerts(srv.observeAlertExpressions(240))
+    if len(events) != 0 {
+        t.Fatalf("Expected no events, got %+v", events)
+    }
+
+    for ts := int64(300); ts <= 420; ts += 60 {
+        srv.recordValueMap("cl-0", ts, map[string] interface{}{"load": 4.0}, 60)
+        srv.recordValueMap("cl-1", ts, map[string] interface{}{"load": 8.0}, 60)
+    }
+    // sum(load) is 12, load * 2 of cl-1 is 16 and pending
+    events = srv.advanceAlerts(srv.observeAlertExpressions(360))
+    if len(events) != 1 || events[0].Rule != "load-sum" || events[0].ClientId != "" || events[0].Value != 12 {
+        t.Fatalf("Unexpected events %+v", events)
+    }
+    events = srv.advanceAlerts(srv.observeAlertExpressions(420))
+    if len(events) != 1 || events[0].Rule != "load-high" || events[0].ClientId != "cl-1" || events[0].Value != 16 {
+        t.Fatalf("Unexpected events %+v", events)
+    }
+
+}
+
+func TestClientDownAlerts(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.config.AlertClientDownGrace = 120
+    clRule := srv.clientConfig.RuleMap["test"]
+    clRule.MonitorInterval = 30
+    clRule.BatchLength     = 2
+    srv.clientConfig.RuleMap["test"] = clRule
+
+    srv.UpdateClientMetaLastConnection("cl-0", 1000)
+    srv.UpdateClientMetaLastHello("cl-1", 900)
+    srv.UpdateClientMetaLastConnection("cl-1", 1000)
+
+    evaluate := func(now int64) []string {
+        statuses := []string{}
+        for _, ev := range srv.advanceAlerts(srv.observeClientsDown(now)) {
+            statuses = append(statuses, ev.ClientId + ":" + ev.Status)
+        }
+        return statuses
+    }
+
+    if st := evaluate(1180); len(st) != 0 {
+        t.Fatalf("Expected no events within the threshold, got %v", st)
+    }
+    st := evaluate(1200)
+    if len(st) != 2 || st[0] != "cl-0:firing" || st[1] != "cl-1:firing" {
+        t.Fatalf("Expected the clients that connected to be down, got %v", st)
+    }
+
+    // Hello
+    srv.UpdateClientMetaLastHello("cl-0", 1250)
+    srv.recoverClientDown("cl-0", 1250)
+    states := srv.alertManager.States()
+    if len(states) != 1 || states[0].ClientId != "cl-1" {
+        t.Fatalf("Expected cl-0 to be recovered, got %+v", states)
+    }
+    if st := evaluate(1300); len(st) != 0 {
+        t.Errorf("Expected no events, got %v", st)
+    }
+
+    // Recovered by the checker when the recovery was missed
+    srv.UpdateClientMetaLastConnection("cl-1", 1350)
+    st = evaluate(1360)
+    if len(st) != 1 || st[0] != "cl-1:resolved" {
+        t.Errorf("Expected cl-1 to be resolved, got %v", st)
+    }
+
+    // Summaries
+    ev := clientDownAlertRule.decorate(alertEvent{Status: AlertStatusFiring, ClientId: "cl-0", Value: 200})
+    if ev.Summary != "cl-0 has been silent for 200 seconds" || ev.Severity != "critical" {
+        t.Errorf("Unexpected event %+v", ev)
+    }
+
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+func t_alertStatuses(events []alertEvent) []string {
+    statuses := []string{}
+    for _, ev := range events {
+        status := ev.Status
+        if ev.Repeated {
+            status += "(repeated)"
+        }
+        statuses = append(statuses, status)
+    }
+    return statuses
+}
+
+func TestAlertLifecycle(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.config.AlertRepeatInterval = 5
+    srv.clientConfig.RuleMap["test"].MonitorConfigMap["load"] = MonitorConfig{
+        FatalRange:   "10:",
+        ResolveRange: ":8",
+        AlertFor:     "2m",
+    }
+
+    // Value, events expected
+    steps := []struct {
+        val      float64
+        expected []string
+    }{
+        {5, nil},
+        {12, nil}, // Pending
+        {4, nil},  // Back to normal before firing
+        {12, nil}, // Pending again
+        {13, nil},
+        {14, []string{"firing"}}, // Fatal for 2 minutes
+        {9, nil},  // Not fatal, but not resolved either
+        {11, nil},
+        {11, nil},
+        {11, nil},
+        {11, []string{"firing(repeated)"}}, // 5 minutes after firing
+        {11, nil},
+        {7, []string{"resolved"}},
+        {7, nil},
+    }
+
+    for i, step := range steps {
+        ts := int64(60 * (i + 1))
+        recorded := srv.recordValueMap("cl-1", ts, map[string] interface{}{"load": step.val}, 60)
+        events   := srv.evaluateAlerts(recorded)
+        statuses := t_alertStatuses(events)
+        if len(statuses) != len(step.expected) {
+            t.Fatalf("Step %d: expected %v, got %v", i, step.expected, statuses)
+        }
+        for j := range statuses {
+            if statuses[j] != step.expected[j] {
+                t.Fatalf("Step %d: expected %v, got %v", i, step.expected, statuses)
+            }
+        }
+        if len(events) > 0 && (events[0].ClientId != "cl-1" || events[0].Since != 240) {
+            t.Errorf("Step %d: unexpected event %+v", i, events[0])
+        }
+    }
+
+    if states := srv.alertManager.States(); len(states) != 0 {
+        t.Errorf("Expected no alert states, got %+v", states)
+    }
+
+}
+
+func TestAlertStatePersistence(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.clientConfig.RuleMap["test"].MonitorConfigMap["load"] = MonitorConfig{
+        FatalRange: "10:",
+        AlertFor:   "3m",
+    }
+    srv.clientConfig.RuleMap["test"].MonitorConfigMap["cpu-usage"] = MonitorConfig{
+        FatalRange: "90:",
+    }
+    record := func(srv *Server, clId string, ts int64, mKey string, val float64) []string {
+        recorded := srv.recordValueMap(clId, ts, map[string] interface{}{mKey: val}, 60)
+        return t_alertStatuses(srv.evaluateAlerts(recorded))
+    }
+
+    record(srv, "cl-0", 60, "load", 20)
+    record(srv, "cl-0", 120, "load", 20)
+    if st := record(srv, "cl-1", 60, "cpu-usage", 95); len(st) != 1 || st[0] != "firing" {
+        t.Fatalf("Expected firing, got %v", st)
+    }
+
+    // Restart
+    restarted := NewServer()
+    restarted.config       = srv.config
+    restarted.clientConfig = srv.clientConfig
+    if err := restarted.readAlertStates(); err != nil {
+        t.Fatal(err)
+    }
+    states := restarted.alertManager.States()
+    if len(states) != 2 ||
+        states[0].ClientId != "cl-0" || states[0].Status != AlertStatusPending || states[0].Since != 60 ||
+        states[1].ClientId != "cl-1" || states[1].Status != AlertStatusFiring {
+        t.Fatalf("Unexpected states %+v", states)
+    }
+
+    // The pending alert keeps counting, and the firing one is resolved
+    if st := record(restarted, "cl-0", 180, "load", 20); len(st) != 0 {
+        t.Errorf("Expected pending, got %v", st)
+    }
+    if st := record(restarted, "cl-0", 240, "load", 20); len(st) != 1 || st[0] != "firing" {
+        t.Errorf("Expected firing, got %v", st)
+    }
+    if st := record(restarted, "cl-1", 120, "cpu-usage", 50); len(st) != 1 || st[0] != "resolved" {
+        t.Errorf("Expected resolved, got %v", st)
+    }
+
+}
+
+func TestAlertRecordsOutsideLock(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.clientConfig.RuleMap["test"].MonitorConfigMap["load"] = MonitorConfig{
+        FatalRange: "10:",
+    }
+    record := func(clId string, ts int64, val float64) []alertEvent {
+        return srv.evaluateAlerts(srv.recordValueMap(clId, ts, map[string] interface{}{"load": val}, 60))
+    }
+
+    // While the files are being written, the alerts keep advancing
+    srv.alertManager.writeMu.Lock()
+    fired := make(chan []alertEvent)
+    go func() {
+        fired <- record("cl-0", 60, 20)
+    }()
+    done := make(chan struct{})
+    go func() {
+        record("cl-1", 60, 1)
+        srv.alertManager.States()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("Expected the alerts not to wait for the files")
+    }
+    srv.alertManager.writeMu.Unlock()
+    if events := <-fired; len(events) != 1 {
+        t.Fatalf("Expected the alert to fire, got %+v", events)
+    }
+
+    // The history keeps the order of the changes of each alert
+    var wg sync.WaitGroup
+    for i := 10; i < 18; i++ {
+        srv.clientConfig.InfoMap[fmt.Sprintf("cl-%d", i)] = ClientInfo{Tags: "test"}
+    }
+    for i := 10; i < 18; i++ {
+        wg.Add(1)
+        go func(clId string) {
+            defer wg.Done()
+            for ts := int64(60); ts <= 600; ts += 60 {
+                record(clId, ts, float64(ts % 120) / 3) // 20 and 0 in turn
+            }
+        }(fmt.Sprintf("cl-%d", i))
+    }
+    wg.Wait()
+
+    entries, err := srv.ReadAlertHistory(AlertHistoryFilter{}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    statuses := make(map[string] string)
+    for _, entry := range entries {
+        statuses[entry.ClientId] += fmt.Sprintf(" %s:%d", entry.Status, entry.Timestamp)
+    }
+    for i := 10; i < 18; i++ {
+        expected := " firing:60 resolved:120 firing:180 resolved:240 firing:300 resolved:360" +
+            " firing:420 resolved:480 firing:540 resolved:600"
+        if got := statuses[fmt.Sprintf("cl-%d", i)]; got != expected {
+            t.Errorf("cl-%d: expected%s, got%s", i, expected, got)
+        }
+    }
+
+    restarted := NewServer()
+    restarted.config = srv.config
+    if err = restarted.readAlertStates(); err != nil {
+        t.Fatal(err)
+    }
+    if fmt.Sprint(restarted.alertManager.States()) != fmt.Sprint(srv.alertManager.States()) {
+        t.Errorf("Expected the written states %+v, got %+v", srv.alertManager.States(), restarted.alertManager.States())
+    }
+
+}
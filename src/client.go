@@ -5,6 +5,7 @@ import (
     "fmt"
     "net"
     "os"
+    "sync"
     "time"
     "./monitor"
 
@@ -12,24 +13,42 @@ import (
     "github.com/hjjg200/go-together"
 )
 
-const defaultHelloRetryInterval = time.Minute * 1
+const (
+    defaultHelloRetryInterval = time.Minute * 1
+    clientReconnectBackoffMin = time.Second * 1
+    clientReconnectBackoffMax = time.Minute * 5
+)
 
 type Client struct {
     serverAddr    string
     s             *Session
     rule          ClientRule
     configVersion string
+    spool         *ClientSpool
+    pending       []MonitorRecord // Records waiting to be sent in a batch
+    // Connection
+    mu            sync.Mutex // Guards the session, connection, and rule
+    conn          net.Conn   // Open connection in persistent mode
+    lastExchange  time.Time
+    backoff       time.Duration
+    retryAt       time.Time
 }
 
 func NewClient(serverAddr string) *Client {
     return &Client{
         serverAddr: serverAddr,
+        spool:      NewClientSpool(flClientSpoolDir),
     }
 }
 
 func (cl *Client) hello() (err error) {
 
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
     defer Catch(&err)
+
+    // A new session replaces the persistent connection
+    cl.disconnect()
     
     // Connection
     conn, err := net.Dial("tcp", cl.serverAddr)
@@ -44,6 +63,10 @@ func (cl *Client) hello() (err error) {
     clRsp := NewResponse("hello")
     clRsp.Set("version", Version)
     clRsp.Set("alias", flClientAlias)
+    if spoolFrom, ok := cl.spool.Oldest(); ok {
+        // Lets the server know that the data since then is going to be backfilled
+        clRsp.Set("spoolFrom", spoolFrom)
+    }
     Try(s.WriteResponse(clRsp))
 
     // Config
@@ -69,7 +92,12 @@ func (cl *Client) hello() (err error) {
 func (cl *Client) configureRule(cv string, rule []byte) error {
     cl.configVersion = cv
     cl.rule = ClientRule{}
-    return json.Unmarshal(rule, &cl.rule)
+    err := json.Unmarshal(rule, &cl.rule)
+    if err != nil {
+        return err
+    }
+    cl.spool.SetLimits(cl.rule.SpoolMaxSize, cl.rule.SpoolMaxAge)
+    return nil
 }
 
 func (cl *Client) checkKnownHosts() error {
@@ -113,6 +141,213 @@ func (cl *Client) autoUpdate(executable []byte) error {
 
 }
 
+func (cl *Client) collectMonitorRecord() MonitorRecord {
+
+    valMap := make(map[string] interface{})
+    for rawKey := range cl.rule.MonitorConfigMap {
+
+        // Get Getter
+        getter, ok := monitor.Getter(string(rawKey))
+        if !ok {
+            valMap[rawKey] = nil
+            continue
+        }
+
+        // 
+        got := getter()
+        for key, val := range got {
+            valMap[key] = val
+        }
+
+    }
+
+    return MonitorRecord{
+        Timestamp: time.Now().Unix(),
+        Per:       int32(cl.rule.MonitorInterval),
+        ValueMap:  valMap,
+    }
+
+}
+
+func (cl *Client) newMonitorResponse(name string, set func(Response)) Response {
+    clRsp := NewResponse(name)
+    clRsp.Set("version",       Version)
+    clRsp.Set("configVersion", cl.configVersion)
+    clRsp.Set("alias",         flClientAlias)
+    clRsp.Set("keepAlive",     cl.rule.Persistent)
+    set(clRsp)
+    return clRsp
+}
+
+// Sends a response to the server and returns the response from the server;
+// a new connection is dialed for every exchange unless the rule is persistent
+func (cl *Client) exchange(clRsp Response) (srvRsp Response, err error) {
+
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    defer Catch(&err)
+
+    Try(cl.connect())
+    if !cl.rule.Persistent {
+        defer cl.disconnect()
+    }
+
+    err = cl.s.WriteResponse(clRsp)
+    if err == nil {
+        srvRsp, err = cl.s.NextResponse()
+    }
+    if err != nil {
+        cl.disconnect()
+        return Response{}, err
+    }
+
+    cl.lastExchange = time.Now()
+    return srvRsp, nil
+
+}
+
+// Dials the server unless there is an open connection; failed dials make the
+// client back off exponentially before dialing again
+func (cl *Client) connect() error {
+
+    if cl.conn != nil {
+        return nil
+    }
+
+    now := time.Now()
+    if now.Before(cl.retryAt) {
+        return fmt.Errorf("Waiting %v to reconnect", cl.retryAt.Sub(now).Round(time.Second))
+    }
+
+    conn, err := net.Dial("tcp", cl.serverAddr)
+    if err != nil {
+        switch {
+        case cl.backoff == 0:
+            cl.backoff = clientReconnectBackoffMin
+        case cl.backoff < clientReconnectBackoffMax:
+            cl.backoff *= 2
+            if cl.backoff > clientReconnectBackoffMax {
+                cl.backoff = clientReconnectBackoffMax
+            }
+        }
+        cl.retryAt = now.Add(cl.backoff)
+        return fmt.Errorf("Server is not responding")
+    }
+
+    cl.backoff = 0
+    cl.conn    = conn
+    cl.s.SetConn(conn)
+    return nil
+
+}
+
+func (cl *Client) disconnect() {
+    if cl.conn != nil {
+        cl.conn.Close()
+        cl.conn = nil
+    }
+}
+
+// Keeps the persistent connection alive while there is nothing to send
+func (cl *Client) heartbeat() {
+
+    for Sleep(time.Second) {
+
+        cl.mu.Lock()
+        persistent := cl.rule.Persistent && cl.conn != nil
+        itv        := time.Second * time.Duration(cl.rule.HeartbeatInterval)
+        past       := time.Now().Sub(cl.lastExchange)
+        cl.mu.Unlock()
+
+        if !persistent || past < itv {
+            continue
+        }
+
+        srvRsp, err := cl.exchange(cl.newMonitorResponse("heartbeat", func(Response) {}))
+        if err != nil {
+            EventLogger.Warnln("Heartbeat failed:", err)
+            continue
+        }
+        if srvRsp.Name() != "ok" {
+            EventLogger.Warnln("Unexpected heartbeat response:", srvRsp.Name())
+        }
+
+    }
+
+}
+
+// Sends a single record as monitor-record and multiple records as monitor-batch
+func (cl *Client) sendRecords(recs []MonitorRecord) (Response, error) {
+
+    if len(recs) == 1 {
+        rec := recs[0]
+        return cl.exchange(cl.newMonitorResponse("monitor-record", func(clRsp Response) {
+            clRsp.Set("timestamp", rec.Timestamp)
+            clRsp.Set("valueMap",  rec.ValueMap)
+            clRsp.Set("per",       rec.Per)
+        }))
+    }
+
+    return cl.exchange(cl.newMonitorResponse("monitor-batch", func(clRsp Response) {
+        clRsp.Set("records", recs)
+    }))
+
+}
+
+func (cl *Client) spoolRecords(recs []MonitorRecord) {
+    for _, rec := range recs {
+        err := cl.spool.Push(rec)
+        if err != nil {
+            EventLogger.Warnln("Failed to spool:", err)
+        }
+    }
+}
+
+// Whether the server recorded the values of the sent record
+func isRecordAccepted(srvRsp Response) bool {
+    switch srvRsp.Name() {
+    case "ok", "reconfigure":
+        // Reconfigure is given after the values are recorded
+        return true
+    }
+    return false
+}
+
+// Sends the spooled records in timestamp order and returns the last response
+func (cl *Client) replaySpool() (srvRsp Response, err error) {
+
+    for {
+
+        recs, names, err := cl.spool.Next(clientSpoolReplayLength)
+        if err != nil {
+            return Response{}, err
+        }
+        if len(recs) == 0 {
+            return srvRsp, nil
+        }
+
+        srvRsp, err = cl.exchange(cl.newMonitorResponse("monitor-backfill", func(clRsp Response) {
+            clRsp.Set("records", recs)
+        }))
+        if err != nil || !isRecordAccepted(srvRsp) {
+            return srvRsp, err
+        }
+
+        err = cl.spool.Remove(names)
+        if err != nil {
+            return srvRsp, err
+        }
+        EventLogger.Infoln("Replayed", len(recs), "spooled records")
+
+        if srvRsp.Name() != "ok" {
+            // Let the caller reconfigure first
+            return srvRsp, nil
+        }
+
+    }
+
+}
+
 func (cl *Client) Start() error {
 
     err := cl.checkKnownHosts()
@@ -122,6 +357,7 @@ func (cl *Client) Start() error {
 
     //
     hri := defaultHelloRetryInterval
+    go cl.heartbeat()
 
     for {
 
@@ -141,64 +377,35 @@ func (cl *Client) Start() error {
         door := together.NewDoor(mrif())
 
         // Loop
-        var conn net.Conn
-
         MonitorLoop:
         for {
 
             door.Knock()
 
-            // Close open connection
-            if conn != nil {
-                conn.Close()
-                conn = nil
-            }
-
-            // Dial
-            conn, err := net.Dial("tcp", cl.serverAddr)
-            if err != nil {
-                EventLogger.Warnln("Server is not responding")
-                continue
-            }
-            cl.s.SetConn(conn)
-
             // Monitored values
-            valMap := make(map[string] interface{})
-            for rawKey := range cl.rule.MonitorConfigMap {
-
-                // Get Getter
-                getter, ok := monitor.Getter(string(rawKey))
-                if !ok {
-                    valMap[rawKey] = nil
-                    continue
-                }
-
-                // 
-                got := getter()
-                for key, val := range got {
-                    valMap[key] = val
-                }
-
+            // + Records are sent every BatchLength intervals
+            cl.pending = append(cl.pending, cl.collectMonitorRecord())
+            if len(cl.pending) < cl.rule.BatchLength {
+                continue
             }
+            recs      := cl.pending
+            cl.pending = nil
 
             // Send to Server
-            clRsp := NewResponse("monitor-record")
-            clRsp.Set("version",       Version)
-            clRsp.Set("configVersion", cl.configVersion)
-            clRsp.Set("alias",         flClientAlias)
-            clRsp.Set("timestamp",     time.Now().Unix())
-            clRsp.Set("valueMap",      valMap)
-            clRsp.Set("per",           cl.rule.MonitorInterval)
-            err = cl.s.WriteResponse(clRsp)
-            if err != nil {
-                EventLogger.Debugln("may27:valueMap", valMap)
-                EventLogger.Warnln(err)
-                continue
+            // + When there are spooled records, the new records are spooled as well
+            //   so that the server receives the records in timestamp order
+            var srvRsp Response
+            if cl.spool.Len() > 0 {
+                cl.spoolRecords(recs)
+                srvRsp, err = cl.replaySpool()
+            } else {
+                srvRsp, err = cl.sendRecords(recs)
+                if err != nil || !isRecordAccepted(srvRsp) {
+                    cl.spoolRecords(recs)
+                }
             }
-
-            // Get response
-            srvRsp, err := cl.s.NextResponse()
             if err != nil {
+                EventLogger.Debugln("may27:valueMap", recs[len(recs) - 1].ValueMap)
                 EventLogger.Warnln(err)
                 continue
             }
@@ -207,10 +414,12 @@ func (cl *Client) Start() error {
             case "ok":
                 AccessLogger.Infoln("Sent")
             case "reconfigure":
+                cl.mu.Lock()
                 err = cl.configureRule(
                     srvRsp.String("configVersion"),
                     srvRsp.Bytes("rule"), 
                 )
+                cl.mu.Unlock()
                 if err != nil {
                     EventLogger.Warnln(err)
                     break MonitorLoop
@@ -282,6 +491,13 @@ func(clInfo *ClientInfo) HasAddr(addr string) bool {
 type ClientRule struct { // clRule
     MonitorConfigMap MonitorConfigMap `json:"monitorConfigMap"`
     MonitorInterval  int              `json:"monitorInterval"`
+    SpoolMaxSize     int              `json:"spool.maxSize"` // (kB)
+    SpoolMaxAge      int              `json:"spool.maxAge"` // (minutes)
+    BatchLength      int              `json:"batchLength"`
+    Persistent       bool             `json:"persistent"`
+    HeartbeatInterval int             `json:"heartbeatInterval"` // (seconds)
+    Retention        Retention        `json:"retention"` // Server-side only
+    AlertRules       []AlertRule      `json:"alertRules"` // Server-side only
 }
 
 func(clRule ClientRule) Version() string {
@@ -299,6 +515,18 @@ func(clRule ClientRule) Merge(rhs ClientRule) ClientRule {
     }
     // MonitorInterval
     lhs.MonitorInterval = rhs.MonitorInterval
+    // Spool
+    lhs.SpoolMaxSize = rhs.SpoolMaxSize
+    lhs.SpoolMaxAge  = rhs.SpoolMaxAge
+    // BatchLength
+    lhs.BatchLength = rhs.BatchLength
+    // Persistent connection
+    lhs.Persistent        = rhs.Persistent
+    lhs.HeartbeatInterval = rhs.HeartbeatInterval
+    // Retention
+    lhs.Retention = rhs.Retention
+    // Alert rules
+    lhs.AlertRules = mergeAlertRules(lhs.AlertRules, rhs.AlertRules)
 
     return lhs
 }
@@ -325,4 +553,20 @@ type ClientItemStatus struct { // itemStat
     Status    int     `json:"status"`
 }
 
-type ClientItemStatusMap map[string/* mKey */] ClientItemStatus
\ No newline at end of file
+type ClientItemStatusMap map[string/* mKey */] ClientItemStatus
+
+// RECORD ---
+
+// A set of monitored values taken at a single point in time
+type MonitorRecord struct {
+    Timestamp int64                   `json:"timestamp"`
+    Per       int32                   `json:"per"`
+    ValueMap  map[string] interface{} `json:"valueMap"`
+}
+
+type MonitorRecords []MonitorRecord
+
+// sort.Interface
+func(recs MonitorRecords) Len() int { return len(recs) }
+func(recs MonitorRecords) Less(i, j int) bool { return recs[i].Timestamp < recs[j].Timestamp }
+func(recs MonitorRecords) Swap(i, j int) { recs[i], recs[j] = recs[j], recs[i] }
\ No newline at end of file
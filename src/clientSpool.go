@@ -0,0 +1,207 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    clientSpoolExt          = ".spool"
+    clientSpoolReplayLength = 500 // records per backfill
+)
+
+/*
+
+The spool keeps the monitor records that could not be sent to the server.
+Each record is written to its own file whose name starts with the zero-padded
+timestamp of the record, so that listing the directory yields the records in
+timestamp order.
+
+<spool dir>/<timestamp>-<random>.spool
+
+*/
+
+type ClientSpool struct { // spool
+    dir     string
+    maxSize int64 // (bytes)
+    maxAge  int64 // (seconds)
+}
+
+func NewClientSpool(dir string) *ClientSpool {
+    return &ClientSpool{
+        dir: dir,
+    }
+}
+
+// Sets the limits as given in the client rule; maxSize is in kB and maxAge is in minutes
+func(spool *ClientSpool) SetLimits(maxSize, maxAge int) {
+    spool.maxSize = int64(maxSize) * 1024
+    spool.maxAge  = int64(maxAge) * 60
+}
+
+func(spool *ClientSpool) Enabled() bool {
+    return spool.maxSize > 0 && spool.maxAge > 0
+}
+
+type clientSpoolEntry struct {
+    name      string
+    timestamp int64
+    size      int64
+}
+
+// Returns the spooled entries in timestamp order
+func(spool *ClientSpool) entries() ([]clientSpoolEntry, error) {
+
+    fis, err := ioutil.ReadDir(spool.dir)
+    switch {
+    case os.IsNotExist(err):
+        return []clientSpoolEntry{}, nil
+    case err != nil:
+        return nil, err
+    }
+
+    // ioutil.ReadDir returns entries sorted by filename
+    ret := make([]clientSpoolEntry, 0, len(fis))
+    for _, fi := range fis {
+        name := fi.Name()
+        if fi.IsDir() || !strings.HasSuffix(name, clientSpoolExt) {
+            continue
+        }
+        ts, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+        if err != nil {
+            continue
+        }
+        ret = append(ret, clientSpoolEntry{
+            name: name, timestamp: ts, size: fi.Size(),
+        })
+    }
+
+    return ret, nil
+
+}
+
+func(spool *ClientSpool) Len() int {
+    ents, err := spool.entries()
+    if err != nil {
+        return 0
+    }
+    return len(ents)
+}
+
+// Returns the timestamp of the oldest spooled record
+func(spool *ClientSpool) Oldest() (int64, bool) {
+    ents, err := spool.entries()
+    if err != nil || len(ents) == 0 {
+        return 0, false
+    }
+    return ents[0].timestamp, true
+}
+
+func(spool *ClientSpool) Push(rec MonitorRecord) error {
+
+    if !spool.Enabled() {
+        return nil
+    }
+
+    err := EnsureDirectory(spool.dir)
+    if err != nil {
+        return err
+    }
+
+    p, err := json.Marshal(rec)
+    if err != nil {
+        return err
+    }
+
+    // The random suffix prevents records of the same second from colliding
+    name := fmt.Sprintf("%020d-%s%s", rec.Timestamp, RandomAlphaNum(6), clientSpoolExt)
+    err   = ioutil.WriteFile(filepath.Join(spool.dir, name), p, 0600)
+    if err != nil {
+        return err
+    }
+
+    return spool.Prune()
+
+}
+
+// Returns at most n oldest records along with their file names
+func(spool *ClientSpool) Next(n int) ([]MonitorRecord, []string, error) {
+
+    ents, err := spool.entries()
+    if err != nil {
+        return nil, nil, err
+    }
+    if len(ents) > n {
+        ents = ents[:n]
+    }
+
+    recs  := make([]MonitorRecord, 0, len(ents))
+    names := make([]string, 0, len(ents))
+    for _, ent := range ents {
+        fn   := filepath.Join(spool.dir, ent.name)
+        p, err := ioutil.ReadFile(fn)
+        if err != nil {
+            return nil, nil, err
+        }
+        rec := MonitorRecord{}
+        if err = json.Unmarshal(p, &rec); err != nil {
+            // Corrupted records are discarded
+            EventLogger.Warnln("Discarding a corrupted spool file:", ent.name)
+            os.Remove(fn)
+            continue
+        }
+        recs  = append(recs, rec)
+        names = append(names, ent.name)
+    }
+
+    return recs, names, nil
+
+}
+
+func(spool *ClientSpool) Remove(names []string) error {
+    for _, name := range names {
+        err := os.Remove(filepath.Join(spool.dir, name))
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return nil
+}
+
+// Removes the records that are older than the max age and then the oldest
+// records until the spool fits in the max size
+func(spool *ClientSpool) Prune() error {
+
+    ents, err := spool.entries()
+    if err != nil {
+        return err
+    }
+
+    total := int64(0)
+    for _, ent := range ents {
+        total += ent.size
+    }
+
+    expiry  := time.Now().Unix() - spool.maxAge
+    removed := []string{}
+    for _, ent := range ents {
+        if ent.timestamp >= expiry && total <= spool.maxSize {
+            break
+        }
+        removed  = append(removed, ent.name)
+        total   -= ent.size
+    }
+
+    if len(removed) > 0 {
+        EventLogger.Warnln("Dropping", len(removed), "spooled records due to the spool limits")
+    }
+
+    return spool.Remove(removed)
+
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "testing"
+    "time"
+    "./log"
+)
+
+func TestClientSpool(t *testing.T) {
+
+    EventLogger = &log.Logger{}
+
+    dir, err := ioutil.TempDir("", "telescribe-spool")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    spool := NewClientSpool(dir)
+    spool.SetLimits(1024, 60)
+
+    now := time.Now().Unix()
+    for _, ts := range []int64{now - 10, now - 30, now - 20, now - 7200} {
+        err = spool.Push(MonitorRecord{
+            Timestamp: ts, Per: 10, ValueMap: map[string] interface{}{"cpu-usage": 1.0},
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // The record older than the max age must have been dropped
+    recs, names, err := spool.Next(10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(recs) != 3 {
+        t.Fatalf("expected 3 records, got %d", len(recs))
+    }
+    for i, ts := range []int64{now - 30, now - 20, now - 10} {
+        if recs[i].Timestamp != ts {
+            t.Errorf("record %d: expected %d, got %d", i, ts, recs[i].Timestamp)
+        }
+    }
+    if oldest, _ := spool.Oldest(); oldest != now - 30 {
+        t.Errorf("expected the oldest to be %d, got %d", now - 30, oldest)
+    }
+
+    // Remove
+    if err = spool.Remove(names[:2]); err != nil {
+        t.Fatal(err)
+    }
+    if spool.Len() != 1 {
+        t.Errorf("expected 1 record, got %d", spool.Len())
+    }
+
+}
@@ -5,7 +5,6 @@ import (
     "crypto/sha256"
     "crypto/rand"
     "io"
-    "net"
     "os"
     "time"
     "regexp"
@@ -111,11 +110,3 @@ func Sleep(d time.Duration) bool {
     time.Sleep(d)
     return true
 }
-
-// IO ---
-
-func connCopy(dest, src net.Conn) {
-    defer src.Close()
-    defer dest.Close()
-    io.Copy(dest, src)
-}
\ No newline at end of file
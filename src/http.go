@@ -3,6 +3,7 @@ package main
 import (
     "bytes"
     "crypto/subtle"
+    "crypto/tls"
     "encoding/json"
     "fmt"
     "io"
@@ -20,16 +21,34 @@ import (
     "github.com/hjjg200/go-together"
 )
 
-func (srv *Server) startHttpServer() error {
+// Loads the key pair for TLS, if set, so that the server fails to start rather
+// than accepting HTTPS connections that no one answers
+func (srv *Server) loadHttpTlsConfig() error {
+
+    certFile := srv.config.HttpCertFilePath
+    keyFile  := srv.config.HttpKeyFilePath
+    if certFile == "" || keyFile == "" {
+        srv.httpTlsConfig = nil
+        return nil
+    }
 
-    var err error
-    srv.httpListener, err = net.Listen("tcp", "127.0.0.1:0") // Random port
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
     if err != nil {
-        return err
+        return fmt.Errorf("Failed to load the key pair for TLS: %v", err)
     }
+    srv.httpTlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+    return nil
+
+}
+
+// Serves the connections that the main listener hands over; the listeners are
+// closed when it returns so that later connections are closed instead of
+// waiting for a server that is gone
+func (srv *Server) startHttpServer() error {
+
+    defer srv.httpListener.Close()
+    defer srv.plainHttpListener.Close()
 
-    certFile   := srv.config.HttpCertFilePath
-    keyFile    := srv.config.HttpKeyFilePath
     httpServer := &http.Server{
         Addr: srv.HttpAddr(),
         Handler: srv,
@@ -51,13 +70,42 @@ func (srv *Server) startHttpServer() error {
     }
 
     // TLS
-    if certFile != "" && keyFile != "" {
-        return httpServer.ServeTLS(srv.httpListener, certFile, keyFile)
+    // + Plain HTTP is answered by a server of its own, as the TLS server would
+    //   only fail the handshake
+    // + The plain server stops along with the TLS server
+    if srv.httpTlsConfig != nil {
+        httpServer.TLSConfig = srv.httpTlsConfig
+        plainServer := &http.Server{
+            Addr: srv.HttpAddr(),
+            Handler: http.HandlerFunc(redirectToHttps),
+        }
+        plainStopped := make(chan struct{})
+        go func() {
+            defer close(plainStopped)
+            err := plainServer.Serve(srv.plainHttpListener)
+            if err != http.ErrServerClosed {
+                EventLogger.Warnln("The plain HTTP server stopped:", err)
+            }
+        }()
+        err := httpServer.ServeTLS(srv.httpListener, "", "")
+        plainServer.Close()
+        <-plainStopped
+        return err
     }
 
     return httpServer.Serve(srv.httpListener)
 }
 
+// Redirects the requests that can be repeated to HTTPS on the same host, and
+// refuses the others, as their bodies may have been sent in plain text
+func redirectToHttps(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        http.Error(w, "Use HTTPS", 400)
+        return
+    }
+    http.Redirect(w, r, "https://" + r.Host + r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
 func (srv *Server) HttpAddr() string {
     return srv.httpListener.Addr().String()
 }
@@ -73,6 +121,10 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         }
     }()
 
+    // Access
+    host, _, _ := net.SplitHostPort(r.RemoteAddr)
+    AccessLogger.Infoln(host, r.Method, r.URL.Path, r.Proto)
+
     // Auth
     w.Header().Set("WWW-Authenticate", "Basic realm=\"\"")
     hun, hplainPwd, ok := r.BasicAuth()
@@ -168,6 +220,25 @@ func(srv *Server) populateHttpRouter() {
     })
     hr.Get("/static/(.+)", serveStatic)
 
+    // Metrics
+    hr.Get("/metrics", func(hctx HttpContext) {
+
+        w := hctx.Writer
+        if !hctx.User.IsPermitted(metricsPermission) {
+            w.WriteHeader(403)
+            return
+        }
+
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        err := srv.FprintMetrics(w, func(clId, mKey string) bool {
+            return hctx.User.IsPermitted(metricsPermission, clId, mKey)
+        })
+        if err != nil {
+            EventLogger.Warnln("Failed to write metrics:", err)
+        }
+
+    })
+
     // API
     srv.registerAPIV1()
 
@@ -269,37 +340,16 @@ func(srv *Server) registerAPIV1() {
         defer catchStatus(hctx)
 
         // Vars
-        ret  := make(ClientItemStatusMap)
         clId := hctx.Matches[1]
 
         // Permission
         assertStatus(isPermitted(hctx, keyClItStat, clId), 403)
 
-        mKeys, ok :=  srv.GetClientMonitorDataKeys(clId)
-        EventLogger.Debugln("oct22-http", clId, mKeys, ok)
+        ret, ok := srv.GetClientItemStatusMap(clId, func(mKey string) bool {
+            return isPermitted(hctx, keyClItStat, clId, mKey)
+        })
         assertStatus(ok, 400)
 
-        for _, mKey := range mKeys {
-            if !isPermitted(hctx, keyClItStat, clId, mKey) {
-                continue
-            }
-
-            // Config
-            mCfg, ok := srv.getClientMonitorConfig(clId, mKey)
-            if !ok {
-                EventLogger.Warnln("Monitor config for", mKey, "was not found")
-            }
-
-            length := srv.GetClientMonitorDataLength(clId, mKey)
-            last   := srv.GetClientMonitorDataSlice(clId, mKey, length - 1, length)[0]
-            ret[mKey] = ClientItemStatus{
-                Timestamp: last.Timestamp,
-                Value:     last.Value,
-                Per:       last.Per,
-                Status:    mCfg.StatusOf(last.Value),
-            }
-        }
-
         // Respond
         respond(hctx, keyClItStat, ret)
     })
@@ -392,6 +442,491 @@ func(srv *Server) registerAPIV1() {
 
     })
 
+    // monitorDataColumns
+    keyMdCols := "monitorDataColumns"
+    rgxMdCols := formatRgx(keyMdCols, 0)
+    hr.Post(rgxMdCols, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyMdCols), 403)
+
+        // Request body
+        body := struct {
+            Patterns []MonitorColumnPattern `json:"patterns"`
+            Filter   FprintCsvFilter        `json:"filter"`
+        }{}
+        p, err := ioutil.ReadAll(hctx.Request.Body)
+        assertStatus(err == nil && json.Unmarshal(p, &body) == nil, 400)
+
+        // Columns
+        timestamps, columns, err := srv.GetMonitorDataColumns(body.Patterns, body.Filter, func(clId, mKey string) bool {
+            return isPermitted(hctx, keyMdCols, clId, mKey)
+        })
+        if err != nil {
+            EventLogger.Debugln("Bad monitor data columns:", err)
+        }
+        assertStatus(err == nil, 400)
+
+        // Respond
+        respond(hctx, keyMdCols, map[string] interface{}{
+            "timestamps": timestamps,
+            "columns":    columns,
+        })
+
+    })
+
+    // monitorDataExport
+    keyMdExport := "monitorDataExport"
+    rgxMdExport := formatRgx(keyMdExport, 0)
+    hr.Get(rgxMdExport, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyMdExport), 403)
+
+        // Query
+        w      := hctx.Writer
+        query  := hctx.Request.URL.Query()
+        format := query.Get("format")
+        if format == "" {
+            format = monitorDataFormatCsv
+        }
+        assertStatus(isMonitorDataFormat(format), 400)
+
+        filter := MonitorExportFilter{ClientIds: query["client"]}
+        var err1, err2 error
+        if s := query.Get("from"); s != "" {
+            filter.From, err1 = strconv.ParseInt(s, 10, 64)
+        }
+        if s := query.Get("to"); s != "" {
+            filter.To, err2 = strconv.ParseInt(s, 10, 64)
+        }
+        assertStatus(err1 == nil && err2 == nil, 400)
+
+        // Write
+        switch format {
+        case monitorDataFormatCsv:
+            w.Header().Set("Content-Type", "text/csv")
+        case monitorDataFormatJsonLines:
+            w.Header().Set("Content-Type", "application/x-ndjson")
+        case monitorDataFormatOpenMetrics:
+            w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+        }
+        err := srv.ExportMonitorData(w, format, filter, func(clId, mKey string) bool {
+            return isPermitted(hctx, keyMdExport, clId, mKey)
+        })
+        if err != nil {
+            EventLogger.Warnln("Failed to export monitor data:", err)
+        }
+
+    })
+
+    // monitorDataImport
+    keyMdImport := "monitorDataImport"
+    rgxMdImport := formatRgx(keyMdImport, 0)
+    hr.Post(rgxMdImport, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyMdImport), 403)
+
+        // Query
+        format := hctx.Request.URL.Query().Get("format")
+        if format == "" {
+            format = monitorDataFormatCsv
+        }
+        assertStatus(isMonitorDataFormat(format), 400)
+
+        // Import
+        report, err := srv.ImportMonitorData(hctx.Request.Body, format, func(clId, mKey string) bool {
+            return isPermitted(hctx, keyMdImport, clId, mKey)
+        })
+        if err != nil {
+            EventLogger.Warnln("Failed to import monitor data:", err)
+        }
+        assertStatus(err == nil, 400)
+
+        // Respond
+        respond(hctx, keyMdImport, report)
+
+    })
+
+    // write
+    // + Prometheus remote write
+    keyWrite := "write"
+    rgxWrite := formatRgx(keyWrite, 0)
+    hr.Post(rgxWrite, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyWrite), 403)
+
+        // Request body
+        r := hctx.Request
+        assertStatus(strings.EqualFold(r.Header.Get("Content-Encoding"), "snappy"), 415)
+        p, err := ioutil.ReadAll(io.LimitReader(r.Body, remoteWriteMaxSize))
+        assertStatus(err == nil, 400)
+
+        // Record
+        report, err := srv.RecordRemoteWrite(p, func(clId, mKey string) bool {
+            return isPermitted(hctx, keyWrite, clId, mKey)
+        })
+        if err != nil {
+            EventLogger.Warnln("Malformed remote write request:", err)
+        }
+        assertStatus(err == nil, 400)
+        if report.Dropped > 0 {
+            EventLogger.Debugln("Dropped", report.Dropped, "remote write samples of unknown clients or keys")
+        }
+
+        hctx.Writer.WriteHeader(204)
+
+    })
+
+    // query
+    keyQuery := "query"
+    rgxQuery := formatRgx(keyQuery, 0)
+    hr.Get(rgxQuery, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyQuery), 403)
+
+        // Query
+        w      := hctx.Writer
+        query  := hctx.Request.URL.Query()
+        expr   := query.Get("expr")
+        format := query.Get("format")
+        if format == "" {
+            format = monitorDataFormatCsv
+        }
+        assertStatus(expr != "" && isMonitorDataFormat(format), 400)
+
+        filter := QueryFilter{ClientIds: query["client"], Per: 60}
+        filter.To   = time.Now().Unix()
+        filter.From = filter.To - 3600
+        var err1, err2, err3 error
+        if s := query.Get("from"); s != "" {
+            filter.From, err1 = strconv.ParseInt(s, 10, 64)
+        }
+        if s := query.Get("to"); s != "" {
+            filter.To, err2 = strconv.ParseInt(s, 10, 64)
+        }
+        if s := query.Get("per"); s != "" {
+            filter.Per, err3 = strconv.ParseInt(s, 10, 64)
+        }
+        assertStatus(err1 == nil && err2 == nil && err3 == nil, 400)
+
+        // Evaluate
+        series, err := srv.EvaluateQuery(expr, filter, func(clId, mKey string) bool {
+            return isPermitted(hctx, keyQuery, clId, mKey)
+        })
+        if err != nil {
+            EventLogger.Debugln("Bad query:", err)
+        }
+        assertStatus(err == nil, 400)
+
+        // Write
+        switch format {
+        case monitorDataFormatCsv:
+            w.Header().Set("Content-Type", "text/csv")
+        case monitorDataFormatJsonLines:
+            w.Header().Set("Content-Type", "application/x-ndjson")
+        case monitorDataFormatOpenMetrics:
+            w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+        }
+        err = writeQuerySeries(w, format, series, filter)
+        if err != nil {
+            EventLogger.Warnln("Failed to write query:", err)
+        }
+
+    })
+
+    // stream
+    // + Server-Sent Events of the recorded values
+    keyStream := "stream"
+    rgxStream := formatRgx(keyStream, 0)
+    hr.Get(rgxStream, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyStream), 403)
+
+        // Patterns
+        query := hctx.Request.URL.Query()
+        matchAny := func(patterns []string, values ...string) bool {
+            if len(patterns) == 0 {
+                return true
+            }
+            for _, pattern := range patterns {
+                for _, val := range values {
+                    if matchQueryPattern(pattern, val) {
+                        return true
+                    }
+                }
+            }
+            return false
+        }
+
+        // The permission node of the user is built once, as the subscriber
+        // is called by the publishers concurrently
+        usr := hctx.User
+        usr.IsPermitted(apiName)
+        sub := srv.sampleStream.Subscribe(func(clId, mKey string) bool {
+            tags := SplitWhitespace(srv.clientConfig.InfoMap[clId].Tags)
+            return matchAny(query["client"], clId) &&
+                matchAny(query["tag"], tags...) &&
+                matchAny(query["key"], mKey) &&
+                usr.IsPermitted(apiName, "GET", keyStream, clId, mKey)
+        })
+        assertStatus(sub != nil, 503)
+        defer srv.sampleStream.Unsubscribe(sub)
+
+        // Events
+        err := sub.serveEvents(hctx.Writer, hctx.Request)
+        if err != nil {
+            EventLogger.Debugln("Stream ended:", err)
+        }
+
+    })
+
+    // retentionReport
+    keyRtReport := "retentionReport"
+    rgxRtReport := formatRgx(keyRtReport, 0)
+    hr.Get(rgxRtReport, func(hctx HttpContext) {
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyRtReport), 403)
+
+        // Dry run
+        report, err := srv.EnforceMonitorDataRetention(true)
+        assertStatus(err == nil, 500)
+
+        // Respond
+        respond(hctx, keyRtReport, report)
+    })
+
+    // snapshot
+    keySnapshot := "snapshot"
+    rgxSnapshot := formatRgx(keySnapshot, 0)
+    hr.Get(rgxSnapshot, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keySnapshot), 403)
+
+        // Storing and retention cycles are held until the snapshot is taken
+        assertStatus(railSwitch.Queue(threadSnapshot, 1), 503)
+        tmp, err := func() (*os.File, error) {
+            defer railSwitch.Proceed(threadSnapshot)
+            tmp, err := ioutil.TempFile("", "telescribe-snapshot")
+            if err != nil {
+                return nil, err
+            }
+            if _, err = srv.Snapshot(tmp, false); err != nil {
+                tmp.Close()
+                os.Remove(tmp.Name())
+                return nil, err
+            }
+            return tmp, nil
+        }()
+        if err != nil {
+            EventLogger.Warnln("Failed to take a snapshot:", err)
+        }
+        assertStatus(err == nil, 500)
+        defer os.Remove(tmp.Name())
+        defer tmp.Close()
+
+        // Write
+        // + The snapshot is sent from a temporary file so that a slow download
+        //   does not hold the store
+        w := hctx.Writer
+        w.Header().Set("Content-Type", "application/gzip")
+        w.Header().Set("Content-Disposition", fmt.Sprintf(
+            "attachment; filename=\"telescribe-snapshot-%d.tar.gz\"", time.Now().Unix(),
+        ))
+        tmp.Seek(0, io.SeekStart)
+        io.Copy(w, tmp)
+
+    })
+
+    // silences
+    keySilences := "silences"
+    rgxSilences := formatRgx(keySilences, 0)
+    hr.Get(rgxSilences, func(hctx HttpContext) {
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keySilences), 403)
+
+        // Respond
+        silences, _ := srv.GetSilences()
+        respond(hctx, keySilences, silences)
+    })
+    hr.Post(rgxSilences, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keySilences), 403)
+
+        // Request body
+        sl     := Silence{}
+        p, err := ioutil.ReadAll(hctx.Request.Body)
+        assertStatus(err == nil && json.Unmarshal(p, &sl) == nil, 400)
+        if sl.Author == "" {
+            sl.Author = hctx.User.Name
+        }
+
+        // Add
+        sl, err = srv.AddSilence(sl)
+        if err != nil {
+            EventLogger.Debugln("Bad silence:", err)
+        }
+        assertStatus(err == nil, 400)
+
+        // Respond
+        respond(hctx, "silence", sl)
+
+    })
+
+    // expireSilence
+    keyExpSilence := "expireSilence"
+    rgxExpSilence := formatRgx(keyExpSilence, 1)
+    hr.Post(rgxExpSilence, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Vars
+        id := hctx.Matches[1]
+        // Permission
+        assertStatus(isPermitted(hctx, keyExpSilence), 403)
+
+        // Expire
+        sl, ok, err := srv.ExpireSilence(id, time.Now().Unix())
+        assertStatus(ok, 404)
+        if err != nil {
+            EventLogger.Warnln("Failed to write the silences:", err)
+        }
+        assertStatus(err == nil, 500)
+
+        // Respond
+        respond(hctx, "silence", sl)
+
+    })
+
+    // maintenanceWindows
+    keyMtWindows := "maintenanceWindows"
+    rgxMtWindows := formatRgx(keyMtWindows, 0)
+    hr.Get(rgxMtWindows, func(hctx HttpContext) {
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyMtWindows), 403)
+
+        // Respond
+        _, windows := srv.GetSilences()
+        respond(hctx, keyMtWindows, windows)
+    })
+    hr.Post(rgxMtWindows, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyMtWindows), 403)
+
+        // Request body
+        mw     := MaintenanceWindow{}
+        p, err := ioutil.ReadAll(hctx.Request.Body)
+        assertStatus(err == nil && json.Unmarshal(p, &mw) == nil, 400)
+        if mw.Author == "" {
+            mw.Author = hctx.User.Name
+        }
+
+        // Add
+        mw, err = srv.AddMaintenanceWindow(mw)
+        if err != nil {
+            EventLogger.Debugln("Bad maintenance window:", err)
+        }
+        assertStatus(err == nil, 400)
+
+        // Respond
+        respond(hctx, "maintenanceWindow", mw)
+
+    })
+
+    // deleteMaintenanceWindow
+    keyDelMtWindow := "deleteMaintenanceWindow"
+    rgxDelMtWindow := formatRgx(keyDelMtWindow, 1)
+    hr.Post(rgxDelMtWindow, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Vars
+        id := hctx.Matches[1]
+        // Permission
+        assertStatus(isPermitted(hctx, keyDelMtWindow), 403)
+
+        // Delete
+        ok, err := srv.DeleteMaintenanceWindow(id)
+        assertStatus(ok, 404)
+        if err != nil {
+            EventLogger.Warnln("Failed to write the silences:", err)
+        }
+        assertStatus(err == nil, 500)
+
+        hctx.Writer.WriteHeader(204)
+
+    })
+
+    // alertHistory
+    keyAlHistory := "alertHistory"
+    rgxAlHistory := formatRgx(keyAlHistory, 0)
+    hr.Get(rgxAlHistory, func(hctx HttpContext) {
+
+        defer catchStatus(hctx)
+
+        // Permission
+        assertStatus(isPermitted(hctx, keyAlHistory), 403)
+
+        // Query
+        query  := hctx.Request.URL.Query()
+        filter := AlertHistoryFilter{ClientIds: query["client"]}
+        var err1, err2, err3 error
+        if s := query.Get("from"); s != "" {
+            filter.From, err1 = strconv.ParseInt(s, 10, 64)
+        }
+        if s := query.Get("to"); s != "" {
+            filter.To, err2 = strconv.ParseInt(s, 10, 64)
+        }
+        if s := query.Get("limit"); s != "" {
+            filter.Limit, err3 = strconv.Atoi(s)
+        }
+        assertStatus(err1 == nil && err2 == nil && err3 == nil && filter.Limit >= 0, 400)
+
+        // Read
+        entries, err := srv.ReadAlertHistory(filter, func(clId, mKey string) bool {
+            return isPermitted(hctx, keyAlHistory, clId, mKey)
+        })
+        if err != nil {
+            EventLogger.Warnln("Failed to read the alert history:", err)
+        }
+        assertStatus(err == nil, 500)
+
+        // Respond
+        respond(hctx, keyAlHistory, entries)
+
+    })
+
     // webConfig
     keyWebCfg := "webConfig"
     rgxWebCfg := formatRgx(keyWebCfg, 0)
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+)
+
+const (
+    metricsPermission   = "metrics"
+    metricsNamePrefix   = "telescribe_"
+    metricsStatusSuffix = "_status"
+)
+
+/*
+
+The latest value of every monitor key of every client is exposed at /metrics
+in the Prometheus text exposition format, along with its status:
+
+# TYPE telescribe_disk_usage gauge
+telescribe_disk_usage{client="cl-1",client_alias="web",client_tags="linux,web",param="/dev/sda"} 41.5 1600000060000
+# TYPE telescribe_disk_usage_status gauge
+telescribe_disk_usage_status{client="cl-1",client_alias="web",client_tags="linux,web",param="/dev/sda"} 0
+
+The metric name is the base of the monitor key, whose characters that are not
+allowed in metric names are replaced with underscores, and the param and the
+index of the monitor key become the labels param and idx. The alias of the
+monitor config, if any, becomes the label alias. The status is 0 for normal,
+8 for warning, and 16 for fatal, as in clientItemStatus.
+
+The samples carry the timestamps of the data in milliseconds, so that the
+values of the clients that stopped sending data become stale.
+
+*/
+
+type metricsSample struct {
+    labels    string
+    value     float64
+    status    int
+    timestamp int64
+}
+
+// Returns the metric name for the base of a monitor key
+func metricsNameOf(base string) string {
+    var sb strings.Builder
+    sb.WriteString(metricsNamePrefix)
+    for _, r := range base {
+        switch {
+        case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+            sb.WriteRune(r)
+        default:
+            sb.WriteByte('_')
+        }
+    }
+    return sb.String()
+}
+
+func formatMetricsLabels(pairs ...string) string {
+    parts := make([]string, 0, len(pairs) / 2)
+    for i := 0; i + 1 < len(pairs); i += 2 {
+        if pairs[i + 1] == "" {
+            continue
+        }
+        parts = append(parts, pairs[i] + "=\"" + escapeOpenMetricsLabel(pairs[i + 1]) + "\"")
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Writes the latest values of the monitor keys; keep, if not nil, decides
+// which monitor keys are included
+func(srv *Server) FprintMetrics(w io.Writer, keep func(clId, mKey string) bool) error {
+
+    families := make(map[string/* name */] []metricsSample)
+
+    for _, clId := range srv.GetClientIds() {
+
+        itStatMap, ok := srv.GetClientItemStatusMap(clId, func(mKey string) bool {
+            return keep == nil || keep(clId, mKey)
+        })
+        if !ok {
+            continue
+        }
+
+        clInfo := srv.clientConfig.InfoMap[clId]
+        tags   := strings.Join(SplitWhitespace(strings.TrimSpace(clInfo.Tags)), ",")
+        for mKey, itStat := range itStatMap {
+            base, param, idx := ParseMonitorKey(mKey)
+            mCfg, _          := srv.getClientMonitorConfig(clId, mKey)
+            name             := metricsNameOf(base)
+            families[name] = append(families[name], metricsSample{
+                labels: formatMetricsLabels(
+                    "client", clId, "client_alias", clInfo.Alias, "client_tags", tags,
+                    "param", param, "idx", idx, "alias", mCfg.Alias,
+                ),
+                value:     itStat.Value,
+                status:    itStat.Status,
+                timestamp: itStat.Timestamp * 1000,
+            })
+        }
+
+    }
+
+    names := make([]string, 0, len(families))
+    for name := range families {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    bw := bufio.NewWriter(w)
+    for _, name := range names {
+        samples := families[name]
+        sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+
+        fmt.Fprintf(bw, "# TYPE %s gauge\n", name)
+        for _, s := range samples {
+            fmt.Fprintf(bw, "%s%s %s %d\n", name, s.labels, formatOpenMetricsFloat(s.value), s.timestamp)
+        }
+        fmt.Fprintf(bw, "# TYPE %s%s gauge\n", name, metricsStatusSuffix)
+        for _, s := range samples {
+            fmt.Fprintf(bw, "%s%s%s %d\n", name, metricsStatusSuffix, s.labels, s.status)
+        }
+    }
+    return bw.Flush()
+
+}
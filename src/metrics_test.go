@@ -0,0 +1,44 @@
+package main
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestFprintMetrics(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    diskKey := FormatMonitorKey("disk-usage", "/dev/sda", "0")
+    rule    := srv.clientConfig.RuleMap["test"]
+    rule.MonitorConfigMap[diskKey] = MonitorConfig{Alias: "Disk", FatalRange: "90:"}
+    srv.clientConfig.RuleMap["test"] = rule
+    srv.clientConfig.InfoMap["cl-0"] = ClientInfo{Alias: `web "1"`, Tags: "test  prod"}
+
+    srv.RecordValueMap("cl-0", 100, map[string] interface{}{"load": 1.5, diskKey: 95.0}, 60)
+    srv.RecordValueMap("cl-0", 160, map[string] interface{}{"load": 2.5}, 60)
+    srv.RecordValueMap("cl-1", 100, map[string] interface{}{"load": 0.5}, 60)
+
+    buf := bytes.NewBuffer(nil)
+    if err := srv.FprintMetrics(buf, func(clId, mKey string) bool { return clId != "cl-1" }); err != nil {
+        t.Fatal(err)
+    }
+    out := buf.String()
+
+    for _, line := range []string{
+        "# TYPE telescribe_load gauge",
+        `telescribe_load{client="cl-0",client_alias="web \"1\"",client_tags="test,prod"} 2.5 160000`,
+        `telescribe_disk_usage{client="cl-0",client_alias="web \"1\"",client_tags="test,prod",param="/dev/sda",idx="0",alias="Disk"} 95 100000`,
+        `telescribe_disk_usage_status{client="cl-0",client_alias="web \"1\"",client_tags="test,prod",param="/dev/sda",idx="0",alias="Disk"} 16`,
+    } {
+        if !strings.Contains(out, line + "\n") {
+            t.Errorf("expected %s in\n%s", line, out)
+        }
+    }
+    if strings.Contains(out, `client="cl-1"`) {
+        t.Errorf("cl-1 must not be exposed:\n%s", out)
+    }
+
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    monitorColumnsMax = 1000
+)
+
+/*
+
+The data of several monitor keys of several clients are aggregated into
+columns of the same timestamps, so that a dashboard of a fleet loads in a
+single request. The columns are given as patterns of the client id, the tag of
+the client, and the monitor key, in which * and ? match any characters:
+
+{"client": "cl-1", "key": "load"}           The load of cl-1
+{"tag": "web", "key": "cpu-usage[*]"}       Every cpu of the clients tagged web
+{"key": "memory-usage"}                     The memory usage of every client
+
+The range from from to to of the filter is divided into steps of per, and each
+column has the value of the aggregate type of the filter for each step, or NaN
+if there are no data within the step. As in monitorDataCsv, the rollups are
+used when per is at least as long as one of their resolutions.
+
+*/
+
+type MonitorColumnPattern struct {
+    ClientId string `json:"client"`
+    Tag      string `json:"tag"`
+    Key      string `json:"key"`
+}
+
+type MonitorColumn struct {
+    ClientId string    `json:"client"`
+    Key      string    `json:"key"`
+    Values   monitorColumnValues `json:"values"`
+}
+
+// NaN and infinities are null in json
+type monitorColumnValues []float64
+
+func(values monitorColumnValues) MarshalJSON() ([]byte, error) {
+    buf := bytes.NewBuffer(nil)
+    buf.WriteByte('[')
+    for i, val := range values {
+        if i > 0 {
+            buf.WriteByte(',')
+        }
+        if math.IsNaN(val) || math.IsInf(val, 0) {
+            buf.WriteString("null")
+        } else {
+            buf.WriteString(strconv.FormatFloat(val, 'g', -1, 64))
+        }
+    }
+    buf.WriteByte(']')
+    return buf.Bytes(), nil
+}
+
+type monitorDataBucket struct {
+    Value float64 // The sum for the mean
+    Count float64 // Raw data
+    Per   float64 // The seconds that the data stand for
+}
+
+// Returns the value of the aggregate type for the bucket, or NaN if it is empty
+func(b monitorDataBucket) valueOf(agrg string) float64 {
+    switch {
+    case b.Count == 0:
+        return math.NaN()
+    case agrg == monitorAggregateKeyMean:
+        return b.Value / b.Count
+    }
+    return b.Value
+}
+
+// Returns n buckets of the aggregate type, each of which holds the data within
+// (from + i * per, from + (i + 1) * per]
+func(srv *Server) getMonitorDataBuckets(clId, mKey, agrg string, from, per int64, n int) []monitorDataBucket {
+
+    to      := from + int64(n) * per
+    buckets := make([]monitorDataBucket, n)
+    put     := func(ts int64, val, count, datumPer float64) {
+        if ts <= from || ts > to {
+            return
+        }
+        b := &buckets[(ts - from - 1) / per]
+        switch {
+        case b.Count == 0:
+            b.Value = val
+        case agrg == monitorAggregateKeyMin:
+            b.Value = math.Min(b.Value, val)
+        case agrg == monitorAggregateKeyMax:
+            b.Value = math.Max(b.Value, val)
+        default: // Sum and mean
+            b.Value += val
+        }
+        b.Count += count
+        b.Per   += datumPer
+    }
+
+    // Rollups stand for their resolutions
+    rawFrom := from + 1
+    if res := srv.pickMonitorRollupResolution(int32(per)); res > 0 {
+        rolled, rolledCounts := srv.getMonitorRollupRange(clId, mKey, res, agrg, rawFrom, to)
+        for i, datum := range rolled {
+            put(datum.Timestamp, datum.Value, rolledCounts[i], float64(res))
+        }
+        if watermark := srv.monitorRollupWatermark(clId, mKey, res); watermark > rawFrom {
+            rawFrom = watermark
+        }
+    }
+
+    raw := getMonitorDataRange(srv.monitorDataStore, srv.config.DataStoreDir, clId, mKey, rawFrom, to)
+    for _, datum := range raw {
+        put(datum.Timestamp, datum.Value, 1, float64(datum.Per))
+    }
+
+    return buckets
+
+}
+
+// Returns the client ids and the monitor keys that match the patterns, in the
+// order of the patterns; keep, if not nil, decides which monitor keys are included
+func(srv *Server) matchMonitorColumns(patterns []MonitorColumnPattern, keep func(clId, mKey string) bool) []MonitorColumn {
+
+    clIds := srv.monitorDataStore.ClientIds()
+    sort.Strings(clIds)
+
+    ret  := []MonitorColumn{}
+    seen := make(map[[2]string] bool)
+    for _, pattern := range patterns {
+        for _, clId := range clIds {
+
+            if pattern.ClientId != "" && !matchQueryPattern(pattern.ClientId, clId) {
+                continue
+            }
+            if pattern.Tag != "" {
+                tagged := false
+                for _, tag := range SplitWhitespace(srv.clientConfig.InfoMap[clId].Tags) {
+                    if matchQueryPattern(pattern.Tag, tag) {
+                        tagged = true
+                        break
+                    }
+                }
+                if !tagged {
+                    continue
+                }
+            }
+
+            mKeys, _ := srv.monitorDataStore.Keys(clId)
+            sort.Strings(mKeys)
+            for _, mKey := range mKeys {
+                pair := [2]string{clId, mKey}
+                if seen[pair] || !matchQueryPattern(pattern.Key, mKey) || (keep != nil && !keep(clId, mKey)) {
+                    continue
+                }
+                seen[pair] = true
+                ret = append(ret, MonitorColumn{ClientId: clId, Key: mKey})
+            }
+
+        }
+    }
+    return ret
+
+}
+
+// Returns the timestamps and the columns of the data that match the patterns;
+// keep, if not nil, decides which monitor keys are included
+func(srv *Server) GetMonitorDataColumns(
+    patterns []MonitorColumnPattern, filter FprintCsvFilter, keep func(clId, mKey string) bool,
+) (timestamps []int64, columns []MonitorColumn, err error) {
+
+    defer Catch(&err)
+
+    _, ok := monitorAggregateTypesMap[filter.Type]
+    Assert(ok, "Unknown aggregate type: " + filter.Type)
+    Assert(filter.Per > 0, "The per must be positive")
+    Assert(filter.To > filter.From, "The range must not be empty")
+    per := int64(filter.Per)
+    n   := (filter.To - filter.From + per - 1) / per
+    Assert(n <= queryMaxPoints, fmt.Sprintf("The columns have more than %d values each", queryMaxPoints))
+    for _, pattern := range patterns {
+        Assert(strings.TrimSpace(pattern.Key) != "", "Patterns must have keys")
+    }
+
+    columns = srv.matchMonitorColumns(patterns, keep)
+    Assert(len(columns) <= monitorColumnsMax, fmt.Sprintf("The patterns match more than %d columns", monitorColumnsMax))
+
+    timestamps = make([]int64, n)
+    for i := range timestamps {
+        timestamps[i] = filter.From + int64(i + 1) * per
+    }
+    for i := range columns {
+        buckets := srv.getMonitorDataBuckets(columns[i].ClientId, columns[i].Key, filter.Type, filter.From, per, int(n))
+        values  := make(monitorColumnValues, n)
+        for j, b := range buckets {
+            values[j] = b.valueOf(filter.Type)
+            if filter.EqualWeight && b.Per > 0 {
+                values[j] *= float64(per) / b.Per
+            }
+        }
+        columns[i].Values = values
+    }
+    return timestamps, columns, nil
+
+}
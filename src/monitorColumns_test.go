@@ -0,0 +1,100 @@
+package main
+
+import (
+    "encoding/json"
+    "math"
+    "testing"
+)
+
+func TestGetMonitorDataColumns(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.clientConfig.InfoMap["cl-1"] = ClientInfo{Tags: "test web"}
+    srv.clientConfig.InfoMap["cl-2"] = ClientInfo{Tags: "test web"}
+    for _, ts := range []int64{30, 60, 90, 120, 180} {
+        for _, clId := range []string{"cl-0", "cl-1", "cl-2"} {
+            srv.recordValueMap(clId, ts, map[string] interface{}{
+                "load": float64(ts / 30), "cpu-usage[0]": 10.0, "cpu-usage[1]": 20.0,
+            }, 30)
+        }
+    }
+
+    columnsOf := func(patterns []MonitorColumnPattern, filter FprintCsvFilter) ([]int64, []MonitorColumn) {
+        timestamps, columns, err := srv.GetMonitorDataColumns(patterns, filter, func(clId, mKey string) bool {
+            return clId != "cl-2" || mKey != "cpu-usage[1]"
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        return timestamps, columns
+    }
+
+    // Matching
+    _, columns := columnsOf([]MonitorColumnPattern{
+        {ClientId: "cl-0", Key: "load"},
+        {Tag: "web", Key: "cpu-usage[*]"},
+        {Key: "load"},
+    }, FprintCsvFilter{From: 0, To: 180, Per: 60, Type: "mean"})
+    expected := [][2]string{
+        {"cl-0", "load"},
+        {"cl-1", "cpu-usage[0]"}, {"cl-1", "cpu-usage[1]"}, {"cl-2", "cpu-usage[0]"},
+        {"cl-1", "load"}, {"cl-2", "load"},
+    }
+    if len(columns) != len(expected) {
+        t.Fatalf("expected %v, got %+v", expected, columns)
+    }
+    for i, col := range columns {
+        if col.ClientId != expected[i][0] || col.Key != expected[i][1] {
+            t.Errorf("expected %v, got %+v", expected[i], col)
+        }
+    }
+
+    // Aggregate types
+    for agrg, values := range map[string] []float64{
+        "mean": {1.5, 3.5, 6},
+        "min":  {1, 3, 6},
+        "max":  {2, 4, 6},
+        "sum":  {3, 7, 6},
+    } {
+        timestamps, columns := columnsOf(
+            []MonitorColumnPattern{{ClientId: "cl-0", Key: "load"}},
+            FprintCsvFilter{From: 0, To: 180, Per: 60, Type: agrg},
+        )
+        if len(timestamps) != 3 || timestamps[0] != 60 || timestamps[2] != 180 {
+            t.Errorf("unexpected timestamps %v", timestamps)
+        }
+        for i := range values {
+            if columns[0].Values[i] != values[i] {
+                t.Errorf("%s: expected %v, got %v", agrg, values, columns[0].Values)
+                break
+            }
+        }
+    }
+
+    // Equal weight and gaps
+    _, columns = columnsOf(
+        []MonitorColumnPattern{{ClientId: "cl-0", Key: "load"}},
+        FprintCsvFilter{From: 0, To: 240, Per: 60, Type: "sum", EqualWeight: true},
+    )
+    if columns[0].Values[2] != 12 || !math.IsNaN(columns[0].Values[3]) {
+        t.Errorf("unexpected values %v", columns[0].Values)
+    }
+    p, err := json.Marshal(columns[0])
+    if err != nil || string(p) != `{"client":"cl-0","key":"load","values":[3,7,12,null]}` {
+        t.Errorf("unexpected json %s %v", p, err)
+    }
+
+    // Errors
+    for _, filter := range []FprintCsvFilter{
+        {From: 0, To: 180, Per: 60, Type: "median"},
+        {From: 0, To: 180, Per: 0, Type: "mean"},
+        {From: 0, To: 1e9, Per: 1, Type: "mean"},
+    } {
+        if _, _, err = srv.GetMonitorDataColumns([]MonitorColumnPattern{{Key: "load"}}, filter, nil); err == nil {
+            t.Errorf("%+v: expected an error", filter)
+        }
+    }
+
+}
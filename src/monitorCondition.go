@@ -0,0 +1,189 @@
+package main
+
+import (
+    "math"
+)
+
+/*
+
+Besides the warning and fatal ranges of values, a monitor config may judge the
+status of a monitor key by the following conditions, the most severe of which
+is the status of the key:
+
+rate        The change of the values over rateWindow, which is the slope between
+            the first and the last values within the window times the window,
+            e.g., rateWindow of 1h and rateFatalRange of 5: for disk usage
+            growing by more than 5 an hour
+full        The time until the values reach fullAt, which is predicted by the
+            linear regression of the values within fullWindow, e.g.,
+            fullWindow of 6h, fullAt of 100, and fullWarningTime of 1d; the
+            time is predicted only while the values head toward fullAt
+absent      How long the key has had no value while the client has kept
+            recording others, e.g., absentFatalTime of 10m for a command whose
+            getter started failing; only the keys that have had a value are
+            judged, and the silence of the whole client is left to clientDown
+
+The rate and the full conditions are judged with the values up to each value,
+while the absent condition is judged every alert.evaluationInterval, so that
+the built-in fatalRange rule fires for the fatal rate and full conditions as
+well, and the built-in absent rule fires for the fatal absent condition. The
+values within the windows are taken from the recent data kept in memory for
+the key, see monitorWindow.go, so that judging a value never reads chunk files.
+
+*/
+
+// Returns whether the config has the conditions of the values within windows
+func(mCfg MonitorConfig) hasTrendConditions() bool {
+    return (mCfg.RateWindow != "" && (mCfg.RateWarningRange != "" || mCfg.RateFatalRange != "")) ||
+        (mCfg.FullWindow != "" && (mCfg.FullWarningTime != "" || mCfg.FullFatalTime != ""))
+}
+
+// Returns whether any of the conditions of the values is fatal
+func(mCfg MonitorConfig) hasFatalConditions() bool {
+    return mCfg.FatalRange != "" ||
+        (mCfg.RateWindow != "" && mCfg.RateFatalRange != "") ||
+        (mCfg.FullWindow != "" && mCfg.FullFatalTime != "")
+}
+
+// Returns the status of the seconds against the warning and the fatal limits,
+// each of which is disabled when empty
+func statusOfTimeLimits(sec float64, warning, fatal Retention) int {
+    fatalSec, _   := fatal.Seconds()
+    warningSec, _ := warning.Seconds()
+    switch {
+    case fatalSec > 0 && sec <= float64(fatalSec):
+        return MonitorStatusFatal
+    case warningSec > 0 && sec <= float64(warningSec):
+        return MonitorStatusWarning
+    }
+    return MonitorStatusNormal
+}
+
+// Returns the data of the key within (to - window, to], from the recent data
+// kept in memory for the key
+func(srv *Server) getMonitorDataWindow(clId, mKey string, window Retention, to int64) MonitorData {
+    sec, err := window.Seconds()
+    if err != nil || sec <= 0 {
+        return nil
+    }
+    return srv.getMonitorDataRecent(clId, mKey, sec, to)
+}
+
+// Returns the change of the values over the window of the data
+func monitorDataRate(md MonitorData, window Retention) (float64, bool) {
+    sec, _ := window.Seconds()
+    if len(md) < 2 || sec <= 0 {
+        return 0, false
+    }
+    first, last := md[0], md[len(md) - 1]
+    if last.Timestamp <= first.Timestamp {
+        return 0, false
+    }
+    slope := (last.Value - first.Value) / float64(last.Timestamp - first.Timestamp)
+    return slope * float64(sec), true
+}
+
+// Returns the seconds from the time until the regression line of the data
+// reaches the value; false when the line does not head toward it
+func monitorDataTimeToReach(md MonitorData, val float64, at int64) (float64, bool) {
+
+    n := float64(len(md))
+    if n < 2 {
+        return 0, false
+    }
+
+    // Least squares, relative to the time for precision
+    var sumX, sumY float64
+    for _, datum := range md {
+        sumX += float64(datum.Timestamp - at)
+        sumY += datum.Value
+    }
+    meanX, meanY := sumX / n, sumY / n
+    var sxy, sxx float64
+    for _, datum := range md {
+        dx := float64(datum.Timestamp - at) - meanX
+        sxy += dx * (datum.Value - meanY)
+        sxx += dx * dx
+    }
+    if sxx == 0 || sxy == 0 {
+        return 0, false
+    }
+    slope     := sxy / sxx
+    predicted := meanY - slope * meanX // At the time
+    remaining := (val - predicted) / slope
+    if remaining <= 0 || math.IsInf(remaining, 0) || math.IsNaN(remaining) {
+        return 0, false
+    }
+    return remaining, true
+
+}
+
+// Returns the status of the value of the key at the time, judged by the
+// ranges of values, the rate, and the full conditions
+func(srv *Server) statusOfMonitorValue(clId, mKey string, mCfg MonitorConfig, ts int64, val float64) int {
+
+    status := mCfg.StatusOf(val)
+    if status == MonitorStatusFatal || !mCfg.hasTrendConditions() {
+        return status
+    }
+
+    // Rate
+    if mCfg.RateWindow != "" {
+        rate, ok := monitorDataRate(srv.getMonitorDataWindow(clId, mKey, mCfg.RateWindow, ts), mCfg.RateWindow)
+        switch {
+        case !ok:
+        case mCfg.RateFatalRange.Includes(rate):
+            return MonitorStatusFatal
+        case mCfg.RateWarningRange.Includes(rate):
+            status = MonitorStatusWarning
+        }
+    }
+
+    // Full
+    if mCfg.FullWindow != "" {
+        md := srv.getMonitorDataWindow(clId, mKey, mCfg.FullWindow, ts)
+        if remaining, ok := monitorDataTimeToReach(md, mCfg.FullAt, ts); ok {
+            if st := statusOfTimeLimits(remaining, mCfg.FullWarningTime, mCfg.FullFatalTime); st > status {
+                status = st
+            }
+        }
+    }
+
+    return status
+
+}
+
+// Returns the latest timestamp among the keys of the client
+func(srv *Server) getClientLastTimestamp(clId string) (int64, bool) {
+    mKeys, _ := srv.monitorDataStore.Keys(clId)
+    latest, found := int64(0), false
+    for _, mKey := range mKeys {
+        if ts, ok := srv.monitorDataStore.LastTimestamp(clId, mKey); ok && ts > latest {
+            latest, found = ts, true
+        }
+    }
+    return latest, found
+}
+
+// Returns how long the key has had no value until the latest value of the
+// client, and the status of it
+func(srv *Server) absenceOfMonitorKey(clId, mKey string, mCfg MonitorConfig, latest int64) (int64, int) {
+    last, ok := srv.monitorDataStore.LastTimestamp(clId, mKey)
+    if !ok || (mCfg.AbsentWarningTime == "" && mCfg.AbsentFatalTime == "") {
+        return 0, MonitorStatusNormal
+    }
+    absence := latest - last
+    if absence <= 0 {
+        return 0, MonitorStatusNormal
+    }
+    // The limits are the least seconds of absence
+    fatalSec, _   := mCfg.AbsentFatalTime.Seconds()
+    warningSec, _ := mCfg.AbsentWarningTime.Seconds()
+    switch {
+    case fatalSec > 0 && absence >= fatalSec:
+        return absence, MonitorStatusFatal
+    case warningSec > 0 && absence >= warningSec:
+        return absence, MonitorStatusWarning
+    }
+    return absence, MonitorStatusNormal
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+func TestMonitorDataTrends(t *testing.T) {
+
+    md := MonitorData{{0, 10, 60}, {600, 12, 60}, {1200, 13, 60}, {1800, 16, 60}}
+
+    // 6 over 1800 seconds
+    if rate, ok := monitorDataRate(md, "1h"); !ok || math.Abs(rate - 12) > 1e-9 {
+        t.Errorf("Expected the rate of 12, got %v %v", rate, ok)
+    }
+    if _, ok := monitorDataRate(md[:1], "1h"); ok {
+        t.Error("Expected no rate of a single datum")
+    }
+
+    // y = 10 + t / 300
+    linear := MonitorData{{0, 10, 60}, {300, 11, 60}, {600, 12, 60}, {900, 13, 60}}
+    if remaining, ok := monitorDataTimeToReach(linear, 20, 900); !ok || math.Abs(remaining - 2100) > 1e-6 {
+        t.Errorf("Expected 2100 seconds, got %v %v", remaining, ok)
+    }
+    for _, c := range []struct {
+        md  MonitorData
+        val float64
+    }{
+        {linear, 0}, // Heading away
+        {linear, 13}, // Reached
+        {MonitorData{{0, 5, 60}, {300, 5, 60}}, 10}, // Flat
+        {MonitorData{{0, 5, 60}}, 10},
+    } {
+        if remaining, ok := monitorDataTimeToReach(c.md, c.val, 900); ok {
+            t.Errorf("%v to %v: expected no prediction, got %v", c.md, c.val, remaining)
+        }
+    }
+
+}
+
+func TestMonitorConditions(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.config.AlertRepeatInterval = 0
+    mCfgMap := srv.clientConfig.RuleMap["test"].MonitorConfigMap
+    mCfgMap["disk-usage"] = MonitorConfig{
+        RateWindow:      "10m",
+        RateFatalRange:  "5:",
+        FullWindow:      "10m",
+        FullAt:          100,
+        FullWarningTime: "1h",
+    }
+    mCfgMap["command(probe)"] = MonitorConfig{
+        AbsentWarningTime: "2m",
+        AbsentFatalTime:   "4m",
+    }
+
+    evaluate := func(clId string, ts int64, valMap map[string] interface{}) []string {
+        statuses := []string{}
+        for _, ev := range srv.evaluateAlerts(srv.recordValueMap(clId, ts, valMap, 60)) {
+            statuses = append(statuses, ev.Rule + ":" + ev.Key + ":" + ev.Status)
+        }
+        return statuses
+    }
+    statusOf := func(clId, mKey string) int {
+        itStatMap, _ := srv.GetClientItemStatusMap(clId, nil)
+        return itStatMap[mKey].Status
+    }
+
+    // Growing by 1 a minute, 10 over the rate window
+    evaluate("cl-0", 60, map[string] interface{}{"disk-usage": 50.0})
+    if st := evaluate("cl-0", 120, map[string] interface{}{"disk-usage": 51.0}); len(st) != 1 || st[0] != "fatalRange:disk-usage:firing" {
+        t.Fatalf("Expected the rate to fire, got %v", st)
+    }
+    if st := statusOf("cl-0", "disk-usage"); st != MonitorStatusFatal {
+        t.Errorf("Expected the fatal status, got %d", st)
+    }
+    // Steady
+    for ts := int64(180); ts <= 720; ts += 60 {
+        evaluate("cl-0", ts, map[string] interface{}{"disk-usage": 51.0})
+    }
+    if st := statusOf("cl-0", "disk-usage"); st != MonitorStatusNormal {
+        t.Errorf("Expected the normal status, got %d", st)
+    }
+    if len(srv.alertManager.States()) != 0 {
+        t.Errorf("Expected the alert to be resolved, got %+v", srv.alertManager.States())
+    }
+    // Judged from the recent data kept for the longest window
+    if w := srv.monitorWindows.window("cl-0", "disk-usage", false); w == nil || w.span != 600 || len(w.data) != 10 {
+        t.Errorf("Expected the window of 10 data, got %+v", w)
+    }
+
+    // Growing by 0.4 a minute, full in 122 minutes and then in 56 minutes
+    for i, ts := 0, int64(60); i < 4; i, ts = i + 1, ts + 60 {
+        evaluate("cl-1", ts, map[string] interface{}{"disk-usage": 50 + 0.4 * float64(i)})
+    }
+    if st := statusOf("cl-1", "disk-usage"); st != MonitorStatusNormal {
+        t.Errorf("Expected the normal status, got %d", st)
+    }
+    for i, ts := 4, int64(300); i < 70; i, ts = i + 1, ts + 60 {
+        evaluate("cl-1", ts, map[string] interface{}{"disk-usage": 50 + 0.4 * float64(i)})
+    }
+    if st := statusOf("cl-1", "disk-usage"); st != MonitorStatusWarning {
+        t.Errorf("Expected the warning status, got %d", st)
+    }
+
+    // Absent while the client keeps recording others
+    evaluate("cl-2", 60, map[string] interface{}{"load": 1.0, "command(probe)": 1.0})
+    for ts := int64(120); ts <= 240; ts += 60 {
+        evaluate("cl-2", ts, map[string] interface{}{"load": 1.0, "command(probe)": nil})
+    }
+    if st := statusOf("cl-2", "command(probe)"); st != MonitorStatusWarning {
+        t.Errorf("Expected the warning status, got %d", st)
+    }
+    if events := srv.advanceAlerts(srv.observeAbsentValues()); len(events) != 0 {
+        t.Errorf("Expected no events, got %+v", events)
+    }
+    evaluate("cl-2", 300, map[string] interface{}{"load": 1.0})
+    events := srv.advanceAlerts(srv.observeAbsentValues())
+    if len(events) != 1 || events[0].Rule != "absent" || events[0].Key != "command(probe)" || events[0].Value != 240 ||
+        events[0].Summary != "command(probe) of cl-2 has had no value for 240 seconds" {
+        t.Fatalf("Expected the absent alert to fire, got %+v", events)
+    }
+    if st := statusOf("cl-2", "command(probe)"); st != MonitorStatusFatal {
+        t.Errorf("Expected the fatal status, got %d", st)
+    }
+    evaluate("cl-2", 360, map[string] interface{}{"load": 1.0, "command(probe)": 1.0})
+    events = srv.advanceAlerts(srv.observeAbsentValues())
+    if len(events) != 1 || events[0].Status != AlertStatusResolved {
+        t.Errorf("Expected the absent alert to be resolved, got %+v", events)
+    }
+
+}
@@ -2,9 +2,9 @@ package main
 
 import (
     "crypto/sha256"
-    "encoding/binary"
     "fmt"
     "math"
+    "sync"
     "./monitor"
    // "./secret"
 
@@ -35,8 +35,8 @@ type MonitorDataTableBox struct {
 
 type MonitorDataMap map[string/* monitorKey */] MonitorData
 type MonitorData []MonitorDatum
-const MonitorDatumVersion uint8 = 1
-const MonitorDatumSize int = 20
+const MonitorDatumVersion uint8 = 2
+const MonitorDatumSize int = 20 // Version 1
 type MonitorDatum struct {
     Timestamp int64 // timestamp is int64 as go uses int64 for unix timetamps
     Value float64
@@ -193,15 +193,50 @@ func(md MonitorData) Len() int { return len(md) }
 func(md MonitorData) Less(i, j int) bool { return md[i].Timestamp < md[j].Timestamp }
 func(md MonitorData) Swap(i, j int) { md[i], md[j] = md[j], md[i] }
 
+// Returns the data of both in timestamp order, where those of md win over
+// those of rhs with the same timestamps; both must be in timestamp order
+func(md MonitorData) Merge(rhs MonitorData) MonitorData {
+    ret  := make(MonitorData, 0, len(md) + len(rhs))
+    i, j := 0, 0
+    for i < len(md) || j < len(rhs) {
+        switch {
+        case j == len(rhs) || (i < len(md) && md[i].Timestamp < rhs[j].Timestamp):
+            ret = append(ret, md[i])
+            i++
+        case i == len(md) || rhs[j].Timestamp < md[i].Timestamp:
+            ret = append(ret, rhs[j])
+            j++
+        default: // Same timestamp
+            ret = append(ret, md[i])
+            i++
+            j++
+        }
+    }
+    return ret
+}
+
 // CONFIG ---
 
 type MonitorConfig struct {
-    Absolute     bool   `json:"absolute"`
-    Alias        string `json:"alias"`
-    Constant     bool   `json:"constant"`
-    Format       string `json:"format"`
-    FatalRange   Range  `json:"fatalRange"`
-    WarningRange Range  `json:"warningRange"`
+    Absolute     bool      `json:"absolute"`
+    Alias        string    `json:"alias"`
+    Constant     bool      `json:"constant"`
+    Format       string    `json:"format"`
+    FatalRange   Range     `json:"fatalRange"`
+    WarningRange Range     `json:"warningRange"`
+    Retention    Retention `json:"retention"` // Overrides the retention of the client rule
+    AlertFor     Retention `json:"alertFor"` // How long values stay fatal before the alert fires
+    ResolveRange Range     `json:"resolveRange"` // Where values resolve the firing alert
+    // Conditions; see monitorCondition.go
+    RateWindow        Retention `json:"rateWindow"`
+    RateWarningRange  Range     `json:"rateWarningRange"` // Of the change over the rate window
+    RateFatalRange    Range     `json:"rateFatalRange"`
+    FullWindow        Retention `json:"fullWindow"` // Of the regression
+    FullAt            float64   `json:"fullAt"`
+    FullWarningTime   Retention `json:"fullWarningTime"` // Until the values reach fullAt
+    FullFatalTime     Retention `json:"fullFatalTime"`
+    AbsentWarningTime Retention `json:"absentWarningTime"` // Without a value
+    AbsentFatalTime   Retention `json:"absentFatalTime"`
 }
 type MonitorConfigMap map[string/* monitorKey */] MonitorConfig
 
@@ -221,15 +256,21 @@ type monitorKey struct {
     base, param, idx string
 }
 var parsedMonitorKeys = make(map[string] monitorKey)
+var parsedMonitorKeysMu sync.RWMutex
 
 func ParseMonitorKey(mKey string) (base, param, idx string) {
-    if m, ok := parsedMonitorKeys[mKey]; ok {
+    parsedMonitorKeysMu.RLock()
+    m, ok := parsedMonitorKeys[mKey]
+    parsedMonitorKeysMu.RUnlock()
+    if ok {
         base, param, idx = m.base, m.param, m.idx
     } else {
-        base, param, idx        = monitor.ParseWrapperKey(mKey)
+        base, param, idx = monitor.ParseWrapperKey(mKey)
+        parsedMonitorKeysMu.Lock()
         parsedMonitorKeys[mKey] = monitorKey{
             base, param, idx,
         }
+        parsedMonitorKeysMu.Unlock()
     }
     return
 }
@@ -242,56 +283,35 @@ func FormatMonitorKey(base, param, idx string) string {
 func SerializeMonitorData(md MonitorData) []byte {
 
     // Type version check
-    Assert(MonitorDatumVersion == 1, "MonitorDatum version must be 1")
-
-    // Byte
-    lenMd    := len(md)
-    lenTotal := 1 + lenMd * MonitorDatumSize // version byte + data bytes
-    serial   := make([]byte, lenTotal)
-
-    // Version byte
-    serial[0] = byte(MonitorDatumVersion)
-
-    // Data
-    le   := binary.LittleEndian
-    base := 1 // from 1st position
-    for _, datum := range md {
-        le.PutUint64(serial[base:base + 8],       uint64(datum.Timestamp))
-        le.PutUint64(serial[base + 8:base + 16],  math.Float64bits(datum.Value))
-        le.PutUint32(serial[base + 16:base + 20], uint32(datum.Per))
-
-        base += MonitorDatumSize
-    }
+    Assert(MonitorDatumVersion == 2, "MonitorDatum version must be 2")
 
-    return serial
+    return serializeMonitorDataV2(md)
 
 }
 
+// Reads data of any known version; see monitorEncoding.go for the formats
 func DeserializeMonitorData(serial []byte) (md MonitorData, err error) {
 
-    // Type version check
-    Assert(MonitorDatumVersion == 1, "MonitorDatum version must be 1")
-
     defer Catch(&err) // recover from panic from this point
 
+    Assert(len(serial) > 0, "MonitorData is empty")
+
     // Version byte
-    version := serial[0]
-    Assert(uint8(version) == MonitorDatumVersion, "MonitorData version must match the current version")
-
-    // Make
-    mdPart := serial[1:]
-    lenMd  := len(mdPart) / MonitorDatumSize
-    md = make(MonitorData, lenMd)
-
-    // Parse
-    le := binary.LittleEndian
-    for i := range md {
-        base := i * MonitorDatumSize
-        md[i].Timestamp = int64(le.Uint64(mdPart[base:base + 8]))
-        md[i].Value = math.Float64frombits(le.Uint64(mdPart[base + 8:base + 16]))
-        md[i].Per = int32(le.Uint32(mdPart[base + 16:base + 20]))
+    switch version := serial[0]; version {
+    case 1:
+        return deserializeMonitorDataV1(serial), nil
+    case 2:
+        return deserializeMonitorDataV2(serial), nil
+    default:
+        return nil, fmt.Errorf("Unknown MonitorData version %d", version)
     }
 
-    return md, nil
+}
 
+// Returns the version of serialized monitor data
+func MonitorDataVersionOf(serial []byte) uint8 {
+    if len(serial) == 0 {
+        return 0
+    }
+    return uint8(serial[0])
 }
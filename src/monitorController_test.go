@@ -96,6 +96,81 @@ func TestMonitorDataSerialization(t *testing.T) {
 
 }
 
+func TestMonitorDataSerializationV2(t *testing.T) {
+
+    // Regular intervals, jitters, gaps, and irregular values
+    md := make(MonitorData, 0)
+    ts := int64(1580000000)
+    for i := 0; i < 2000; i++ {
+        switch {
+        case i % 500 == 0:
+            ts += 86400 * 30
+        case i % 7 == 0:
+            ts += 61
+        default:
+            ts += 60
+        }
+        val := math.Floor(math.Sin(float64(i) / 10.0) * 1000) / 10.0
+        per := int32(60)
+        switch {
+        case i % 300 == 0:
+            val = math.Inf(1)
+        case i % 301 == 0:
+            val = math.MaxFloat64
+        case i % 100 < 20:
+            val, per = 0.25, 120
+        }
+        md = append(md, MonitorDatum{ts, val, per})
+    }
+    md = append(md, MonitorDatum{math.MaxInt64, -0.5, math.MinInt32})
+    md = append(md, MonitorDatum{math.MinInt64, math.SmallestNonzeroFloat64, math.MaxInt32})
+
+    for _, sub := range []MonitorData{md, md[:0], md[:1], md[:2]} {
+        serial := SerializeMonitorData(sub)
+        if MonitorDataVersionOf(serial) != 2 {
+            t.Fatalf("expected version 2, got %d", serial[0])
+        }
+        decoded, err := DeserializeMonitorData(serial)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(decoded) != len(sub) {
+            t.Fatalf("expected %d data, got %d", len(sub), len(decoded))
+        }
+        for i := range sub {
+            if decoded[i] != sub[i] {
+                t.Fatalf("datum %d: expected %v, got %v", i, sub[i], decoded[i])
+            }
+        }
+    }
+
+    v1 := serializeMonitorDataV1(md)
+    v2 := SerializeMonitorData(md)
+    t.Logf("%d data: version 1 %d bytes, version 2 %d bytes", len(md), len(v1), len(v2))
+    if len(v2) * 2 > len(v1) {
+        t.Errorf("version 2 is expected to be at most half the size of version 1")
+    }
+
+    // Version 1 must still be readable
+    decoded, err := DeserializeMonitorData(v1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := range md {
+        if decoded[i] != md[i] {
+            t.Fatalf("version 1 datum %d: expected %v, got %v", i, md[i], decoded[i])
+        }
+    }
+
+    // Truncated data must not panic
+    for _, l := range []int{0, 1, 5, len(v2) / 2, len(v2) - 1} {
+        if _, err := DeserializeMonitorData(v2[:l]); err == nil {
+            t.Errorf("expected an error for data truncated at %d", l)
+        }
+    }
+
+}
+
 // The first method that was used
 // go test -run MonitorDataEncode_1 -timeout 10m -v
 
@@ -0,0 +1,407 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "math"
+    "math/bits"
+
+    . "github.com/hjjg200/go-act"
+)
+
+/*
+
+Version 1 is a flat array of fixed-size data
+
+| version(1) | timestamp(8) value(8) per(4) | ... |
+
+Version 2 stores each field in its own column
+
+| version(1) | length(uvarint) |
+| timestamp column size(uvarint) | timestamp column |
+| value column size(uvarint) | value column |
+| per column |
+
+Timestamp column is a bit stream of delta-of-deltas; the first timestamp is
+written as it is and the delta before the first one is regarded as 0
+
+    '0'                   delta-of-delta is 0
+    '10'   + 7 bits       -64 ~ 63
+    '110'  + 9 bits       -256 ~ 255
+    '1110' + 12 bits      -2048 ~ 2047
+    '1111' + 64 bits      anything else
+
+Value column is a bit stream of XORs with the previous values; the first value
+is written as it is
+
+    '0'                   XOR is 0
+    '10' + meaningful bits                  the meaningful bits fit in the previous window
+    '11' + 5 bits leading zeros
+         + 6 bits length of meaningful bits(0 for 64)
+         + meaningful bits
+
+Per column is run-length encoded
+
+| runs(uvarint) | count(uvarint) per(varint) | ... |
+
+A chunk file is labeled with the client id and the key of its data so that the
+indexes can be rebuilt from the chunks; the label marker never collides with
+version bytes. Chunks without labels are read as they are.
+
+| 0xff | byte series packet of | client id | key | | serialized data |
+
+*/
+
+// V1 ---
+
+func serializeMonitorDataV1(md MonitorData) []byte {
+
+    // Byte
+    lenMd    := len(md)
+    lenTotal := 1 + lenMd * MonitorDatumSize // version byte + data bytes
+    serial   := make([]byte, lenTotal)
+
+    // Version byte
+    serial[0] = 1
+
+    // Data
+    le   := binary.LittleEndian
+    base := 1 // from 1st position
+    for _, datum := range md {
+        le.PutUint64(serial[base:base + 8],       uint64(datum.Timestamp))
+        le.PutUint64(serial[base + 8:base + 16],  math.Float64bits(datum.Value))
+        le.PutUint32(serial[base + 16:base + 20], uint32(datum.Per))
+
+        base += MonitorDatumSize
+    }
+
+    return serial
+
+}
+
+func deserializeMonitorDataV1(serial []byte) MonitorData {
+
+    // Make
+    mdPart := serial[1:]
+    lenMd  := len(mdPart) / MonitorDatumSize
+    md     := make(MonitorData, lenMd)
+
+    // Parse
+    le := binary.LittleEndian
+    for i := range md {
+        base := i * MonitorDatumSize
+        md[i].Timestamp = int64(le.Uint64(mdPart[base:base + 8]))
+        md[i].Value = math.Float64frombits(le.Uint64(mdPart[base + 8:base + 16]))
+        md[i].Per = int32(le.Uint32(mdPart[base + 16:base + 20]))
+    }
+
+    return md
+
+}
+
+// V2 ---
+
+func serializeMonitorDataV2(md MonitorData) []byte {
+
+    buf := bytes.NewBuffer(nil)
+    buf.WriteByte(2)
+    writeUvarint(buf, uint64(len(md)))
+
+    // Timestamps
+    tsw := &monitorBitWriter{}
+    var prevTs, prevDelta int64
+    for i, datum := range md {
+        if i == 0 {
+            tsw.writeBits(uint64(datum.Timestamp), 64)
+            prevTs = datum.Timestamp
+            continue
+        }
+        delta := datum.Timestamp - prevTs
+        dod   := delta - prevDelta
+        switch {
+        case dod == 0:
+            tsw.writeBits(0x0, 1)
+        case fitsInBits(dod, 7):
+            tsw.writeBits(0x2, 2)
+            tsw.writeBits(uint64(dod), 7)
+        case fitsInBits(dod, 9):
+            tsw.writeBits(0x6, 3)
+            tsw.writeBits(uint64(dod), 9)
+        case fitsInBits(dod, 12):
+            tsw.writeBits(0xe, 4)
+            tsw.writeBits(uint64(dod), 12)
+        default:
+            tsw.writeBits(0xf, 4)
+            tsw.writeBits(uint64(dod), 64)
+        }
+        prevTs, prevDelta = datum.Timestamp, delta
+    }
+    writeUvarint(buf, uint64(len(tsw.buf)))
+    buf.Write(tsw.buf)
+
+    // Values
+    vw := &monitorBitWriter{}
+    var prevBits uint64
+    prevLeading, prevTrailing := -1, 0
+    for i, datum := range md {
+        vBits := math.Float64bits(datum.Value)
+        if i == 0 {
+            vw.writeBits(vBits, 64)
+            prevBits = vBits
+            continue
+        }
+        xor := vBits ^ prevBits
+        prevBits = vBits
+        if xor == 0 {
+            vw.writeBits(0x0, 1)
+            continue
+        }
+
+        leading  := bits.LeadingZeros64(xor)
+        trailing := bits.TrailingZeros64(xor)
+        if leading > 31 {
+            leading = 31
+        }
+
+        if prevLeading != -1 && leading >= prevLeading && trailing >= prevTrailing {
+            vw.writeBits(0x2, 2)
+            vw.writeBits(xor >> uint(prevTrailing), 64 - prevLeading - prevTrailing)
+            continue
+        }
+
+        sig := 64 - leading - trailing
+        vw.writeBits(0x3, 2)
+        vw.writeBits(uint64(leading), 5)
+        vw.writeBits(uint64(sig & 0x3f), 6) // 64 is written as 0
+        vw.writeBits(xor >> uint(trailing), sig)
+        prevLeading, prevTrailing = leading, trailing
+    }
+    writeUvarint(buf, uint64(len(vw.buf)))
+    buf.Write(vw.buf)
+
+    // Pers
+    runs := [][2]int64{}
+    for i, datum := range md {
+        if i > 0 && int64(datum.Per) == runs[len(runs) - 1][1] {
+            runs[len(runs) - 1][0]++
+            continue
+        }
+        runs = append(runs, [2]int64{1, int64(datum.Per)})
+    }
+    writeUvarint(buf, uint64(len(runs)))
+    for _, run := range runs {
+        writeUvarint(buf, uint64(run[0]))
+        writeVarint(buf, run[1])
+    }
+
+    return buf.Bytes()
+
+}
+
+func deserializeMonitorDataV2(serial []byte) MonitorData {
+
+    rd := bytes.NewReader(serial[1:])
+    n  := int(readUvarintOrPanic(rd))
+    Assert(n <= len(serial) * 8, "MonitorData length is larger than possible")
+    md := make(MonitorData, n)
+
+    column := func() []byte {
+        size := readUvarintOrPanic(rd)
+        Assert(size <= uint64(rd.Len()), "MonitorData column is truncated")
+        col := make([]byte, size)
+        rd.Read(col)
+        return col
+    }
+
+    // Timestamps
+    tsr := &monitorBitReader{buf: column()}
+    var prevTs, prevDelta int64
+    for i := range md {
+        if i == 0 {
+            prevTs = int64(tsr.readBits(64))
+            md[i].Timestamp = prevTs
+            continue
+        }
+        var dod int64
+        switch {
+        case tsr.readBits(1) == 0:
+            dod = 0
+        case tsr.readBits(1) == 0:
+            dod = signExtend(tsr.readBits(7), 7)
+        case tsr.readBits(1) == 0:
+            dod = signExtend(tsr.readBits(9), 9)
+        case tsr.readBits(1) == 0:
+            dod = signExtend(tsr.readBits(12), 12)
+        default:
+            dod = int64(tsr.readBits(64))
+        }
+        prevDelta += dod
+        prevTs    += prevDelta
+        md[i].Timestamp = prevTs
+    }
+
+    // Values
+    vr := &monitorBitReader{buf: column()}
+    var prevBits uint64
+    prevLeading, prevTrailing := 0, 0
+    for i := range md {
+        if i == 0 {
+            prevBits = vr.readBits(64)
+            md[i].Value = math.Float64frombits(prevBits)
+            continue
+        }
+        if vr.readBits(1) == 1 {
+            if vr.readBits(1) == 1 {
+                prevLeading  = int(vr.readBits(5))
+                sig         := int(vr.readBits(6))
+                if sig == 0 {
+                    sig = 64
+                }
+                prevTrailing = 64 - prevLeading - sig
+                Assert(prevTrailing >= 0, "Bad XOR window in MonitorData")
+            }
+            sig := 64 - prevLeading - prevTrailing
+            prevBits ^= vr.readBits(sig) << uint(prevTrailing)
+        }
+        md[i].Value = math.Float64frombits(prevBits)
+    }
+
+    // Pers
+    runs := readUvarintOrPanic(rd)
+    i    := 0
+    for r := uint64(0); r < runs; r++ {
+        count := int(readUvarintOrPanic(rd))
+        per, err := binary.ReadVarint(rd)
+        Try(err)
+        Assert(i + count <= n, "Per runs exceed the length of MonitorData")
+        for ; count > 0; count-- {
+            md[i].Per = int32(per)
+            i++
+        }
+    }
+    Assert(i == n, "Per runs do not cover MonitorData")
+
+    return md
+
+}
+
+// Returns whether v is representable as a signed integer of n bits
+func fitsInBits(v int64, n uint) bool {
+    return v >= -(1 << (n - 1)) && v < 1 << (n - 1)
+}
+
+func signExtend(v uint64, n uint) int64 {
+    shift := 64 - n
+    return int64(v << shift) >> shift
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+    p := make([]byte, binary.MaxVarintLen64)
+    buf.Write(p[:binary.PutUvarint(p, v)])
+}
+
+func readUvarintOrPanic(rd *bytes.Reader) uint64 {
+    v, err := binary.ReadUvarint(rd)
+    Try(err)
+    return v
+}
+
+// CHUNK ---
+
+const monitorDataChunkLabelMarker byte = 0xff
+
+func encodeMonitorDataChunk(clId, key string, md MonitorData) []byte {
+    buf := bytes.NewBuffer(nil)
+    buf.WriteByte(monitorDataChunkLabelMarker)
+    writeByteSeriesPacket(buf, [][]byte{[]byte(clId), []byte(key)})
+    buf.Write(SerializeMonitorData(md))
+    return buf.Bytes()
+}
+
+// Returns the label and the data of a chunk; labeled is false for chunks
+// written before labels were introduced
+func decodeMonitorDataChunk(p []byte) (clId, key string, labeled bool, md MonitorData, err error) {
+
+    if len(p) == 0 || p[0] != monitorDataChunkLabelMarker {
+        md, err = DeserializeMonitorData(p)
+        return
+    }
+
+    rd := bytes.NewReader(p[1:])
+    label, err := readNextPacket(rd)
+    if err != nil {
+        return
+    }
+    lrd := bytes.NewReader(label)
+    pClId, err1 := readNextPacket(lrd)
+    pKey, err2  := readNextPacket(lrd)
+    if err1 != nil || err2 != nil {
+        err = fmt.Errorf("Bad chunk label")
+        return
+    }
+
+    clId, key, labeled = string(pClId), string(pKey), true
+    md, err = DeserializeMonitorData(p[len(p) - rd.Len():])
+    return
+
+}
+
+// Returns the chunk file content and its index whose uuid is the hash of the content
+func createMonitorDataChunk(clId, key string, md MonitorData) (MonitorDataIndex, []byte) {
+    p     := encodeMonitorDataChunk(clId, key, md)
+    index := CreateIndexForMonitorData(md)
+    index.Uuid = fmt.Sprintf("%x", sha256.Sum256(p))
+    return index, p
+}
+
+// BIT STREAM ---
+
+type monitorBitWriter struct {
+    buf  []byte
+    free uint // Unused bits in the last byte
+}
+
+// Writes the lowest n bits of v, most significant bit first
+func(w *monitorBitWriter) writeBits(v uint64, n int) {
+    for n > 0 {
+        if w.free == 0 {
+            w.buf  = append(w.buf, 0)
+            w.free = 8
+        }
+        take := n
+        if take > int(w.free) {
+            take = int(w.free)
+        }
+        chunk := byte((v >> uint(n - take)) & (1 << uint(take) - 1))
+        w.buf[len(w.buf) - 1] |= chunk << (w.free - uint(take))
+        w.free -= uint(take)
+        n      -= take
+    }
+}
+
+type monitorBitReader struct {
+    buf []byte
+    pos uint // in bits
+}
+
+func(r *monitorBitReader) readBits(n int) uint64 {
+    if uint(n) > uint(len(r.buf)) * 8 - r.pos {
+        panic(fmt.Errorf("MonitorData bit stream is truncated"))
+    }
+    var v uint64
+    for n > 0 {
+        idx   := r.pos / 8
+        avail := 8 - r.pos % 8
+        take  := n
+        if take > int(avail) {
+            take = int(avail)
+        }
+        chunk := uint64(r.buf[idx] >> (avail - uint(take))) & (1 << uint(take) - 1)
+        v      = v << uint(take) | chunk
+        r.pos += uint(take)
+        n     -= take
+    }
+    return v
+}
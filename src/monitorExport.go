@@ -0,0 +1,512 @@
+package main
+
+import (
+    "bufio"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    monitorDataFormatCsv         = "csv"
+    monitorDataFormatJsonLines   = "jsonl"
+    monitorDataFormatOpenMetrics = "openmetrics"
+    monitorDataOpenMetricsName   = "telescribe_monitor_value"
+)
+
+/*
+
+Monitor data are exported and imported as rows of the client id, the monitor
+key, the timestamp, the value, and the per, in one of the following formats.
+
+csv
+
+client,key,timestamp,value,per
+cl-1,cpu-usage,1600000060,12.5,60
+
+jsonl
+
+{"client":"cl-1","key":"cpu-usage","timestamp":1600000060,"value":12.5,"per":60}
+
+openmetrics
+
+# TYPE telescribe_monitor_value gauge
+telescribe_monitor_value{client="cl-1",key="cpu-usage",per="60"} 12.5 1600000060
+# EOF
+
+As json has no representation for NaN or infinities, such values are left out
+of json lines.
+
+Imported rows are recorded in the same way as the values sent by clients, but
+without alarms, and are stored in chunks as they are recorded. Rows older than
+the stored data of their monitor keys are merged into the chunks that they
+fall into, so that history can be imported into a live server, while rows
+whose timestamps are already recorded, either stored or in memory, are
+skipped.
+
+*/
+
+type MonitorExportFilter struct {
+    ClientIds []string // Every client when empty
+    From      int64
+    To        int64    // No limit when 0
+}
+
+type MonitorImportReport struct {
+    Imported int `json:"imported"`
+    Skipped  int `json:"skipped"`
+}
+
+type monitorDataRow struct {
+    ClientId  string  `json:"client"`
+    Key       string  `json:"key"`
+    Timestamp int64   `json:"timestamp"`
+    Value     float64 `json:"value"`
+    Per       int32   `json:"per"`
+}
+
+// Returns the format for the file name, or an empty string if it is unknown
+func MonitorDataFormatOf(fn string) string {
+    switch strings.ToLower(filepath.Ext(fn)) {
+    case ".csv":
+        return monitorDataFormatCsv
+    case ".jsonl", ".ndjson":
+        return monitorDataFormatJsonLines
+    case ".om", ".prom", ".txt":
+        return monitorDataFormatOpenMetrics
+    }
+    return ""
+}
+
+func isMonitorDataFormat(format string) bool {
+    switch format {
+    case monitorDataFormatCsv, monitorDataFormatJsonLines, monitorDataFormatOpenMetrics:
+        return true
+    }
+    return false
+}
+
+func escapeOpenMetricsLabel(s string) string {
+    return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatOpenMetricsFloat(f float64) string {
+    switch {
+    case math.IsNaN(f):
+        return "NaN"
+    case math.IsInf(f, 1):
+        return "+Inf"
+    case math.IsInf(f, -1):
+        return "-Inf"
+    }
+    return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Writes rows in one of the formats; Write and Flush panic on errors
+type monitorDataRowWriter struct {
+    format string
+    bw     *bufio.Writer
+    cw     *csv.Writer
+    enc    *json.Encoder
+    rec    []string
+}
+
+// Returns a row writer that has written the header of the format
+func newMonitorDataRowWriter(w io.Writer, format string) *monitorDataRowWriter {
+
+    bw := bufio.NewWriter(w)
+    rw := &monitorDataRowWriter{
+        format: format,
+        bw:     bw,
+        cw:     csv.NewWriter(bw),
+        enc:    json.NewEncoder(bw),
+        rec:    make([]string, 5),
+    }
+
+    switch format {
+    case monitorDataFormatCsv:
+        Try(rw.cw.Write([]string{"client", "key", "timestamp", "value", "per"}))
+    case monitorDataFormatOpenMetrics:
+        fmt.Fprintf(bw, "# TYPE %s gauge\n", monitorDataOpenMetricsName)
+        fmt.Fprintf(bw, "# HELP %s The values of the monitor keys of the clients\n", monitorDataOpenMetricsName)
+    }
+    return rw
+
+}
+
+func(rw *monitorDataRowWriter) Write(clId, mKey string, datum MonitorDatum) {
+    switch rw.format {
+    case monitorDataFormatCsv:
+        rec := rw.rec
+        rec[0], rec[1] = clId, mKey
+        rec[2] = strconv.FormatInt(datum.Timestamp, 10)
+        rec[3] = strconv.FormatFloat(datum.Value, 'g', -1, 64)
+        rec[4] = strconv.FormatInt(int64(datum.Per), 10)
+        Try(rw.cw.Write(rec))
+    case monitorDataFormatJsonLines:
+        if math.IsNaN(datum.Value) || math.IsInf(datum.Value, 0) {
+            return
+        }
+        Try(rw.enc.Encode(monitorDataRow{clId, mKey, datum.Timestamp, datum.Value, datum.Per}))
+    case monitorDataFormatOpenMetrics:
+        fmt.Fprintf(
+            rw.bw, "%s{client=\"%s\",key=\"%s\",per=\"%d\"} %s %d\n",
+            monitorDataOpenMetricsName, escapeOpenMetricsLabel(clId), escapeOpenMetricsLabel(mKey),
+            datum.Per, formatOpenMetricsFloat(datum.Value), datum.Timestamp,
+        )
+    }
+}
+
+func(rw *monitorDataRowWriter) Flush() {
+    rw.cw.Flush()
+    Try(rw.cw.Error())
+}
+
+func(rw *monitorDataRowWriter) Close() error {
+    rw.Flush()
+    if rw.format == monitorDataFormatOpenMetrics {
+        fmt.Fprintln(rw.bw, "# EOF")
+    }
+    return rw.bw.Flush()
+}
+
+// EXPORT ---
+
+// Writes the stored and in-memory monitor data that pass the filter; keep, if
+// not nil, decides which monitor keys are exported
+func(srv *Server) ExportMonitorData(
+    w io.Writer, format string, filter MonitorExportFilter, keep func(clId, mKey string) bool,
+) (err error) {
+
+    defer Catch(&err)
+
+    Assert(isMonitorDataFormat(format), "Unknown format: " + format)
+
+    clIds := filter.ClientIds
+    if len(clIds) == 0 {
+        clIds = srv.monitorDataStore.ClientIds()
+    }
+    to := filter.To
+    if to == 0 {
+        to = math.MaxInt64
+    }
+
+    rw := newMonitorDataRowWriter(w, format)
+
+    for _, clId := range clIds {
+        mKeys, _ := srv.monitorDataStore.Keys(clId)
+        for _, mKey := range mKeys {
+            if keep != nil && !keep(clId, mKey) {
+                continue
+            }
+            md := getMonitorDataRange(srv.monitorDataStore, srv.config.DataStoreDir, clId, mKey, filter.From, to)
+            for _, datum := range md {
+                rw.Write(clId, mKey, datum)
+            }
+            rw.Flush()
+        }
+    }
+
+    return rw.Close()
+
+}
+
+// Exports the stored monitor data to the file, or to the standard output if
+// fn is -, without starting the server
+func(srv *Server) ExportMonitorDataFile(fn, format string, filter MonitorExportFilter) (err error) {
+
+    defer Catch(&err)
+
+    Try(srv.loadConfigs())
+    Try(loadMonitorDataIndexes(srv.monitorDataStore, srv.config.DataIndexesDir, srv.config.DataIndexesFile))
+
+    if format == "" {
+        format = MonitorDataFormatOf(fn)
+    }
+
+    var w io.Writer = os.Stdout
+    if fn != "-" {
+        f, err := os.OpenFile(fn, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+        Try(err)
+        defer f.Close()
+        w = f
+    }
+    return srv.ExportMonitorData(w, format, filter, nil)
+
+}
+
+// IMPORT ---
+
+// Reads the rows in the format and records them; keep, if not nil, decides
+// which monitor keys are imported
+func(srv *Server) ImportMonitorData(
+    r io.Reader, format string, keep func(clId, mKey string) bool,
+) (report MonitorImportReport, err error) {
+
+    defer Catch(&err)
+
+    Assert(isMonitorDataFormat(format), "Unknown format: " + format)
+
+    // The in-memory data are trimmed to the max data length, so they are
+    // stored before they reach it
+    batch := srv.config.MaxDataLength - srv.config.DataChunkLength
+    if batch < 1 {
+        batch = 1
+    }
+
+    // The indexes of each key until the next store, and the timestamps of the
+    // chunk read last for each key, as rows of a key come mostly in order
+    type chunkTimestamps struct {
+        uuid       string
+        timestamps map[int64] bool
+    }
+    indexesOf := make(map[[2]string] MonitorDataIndexes)
+    chunkOf   := make(map[[2]string] chunkTimestamps)
+    isStored  := func(k [2]string, ts int64) bool {
+
+        indexes, ok := indexesOf[k]
+        if !ok {
+            indexes = srv.monitorDataStore.Indexes(k[0], k[1])
+            indexesOf[k] = indexes
+        }
+        // An index holds the data within (From, To]
+        i := sort.Search(len(indexes), func(i int) bool {
+            return indexes[i].To >= ts
+        })
+        if i == len(indexes) || indexes[i].From >= ts {
+            return false
+        }
+
+        ct := chunkOf[k]
+        if ct.uuid != indexes[i].Uuid {
+            md, err := readMonitorDataChunk(srv.config.DataStoreDir, indexes[i].Uuid)
+            Try(err)
+            ct = chunkTimestamps{indexes[i].Uuid, make(map[int64] bool, len(md))}
+            for _, datum := range md {
+                ct.timestamps[datum.Timestamp] = true
+            }
+            chunkOf[k] = ct
+        }
+        return ct.timestamps[ts]
+
+    }
+
+    record := func(row monitorDataRow) {
+
+        k := [2]string{row.ClientId, row.Key}
+        if (keep != nil && !keep(row.ClientId, row.Key)) || isStored(k, row.Timestamp) {
+            report.Skipped++
+            return
+        }
+
+        // Recorded values decide, as the ones in memory are not put again
+        recorded := srv.recordValueMap(row.ClientId, row.Timestamp, map[string] interface{}{row.Key: row.Value}, row.Per)
+        if len(recorded) == 0 {
+            report.Skipped++
+            return
+        }
+        report.Imported++
+        if report.Imported % batch == 0 {
+            Try(srv.StoreClientMonitorDataMap(false))
+            // Stored chunks change the indexes
+            indexesOf = make(map[[2]string] MonitorDataIndexes)
+        }
+
+    }
+
+    switch format {
+    case monitorDataFormatCsv:
+        Try(readMonitorDataCsv(r, record))
+    case monitorDataFormatJsonLines:
+        Try(readMonitorDataJsonLines(r, record))
+    case monitorDataFormatOpenMetrics:
+        Try(readMonitorDataOpenMetrics(r, record))
+    }
+
+    return report, nil
+
+}
+
+// Imports the file, or the standard input if fn is -, into the store without
+// starting the server
+func(srv *Server) ImportMonitorDataFile(fn, format string) (report MonitorImportReport, err error) {
+
+    defer Catch(&err)
+
+    Try(srv.loadConfigs())
+    Try(srv.readClientMonitorIndexesMap())
+    Try(EnsureDirectory(srv.config.DataStoreDir))
+    Try(srv.replayMonitorWal())
+    defer srv.monitorWal.Close()
+
+    if format == "" {
+        format = MonitorDataFormatOf(fn)
+    }
+
+    var r io.Reader = os.Stdin
+    if fn != "-" {
+        f, err := os.Open(fn)
+        Try(err)
+        defer f.Close()
+        r = f
+    }
+
+    report, err = srv.ImportMonitorData(r, format, nil)
+    Try(err)
+    Try(srv.StoreClientMonitorDataMap(true))
+    return report, nil
+
+}
+
+func readMonitorDataCsv(r io.Reader, fn func(monitorDataRow)) (err error) {
+
+    defer Catch(&err)
+
+    cr := csv.NewReader(r)
+    header, err := cr.Read()
+    if err == io.EOF {
+        return nil
+    }
+    Try(err)
+
+    cols := make(map[string] int)
+    for i, name := range header {
+        cols[strings.TrimSpace(name)] = i
+    }
+    for _, name := range []string{"client", "key", "timestamp", "value", "per"} {
+        _, ok := cols[name]
+        Assert(ok, "Missing column: " + name)
+    }
+
+    for line := 2;; line++ {
+
+        rec, err := cr.Read()
+        if err == io.EOF {
+            break
+        }
+        Try(err)
+
+        row := monitorDataRow{ClientId: rec[cols["client"]], Key: rec[cols["key"]]}
+        ts, err1  := strconv.ParseInt(rec[cols["timestamp"]], 10, 64)
+        val, err2 := strconv.ParseFloat(rec[cols["value"]], 64)
+        per, err3 := strconv.ParseInt(rec[cols["per"]], 10, 32)
+        Assert(err1 == nil && err2 == nil && err3 == nil, fmt.Sprintf("Malformed row at line %d", line))
+        row.Timestamp, row.Value, row.Per = ts, val, int32(per)
+        fn(row)
+
+    }
+
+    return nil
+
+}
+
+func readMonitorDataJsonLines(r io.Reader, fn func(monitorDataRow)) (err error) {
+
+    defer Catch(&err)
+
+    dec := json.NewDecoder(r)
+    for {
+        row := monitorDataRow{}
+        err := dec.Decode(&row)
+        if err == io.EOF {
+            break
+        }
+        Try(err)
+        fn(row)
+    }
+
+    return nil
+
+}
+
+// Reads the samples of telescribe_monitor_value and ignores the rest
+func readMonitorDataOpenMetrics(r io.Reader, fn func(monitorDataRow)) (err error) {
+
+    defer Catch(&err)
+
+    sc := bufio.NewScanner(r)
+    sc.Buffer(nil, 1024 * 1024)
+    for line := 1; sc.Scan(); line++ {
+
+        text := sc.Text()
+        if !strings.HasPrefix(text, monitorDataOpenMetricsName + "{") {
+            continue
+        }
+
+        labels, rest, err := parseOpenMetricsLabels(text[len(monitorDataOpenMetricsName):])
+        Assert(err == nil, fmt.Sprintf("Malformed labels at line %d: %v", line, err))
+
+        fields := strings.Fields(rest)
+        Assert(len(fields) == 2, fmt.Sprintf("Missing the value or the timestamp at line %d", line))
+
+        val, err1 := strconv.ParseFloat(fields[0], 64)
+        ts, err2  := strconv.ParseFloat(fields[1], 64)
+        per, err3 := strconv.ParseInt(labels["per"], 10, 32)
+        Assert(err1 == nil && err2 == nil && err3 == nil, fmt.Sprintf("Malformed sample at line %d", line))
+
+        fn(monitorDataRow{labels["client"], labels["key"], int64(ts), val, int32(per)})
+
+    }
+
+    return sc.Err()
+
+}
+
+// Parses {name="value",...} at the start of s and returns the rest
+func parseOpenMetricsLabels(s string) (map[string] string, string, error) {
+
+    labels := make(map[string] string)
+    if !strings.HasPrefix(s, "{") {
+        return labels, s, nil
+    }
+
+    i := 1
+    for {
+        if i < len(s) && s[i] == '}' {
+            return labels, s[i + 1:], nil
+        }
+
+        // Name
+        eq := strings.IndexByte(s[i:], '=')
+        if eq == -1 || i + eq + 1 >= len(s) || s[i + eq + 1] != '"' {
+            return nil, "", fmt.Errorf("expected a label at %d", i)
+        }
+        name := s[i:i + eq]
+        i   += eq + 2
+
+        // Value
+        var sb strings.Builder
+        for ; i < len(s) && s[i] != '"'; i++ {
+            if s[i] != '\\' || i + 1 >= len(s) {
+                sb.WriteByte(s[i])
+                continue
+            }
+            i++
+            switch s[i] {
+            case 'n':
+                sb.WriteByte('\n')
+            default:
+                sb.WriteByte(s[i])
+            }
+        }
+        if i >= len(s) {
+            return nil, "", fmt.Errorf("unterminated value of %s", name)
+        }
+        labels[name] = sb.String()
+        i++
+
+        if i < len(s) && s[i] == ',' {
+            i++
+        }
+    }
+
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math"
+    "testing"
+)
+
+func TestMonitorDataExportImport(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    for ts := int64(60); ts <= 120 * 60; ts += 60 {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{
+            "cpu-usage": float64(ts) / 7, "load": math.Sqrt(float64(ts)),
+        }, 60)
+        srv.RecordValueMap("cl-1", ts, map[string] interface{}{"load": -float64(ts)}, 60)
+    }
+    if err := srv.StoreClientMonitorDataMap(false); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, format := range []string{monitorDataFormatCsv, monitorDataFormatJsonLines, monitorDataFormatOpenMetrics} {
+
+        buf    := bytes.NewBuffer(nil)
+        filter := MonitorExportFilter{From: 600, To: 3600}
+        if err := srv.ExportMonitorData(buf, format, filter, nil); err != nil {
+            t.Fatal(err)
+        }
+
+        imported, cleanup := t_newStoreTestServer(t)
+        defer cleanup()
+        report, err := imported.ImportMonitorData(bytes.NewReader(buf.Bytes()), format, func(clId, mKey string) bool {
+            return clId == "cl-0"
+        })
+        if err != nil {
+            t.Fatal(format, err)
+        }
+        if report.Imported != 2 * 51 || report.Skipped != 51 {
+            t.Errorf("%s: unexpected report %+v", format, report)
+        }
+
+        for _, mKey := range []string{"cpu-usage", "load"} {
+            want := getMonitorDataRange(srv.monitorDataStore, srv.config.DataStoreDir, "cl-0", mKey, 600, 3600)
+            got  := getMonitorDataRange(imported.monitorDataStore, imported.config.DataStoreDir, "cl-0", mKey, 0, math.MaxInt64)
+            if fmt.Sprint(want) != fmt.Sprint(got) {
+                t.Errorf("%s %s: expected\n%v\ngot\n%v", format, mKey, want, got)
+            }
+        }
+
+        // Rows that are already stored are skipped
+        if err = imported.StoreClientMonitorDataMap(true); err != nil {
+            t.Fatal(err)
+        }
+        report, err = imported.ImportMonitorData(bytes.NewReader(buf.Bytes()), format, nil)
+        if err != nil || report.Imported != 51 || report.Skipped != 2 * 51 {
+            t.Errorf("%s: unexpected report of importing again %+v %v", format, report, err)
+        }
+
+        // Older rows are merged into a live server, once
+        older := bytes.NewBuffer(nil)
+        if err = srv.ExportMonitorData(older, format, MonitorExportFilter{From: 60, To: 540}, nil); err != nil {
+            t.Fatal(err)
+        }
+        for i, expected := range []MonitorImportReport{{3 * 9, 0}, {0, 3 * 9}} {
+            report, err = imported.ImportMonitorData(bytes.NewReader(older.Bytes()), format, nil)
+            if err != nil || report != expected {
+                t.Errorf("%s: unexpected report of importing older rows %d %+v %v", format, i, report, err)
+            }
+        }
+        if err = imported.StoreClientMonitorDataMap(true); err != nil {
+            t.Fatal(err)
+        }
+        for _, mKey := range []string{"cpu-usage", "load"} {
+            want := getMonitorDataRange(srv.monitorDataStore, srv.config.DataStoreDir, "cl-0", mKey, 60, 3600)
+            got  := getMonitorDataRange(imported.monitorDataStore, imported.config.DataStoreDir, "cl-0", mKey, 0, math.MaxInt64)
+            if fmt.Sprint(want) != fmt.Sprint(got) {
+                t.Errorf("%s %s: expected the older rows to be merged\n%v\ngot\n%v", format, mKey, want, got)
+            }
+        }
+
+    }
+
+}
+
+func TestParseOpenMetricsLabels(t *testing.T) {
+    labels, rest, err := parseOpenMetricsLabels(`{client="a\"b",key="x\\y\nz",per="60"} 1 2`)
+    if err != nil || labels["client"] != `a"b` || labels["key"] != "x\\y\nz" || labels["per"] != "60" || rest != " 1 2" {
+        t.Errorf("unexpected labels %q, rest %q, err %v", labels, rest, err)
+    }
+    if _, _, err = parseOpenMetricsLabels(`{client="a`); err == nil {
+        t.Error("expected an error for an unterminated value")
+    }
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    . "github.com/hjjg200/go-act"
+)
+
+/*
+
+The integrity checker walks the indexes and the chunk directory of both
+the raw data and the rollups, and reports
+
+- chunks that cannot be read
+- chunks that do not match their indexes, or whose labels differ from them
+- indexes whose chunks are missing
+- chunks that overlap earlier chunks of the same key
+- chunk files that no index refers to
+
+When repairing, the indexes are rebuilt from the chunks themselves: labeled
+chunks are indexed under their labels and unlabeled ones under the keys of the
+readable indexes that refer to them. Chunks that overlap each other, such as
+the ones left by a flush of backfilled data that was interrupted, are merged
+into a new chunk, where the chunk that starts earlier wins for the same
+timestamp. The previous indexes directory is kept with the extension .bak, and
+the merged chunks are removed after the indexes are written unless another
+index still refers to them; no other chunk file is removed.
+
+The server must not be running while checking.
+
+*/
+
+type FsckReport struct {
+    Ok     bool              `json:"ok"`
+    Stores []FsckStoreReport `json:"stores"`
+}
+
+type FsckStoreReport struct {
+    Dir            string        `json:"dir"`
+    IndexesDir     string        `json:"indexesDir"`
+    IndexesError   string        `json:"indexesError,omitempty"`
+    Chunks         int           `json:"chunks"`
+    Indexes        int           `json:"indexes"`
+    Corrupted      []FsckProblem `json:"corrupted"`
+    Mismatched     []FsckProblem `json:"mismatched"`
+    Dangling       []FsckProblem `json:"dangling"`
+    Overlapping    []FsckProblem `json:"overlapping"`
+    Orphans        []string      `json:"orphans"`
+    Rebuilt        bool          `json:"rebuilt"`
+    RebuiltIndexes int           `json:"rebuiltIndexes"`
+    MergedChunks   int           `json:"mergedChunks"`
+    Unrecoverable  []string      `json:"unrecoverable"`
+}
+
+type FsckProblem struct {
+    ClientId string `json:"clientId"`
+    Key      string `json:"key"`
+    Uuid     string `json:"uuid"`
+    Detail   string `json:"detail"`
+}
+
+func(report FsckStoreReport) ok() bool {
+    return report.intact() &&
+        len(report.Overlapping) == 0 &&
+        len(report.Orphans) == 0
+}
+
+// Returns whether every index refers to a readable chunk that matches it;
+// orphans and overlaps lose no data
+func(report FsckStoreReport) intact() bool {
+    return report.IndexesError == "" &&
+        len(report.Corrupted) == 0 &&
+        len(report.Mismatched) == 0 &&
+        len(report.Dangling) == 0
+}
+
+type fsckChunk struct {
+    clId, key string
+    labeled   bool
+    md        MonitorData
+    err       error
+}
+
+// Checks the store and writes the report; when repair is true, the indexes
+// files are rebuilt from the chunks
+func(srv *Server) Fsck(w io.Writer, repair bool) (err error) {
+
+    defer Catch(&err)
+
+    Try(srv.loadConfigs())
+
+    report := FsckReport{Ok: true}
+    for _, paths := range [][3]string{
+        {srv.config.DataStoreDir, srv.config.DataIndexesDir, srv.config.DataIndexesFile},
+        {srv.monitorRollupDir(), srv.config.RollupIndexesDir, srv.config.RollupIndexesFile},
+    } {
+        storeReport, err := fsckMonitorDataStore(paths[0], paths[1], paths[2], repair)
+        Try(err)
+        report.Ok    = report.Ok && storeReport.ok()
+        report.Stores = append(report.Stores, storeReport)
+    }
+
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    Try(enc.Encode(report))
+
+    if !report.Ok && !repair {
+        return fmt.Errorf("Found problems in the store; run with -fsck_repair to rebuild the indexes")
+    }
+    return nil
+
+}
+
+func fsckMonitorDataStore(dir, indexesDir, legacyFile string, repair bool) (report FsckStoreReport, err error) {
+
+    defer Catch(&err)
+
+    report = FsckStoreReport{
+        Dir: dir, IndexesDir: indexesDir,
+        Corrupted: []FsckProblem{}, Mismatched: []FsckProblem{}, Dangling: []FsckProblem{},
+        Overlapping: []FsckProblem{}, Orphans: []string{}, Unrecoverable: []string{},
+    }
+
+    // Indexes
+    mdStore := NewMonitorDataStore()
+    if err := loadMonitorDataIndexes(mdStore, indexesDir, legacyFile); err != nil {
+        report.IndexesError = err.Error()
+    }
+
+    // Chunks
+    chunks := make(map[string/* uuid */] fsckChunk)
+    fis, err := ioutil.ReadDir(dir)
+    if err != nil && !os.IsNotExist(err) {
+        panic(err)
+    }
+    for _, fi := range fis {
+        if fi.IsDir() || filepath.Ext(fi.Name()) != dataStoreExt {
+            continue
+        }
+        uuid := strings.TrimSuffix(fi.Name(), dataStoreExt)
+        p, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+        Try(err)
+        ch := fsckChunk{}
+        ch.clId, ch.key, ch.labeled, ch.md, ch.err = decodeMonitorDataChunk(p)
+        if ch.err == nil && len(ch.md) == 0 {
+            ch.err = fmt.Errorf("Chunk is empty")
+        }
+        chunks[uuid] = ch
+    }
+    report.Chunks = len(chunks)
+
+    // Check every index
+    referenced := make(map[string/* uuid */] struct{})
+    owners     := make(map[string/* uuid */] [][2]string) // Readable indexes
+    for clId, mdIdxMap := range mdStore.IndexesMap() {
+        for key, indexes := range mdIdxMap {
+            last := MonitorDataIndex{} // Of the latest data so far
+            for _, index := range indexes {
+
+                report.Indexes++
+                referenced[index.Uuid] = struct{}{}
+                problem := FsckProblem{ClientId: clId, Key: key, Uuid: index.Uuid}
+
+                ch, ok := chunks[index.Uuid]
+                switch {
+                case !ok:
+                    problem.Detail = "Chunk file is missing"
+                    report.Dangling = append(report.Dangling, problem)
+                    continue
+                case ch.err != nil:
+                    problem.Detail = ch.err.Error()
+                    report.Corrupted = append(report.Corrupted, problem)
+                    continue
+                }
+
+                if detail := fsckCompareIndex(index, ch.md); detail != "" {
+                    problem.Detail = detail
+                    report.Mismatched = append(report.Mismatched, problem)
+                    continue
+                }
+                if ch.labeled && (ch.clId != clId || ch.key != key) {
+                    problem.Detail = fmt.Sprintf("Chunk is labeled with %s %s", ch.clId, ch.key)
+                    report.Mismatched = append(report.Mismatched, problem)
+                    continue
+                }
+                owners[index.Uuid] = append(owners[index.Uuid], [2]string{clId, key})
+
+                if last.Uuid != "" && ch.md[0].Timestamp <= last.To {
+                    problem.Detail = fmt.Sprintf("Chunk overlaps %s at %d-%d", last.Uuid, ch.md[0].Timestamp, last.To)
+                    report.Overlapping = append(report.Overlapping, problem)
+                }
+                if index.To > last.To || last.Uuid == "" {
+                    last = index
+                }
+
+            }
+        }
+    }
+
+    // Orphans
+    for uuid, ch := range chunks {
+        if _, ok := referenced[uuid]; ok {
+            continue
+        }
+        if ch.err != nil {
+            report.Corrupted = append(report.Corrupted, FsckProblem{Uuid: uuid, Detail: ch.err.Error()})
+            continue
+        }
+        report.Orphans = append(report.Orphans, uuid)
+    }
+    sort.Strings(report.Orphans)
+
+    if !repair || report.ok() {
+        return report, nil
+    }
+
+    // Rebuild
+    type candidate struct {
+        uuid string
+        md   MonitorData
+    }
+    candidates := make(map[[2]string] []candidate)
+    for uuid, ch := range chunks {
+        switch {
+        case ch.err != nil:
+            report.Unrecoverable = append(report.Unrecoverable, uuid)
+        case ch.labeled:
+            k := [2]string{ch.clId, ch.key}
+            candidates[k] = append(candidates[k], candidate{uuid, ch.md})
+        case len(owners[uuid]) > 0:
+            for _, k := range owners[uuid] {
+                candidates[k] = append(candidates[k], candidate{uuid, ch.md})
+            }
+        default:
+            // Unlabeled chunks that no readable index refers to
+            report.Unrecoverable = append(report.Unrecoverable, uuid)
+        }
+    }
+    sort.Strings(report.Unrecoverable)
+
+    rebuilt := NewMonitorDataStore()
+    merged  := []string{} // uuids
+    for k, cands := range candidates {
+        sort.Slice(cands, func(i, j int) bool {
+            if cands[i].md[0].Timestamp == cands[j].md[0].Timestamp {
+                return cands[i].uuid < cands[j].uuid
+            }
+            return cands[i].md[0].Timestamp < cands[j].md[0].Timestamp
+        })
+
+        // Groups of the chunks that overlap each other
+        indexes := MonitorDataIndexes{}
+        group   := []candidate{}
+        flush   := func() {
+            md := group[0].md
+            if len(group) == 1 {
+                index     := CreateIndexForMonitorData(md)
+                index.Uuid = group[0].uuid
+                indexes    = append(indexes, index)
+                return
+            }
+            for _, cand := range group[1:] {
+                md = md.Merge(cand.md)
+                EventLogger.Warnln("Merging", cand.uuid, "into an earlier chunk of", k[0], k[1])
+            }
+            index, p := createMonitorDataChunk(k[0], k[1], md)
+            Try(rewriteFile(monitorDataChunkPath(dir, index.Uuid), bytes.NewReader(p)))
+            indexes = append(indexes, index)
+            for _, cand := range group {
+                merged = append(merged, cand.uuid)
+            }
+            report.MergedChunks += len(group)
+        }
+        groupTo := int64(0)
+        for _, cand := range cands {
+            if len(group) > 0 && cand.md[0].Timestamp > groupTo {
+                flush()
+                group = group[:0]
+            }
+            group = append(group, cand)
+            if to := cand.md.To(); len(group) == 1 || to > groupTo {
+                groupTo = to
+            }
+        }
+        flush()
+
+        rebuilt.SetIndexes(k[0], k[1], indexes)
+        report.RebuiltIndexes += len(indexes)
+    }
+
+    // Keep the previous indexes
+    if _, err := os.Stat(indexesDir); err == nil {
+        Try(os.RemoveAll(indexesDir + ".bak"))
+        Try(os.Rename(indexesDir, indexesDir + ".bak"))
+    }
+    Try(writeMonitorDataIndexes(rebuilt, indexesDir, nil))
+    report.Rebuilt = true
+
+    // Remove the merged chunks that are no longer referred to
+    referenced = make(map[string] struct{})
+    for _, mdIdxMap := range rebuilt.IndexesMap() {
+        for _, indexes := range mdIdxMap {
+            for _, index := range indexes {
+                referenced[index.Uuid] = struct{}{}
+            }
+        }
+    }
+    for _, uuid := range merged {
+        if _, ok := referenced[uuid]; ok {
+            continue
+        }
+        err := os.Remove(monitorDataChunkPath(dir, uuid))
+        if err != nil && !os.IsNotExist(err) {
+            EventLogger.Warnln("Failed to remove a merged chunk:", err)
+        }
+    }
+
+    return report, nil
+
+}
+
+// Returns what differs between the index and the data
+func fsckCompareIndex(index MonitorDataIndex, md MonitorData) string {
+    expected := CreateIndexForMonitorData(md)
+    sameFloat := func(a, b float64) bool {
+        return a == b || (math.IsNaN(a) && math.IsNaN(b))
+    }
+    switch {
+    case index.Length != expected.Length:
+        return fmt.Sprintf("Length is %d in the index but %d in the chunk", index.Length, expected.Length)
+    case index.From != expected.From || index.To != expected.To:
+        return fmt.Sprintf(
+            "Range is %d-%d in the index but %d-%d in the chunk",
+            index.From, index.To, expected.From, expected.To,
+        )
+    case !sameFloat(index.Min, expected.Min) || !sameFloat(index.Max, expected.Max):
+        return fmt.Sprintf(
+            "Min and max are %v, %v in the index but %v, %v in the chunk",
+            index.Min, index.Max, expected.Min, expected.Max,
+        )
+    }
+    return ""
+}
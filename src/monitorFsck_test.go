@@ -0,0 +1,149 @@
+package main
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestFsckMonitorDataStore(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    for ts := int64(1); ts <= 200; ts++ {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{"load": float64(ts)}, 1)
+        srv.RecordValueMap("cl-1", ts, map[string] interface{}{"load": float64(ts)}, 1)
+    }
+    if err := srv.StoreClientMonitorDataMap(true); err != nil {
+        t.Fatal(err)
+    }
+
+    dir, idxDir, fn := srv.config.DataStoreDir, srv.config.DataIndexesDir, srv.config.DataIndexesFile
+    report, err := fsckMonitorDataStore(dir, idxDir, fn, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !report.ok() || report.Chunks != 8 || report.Indexes != 8 {
+        t.Fatalf("expected a healthy store, got %+v", report)
+    }
+
+    // Break things
+    indexes := srv.monitorDataStore.Indexes("cl-0", "load")
+    os.Remove(monitorDataChunkPath(dir, indexes[0].Uuid))
+    os.Truncate(monitorDataChunkPath(dir, indexes[1].Uuid), 10)
+    indexes[2].Max = 1000
+    srv.monitorDataStore.SetIndexes("cl-0", "load", indexes)
+    srv.monitorDataStore.SetIndexes("cl-1", "load", nil)
+    if err = writeMonitorDataIndexes(srv.monitorDataStore, idxDir, nil); err != nil {
+        t.Fatal(err)
+    }
+
+    report, err = fsckMonitorDataStore(dir, idxDir, fn, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(report.Dangling) != 1 || len(report.Corrupted) != 1 ||
+        len(report.Mismatched) != 1 || len(report.Orphans) != 4 {
+        t.Fatalf("unexpected report %+v", report)
+    }
+
+    // Repair
+    report, err = fsckMonitorDataStore(dir, idxDir, fn, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !report.Rebuilt || report.RebuiltIndexes != 6 || len(report.Unrecoverable) != 1 {
+        t.Fatalf("unexpected repair report %+v", report)
+    }
+    if _, err = ioutil.ReadFile(filepath.Join(idxDir + ".bak", monitorIndexesManifestName)); err != nil {
+        t.Error("the previous indexes must be kept:", err)
+    }
+
+    restarted := NewServer()
+    restarted.config       = srv.config
+    restarted.clientConfig = srv.clientConfig
+    if err = restarted.readClientMonitorIndexesMap(); err != nil {
+        t.Fatal(err)
+    }
+    for clId, expected := range map[string] int{"cl-0": 100, "cl-1": 200} {
+        if l := restarted.GetClientMonitorDataLength(clId, "load"); l != expected {
+            t.Errorf("%s: expected %d data after repair, got %d", clId, expected, l)
+        }
+    }
+
+    // Only the unrecoverable chunk remains as a problem
+    report, err = fsckMonitorDataStore(dir, idxDir, fn, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(report.Corrupted) != 1 || len(report.Dangling) + len(report.Mismatched) + len(report.Orphans) != 0 {
+        t.Errorf("unexpected report after repair %+v", report)
+    }
+
+}
+
+func TestFsckOverlappingChunks(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    for ts := int64(1); ts <= 200; ts++ {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{"load": float64(ts)}, 1)
+    }
+    if err := srv.StoreClientMonitorDataMap(true); err != nil {
+        t.Fatal(err)
+    }
+
+    // A chunk of backfilled data indexed after the chunks that it overlaps
+    dir, idxDir, fn := srv.config.DataStoreDir, srv.config.DataIndexesDir, srv.config.DataIndexesFile
+    index, p := createMonitorDataChunk("cl-0", "load", MonitorData{{60, -1, 1}, {120, -1, 1}, {250, 250, 1}})
+    if err := rewriteFile(monitorDataChunkPath(dir, index.Uuid), bytes.NewReader(p)); err != nil {
+        t.Fatal(err)
+    }
+    srv.monitorDataStore.SetIndexes("cl-0", "load", srv.monitorDataStore.Indexes("cl-0", "load").Append(index))
+    if err := writeMonitorDataIndexes(srv.monitorDataStore, idxDir, nil); err != nil {
+        t.Fatal(err)
+    }
+
+    report, err := fsckMonitorDataStore(dir, idxDir, fn, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.ok() || len(report.Overlapping) != 1 || report.Overlapping[0].Uuid != index.Uuid {
+        t.Fatalf("expected the overlapping chunk, got %+v", report)
+    }
+
+    // The chunks from 51 on are merged into one
+    report, err = fsckMonitorDataStore(dir, idxDir, fn, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !report.Rebuilt || report.MergedChunks != 4 || report.RebuiltIndexes != 2 {
+        t.Fatalf("unexpected repair report %+v", report)
+    }
+
+    restarted := NewServer()
+    restarted.config       = srv.config
+    restarted.clientConfig = srv.clientConfig
+    if err = restarted.readClientMonitorIndexesMap(); err != nil {
+        t.Fatal(err)
+    }
+    // + The chunk that starts earlier wins
+    md := getMonitorDataRange(restarted.monitorDataStore, dir, "cl-0", "load", 0, 1000)
+    if len(md) != 201 || md[59].Value != 60 || md[119].Value != -1 || md[200].Value != 250 {
+        t.Errorf("unexpected data after repair %v", md)
+    }
+
+    // Healthy with the merged chunks removed
+    report, err = fsckMonitorDataStore(dir, idxDir, fn, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !report.ok() || report.Chunks != 2 {
+        t.Errorf("unexpected report after repair %+v", report)
+    }
+
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    monitorIndexesManifestName    = "manifest.json"
+    monitorIndexesManifestVersion = 1
+    monitorIndexesExt             = ".csv"
+    monitorIndexesMigratedExt     = ".migrated"
+)
+
+/*
+
+The indexes of a store are kept in a directory that consists of a manifest and
+a csv file for each client, so that a store cycle only appends the indexes of
+the new chunks instead of rewriting the entire indexes.
+
+manifest.json
+{
+    "version": 1,
+    "clients": {
+        "<client id>": "<lowercase hex of sha256 of the client id>.csv"
+    }
+}
+
+Each line of the csv file of a client is the index of a chunk, and the indexes
+of a monitor key are in the order of their lines.
+
+<monitor key>,<uuid>,<length>,<from>,<to>,<min>,<max>
+
+The csv files are rewritten only when indexes are replaced, as by retention or
+by -fsck_repair. A line torn by a crash is cut off when the file is read, and
+the data of its chunk are stored again from the write-ahead log.
+
+The json indexes file of earlier versions is migrated to the directory once,
+and is then renamed with the extension .migrated.
+
+*/
+
+type monitorIndexesManifest struct {
+    Version int                          `json:"version"`
+    Clients map[string/* clId */] string `json:"clients"`
+}
+
+func monitorIndexesFileName(clId string) string {
+    return fmt.Sprintf("%x", sha256.Sum256([]byte(clId))) + monitorIndexesExt
+}
+
+func readMonitorIndexesManifest(dir string) (manifest monitorIndexesManifest, ok bool, err error) {
+
+    p, err := ioutil.ReadFile(filepath.Join(dir, monitorIndexesManifestName))
+    if os.IsNotExist(err) {
+        return monitorIndexesManifest{
+            Version: monitorIndexesManifestVersion,
+            Clients: make(map[string] string),
+        }, false, nil
+    }
+    if err != nil {
+        return
+    }
+
+    if err = json.Unmarshal(p, &manifest); err != nil {
+        return
+    }
+    if manifest.Version != monitorIndexesManifestVersion {
+        err = fmt.Errorf("Unknown manifest version %d", manifest.Version)
+        return
+    }
+    if manifest.Clients == nil {
+        manifest.Clients = make(map[string] string)
+    }
+    return manifest, true, nil
+
+}
+
+func writeMonitorIndexesManifest(dir string, manifest monitorIndexesManifest) error {
+    p, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return err
+    }
+    return rewriteFile(filepath.Join(dir, monitorIndexesManifestName), bytes.NewReader(p))
+}
+
+// Reads the csv file of a client; when cut is true, a torn last line is cut
+// off from the file, otherwise it is just ignored
+func readMonitorIndexesCsv(fn string, cut bool) (mdIdxMap MonitorDataIndexesMap, err error) {
+
+    defer Catch(&err)
+
+    mdIdxMap = make(MonitorDataIndexesMap)
+
+    p, err := ioutil.ReadFile(fn)
+    if os.IsNotExist(err) {
+        return mdIdxMap, nil
+    }
+    Try(err)
+
+    // Torn line
+    complete := bytes.LastIndexByte(p, '\n') + 1
+    if complete < len(p) {
+        EventLogger.Warnln("Cutting off a torn line of", fn)
+        if cut {
+            Try(os.Truncate(fn, int64(complete)))
+        }
+        p = p[:complete]
+    }
+
+    rd := csv.NewReader(bytes.NewReader(p))
+    rd.FieldsPerRecord = 7
+    for {
+
+        rec, err := rd.Read()
+        if err == io.EOF {
+            break
+        }
+        Try(err)
+
+        index := MonitorDataIndex{Uuid: rec[1]}
+        index.Length, err = strconv.Atoi(rec[2])
+        Try(err)
+        index.From, err = strconv.ParseInt(rec[3], 10, 64)
+        Try(err)
+        index.To, err = strconv.ParseInt(rec[4], 10, 64)
+        Try(err)
+        index.Min, err = strconv.ParseFloat(rec[5], 64)
+        Try(err)
+        index.Max, err = strconv.ParseFloat(rec[6], 64)
+        Try(err)
+
+        mdIdxMap[rec[0]] = append(mdIdxMap[rec[0]], index)
+
+    }
+
+    return mdIdxMap, nil
+
+}
+
+func encodeMonitorIndexesCsv(w io.Writer, mdIdxMap MonitorDataIndexesMap) error {
+
+    mKeys := make([]string, 0, len(mdIdxMap))
+    for mKey := range mdIdxMap {
+        mKeys = append(mKeys, mKey)
+    }
+    sort.Strings(mKeys)
+
+    formatFloat := func(f float64) string {
+        return strconv.FormatFloat(f, 'g', -1, 64)
+    }
+
+    cw := csv.NewWriter(w)
+    for _, mKey := range mKeys {
+        for _, index := range mdIdxMap[mKey] {
+            cw.Write([]string{
+                mKey, index.Uuid, strconv.Itoa(index.Length),
+                strconv.FormatInt(index.From, 10), strconv.FormatInt(index.To, 10),
+                formatFloat(index.Min), formatFloat(index.Max),
+            })
+        }
+    }
+    cw.Flush()
+    return cw.Error()
+
+}
+
+// Reads the indexes in dir into the store, or the legacy json file when dir
+// has no manifest; nothing is changed on disk
+func loadMonitorDataIndexes(mdStore *MonitorDataStore, dir, legacyFile string) (err error) {
+
+    defer Catch(&err)
+
+    manifest, ok, err := readMonitorIndexesManifest(dir)
+    Try(err)
+
+    if !ok {
+        f, err := os.Open(legacyFile)
+        if os.IsNotExist(err) {
+            return nil
+        }
+        Try(err)
+        defer f.Close()
+        return mdStore.DecodeIndexes(f)
+    }
+
+    for clId, name := range manifest.Clients {
+        mdIdxMap, err := readMonitorIndexesCsv(filepath.Join(dir, name), false)
+        Try(err)
+        mdStore.SetIndexesMap(clId, mdIdxMap)
+    }
+    return nil
+
+}
+
+// Reads the indexes in dir into the store, migrating the legacy json file to
+// dir first if there is one
+func readMonitorDataIndexes(mdStore *MonitorDataStore, dir, legacyFile string) (err error) {
+
+    defer func() {
+        Catch(&err)
+        if err != nil {
+            err = fmt.Errorf("Failed to read the indexes in %s, which can be checked with -fsck: %v", dir, err)
+        }
+    }()
+
+    Try(EnsureDirectory(dir))
+    manifest, ok, err := readMonitorIndexesManifest(dir)
+    Try(err)
+
+    if ok {
+        for clId, name := range manifest.Clients {
+            mdIdxMap, err := readMonitorIndexesCsv(filepath.Join(dir, name), true)
+            Try(err)
+            mdStore.SetIndexesMap(clId, mdIdxMap)
+        }
+        return nil
+    }
+
+    // Migrate
+    Try(loadMonitorDataIndexes(mdStore, dir, legacyFile))
+    Try(writeMonitorDataIndexes(mdStore, dir, nil))
+    if _, err := os.Stat(legacyFile); err == nil {
+        Try(os.Rename(legacyFile, legacyFile + monitorIndexesMigratedExt))
+        EventLogger.Infoln("Migrated", legacyFile, "to", dir)
+    }
+    return nil
+
+}
+
+// Appends the indexes of new chunks to the csv files of their clients
+func appendMonitorDataIndexes(dir string, added map[string/* clId */] MonitorDataIndexesMap) (err error) {
+
+    defer Catch(&err)
+
+    if len(added) == 0 {
+        return nil
+    }
+
+    Try(EnsureDirectory(dir))
+    manifest, _, err := readMonitorIndexesManifest(dir)
+    Try(err)
+
+    // The manifest is written first, as a missing csv file is read as empty
+    changed := false
+    for clId := range added {
+        if _, ok := manifest.Clients[clId]; !ok {
+            manifest.Clients[clId] = monitorIndexesFileName(clId)
+            changed = true
+        }
+    }
+    if changed {
+        Try(writeMonitorIndexesManifest(dir, manifest))
+    }
+
+    for clId, mdIdxMap := range added {
+        buf := bytes.NewBuffer(nil)
+        Try(encodeMonitorIndexesCsv(buf, mdIdxMap))
+        if buf.Len() == 0 {
+            continue
+        }
+
+        f, err := os.OpenFile(
+            filepath.Join(dir, manifest.Clients[clId]), os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0600,
+        )
+        Try(err)
+        _, err = f.Write(buf.Bytes())
+        f.Close()
+        Try(err)
+    }
+
+    return nil
+
+}
+
+// Rewrites the csv files of the clients with the indexes of the store, or of
+// every client when clIds is nil
+func writeMonitorDataIndexes(mdStore *MonitorDataStore, dir string, clIds []string) (err error) {
+
+    defer Catch(&err)
+
+    Try(EnsureDirectory(dir))
+    manifest, _, err := readMonitorIndexesManifest(dir)
+    Try(err)
+
+    if clIds == nil {
+        clIds = mdStore.ClientIds()
+    }
+
+    indexesMap := mdStore.IndexesMap()
+    for _, clId := range clIds {
+        name, ok := manifest.Clients[clId]
+        if !ok {
+            name = monitorIndexesFileName(clId)
+            manifest.Clients[clId] = name
+        }
+        buf := bytes.NewBuffer(nil)
+        Try(encodeMonitorIndexesCsv(buf, indexesMap[clId]))
+        Try(rewriteFile(filepath.Join(dir, name), buf))
+    }
+
+    return writeMonitorIndexesManifest(dir, manifest)
+
+}
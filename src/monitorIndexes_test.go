@@ -0,0 +1,79 @@
+package main
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestMonitorDataIndexesMigration(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    for ts := int64(1); ts <= 120; ts++ {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{"load": float64(ts)}, 1)
+        srv.RecordValueMap("cl-1", ts, map[string] interface{}{"cpu-usage": float64(ts)}, 1)
+    }
+    if err := srv.StoreClientMonitorDataMap(true); err != nil {
+        t.Fatal(err)
+    }
+
+    // Legacy indexes file
+    buf := bytes.NewBuffer(nil)
+    if err := srv.monitorDataStore.EncodeIndexes(buf); err != nil {
+        t.Fatal(err)
+    }
+    legacy := srv.config.DataIndexesFile
+    if err := ioutil.WriteFile(legacy, buf.Bytes(), 0600); err != nil {
+        t.Fatal(err)
+    }
+    os.RemoveAll(srv.config.DataIndexesDir)
+
+    restarted := NewServer()
+    restarted.config       = srv.config
+    restarted.clientConfig = srv.clientConfig
+    if err := restarted.readClientMonitorIndexesMap(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(legacy + monitorIndexesMigratedExt); err != nil {
+        t.Error("the legacy indexes file must be renamed:", err)
+    }
+    for _, clKey := range [][2]string{{"cl-0", "load"}, {"cl-1", "cpu-usage"}} {
+        if l := restarted.GetClientMonitorDataLength(clKey[0], clKey[1]); l != 120 {
+            t.Errorf("%s %s: expected 120 data after migration, got %d", clKey[0], clKey[1], l)
+        }
+    }
+
+    // Appending
+    for ts := int64(121); ts <= 170; ts++ {
+        restarted.RecordValueMap("cl-0", ts, map[string] interface{}{"load": float64(ts)}, 1)
+    }
+    if err := restarted.StoreClientMonitorDataMap(false); err != nil {
+        t.Fatal(err)
+    }
+
+    // Torn line
+    fn := filepath.Join(srv.config.DataIndexesDir, monitorIndexesFileName("cl-0"))
+    f, err := os.OpenFile(fn, os.O_APPEND | os.O_WRONLY, 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Write([]byte("load,abc,1"))
+    f.Close()
+
+    again := NewServer()
+    again.config = srv.config
+    if err = again.readClientMonitorIndexesMap(); err != nil {
+        t.Fatal(err)
+    }
+    if l := again.GetClientMonitorDataLength("cl-0", "load"); l != 170 {
+        t.Errorf("expected 170 data after appending, got %d", l)
+    }
+    if p, _ := ioutil.ReadFile(fn); p[len(p) - 1] != '\n' {
+        t.Error("the torn line must be cut off")
+    }
+
+}
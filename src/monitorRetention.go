@@ -0,0 +1,262 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "os"
+    "time"
+
+    . "github.com/hjjg200/go-act"
+)
+
+/*
+
+Retention removes the stored monitor data that are older than the retention
+period of their monitor keys. The retention of a monitor config overrides that
+of the client rule, and empty retention keeps data forever.
+
+Chunks that are entirely expired are removed, and chunks that are partially
+expired are rewritten with the remaining data. New chunk files are written
+first, then the index files of the clients are replaced atomically, and the
+old chunk files are removed last, so that an interruption leaves at most some
+orphan files behind. Rollups are kept as long as the rollup retention of the
+server config. As unlabeled chunks of earlier versions can be shared by several
+monitor keys, a chunk file is only removed when no index refers to it anymore.
+
+In-memory data are left as they are, as they are stored and then enforced in
+the following cycles.
+
+*/
+
+type RetentionReport struct {
+    DryRun          bool                  `json:"dryRun"`
+    Timestamp       int64                 `json:"timestamp"`
+    RemovedChunks   int                   `json:"removedChunks"`
+    RewrittenChunks int                   `json:"rewrittenChunks"`
+    RemovedData     int                   `json:"removedData"`
+    FreedBytes      int64                 `json:"freedBytes"`
+    Items           []RetentionReportItem `json:"items"`
+}
+
+type RetentionReportItem struct {
+    ClientId        string    `json:"clientId"`
+    MonitorKey      string    `json:"monitorKey"`
+    Retention       Retention `json:"retention"`
+    Cutoff          int64     `json:"cutoff"`
+    RemovedChunks   int       `json:"removedChunks"`
+    RewrittenChunks int       `json:"rewrittenChunks"`
+    RemovedData     int       `json:"removedData"`
+    FreedBytes      int64     `json:"freedBytes"`
+    obsolete        []string  // uuids
+    written         int64     // bytes of rewritten chunks
+}
+
+// Returns the retention of the monitor key of the client
+func(srv *Server) getClientMonitorRetention(clId, mKey string) Retention {
+    if mCfg, ok := srv.getClientMonitorConfig(clId, mKey); ok && mCfg.Retention != "" {
+        return mCfg.Retention
+    }
+    clInfo := srv.clientConfig.InfoMap[clId]
+    return srv.clientConfig.RuleMap.Get(clInfo.Tags).Retention
+}
+
+func monitorDataChunkSize(dir, uuid string) int64 {
+    fi, err := os.Stat(monitorDataChunkPath(dir, uuid))
+    if err != nil {
+        return 0
+    }
+    return fi.Size()
+}
+
+// Writes the dry-run report of the stored data without starting the server
+func(srv *Server) ReportMonitorDataRetention(w io.Writer) (err error) {
+
+    defer Catch(&err)
+
+    Try(srv.loadConfigs())
+    Try(loadMonitorDataIndexes(srv.monitorDataStore, srv.config.DataIndexesDir, srv.config.DataIndexesFile))
+    Try(loadMonitorDataIndexes(srv.rollupStore, srv.config.RollupIndexesDir, srv.config.RollupIndexesFile))
+
+    report, err := srv.EnforceMonitorDataRetention(true)
+    Try(err)
+
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(report)
+
+}
+
+// Removes the expired monitor data; when dryRun is true, nothing is changed
+// and the report tells what would be removed
+func(srv *Server) EnforceMonitorDataRetention(dryRun bool) (report RetentionReport, err error) {
+
+    defer Catch(&err)
+
+    // Storing cycles also write the indexes
+    srv.storeMu.Lock()
+    defer srv.storeMu.Unlock()
+
+    report = RetentionReport{
+        DryRun:    dryRun,
+        Timestamp: time.Now().Unix(),
+        Items:     []RetentionReportItem{},
+    }
+
+    // Raw data
+    Try(srv.enforceRetention(
+        srv.monitorDataStore, srv.config.DataStoreDir, srv.config.DataIndexesDir,
+        srv.getClientMonitorRetention, &report,
+    ))
+
+    // Rollups
+    Try(srv.enforceRetention(
+        srv.rollupStore, srv.monitorRollupDir(), srv.config.RollupIndexesDir,
+        func(string, string) Retention { return srv.config.RollupRetention }, &report,
+    ))
+
+    return report, nil
+
+}
+
+func(srv *Server) enforceRetention(
+    mdStore *MonitorDataStore, dir, indexesDir string,
+    retentionOf func(clId, mKey string) Retention, report *RetentionReport,
+) (err error) {
+
+    defer Catch(&err)
+
+    dryRun     := report.DryRun
+    now        := report.Timestamp
+    items      := []RetentionReportItem{}
+    referenced := make(map[string] struct{}) // uuids that remain
+
+    for clId, mdIdxMap := range mdStore.IndexesMap() {
+        for mKey, indexes := range mdIdxMap {
+
+            rt     := retentionOf(clId, mKey)
+            period, err := rt.Seconds()
+            if err != nil {
+                EventLogger.Warnln("Retention of", clId, mKey, "is malformed:", err)
+                continue
+            }
+            if period == 0 {
+                for _, index := range indexes {
+                    referenced[index.Uuid] = struct{}{}
+                }
+                continue
+            }
+
+            item := RetentionReportItem{
+                ClientId: clId, MonitorKey: mKey, Retention: rt, Cutoff: now - period,
+            }
+            kept := make(MonitorDataIndexes, 0, len(indexes))
+            for _, index := range indexes {
+
+                switch {
+                case index.To <= item.Cutoff: // Entirely expired
+                    item.RemovedChunks++
+                    item.RemovedData += index.Length
+                    item.obsolete     = append(item.obsolete, index.Uuid)
+                    continue
+                case index.From >= item.Cutoff: // Not expired
+                    kept = append(kept, index)
+                    continue
+                }
+
+                // Partially expired
+                md, err := readMonitorDataChunk(dir, index.Uuid)
+                if err != nil {
+                    EventLogger.Warnln("Failed to read index:", index.Uuid)
+                    kept = append(kept, index)
+                    continue
+                }
+                remaining := make(MonitorData, 0, len(md))
+                for _, datum := range md {
+                    if datum.Timestamp > item.Cutoff {
+                        remaining = append(remaining, datum)
+                    }
+                }
+                if len(remaining) == len(md) {
+                    // Only the per of the first datum reaches beyond the cutoff
+                    kept = append(kept, index)
+                    continue
+                }
+
+                newIndex, chunk := createMonitorDataChunk(clId, mKey, remaining)
+                item.RewrittenChunks++
+                item.RemovedData += len(md) - len(remaining)
+                item.obsolete     = append(item.obsolete, index.Uuid)
+                if len(remaining) == 0 {
+                    continue
+                }
+                item.written += int64(len(chunk))
+
+                kept = append(kept, newIndex)
+                if !dryRun {
+                    Try(rewriteFile(monitorDataChunkPath(dir, newIndex.Uuid), bytes.NewReader(chunk)))
+                }
+
+            }
+
+            for _, index := range kept {
+                referenced[index.Uuid] = struct{}{}
+            }
+            if item.RemovedChunks == 0 && item.RewrittenChunks == 0 {
+                continue
+            }
+            if !dryRun {
+                mdStore.SetIndexes(clId, mKey, kept)
+            }
+            items = append(items, item)
+
+        }
+    }
+
+    // Count the chunk files that are no longer referenced
+    obsolete := []string{}
+    for i := range items {
+        item := &items[i]
+        for _, uuid := range item.obsolete {
+            if _, ok := referenced[uuid]; ok {
+                continue
+            }
+            referenced[uuid] = struct{}{} // Count once
+            item.FreedBytes += monitorDataChunkSize(dir, uuid)
+            obsolete         = append(obsolete, uuid)
+        }
+        item.FreedBytes -= item.written
+
+        report.RemovedChunks   += item.RemovedChunks
+        report.RewrittenChunks += item.RewrittenChunks
+        report.RemovedData     += item.RemovedData
+        report.FreedBytes      += item.FreedBytes
+    }
+    report.Items = append(report.Items, items...)
+
+    if dryRun || len(items) == 0 {
+        return nil
+    }
+
+    // Store new indexes
+    changed := make(map[string] struct{})
+    for _, item := range items {
+        changed[item.ClientId] = struct{}{}
+    }
+    clIds := make([]string, 0, len(changed))
+    for clId := range changed {
+        clIds = append(clIds, clId)
+    }
+    Try(writeMonitorDataIndexes(mdStore, indexesDir, clIds))
+
+    // Remove old chunks
+    for _, uuid := range obsolete {
+        err := os.Remove(monitorDataChunkPath(dir, uuid))
+        if err != nil && !os.IsNotExist(err) {
+            EventLogger.Warnln("Failed to remove an expired chunk:", err)
+        }
+    }
+
+    return nil
+
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+    "io/ioutil"
+    "testing"
+    "time"
+)
+
+func TestMonitorDataRetention(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    rule := srv.clientConfig.RuleMap["test"]
+    rule.Retention = "1h"
+    rule.MonitorConfigMap["load"] = MonitorConfig{Retention: "90m"}
+    srv.clientConfig.RuleMap["test"] = rule
+
+    // 3 hours of 1-minute data in chunks of 50
+    now   := time.Now().Unix()
+    start := now - 3 * 3600
+    for ts := start + 60; ts <= now; ts += 60 {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{
+            "cpu-usage": 1.0, "load": 1.0,
+        }, 60)
+    }
+    if err := srv.StoreClientMonitorDataMap(true); err != nil {
+        t.Fatal(err)
+    }
+    countChunks := func() int {
+        fis, _ := ioutil.ReadDir(srv.config.DataStoreDir)
+        return len(fis)
+    }
+    lengthBefore := srv.GetClientMonitorDataLength("cl-0", "cpu-usage")
+    chunksBefore := countChunks()
+
+    // Dry run
+    report, err := srv.EnforceMonitorDataRetention(true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.RemovedData == 0 || report.FreedBytes <= 0 || len(report.Items) != 2 {
+        t.Fatalf("unexpected dry-run report %+v", report)
+    }
+    if srv.GetClientMonitorDataLength("cl-0", "cpu-usage") != lengthBefore || countChunks() != chunksBefore {
+        t.Fatal("dry run must not change anything")
+    }
+
+    // Enforce
+    enforced, err := srv.EnforceMonitorDataRetention(false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if enforced.RemovedData != report.RemovedData || enforced.FreedBytes != report.FreedBytes {
+        t.Errorf("expected the dry-run report %+v to match %+v", report, enforced)
+    }
+
+    for mKey, period := range map[string] int64{"cpu-usage": 3600, "load": 5400} {
+        length := srv.GetClientMonitorDataLength("cl-0", mKey)
+        if length != int(period / 60) {
+            t.Errorf("%s: expected %d data, got %d", mKey, period / 60, length)
+        }
+        md := srv.GetClientMonitorDataSlice("cl-0", mKey, 0, length)
+        if len(md) != length || md[0].Timestamp <= now - period {
+            t.Errorf("%s: expired data remain", mKey)
+        }
+    }
+
+    // Indexes must survive a restart
+    restarted := NewServer()
+    restarted.config = srv.config
+    if err = restarted.readClientMonitorIndexesMap(); err != nil {
+        t.Fatal(err)
+    }
+    if l := restarted.GetClientMonitorDataLength("cl-0", "cpu-usage"); l != 60 {
+        t.Errorf("expected 60 data after restart, got %d", l)
+    }
+
+}
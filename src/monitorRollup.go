@@ -0,0 +1,255 @@
+package main
+
+import (
+    "math"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    monitorRollupDirName  = "rollup"
+    monitorRollupKeyCount = "count"
+)
+
+/*
+
+Rollups are downsampled archives of the raw monitor data. For every resolution
+in the rollup tiers of the server config, the raw data of each monitor key are
+divided into buckets of the resolution, and each bucket yields one datum for
+each aggregate type in monitorAggregateTypesMap, plus the count of the raw data.
+
+Each of them is kept as a series of its own in a separate MonitorDataStore,
+under the rollup key below, and stored in the same chunk format in the rollup
+directory under the data store directory.
+
+<monitor key>@<resolution in seconds>:<aggregate type or count>
+
+As a datum covers the per before its timestamp, a bucket of resolution R holds
+the data whose timestamps are greater than n * R and not greater than (n + 1) * R.
+A rollup datum takes the timestamp of the last raw datum of its bucket and the
+duration of the bucket data as its per, so that rollups and raw data can be
+aggregated in the same way.
+
+Buckets are rolled up once a raw datum of a later bucket arrives; the raw data
+that are backfilled into buckets that are already rolled up are not reflected.
+Rollups that are lost on a crash are rolled up again from the raw data.
+
+*/
+
+func formatMonitorRollupKey(mKey string, res int64, agrg string) string {
+    return mKey + "@" + strconv.FormatInt(res, 10) + ":" + agrg
+}
+
+func parseMonitorRollupKey(rKey string) (mKey string, res int64, agrg string, ok bool) {
+    at := strings.LastIndex(rKey, "@")
+    if at == -1 {
+        return
+    }
+    split := strings.SplitN(rKey[at + 1:], ":", 2)
+    if len(split) != 2 {
+        return
+    }
+    res, err := strconv.ParseInt(split[0], 10, 64)
+    if err != nil {
+        return
+    }
+    return rKey[:at], res, split[1], true
+}
+
+func monitorRollupBucket(ts, res int64) int64 {
+    return (ts - 1) / res
+}
+
+func(srv *Server) monitorRollupDir() string {
+    return filepath.Join(srv.config.DataStoreDir, monitorRollupDirName)
+}
+
+// Returns the rollup resolutions in seconds in ascending order
+func(srv *Server) monitorRollupResolutions() []int64 {
+    ret := make([]int64, 0, len(srv.config.RollupTiers))
+    for _, tier := range srv.config.RollupTiers {
+        ret = append(ret, int64(tier) * 60)
+    }
+    sort.Sort(Int64Slice(ret))
+    return ret
+}
+
+// Returns the coarsest resolution that is not coarser than per, or 0 if there is none
+func(srv *Server) pickMonitorRollupResolution(per int32) int64 {
+    picked := int64(0)
+    for _, res := range srv.monitorRollupResolutions() {
+        if res <= int64(per) {
+            picked = res
+        }
+    }
+    return picked
+}
+
+func(srv *Server) readMonitorRollupIndexes() error {
+    return readMonitorDataIndexes(srv.rollupStore, srv.config.RollupIndexesDir, srv.config.RollupIndexesFile)
+}
+
+// Returns the data of the store whose timestamps are within from and to, reading
+// only the chunks that overlap them
+func getMonitorDataRange(mdStore *MonitorDataStore, dir, clId, key string, from, to int64) MonitorData {
+
+    ret := MonitorData{}
+    indexes, inMem := mdStore.Snapshot(clId, key)
+    inRange := func(md MonitorData) {
+        for _, datum := range md {
+            if datum.Timestamp >= from && datum.Timestamp <= to {
+                ret = append(ret, datum)
+            }
+        }
+    }
+
+    for _, index := range indexes {
+        if index.To < from || index.From > to {
+            continue
+        }
+        part, err := readMonitorDataChunk(dir, index.Uuid)
+        if err != nil {
+            EventLogger.Warnln("Failed to read index:", index.Uuid)
+            continue
+        }
+        inRange(part)
+    }
+    inRange(inMem)
+
+    // Backfilled data stay in memory until they are merged into the chunks
+    // that they fall into, where the stored ones win
+    if !sort.IsSorted(ret) {
+        sort.Stable(ret)
+        deduped := ret[:1]
+        for _, datum := range ret[1:] {
+            if datum.Timestamp != deduped[len(deduped) - 1].Timestamp {
+                deduped = append(deduped, datum)
+            }
+        }
+        ret = deduped
+    }
+    return ret
+
+}
+
+// Returns the timestamp from which the raw data are not rolled up yet
+func(srv *Server) monitorRollupWatermark(clId, mKey string, res int64) int64 {
+
+    indexes, inMem := srv.rollupStore.Snapshot(clId, formatMonitorRollupKey(mKey, res, monitorRollupKeyCount))
+    switch {
+    case len(inMem) > 0:
+        return (monitorRollupBucket(inMem.To(), res) + 1) * res + 1
+    case len(indexes) > 0:
+        return (monitorRollupBucket(indexes[len(indexes) - 1].To, res) + 1) * res + 1
+    }
+    return 0
+
+}
+
+// Rolls up the buckets that are complete
+func(srv *Server) BuildMonitorRollups() (err error) {
+
+    defer Catch(&err)
+
+    mdStore := srv.monitorDataStore
+    for _, clId := range mdStore.ClientIds() {
+
+        mKeys, _ := mdStore.Keys(clId)
+        for _, mKey := range mKeys {
+
+            if _, ok := srv.getClientMonitorConfig(clId, mKey); !ok {
+                continue
+            }
+
+            for _, res := range srv.monitorRollupResolutions() {
+
+                watermark := srv.monitorRollupWatermark(clId, mKey, res)
+                raw       := getMonitorDataRange(mdStore, srv.config.DataStoreDir, clId, mKey, watermark, math.MaxInt64)
+                if len(raw) == 0 {
+                    continue
+                }
+
+                // The bucket of the latest datum is not complete yet
+                latest := monitorRollupBucket(raw.To(), res)
+                start  := 0
+                for i := 1; i <= len(raw); i++ {
+                    if i < len(raw) &&
+                        monitorRollupBucket(raw[i].Timestamp, res) == monitorRollupBucket(raw[start].Timestamp, res) {
+                        continue
+                    }
+                    bucket := raw[start:i]
+                    start   = i
+                    if monitorRollupBucket(bucket.To(), res) >= latest {
+                        break
+                    }
+                    srv.putMonitorRollup(clId, mKey, res, bucket)
+                }
+
+            }
+
+        }
+
+    }
+
+    return nil
+
+}
+
+func(srv *Server) putMonitorRollup(clId, mKey string, res int64, bucket MonitorData) {
+
+    ts  := bucket.To()
+    per := int32(bucket.Duration())
+    put := func(agrg string, val float64) {
+        rKey := formatMonitorRollupKey(mKey, res, agrg)
+        srv.rollupStore.Put(clId, rKey, MonitorDatum{ts, val, per}, 0)
+    }
+
+    for agrg, agrgFn := range monitorAggregateTypesMap {
+        put(agrg, agrgFn(bucket))
+    }
+    // The count is put last as it determines the watermark
+    put(monitorRollupKeyCount, float64(len(bucket)))
+
+}
+
+// Writes the in-memory rollups to chunks
+func(srv *Server) StoreMonitorRollups(forced bool) error {
+
+    srv.storeMu.Lock()
+    defer srv.storeMu.Unlock()
+
+    return srv.storeMonitorDataStore(
+        srv.rollupStore, srv.monitorRollupDir(), srv.config.RollupIndexesDir, forced, false,
+    )
+
+}
+
+// Returns the rollup data for the aggregate type along with the counts, both
+// of which are within from and to; for the mean, the values are the sums so
+// that the mean of several rollup data is their sum divided by their count
+func(srv *Server) getMonitorRollupRange(clId, mKey string, res int64, agrg string, from, to int64) (MonitorData, []float64) {
+
+    if agrg == monitorAggregateKeyMean {
+        agrg = monitorAggregateKeySum
+    }
+
+    dir    := srv.monitorRollupDir()
+    values := getMonitorDataRange(srv.rollupStore, dir, clId, formatMonitorRollupKey(mKey, res, agrg), from, to)
+    counts := getMonitorDataRange(srv.rollupStore, dir, clId, formatMonitorRollupKey(mKey, res, monitorRollupKeyCount), from, to)
+
+    countMap := make(map[int64] float64, len(counts))
+    for _, datum := range counts {
+        countMap[datum.Timestamp] = datum.Value
+    }
+    ret := make([]float64, len(values))
+    for i, datum := range values {
+        ret[i] = countMap[datum.Timestamp]
+    }
+
+    return values, ret
+
+}
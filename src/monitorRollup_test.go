@@ -0,0 +1,89 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math"
+    "testing"
+)
+
+func TestMonitorRollups(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    // 6 hours and a half of 1-minute data
+    start := int64(1600000000 / 3600 * 3600)
+    for ts := start + 60; ts <= start + 6 * 3600 + 1800; ts += 60 {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{
+            "cpu-usage": 50 + 50 * math.Sin(float64(ts) / 1000),
+        }, 60)
+    }
+    if err := srv.StoreClientMonitorDataMap(false); err != nil {
+        t.Fatal(err)
+    }
+
+    query := func(per int32, agrg string) string {
+        buf := bytes.NewBuffer(nil)
+        srv.FprintClientMonitorDataCsvFilter(buf, "cl-0", "cpu-usage", FprintCsvFilter{
+            From: start, To: start + 7 * 3600, Per: per, Type: agrg,
+        })
+        return buf.String()
+    }
+
+    // Raw aggregation
+    expected := make(map[string] string)
+    for agrg := range monitorAggregateTypesMap {
+        for _, per := range []int32{1800, 3600, 7200} {
+            expected[fmt.Sprint(agrg, per)] = query(per, agrg)
+        }
+    }
+
+    // Rollups
+    if err := srv.BuildMonitorRollups(); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.BuildMonitorRollups(); err != nil { // Idempotent
+        t.Fatal(err)
+    }
+    if err := srv.StoreMonitorRollups(true); err != nil {
+        t.Fatal(err)
+    }
+    if _, inMem := srv.rollupStore.Snapshot("cl-0", formatMonitorRollupKey("cpu-usage", 600, "max")); len(inMem) > 0 {
+        t.Errorf("rollups must be stored in chunks")
+    }
+
+    rKey := formatMonitorRollupKey("cpu-usage", 3600, monitorRollupKeyCount)
+    if l := srv.rollupStore.Length("cl-0", rKey); l != 6 {
+        t.Fatalf("expected 6 hourly rollups, got %d", l)
+    }
+    if w := srv.monitorRollupWatermark("cl-0", "cpu-usage", 3600); w != start + 6 * 3600 + 1 {
+        t.Errorf("unexpected watermark %d", w - start)
+    }
+
+    for agrg := range monitorAggregateTypesMap {
+        for _, per := range []int32{1800, 3600, 7200} {
+            got  := query(per, agrg)
+            want := expected[fmt.Sprint(agrg, per)]
+            if got != want {
+                t.Errorf("%s per %d: rollups yield\n%s\nwhereas raw data yield\n%s", agrg, per, got, want)
+            }
+        }
+    }
+
+    // Raw data may expire while rollups remain
+    srv.monitorDataStore.SetIndexes("cl-0", "cpu-usage", nil)
+    if out := query(3600, monitorAggregateKeyMax); len(bytes.Split([]byte(out), []byte("\n"))) < 6 {
+        t.Errorf("expected rollups without raw data, got\n%s", out)
+    }
+
+}
+
+func TestMonitorRollupKey(t *testing.T) {
+    mKey := FormatMonitorKey("disk-usage", "/dev/sda@1", "0")
+    rKey := formatMonitorRollupKey(mKey, 600, monitorAggregateKeyMean)
+    parsed, res, agrg, ok := parseMonitorRollupKey(rKey)
+    if !ok || parsed != mKey || res != 600 || agrg != monitorAggregateKeyMean {
+        t.Errorf("failed to parse %s: %s %d %s", rKey, parsed, res, agrg)
+    }
+}
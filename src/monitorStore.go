@@ -0,0 +1,334 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "sort"
+    "sync"
+)
+
+/*
+
+MonitorDataStore holds the in-memory monitor data and the indexes of the
+stored monitor data of every client. Each client has its own shard with its
+own lock, so that recording values for one client never waits on another
+client's data being stored or queried.
+
+Every accessor returns copies so that callers can read chunk files and
+aggregate data without holding any lock.
+
+*/
+
+type MonitorDataStore struct { // mdStore
+    mu     sync.RWMutex // Guards shards
+    shards map[string/* clId */] *monitorDataShard
+}
+
+type monitorDataShard struct {
+    mu         sync.RWMutex
+    dataMap    MonitorDataMap        // In-memory monitor data
+    indexesMap MonitorDataIndexesMap // Stored monitor data
+}
+
+func NewMonitorDataStore() *MonitorDataStore {
+    return &MonitorDataStore{
+        shards: make(map[string] *monitorDataShard),
+    }
+}
+
+func newMonitorDataShard() *monitorDataShard {
+    return &monitorDataShard{
+        dataMap:    make(MonitorDataMap),
+        indexesMap: make(MonitorDataIndexesMap),
+    }
+}
+
+// Returns the shard of the client, creating one when create is true
+func(mdStore *MonitorDataStore) shard(clId string, create bool) *monitorDataShard {
+
+    mdStore.mu.RLock()
+    sh, ok := mdStore.shards[clId]
+    mdStore.mu.RUnlock()
+
+    if ok || !create {
+        return sh
+    }
+
+    mdStore.mu.Lock()
+    defer mdStore.mu.Unlock()
+
+    // Check again since a shard could have been created
+    sh, ok = mdStore.shards[clId]
+    if !ok {
+        sh = newMonitorDataShard()
+        mdStore.shards[clId] = sh
+    }
+    return sh
+
+}
+
+func(mdStore *MonitorDataStore) ClientIds() []string {
+    mdStore.mu.RLock()
+    defer mdStore.mu.RUnlock()
+    ret := make([]string, 0, len(mdStore.shards))
+    for clId := range mdStore.shards {
+        ret = append(ret, clId)
+    }
+    sort.Strings(ret)
+    return ret
+}
+
+// Returns the monitor keys that have either stored or in-memory data
+func(mdStore *MonitorDataStore) Keys(clId string) ([]string, bool) {
+
+    sh := mdStore.shard(clId, false)
+    if sh == nil {
+        return nil, false
+    }
+
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
+
+    m := make(map[string] struct{})
+    for mKey := range sh.indexesMap {m[mKey] = struct{}{}}
+    for mKey := range sh.dataMap    {m[mKey] = struct{}{}}
+
+    ret := make([]string, 0, len(m))
+    for mKey := range m {ret = append(ret, mKey)}
+    sort.Strings(ret)
+    return ret, true
+
+}
+
+// Returns copies of the indexes and the in-memory data of the monitor key,
+// which are consistent with each other
+func(mdStore *MonitorDataStore) Snapshot(clId, mKey string) (MonitorDataIndexes, MonitorData) {
+
+    sh := mdStore.shard(clId, false)
+    if sh == nil {
+        return MonitorDataIndexes{}, MonitorData{}
+    }
+
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
+
+    indexes := make(MonitorDataIndexes, len(sh.indexesMap[mKey]))
+    copy(indexes, sh.indexesMap[mKey])
+    inMem   := make(MonitorData, len(sh.dataMap[mKey]))
+    copy(inMem, sh.dataMap[mKey])
+
+    return indexes, inMem
+
+}
+
+func(mdStore *MonitorDataStore) Indexes(clId, mKey string) MonitorDataIndexes {
+    indexes, _ := mdStore.Snapshot(clId, mKey)
+    return indexes
+}
+
+func(mdStore *MonitorDataStore) InMemory(clId, mKey string) MonitorData {
+    _, inMem := mdStore.Snapshot(clId, mKey)
+    return inMem
+}
+
+func(mdStore *MonitorDataStore) Length(clId, mKey string) int {
+
+    sh := mdStore.shard(clId, false)
+    if sh == nil {
+        return 0
+    }
+
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
+
+    sum := len(sh.dataMap[mKey])
+    for _, index := range sh.indexesMap[mKey] {
+        sum += index.Length
+    }
+    return sum
+
+}
+
+// Returns the timestamp of the latest datum of the monitor key, whether it is
+// in memory or stored
+func(mdStore *MonitorDataStore) LastTimestamp(clId, mKey string) (int64, bool) {
+
+    sh := mdStore.shard(clId, false)
+    if sh == nil {
+        return 0, false
+    }
+
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
+
+    if inMem := sh.dataMap[mKey]; len(inMem) > 0 {
+        return inMem[len(inMem) - 1].Timestamp, true
+    }
+    if indexes := sh.indexesMap[mKey]; len(indexes) > 0 {
+        return indexes[len(indexes) - 1].To, true
+    }
+    return 0, false
+
+}
+
+// Puts a datum in timestamp order, trimming the in-memory data to maxLength;
+// returns false when a datum with the same timestamp already exists
+func(mdStore *MonitorDataStore) Put(clId, mKey string, datum MonitorDatum, maxLength int) bool {
+
+    sh := mdStore.shard(clId, true)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    short := sh.dataMap[mKey]
+
+    // Trim Data
+    if maxLength > 0 && len(short) > maxLength {
+        // Get MaxLength - 1 items
+        start := len(short) - maxLength + 1
+        short  = short[start:]
+    }
+
+    if len(short) == 0 || short[len(short) - 1].Timestamp < datum.Timestamp {
+        sh.dataMap[mKey] = append(short, datum)
+        return true
+    }
+
+    // Backfilled data can arrive out of order or more than once
+    i := sort.Search(len(short), func(i int) bool {
+        return short[i].Timestamp >= datum.Timestamp
+    })
+    if short[i].Timestamp == datum.Timestamp {
+        sh.dataMap[mKey] = short
+        return false
+    }
+    short = append(short, MonitorDatum{})
+    copy(short[i + 1:], short[i:])
+    short[i] = datum
+    sh.dataMap[mKey] = short
+    return true
+
+}
+
+// Appends the indexes of newly stored chunks and removes the stored data from
+// the in-memory data; data that were put in the meantime are kept
+func(mdStore *MonitorDataStore) Persist(clId, mKey string, stored MonitorData, indexes MonitorDataIndexes) {
+    mdStore.persist(clId, mKey, stored, indexes, false)
+}
+
+// Replaces the indexes of the monitor key with those that include rewritten
+// chunks, and removes the stored data from the in-memory data
+func(mdStore *MonitorDataStore) PersistRewritten(clId, mKey string, stored MonitorData, indexes MonitorDataIndexes) {
+    mdStore.persist(clId, mKey, stored, indexes, true)
+}
+
+func(mdStore *MonitorDataStore) persist(clId, mKey string, stored MonitorData, indexes MonitorDataIndexes, replace bool) {
+
+    sh := mdStore.shard(clId, true)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    if replace {
+        sh.indexesMap[mKey] = MonitorDataIndexes{}.Append(indexes...)
+    } else {
+        sh.indexesMap[mKey] = sh.indexesMap[mKey].Append(indexes...)
+    }
+
+    if len(stored) == 0 {
+        return
+    }
+
+    isStored := make(map[int64] struct{}, len(stored))
+    for _, datum := range stored {
+        isStored[datum.Timestamp] = struct{}{}
+    }
+
+    inMem := sh.dataMap[mKey]
+    kept  := make(MonitorData, 0, len(inMem))
+    for _, datum := range inMem {
+        if _, ok := isStored[datum.Timestamp]; !ok {
+            kept = append(kept, datum)
+        }
+    }
+    sh.dataMap[mKey] = kept
+
+}
+
+// Replaces the indexes of a monitor key; the key is removed from the indexes
+// when there is none left
+func(mdStore *MonitorDataStore) SetIndexes(clId, mKey string, indexes MonitorDataIndexes) {
+    sh := mdStore.shard(clId, true)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    if len(indexes) == 0 {
+        delete(sh.indexesMap, mKey)
+        return
+    }
+    sh.indexesMap[mKey] = indexes
+}
+
+// Replaces the whole indexes of a client
+func(mdStore *MonitorDataStore) SetIndexesMap(clId string, mdIdxMap MonitorDataIndexesMap) {
+    sh := mdStore.shard(clId, true)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    if mdIdxMap == nil {
+        mdIdxMap = make(MonitorDataIndexesMap)
+    }
+    sh.indexesMap = mdIdxMap
+}
+
+// Returns copies of every in-memory data
+func(mdStore *MonitorDataStore) InMemoryMap() map[string/* clId */] MonitorDataMap {
+    ret := make(map[string] MonitorDataMap)
+    for _, clId := range mdStore.ClientIds() {
+        sh := mdStore.shard(clId, false)
+        sh.mu.RLock()
+        mdMap := make(MonitorDataMap, len(sh.dataMap))
+        for mKey, md := range sh.dataMap {
+            copied := make(MonitorData, len(md))
+            copy(copied, md)
+            mdMap[mKey] = copied
+        }
+        sh.mu.RUnlock()
+        ret[clId] = mdMap
+    }
+    return ret
+}
+
+// Returns copies of every index
+func(mdStore *MonitorDataStore) IndexesMap() map[string/* clId */] MonitorDataIndexesMap {
+    ret := make(map[string] MonitorDataIndexesMap)
+    for _, clId := range mdStore.ClientIds() {
+        sh := mdStore.shard(clId, false)
+        sh.mu.RLock()
+        mdIdxMap := make(MonitorDataIndexesMap, len(sh.indexesMap))
+        for mKey, indexes := range sh.indexesMap {
+            copied := make(MonitorDataIndexes, len(indexes))
+            copy(copied, indexes)
+            mdIdxMap[mKey] = copied
+        }
+        sh.mu.RUnlock()
+        ret[clId] = mdIdxMap
+    }
+    return ret
+}
+
+func(mdStore *MonitorDataStore) EncodeIndexes(w io.Writer) error {
+    return json.NewEncoder(w).Encode(mdStore.IndexesMap())
+}
+
+func(mdStore *MonitorDataStore) DecodeIndexes(r io.Reader) error {
+    clMdIdxMap := make(map[string] MonitorDataIndexesMap)
+    err := json.NewDecoder(r).Decode(&clMdIdxMap)
+    if err == io.EOF {
+        // Empty file
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    for clId, mdIdxMap := range clMdIdxMap {
+        mdStore.SetIndexesMap(clId, mdIdxMap)
+    }
+    return nil
+}
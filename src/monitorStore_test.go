@@ -0,0 +1,261 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sync"
+    "testing"
+    "./log"
+)
+
+// go test -race -run MonitorDataStore
+
+func TestMonitorDataStorePut(t *testing.T) {
+
+    mdStore := NewMonitorDataStore()
+    for _, ts := range []int64{10, 30, 20, 30, 5} {
+        mdStore.Put("cl", "key", MonitorDatum{ts, float64(ts), 5}, 0)
+    }
+
+    md := mdStore.InMemory("cl", "key")
+    expected := []int64{5, 10, 20, 30}
+    if len(md) != len(expected) {
+        t.Fatalf("expected %d data, got %v", len(expected), md)
+    }
+    for i, ts := range expected {
+        if md[i].Timestamp != ts {
+            t.Errorf("datum %d: expected %d, got %d", i, ts, md[i].Timestamp)
+        }
+    }
+
+    // Data put after taking a copy must survive persisting
+    stored := mdStore.InMemory("cl", "key")[:2]
+    mdStore.Put("cl", "key", MonitorDatum{40, 40, 5}, 0)
+    mdStore.Persist("cl", "key", stored, MonitorDataIndexes{CreateIndexForMonitorData(stored)})
+    if l := mdStore.Length("cl", "key"); l != 5 {
+        t.Errorf("expected length 5, got %d", l)
+    }
+    if md = mdStore.InMemory("cl", "key"); len(md) != 3 || md[0].Timestamp != 20 {
+        t.Errorf("unexpected in-memory data %v", md)
+    }
+
+}
+
+func t_newStoreTestServer(t *testing.T) (*Server, func()) {
+
+    EventLogger = &log.Logger{}
+
+    dir, err := ioutil.TempDir("", "telescribe-store")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    srv := NewServer()
+    srv.config = DefaultServerConfig
+    srv.config.DataStoreDir      = dir + "/store.d"
+    srv.config.ClientMetaDir     = dir + "/meta.d"
+    srv.config.DataIndexesDir    = dir + "/dataIndexes.d"
+    srv.config.DataIndexesFile   = dir + "/dataIndexes.json"
+    srv.config.RollupIndexesDir  = dir + "/rollupIndexes.d"
+    srv.config.RollupIndexesFile = dir + "/rollupIndexes.json"
+    srv.config.AlertStateFile    = dir + "/alertState.json"
+    srv.config.AlertHistoryFile  = dir + "/alertHistory.jsonl"
+    srv.config.DataChunkLength   = 50
+    srv.clientConfig = ClientConfig{
+        InfoMap: ClientInfoMap{},
+        RuleMap: ClientRuleMap{
+            "test": ClientRule{
+                MonitorConfigMap: MonitorConfigMap{
+                    "cpu-usage": MonitorConfig{},
+                    "load": MonitorConfig{},
+                },
+            },
+        },
+    }
+    for i := 0; i < 4; i++ {
+        srv.clientConfig.InfoMap[fmt.Sprintf("cl-%d", i)] = ClientInfo{Tags: "test"}
+    }
+
+    for _, d := range []string{srv.config.DataStoreDir, srv.config.ClientMetaDir} {
+        if err = EnsureDirectory(d); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    return srv, func() { os.RemoveAll(dir) }
+
+}
+
+// Records, stores, and queries concurrently
+func TestMonitorDataStoreConcurrency(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    const records = 400
+    clIds := srv.GetClientIds()
+
+    wg   := sync.WaitGroup{}
+    done := make(chan struct{})
+
+    // Recorders
+    for _, clId := range clIds {
+        wg.Add(1)
+        go func(clId string) {
+            defer wg.Done()
+            for ts := int64(1); ts <= records; ts++ {
+                srv.RecordValueMap(clId, ts, map[string] interface{}{
+                    "cpu-usage": float64(ts), "load": 1.0,
+                }, 1)
+            }
+        }(clId)
+    }
+
+    // Storer and queriers
+    background := sync.WaitGroup{}
+    background.Add(1)
+    go func() {
+        defer background.Done()
+        for {
+            select {
+            case <-done:
+                return
+            default:
+            }
+            if err := srv.StoreClientMonitorDataMap(false); err != nil {
+                t.Error(err)
+            }
+        }
+    }()
+    for _, clId := range clIds {
+        background.Add(1)
+        go func(clId string) {
+            defer background.Done()
+            for {
+                select {
+                case <-done:
+                    return
+                default:
+                }
+                mKeys, _ := srv.GetClientMonitorDataKeys(clId)
+                for _, mKey := range mKeys {
+                    srv.FprintClientMonitorDataCsvFilter(ioutil.Discard, clId, mKey, FprintCsvFilter{
+                        From: 0, To: records, Per: 10, Type: monitorAggregateKeyMean,
+                    })
+                    srv.FprintClientMonitorDataMinMax(ioutil.Discard, clId, mKey)
+                    length := srv.GetClientMonitorDataLength(clId, mKey)
+                    srv.GetClientMonitorDataSlice(clId, mKey, length - 10, length)
+                }
+            }
+        }(clId)
+    }
+
+    wg.Wait()
+    close(done)
+    background.Wait()
+
+    if err := srv.StoreClientMonitorDataMap(true); err != nil {
+        t.Fatal(err)
+    }
+
+    // Every record must be found exactly once and in order
+    for _, clId := range clIds {
+        length := srv.GetClientMonitorDataLength(clId, "cpu-usage")
+        if length != records {
+            t.Errorf("%s: expected %d records, got %d", clId, records, length)
+            continue
+        }
+        md := srv.GetClientMonitorDataSlice(clId, "cpu-usage", 0, length)
+        for i, datum := range md {
+            if datum.Timestamp != int64(i + 1) {
+                t.Errorf("%s: datum %d has timestamp %d", clId, i, datum.Timestamp)
+                break
+            }
+        }
+    }
+
+}
+
+// Backfilled data older than the stored data are merged into the chunks
+func TestMonitorDataStoreBackfill(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    record := func(timestamps ...int64) {
+        for _, ts := range timestamps {
+            srv.recordValueMap("cl-0", ts, map[string] interface{}{"load": float64(ts)}, 10)
+        }
+    }
+    series := func(from, to int64) []int64 {
+        ret := []int64{}
+        for ts := from; ts <= to; ts += 10 {
+            ret = append(ret, ts)
+        }
+        return ret
+    }
+    sorted := func(md MonitorData) bool {
+        for i := 1; i < len(md); i++ {
+            if md[i].Timestamp <= md[i - 1].Timestamp {
+                return false
+            }
+        }
+        return true
+    }
+
+    record(series(100, 190)...)
+    if err := srv.StoreClientMonitorDataMap(true); err != nil {
+        t.Fatal(err)
+    }
+    record(series(300, 390)...)
+    if err := srv.StoreClientMonitorDataMap(true); err != nil {
+        t.Fatal(err)
+    }
+    prior := srv.monitorDataStore.Indexes("cl-0", "load")
+
+    // Within the first chunk, between the chunks, a duplicate, within the
+    // second chunk, and a new one
+    record(105, 200, 210, 150, 305, 400)
+    md := getMonitorDataRange(srv.monitorDataStore, srv.config.DataStoreDir, "cl-0", "load", 0, 1000)
+    if len(md) != 25 || !sorted(md) {
+        t.Errorf("expected 25 sorted data before storing, got %v", md)
+    }
+
+    if err := srv.StoreClientMonitorDataMap(true); err != nil {
+        t.Fatal(err)
+    }
+    indexes := srv.monitorDataStore.Indexes("cl-0", "load")
+    // + From is the timestamp of the first datum minus its per
+    expected := [][2]int64{{90, 190}, {190, 210}, {290, 390}, {390, 400}}
+    if len(indexes) != len(expected) {
+        t.Fatalf("expected %d chunks, got %+v", len(expected), indexes)
+    }
+    for i, index := range indexes {
+        if index.From != expected[i][0] || index.To != expected[i][1] {
+            t.Errorf("chunk %d: expected %v, got %d-%d", i, expected[i], index.From, index.To)
+        }
+    }
+    md = getMonitorDataRange(srv.monitorDataStore, srv.config.DataStoreDir, "cl-0", "load", 0, 1000)
+    if len(md) != 25 || !sorted(md) {
+        t.Errorf("expected 25 sorted data, got %v", md)
+    }
+    if inMem := srv.monitorDataStore.InMemory("cl-0", "load"); len(inMem) != 0 {
+        t.Errorf("expected no in-memory data, got %v", inMem)
+    }
+
+    // The rewritten chunks are removed and the index files are rewritten
+    for _, index := range prior {
+        if _, err := os.Stat(monitorDataChunkPath(srv.config.DataStoreDir, index.Uuid)); !os.IsNotExist(err) {
+            t.Errorf("expected %s to be removed", index.Uuid)
+        }
+    }
+    reloaded := NewMonitorDataStore()
+    if err := readMonitorDataIndexes(reloaded, srv.config.DataIndexesDir, srv.config.DataIndexesFile); err != nil {
+        t.Fatal(err)
+    }
+    if got := reloaded.Indexes("cl-0", "load"); fmt.Sprint(got) != fmt.Sprint(indexes) {
+        t.Errorf("expected the reloaded indexes %+v, got %+v", indexes, got)
+    }
+
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    monitorWalDirName = "wal"
+    monitorWalExt     = ".wal"
+)
+
+/*
+
+The write-ahead log keeps every accepted monitor datum on disk until it is
+persisted into store chunks.
+
+Segments are named after their sequence numbers and only the latest segment is
+written to. At each storing cycle the log is checkpointed: a new segment is
+started, the data that still remain in memory are written to it, and the older
+segments are removed.
+
+<data store dir>/wal/<sequence>.wal
+
+Each entry is a byte series packet of | client id | monitor key | serialized datum |
+
+Appended entries are synced to the disk every sync interval, or by every call
+to Append when the interval is zero. A checkpoint syncs the new segment, and
+the directory, before it removes the older segments, which would otherwise be
+gone while the data rewritten into the new one were still in the page cache.
+
+*/
+
+type MonitorWal struct { // wal
+    mu           sync.Mutex
+    dir          string
+    seq          int64
+    f            *os.File
+    syncInterval time.Duration
+    dirty        bool // Appended since the last sync
+    closed       chan struct{}
+}
+
+type monitorWalEntry struct {
+    clId  string
+    mKey  string
+    datum MonitorDatum
+}
+
+func OpenMonitorWal(dir string, syncInterval time.Duration) (*MonitorWal, error) {
+
+    err := EnsureDirectory(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    wal := &MonitorWal{
+        dir:          dir,
+        syncInterval: syncInterval,
+        closed:       make(chan struct{}),
+    }
+    seqs, err := wal.segments()
+    if err != nil {
+        return nil, err
+    }
+    if len(seqs) > 0 {
+        wal.seq = seqs[len(seqs) - 1]
+    }
+
+    // Always start a new segment so that the existing ones can be replayed
+    err = wal.rotate()
+    if err != nil {
+        return nil, err
+    }
+
+    if syncInterval > 0 {
+        go func() {
+            tick := time.NewTicker(syncInterval)
+            defer tick.Stop()
+            for {
+                select {
+                case <-wal.closed:
+                    return
+                case <-tick.C:
+                }
+                if err := wal.Sync(); err != nil {
+                    EventLogger.Warnln("Failed to sync the write-ahead log:", err)
+                }
+            }
+        }()
+    }
+    return wal, nil
+
+}
+
+func(wal *MonitorWal) segmentPath(seq int64) string {
+    return filepath.Join(wal.dir, fmt.Sprintf("%016d%s", seq, monitorWalExt))
+}
+
+// Returns the sequence numbers of the segments in order
+func(wal *MonitorWal) segments() ([]int64, error) {
+
+    fis, err := ioutil.ReadDir(wal.dir)
+    if err != nil {
+        return nil, err
+    }
+
+    seqs := make([]int64, 0, len(fis))
+    for _, fi := range fis {
+        name := fi.Name()
+        if fi.IsDir() || !strings.HasSuffix(name, monitorWalExt) {
+            continue
+        }
+        seq, err := strconv.ParseInt(strings.TrimSuffix(name, monitorWalExt), 10, 64)
+        if err != nil {
+            continue
+        }
+        seqs = append(seqs, seq)
+    }
+
+    sort.Sort(Int64Slice(seqs))
+    return seqs, nil
+
+}
+
+// Starts a new segment; the caller must hold the lock unless the log is not shared yet
+func(wal *MonitorWal) rotate() error {
+
+    if wal.f != nil {
+        wal.f.Close()
+        wal.f = nil
+    }
+
+    wal.seq++
+    f, err := os.OpenFile(wal.segmentPath(wal.seq), os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0600)
+    if err != nil {
+        return err
+    }
+    wal.f = f
+    return nil
+
+}
+
+func(wal *MonitorWal) Append(entries []monitorWalEntry) error {
+
+    if len(entries) == 0 {
+        return nil
+    }
+
+    buf := bytes.NewBuffer(nil)
+    for _, ent := range entries {
+        err := writeByteSeriesPacket(buf, [][]byte{
+            []byte(ent.clId), []byte(ent.mKey), SerializeMonitorData(MonitorData{ent.datum}),
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    // An entire call is written at once so that entries are never interleaved
+    wal.mu.Lock()
+    defer wal.mu.Unlock()
+
+    if wal.f == nil {
+        return fmt.Errorf("The write-ahead log is closed")
+    }
+    _, err := wal.f.Write(buf.Bytes())
+    if err != nil {
+        return err
+    }
+    wal.dirty = true
+    if wal.syncInterval <= 0 {
+        return wal.sync()
+    }
+    return nil
+
+}
+
+// Syncs the entries appended since the last sync to the disk
+func(wal *MonitorWal) Sync() error {
+    wal.mu.Lock()
+    defer wal.mu.Unlock()
+    return wal.sync()
+}
+
+// The caller must hold the lock
+func(wal *MonitorWal) sync() error {
+    if wal.f == nil || !wal.dirty {
+        return nil
+    }
+    err := wal.f.Sync()
+    if err == nil {
+        wal.dirty = false
+    }
+    return err
+}
+
+// Calls fn for every entry of the segments that precede the current one
+func(wal *MonitorWal) Replay(fn func(clId, mKey string, datum MonitorDatum)) error {
+
+    wal.mu.Lock()
+    current := wal.seq
+    wal.mu.Unlock()
+
+    seqs, err := wal.segments()
+    if err != nil {
+        return err
+    }
+
+    for _, seq := range seqs {
+        if seq >= current {
+            break
+        }
+        err = wal.replaySegment(wal.segmentPath(seq), fn)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+
+}
+
+func(wal *MonitorWal) replaySegment(fn string, cb func(clId, mKey string, datum MonitorDatum)) error {
+
+    f, err := os.Open(fn)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    rd := bufio.NewReader(f)
+    for {
+
+        // A torn entry at the end is the result of a crash while writing
+        if _, err := rd.Peek(1); err == io.EOF {
+            return nil
+        }
+        p, err := readNextPacket(rd)
+        if err != nil {
+            EventLogger.Warnln("Ignoring a torn write-ahead log entry in", fn)
+            return nil
+        }
+
+        prd := bytes.NewReader(p)
+        clId, err1 := readNextPacket(prd)
+        mKey, err2 := readNextPacket(prd)
+        serial, err3 := readNextPacket(prd)
+        if err1 != nil || err2 != nil || err3 != nil {
+            EventLogger.Warnln("Ignoring a malformed write-ahead log entry in", fn)
+            continue
+        }
+        md, err := DeserializeMonitorData(serial)
+        if err != nil || len(md) != 1 {
+            EventLogger.Warnln("Ignoring a malformed write-ahead log datum in", fn)
+            continue
+        }
+
+        cb(string(clId), string(mKey), md[0])
+
+    }
+
+}
+
+// Starts a new segment, writes the data that are not persisted yet to it, and
+// removes the older segments; snapshot is called after the new segment is
+// started so that no datum appended in the meantime is lost
+func(wal *MonitorWal) Checkpoint(snapshot func() map[string] MonitorDataMap) error {
+
+    wal.mu.Lock()
+    err := wal.rotate()
+    current := wal.seq
+    wal.mu.Unlock()
+    if err != nil {
+        return err
+    }
+
+    // Remaining data
+    entries := []monitorWalEntry{}
+    for clId, mdMap := range snapshot() {
+        for mKey, md := range mdMap {
+            for _, datum := range md {
+                entries = append(entries, monitorWalEntry{clId, mKey, datum})
+            }
+        }
+    }
+    err = wal.Append(entries)
+    if err != nil {
+        return err
+    }
+
+    // The new segment must be on the disk before the older ones are gone
+    wal.mu.Lock()
+    wal.dirty = true
+    err = wal.sync()
+    wal.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    err = syncDirectory(wal.dir)
+    if err != nil {
+        return err
+    }
+
+    // Truncate
+    seqs, err := wal.segments()
+    if err != nil {
+        return err
+    }
+    for _, seq := range seqs {
+        if seq >= current {
+            break
+        }
+        err = os.Remove(wal.segmentPath(seq))
+        if err != nil {
+            return err
+        }
+    }
+
+    return syncDirectory(wal.dir)
+
+}
+
+func(wal *MonitorWal) Close() error {
+    wal.mu.Lock()
+    defer wal.mu.Unlock()
+    if wal.f == nil {
+        return nil
+    }
+    close(wal.closed)
+    err := wal.sync()
+    if cerr := wal.f.Close(); err == nil {
+        err = cerr
+    }
+    wal.f = nil
+    return err
+}
+
+// Syncs the entries of the directory, such as created and removed files
+func syncDirectory(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
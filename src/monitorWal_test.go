@@ -0,0 +1,157 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "testing"
+    "time"
+)
+
+func TestMonitorWalReplay(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    if err := srv.replayMonitorWal(); err != nil {
+        t.Fatal(err)
+    }
+
+    // Half of the data are stored in chunks
+    for ts := int64(1); ts <= 100; ts++ {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{"load": float64(ts)}, 1)
+    }
+    if err := srv.StoreClientMonitorDataMap(false); err != nil {
+        t.Fatal(err)
+    }
+    for ts := int64(101); ts <= 120; ts++ {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{"load": float64(ts)}, 1)
+    }
+    expected := srv.GetClientMonitorDataLength("cl-0", "load")
+
+    // The process ends without storing the rest
+    srv.monitorWal.Close()
+
+    restarted := NewServer()
+    restarted.config       = srv.config
+    restarted.clientConfig = srv.clientConfig
+    if err := restarted.readClientMonitorIndexesMap(); err != nil {
+        t.Fatal(err)
+    }
+    if err := restarted.replayMonitorWal(); err != nil {
+        t.Fatal(err)
+    }
+    defer restarted.monitorWal.Close()
+
+    length := restarted.GetClientMonitorDataLength("cl-0", "load")
+    if length != expected {
+        t.Fatalf("expected %d data after replay, got %d", expected, length)
+    }
+    md := restarted.GetClientMonitorDataSlice("cl-0", "load", 0, length)
+    for i, datum := range md {
+        if datum.Timestamp != int64(i + 1) || datum.Value != float64(i + 1) {
+            t.Fatalf("datum %d is %v", i, datum)
+        }
+    }
+
+    // Replaying must leave a single segment
+    fis, err := ioutil.ReadDir(restarted.monitorWal.dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(fis) != 1 {
+        t.Errorf("expected 1 segment, got %d", len(fis))
+    }
+
+}
+
+func TestMonitorWalTornEntry(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    wal, err := OpenMonitorWal(srv.config.DataStoreDir + "/wal", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    wal.Append([]monitorWalEntry{
+        {"cl-0", "load", MonitorDatum{1, 1, 1}},
+        {"cl-0", "load", MonitorDatum{2, 2, 1}},
+    })
+    fn := wal.segmentPath(wal.seq)
+    wal.Close()
+
+    // Cut the last entry in half
+    fi, err := os.Stat(fn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = os.Truncate(fn, fi.Size() - 3); err != nil {
+        t.Fatal(err)
+    }
+
+    wal, err = OpenMonitorWal(srv.config.DataStoreDir + "/wal", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer wal.Close()
+
+    replayed := []MonitorDatum{}
+    err = wal.Replay(func(clId, mKey string, datum MonitorDatum) {
+        replayed = append(replayed, datum)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(replayed) != 1 || replayed[0].Timestamp != 1 {
+        t.Errorf("expected only the first datum, got %v", replayed)
+    }
+
+}
+
+func TestMonitorWalSync(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    entries := []monitorWalEntry{{"cl-0", "load", MonitorDatum{1, 1, 1}}}
+    dirtyOf := func(wal *MonitorWal) bool {
+        wal.mu.Lock()
+        defer wal.mu.Unlock()
+        return wal.dirty
+    }
+
+    // Every call
+    wal, err := OpenMonitorWal(srv.config.DataStoreDir + "/wal", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = wal.Append(entries); err != nil || dirtyOf(wal) {
+        t.Errorf("Expected the entries to be synced, got %v %v", dirtyOf(wal), err)
+    }
+    wal.Close()
+
+    // Every interval
+    wal, err = OpenMonitorWal(srv.config.DataStoreDir + "/wal", 10 * time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer wal.Close()
+    if err = wal.Append(entries); err != nil || !dirtyOf(wal) {
+        t.Errorf("Expected the entries to wait for the interval, got %v %v", dirtyOf(wal), err)
+    }
+    deadline := time.Now().Add(time.Second)
+    for dirtyOf(wal) && time.Now().Before(deadline) {
+        time.Sleep(5 * time.Millisecond)
+    }
+    if dirtyOf(wal) {
+        t.Error("Expected the entries to be synced within the interval")
+    }
+
+    // The checkpoint syncs the new segment
+    if err = wal.Checkpoint(func() map[string] MonitorDataMap {
+        return map[string] MonitorDataMap{"cl-0": {"load": MonitorData{{2, 2, 1}}}}
+    }); err != nil || dirtyOf(wal) {
+        t.Errorf("Expected the checkpoint to be synced, got %v %v", dirtyOf(wal), err)
+    }
+
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+    "math"
+    "sort"
+    "sync"
+)
+
+/*
+
+monitorWindowStore keeps the recent data of the monitor keys that are judged
+over windows, so that judging a recorded value never reads chunk files. The
+window of a key is created and loaded from the monitor data store when it is
+first asked for, widened by loading again when a longer window is asked for,
+and afterwards kept up by the recorded values, dropping the data that fall out
+of the longest window asked for.
+
+*/
+
+type monitorWindowStore struct { // ws
+    mu      sync.Mutex // Guards windows
+    windows map[[2]string/* clId, mKey */] *monitorWindow
+}
+
+type monitorWindow struct {
+    mu   sync.Mutex
+    span int64       // Seconds kept up to the last datum
+    data MonitorData // In timestamp order
+}
+
+func newMonitorWindowStore() *monitorWindowStore {
+    return &monitorWindowStore{
+        windows: make(map[[2]string] *monitorWindow),
+    }
+}
+
+// Returns the window of the key, creating one when create is true
+func(ws *monitorWindowStore) window(clId, mKey string, create bool) *monitorWindow {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    w, ok := ws.windows[[2]string{clId, mKey}]
+    if !ok && create {
+        w = &monitorWindow{}
+        ws.windows[[2]string{clId, mKey}] = w
+    }
+    return w
+}
+
+// Puts a recorded datum in the window of the key, if any
+func(ws *monitorWindowStore) Put(clId, mKey string, datum MonitorDatum) {
+
+    w := ws.window(clId, mKey, false)
+    if w == nil {
+        return
+    }
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    n := len(w.data)
+    i := sort.Search(n, func(i int) bool {
+        return w.data[i].Timestamp >= datum.Timestamp
+    })
+    switch {
+    case i < n && w.data[i].Timestamp == datum.Timestamp:
+        // Loaded already
+        return
+    case i == n:
+        w.data = append(w.data, datum)
+    default:
+        // Backfilled
+        w.data = append(w.data, MonitorDatum{})
+        copy(w.data[i + 1:], w.data[i:])
+        w.data[i] = datum
+    }
+    w.trim()
+
+}
+
+// Returns the data of the key within (to - sec, to]; load returns the data
+// within [from, to] when the window does not hold them
+func(ws *monitorWindowStore) Range(
+    clId, mKey string, sec, to int64, load func(from, to int64) MonitorData,
+) MonitorData {
+
+    w := ws.window(clId, mKey, true)
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    latest := to
+    if n := len(w.data); n > 0 && w.data[n - 1].Timestamp > latest {
+        latest = w.data[n - 1].Timestamp
+    }
+    if sec > w.span {
+        w.data = load(latest - sec + 1, math.MaxInt64)
+        w.span = sec
+        w.trim()
+    }
+    if to - sec < latest - w.span {
+        // Older than the window
+        return load(to - sec + 1, to)
+    }
+
+    i := sort.Search(len(w.data), func(i int) bool {
+        return w.data[i].Timestamp > to - sec
+    })
+    j := sort.Search(len(w.data), func(j int) bool {
+        return w.data[j].Timestamp > to
+    })
+    return append(MonitorData{}, w.data[i:j]...)
+
+}
+
+// Drops the data that fall out of the span
+func(w *monitorWindow) trim() {
+    n := len(w.data)
+    if n == 0 {
+        return
+    }
+    since := w.data[n - 1].Timestamp - w.span
+    i := sort.Search(n, func(i int) bool {
+        return w.data[i].Timestamp > since
+    })
+    w.data = w.data[i:]
+}
+
+// Returns the data of the key within (to - sec, to] from its window
+func(srv *Server) getMonitorDataRecent(clId, mKey string, sec, to int64) MonitorData {
+    return srv.monitorWindows.Range(clId, mKey, sec, to, func(from, to int64) MonitorData {
+        return getMonitorDataRange(srv.monitorDataStore, srv.config.DataStoreDir, clId, mKey, from, to)
+    })
+}
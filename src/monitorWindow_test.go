@@ -0,0 +1,62 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestMonitorWindowStore(t *testing.T) {
+
+    ws     := newMonitorWindowStore()
+    stored := MonitorData{}
+    loads  := 0
+    load   := func(from, to int64) MonitorData {
+        loads++
+        ret := MonitorData{}
+        for _, datum := range stored {
+            if datum.Timestamp >= from && datum.Timestamp <= to {
+                ret = append(ret, datum)
+            }
+        }
+        return ret
+    }
+    record := func(ts int64) {
+        datum := MonitorDatum{ts, float64(ts), 60}
+        stored = append(stored, datum)
+        ws.Put("cl-0", "load", datum)
+    }
+
+    // Not asked for yet
+    for ts := int64(60); ts <= 600; ts += 60 {
+        record(ts)
+    }
+    if md := ws.Range("cl-0", "load", 180, 600, load); len(md) != 3 || md[0].Timestamp != 480 || loads != 1 {
+        t.Fatalf("Expected 3 data from 480 by a load, got %v %d", md, loads)
+    }
+
+    // Kept up by the recorded values
+    for ts := int64(660); ts <= 900; ts += 60 {
+        record(ts)
+    }
+    if md := ws.Range("cl-0", "load", 180, 900, load); len(md) != 3 || md[0].Timestamp != 780 || loads != 1 {
+        t.Errorf("Expected 3 data from 780 without a load, got %v %d", md, loads)
+    }
+    if w := ws.window("cl-0", "load", false); len(w.data) != 3 {
+        t.Errorf("Expected the window to be trimmed, got %v", w.data)
+    }
+
+    // Backfilled and duplicated
+    ws.Put("cl-0", "load", MonitorDatum{870, -1, 30})
+    ws.Put("cl-0", "load", MonitorDatum{900, -1, 60})
+    if md := ws.Range("cl-0", "load", 60, 900, load); len(md) != 2 || md[0].Value != -1 || md[1].Value != 900 {
+        t.Errorf("Expected the backfilled datum, got %v", md)
+    }
+
+    // Widened, and older than the window
+    if md := ws.Range("cl-0", "load", 600, 900, load); len(md) != 10 || loads != 2 {
+        t.Errorf("Expected 10 data by another load, got %v %d", md, loads)
+    }
+    if md := ws.Range("cl-0", "load", 120, 240, load); len(md) != 2 || md[0].Timestamp != 180 || loads != 3 {
+        t.Errorf("Expected 2 data from 180 by a load, got %v %d", md, loads)
+    }
+
+}
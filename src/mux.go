@@ -0,0 +1,231 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "net"
+    "sync"
+    "time"
+)
+
+const (
+    muxTlsRecordHandshake = 0x16
+    muxMaxStartLine       = 4096
+    muxMaxThrottleWait    = time.Second // The connections behind it are closed
+    muxThrottlePruneSize  = 1024 // Hosts remembered before pruning
+)
+
+var errConnListenerClosed = errors.New("The listener is closed")
+
+/*
+
+The main listener serves both the clients and the HTTP users on the same port.
+The first bytes of each accepted connection are sniffed without being consumed:
+
+0x16 ...                       A TLS handshake, which is HTTPS
+GET / HTTP/1.1                 HTTP
+... TELESCRIBE ...             A session of a client
+
+The connection is then handed over as it is, with the sniffed bytes still to be
+read, either to the HTTP server through a connListener, or to HandleSession.
+Thus the HTTP server sees the remote addresses of the users, and serves TLS
+itself when http.certFilePath and http.keyFilePath are set; plain HTTP is then
+handed to a server of its own, which redirects GET and HEAD requests to HTTPS
+and answers the others with 400.
+
+Accepting is never delayed; instead, the connections of each remote host are
+spaced by 1 / network.tickrate seconds before being sniffed, and the ones that
+would wait longer than a second are closed, so that a host opening connections
+rapidly holds back only itself.
+
+*/
+
+// A net.Listener whose connections are handed over by the main listener
+type connListener struct {
+    addr   net.Addr
+    conns  chan net.Conn
+    closed chan struct{}
+    once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+    return &connListener{
+        addr:   addr,
+        conns:  make(chan net.Conn),
+        closed: make(chan struct{}),
+    }
+}
+
+func(cl *connListener) Accept() (net.Conn, error) {
+    select {
+    case conn := <-cl.conns:
+        return conn, nil
+    case <-cl.closed:
+        return nil, errConnListenerClosed
+    }
+}
+
+func(cl *connListener) Close() error {
+    cl.once.Do(func() { close(cl.closed) })
+    return nil
+}
+
+func(cl *connListener) Addr() net.Addr {
+    return cl.addr
+}
+
+// Hands over the connection, or closes it if the listener is closed
+func(cl *connListener) Deliver(conn net.Conn) {
+    select {
+    case cl.conns <- conn:
+    case <-cl.closed:
+        conn.Close()
+    }
+}
+
+// Spaces the connections of each remote host by the interval
+type hostThrottle struct {
+    mu       sync.Mutex
+    interval time.Duration
+    next     map[string/* host */] time.Time
+}
+
+func newHostThrottle(interval time.Duration) *hostThrottle {
+    return &hostThrottle{
+        interval: interval,
+        next:     make(map[string] time.Time),
+    }
+}
+
+// Returns how long a connection of the host must wait from now, and false if
+// it would wait longer than muxMaxThrottleWait
+func(ht *hostThrottle) Reserve(host string, now time.Time) (time.Duration, bool) {
+
+    ht.mu.Lock()
+    defer ht.mu.Unlock()
+
+    // Forget the hosts that are no longer throttled
+    if len(ht.next) >= muxThrottlePruneSize {
+        for h, next := range ht.next {
+            if !next.After(now) {
+                delete(ht.next, h)
+            }
+        }
+    }
+
+    next, ok := ht.next[host]
+    if !ok || next.Before(now) {
+        next = now
+    }
+    wait := next.Sub(now)
+    if wait > muxMaxThrottleWait {
+        return 0, false
+    }
+    ht.next[host] = next.Add(ht.interval)
+    return wait, true
+
+}
+
+// A connection whose sniffed bytes are read first
+type sniffedConn struct {
+    net.Conn
+    rd *bufio.Reader
+}
+
+func(sc *sniffedConn) Read(p []byte) (int, error) {
+    return sc.rd.Read(p)
+}
+
+// Returns the connection with the start line of it, or with the first byte of
+// it if it is TLS
+func sniffConn(conn net.Conn, timeout time.Duration) (*sniffedConn, []byte, error) {
+
+    sc := &sniffedConn{conn, bufio.NewReaderSize(conn, muxMaxStartLine)}
+    conn.SetReadDeadline(time.Now().Add(timeout))
+    defer conn.SetReadDeadline(time.Time{})
+
+    first, err := sc.rd.Peek(1)
+    if err != nil {
+        return nil, nil, err
+    }
+    if first[0] == muxTlsRecordHandshake {
+        return sc, first, nil
+    }
+
+    // Peek more as the bytes arrive until the end of the line
+    for n := 1; n <= muxMaxStartLine; n++ {
+        p, err := sc.rd.Peek(n)
+        if err != nil {
+            return nil, nil, err
+        }
+        if p[n - 1] == '\n' {
+            return sc, p, nil
+        }
+    }
+    return nil, nil, errors.New("The start line is too long")
+
+}
+
+// Serves a connection of the main listener, which is either HTTP, HTTPS, or
+// TELESCRIBE
+func(srv *Server) serveConn(conn net.Conn) {
+
+    host, _ := HostnameOf(conn)
+    defer func() {
+        if r := recover(); r != nil {
+            EventLogger.Warnln(host, r)
+            conn.Close()
+        }
+    }()
+
+    wait, ok := srv.connThrottle.Reserve(host, time.Now())
+    if !ok {
+        EventLogger.Warnln(host, "opened connections too rapidly")
+        conn.Close()
+        return
+    }
+    time.Sleep(wait)
+
+    timeout := time.Second * time.Duration(srv.config.IdleTimeout)
+    sc, sniffed, err := sniffConn(conn, timeout)
+    if err != nil {
+        conn.Close()
+        return
+    }
+
+    tlsEnabled := srv.httpTlsConfig != nil
+    switch {
+    case sniffed[0] == muxTlsRecordHandshake:
+
+        // HTTPS
+        if !tlsEnabled {
+            EventLogger.Warnln(host, "attempted TLS while the certificate is not configured")
+            conn.Close()
+            return
+        }
+        srv.httpListener.Deliver(sc)
+
+    case bytes.Contains(sniffed, []byte("HTTP")):
+
+        // HTTP
+        if tlsEnabled {
+            srv.plainHttpListener.Deliver(sc)
+            return
+        }
+        srv.httpListener.Deliver(sc)
+
+    case bytes.Contains(sniffed, []byte("TELESCRIBE")):
+
+        // TELESCRIBE
+        s := NewSession(sc)
+        defer s.Close()
+        if err := srv.HandleSession(s); err != nil {
+            EventLogger.Warnln(host, err)
+        }
+
+    default:
+        conn.Close()
+    }
+
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "./log"
+)
+
+func TestSniffConn(t *testing.T) {
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+
+    for _, c := range []struct {
+        input   string
+        sniffed string
+        ok      bool
+    }{
+        {"GET / HTTP/1.1\r\nHost: a\r\n\r\n", "GET / HTTP/1.1\r\n", true},
+        {"\x16\x03\x01\x00\x05hello", "\x16", true},
+        {strings.Repeat("a", muxMaxStartLine + 1), "", false},
+    } {
+
+        client, err := net.Dial("tcp", ln.Addr().String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        conn, err := ln.Accept()
+        if err != nil {
+            t.Fatal(err)
+        }
+        go func() {
+            client.Write([]byte(c.input))
+            client.Close()
+        }()
+
+        sc, sniffed, err := sniffConn(conn, time.Second)
+        switch {
+        case !c.ok:
+            if err == nil {
+                t.Errorf("%q: expected an error", c.input)
+            }
+        case err != nil || string(sniffed) != c.sniffed:
+            t.Errorf("%q: unexpected %q %v", c.input, sniffed, err)
+        default:
+            // The sniffed bytes are read again
+            p, _ := ioutil.ReadAll(sc)
+            if string(p) != c.input {
+                t.Errorf("%q: read %q", c.input, p)
+            }
+            if sc.RemoteAddr().String() != client.LocalAddr().String() {
+                t.Errorf("unexpected remote address %s", sc.RemoteAddr())
+            }
+        }
+        conn.Close()
+
+    }
+
+}
+
+func TestHostThrottle(t *testing.T) {
+
+    ht  := newHostThrottle(300 * time.Millisecond)
+    now := time.Unix(1000, 0)
+    for i, expected := range []time.Duration{0, 300, 600, 900} {
+        wait, ok := ht.Reserve("10.0.0.1", now)
+        if !ok || wait != expected * time.Millisecond {
+            t.Errorf("%d: expected %v, got %v %v", i, expected, wait, ok)
+        }
+    }
+    // More than a second behind
+    if _, ok := ht.Reserve("10.0.0.1", now); ok {
+        t.Error("expected the connection to be refused")
+    }
+    // The others are not held back
+    if wait, ok := ht.Reserve("10.0.0.2", now); !ok || wait != 0 {
+        t.Errorf("unexpected %v %v", wait, ok)
+    }
+    // Caught up
+    if wait, ok := ht.Reserve("10.0.0.1", now.Add(2 * time.Second)); !ok || wait != 0 {
+        t.Errorf("unexpected %v %v", wait, ok)
+    }
+
+}
+
+func t_writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string) {
+
+    priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "127.0.0.1"},
+        IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDer, err := x509.MarshalECPrivateKey(priv)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    certFile = filepath.Join(dir, "cert.pem")
+    keyFile  = filepath.Join(dir, "key.pem")
+    ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+    return
+
+}
+
+func TestServeConnTls(t *testing.T) {
+
+    EventLogger  = &log.Logger{}
+    AccessLogger = &log.Logger{}
+
+    dir, err := ioutil.TempDir("", "telescribe-mux")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    srv := NewServer()
+    srv.config = DefaultServerConfig
+    srv.config.HttpCertFilePath, srv.config.HttpKeyFilePath = t_writeSelfSignedCert(t, dir)
+    if err = srv.loadHttpTlsConfig(); err != nil {
+        t.Fatal(err)
+    }
+    srv.config.HttpUsers = []HttpUser{{
+        Name:        "user",
+        Password:    fmt.Sprintf("%x", Sha256Sum([]byte("password"))),
+        Permissions: []string{"*"},
+    }}
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    srv.httpListener = newConnListener(ln.Addr())
+    defer srv.httpListener.Close()
+    srv.plainHttpListener = newConnListener(ln.Addr())
+    defer srv.plainHttpListener.Close()
+    srv.connThrottle = newHostThrottle(time.Second / time.Duration(srv.config.Tickrate))
+    httpStopped := make(chan struct{})
+    go func() {
+        srv.startHttpServer()
+        close(httpStopped)
+    }()
+    defer func() {
+        srv.httpListener.Close()
+        <-httpStopped
+    }()
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go srv.serveConn(conn)
+        }
+    }()
+
+    client := &http.Client{
+        Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+        Timeout:   5 * time.Second,
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    request := func(method, scheme string) *http.Response {
+        req, _ := http.NewRequest(method, scheme + "://" + ln.Addr().String() + "/api/v1/version?a=1", nil)
+        req.SetBasicAuth("user", "password")
+        rsp, err := client.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        rsp.Body.Close()
+        return rsp
+    }
+
+    if rsp := request("GET", "https"); rsp.StatusCode != 200 {
+        t.Errorf("https: unexpected status %d", rsp.StatusCode)
+    }
+    // Plain HTTP is redirected to HTTPS
+    expected := "https://" + ln.Addr().String() + "/api/v1/version?a=1"
+    if rsp := request("GET", "http"); rsp.StatusCode != 308 || rsp.Header.Get("Location") != expected {
+        t.Errorf("http: unexpected response %d %s", rsp.StatusCode, rsp.Header.Get("Location"))
+    }
+    if rsp := request("POST", "http"); rsp.StatusCode != 400 {
+        t.Errorf("http: unexpected status %d", rsp.StatusCode)
+    }
+
+}
+
+func TestHttpServerStopped(t *testing.T) {
+
+    EventLogger = &log.Logger{}
+
+    srv := NewServer()
+    srv.config = DefaultServerConfig
+    srv.config.HttpCertFilePath = "/nonexistent/cert.pem"
+    srv.config.HttpKeyFilePath  = "/nonexistent/key.pem"
+    if err := srv.loadHttpTlsConfig(); err == nil {
+        t.Error("Expected the missing key pair to fail")
+    }
+
+    // A TLS server without certificates fails before serving
+    addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+    srv.httpListener      = newConnListener(addr)
+    srv.plainHttpListener = newConnListener(addr)
+    srv.httpTlsConfig     = &tls.Config{}
+    if err := srv.startHttpServer(); err == nil {
+        t.Fatal("Expected the server to fail")
+    }
+
+    // Later connections are closed rather than left waiting
+    for _, cl := range []*connListener{srv.httpListener, srv.plainHttpListener} {
+        local, remote := net.Pipe()
+        done := make(chan struct{})
+        go func() {
+            cl.Deliver(local)
+            close(done)
+        }()
+        select {
+        case <-done:
+        case <-time.After(time.Second):
+            t.Fatal("Expected the connection not to wait")
+        }
+        remote.SetReadDeadline(time.Now().Add(time.Second))
+        if _, err := remote.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+            t.Errorf("Expected the connection to be closed, got %v", err)
+        }
+    }
+
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/smtp"
+    "os/exec"
+    "strings"
+    "sync"
+    "text/template"
+    "time"
+)
+
+const (
+    NotifierTypeWebhook = "webhook"
+    NotifierTypeSlack   = "slack"
+    NotifierTypeSmtp    = "smtp"
+    NotifierTypeExec    = "exec"
+
+    notifierLegacyWebhookName = "alarm.webhookUrl"
+    notifierTimeout           = 30 * time.Second
+)
+
+/*
+
+The notifier delivers alert events to the channels in alert.channels:
+
+webhook     Posts the body to the url with the headers; the body is the json of
+            the event by default
+slack       Posts {"text": <body>} to the url of an incoming webhook, which
+            Slack and Mattermost accept alike
+smtp        Mails the body with the subject to the recipients through the SMTP
+            server at smtp.addr
+exec        Runs the command with the body as its standard input
+
+The body and the subject are text/templates executed with the event, and json
+renders its argument as json, e.g., {"alert": {{json .Summary}}}.
+
+Each event goes to the channels of every route in alert.routes that matches
+it, until a matching route whose continue is false. Every event goes to every
+channel when there are no routes. alarm.webhookUrl, if set, is a webhook
+channel that every event goes to regardless of the routes.
+
+A failed delivery is retried alert.retries times, waiting alert.retryBackoff
+seconds before the first retry and twice as long before each next one. The
+deliveries are made concurrently, so that a slow channel does not hold back
+the others.
+The outcome of each delivery is appended to the alert history.
+
+*/
+
+type NotifierChannel struct {
+    Name         string             `json:"name"`
+    Type         string             `json:"type"`
+    Url          string             `json:"url"` // Webhook and slack
+    Headers      map[string] string `json:"headers"` // Webhook
+    Body         string             `json:"body"`
+    Subject      string             `json:"subject"` // Smtp
+    SmtpAddr     string             `json:"smtp.addr"` // host:port
+    SmtpUsername string             `json:"smtp.username"`
+    SmtpPassword string             `json:"smtp.password"`
+    SmtpFrom     string             `json:"smtp.from"`
+    SmtpTo       []string           `json:"smtp.to"`
+    Command      []string           `json:"command"` // Exec
+}
+
+var DefaultNotifierChannel = NotifierChannel{
+    Headers: map[string] string{},
+    Body:    "",
+    Subject: "[{{.Severity}}] {{.Summary}} ({{.Status}})",
+    SmtpTo:  []string{},
+    Command: []string{},
+}
+
+type NotifierRoute struct {
+    Tags     string   `json:"tags"` // Any of the tags of the client; empty for all
+    Key      string   `json:"key"` // The pattern of monitor keys; empty for all
+    Rule     string   `json:"rule"` // The pattern of alert rules; empty for all
+    Severity string   `json:"severity"` // Empty for all
+    Channels []string `json:"channels"`
+    Continue bool     `json:"continue"`
+}
+
+var DefaultNotifierRoute = NotifierRoute{
+    Channels: []string{},
+}
+
+// Returns the default body of the channel type
+func(ch NotifierChannel) body() string {
+    switch {
+    case ch.Body != "":
+        return ch.Body
+    case ch.Type == NotifierTypeSlack, ch.Type == NotifierTypeSmtp:
+        return "[{{.Severity}}] {{.Summary}} ({{.Status}})"
+    }
+    return "{{json .}}"
+}
+
+func(ch NotifierChannel) Validate() error {
+
+    if ch.Name == "" {
+        return fmt.Errorf("A notifier channel must have a name")
+    }
+    switch ch.Type {
+    case NotifierTypeWebhook, NotifierTypeSlack:
+        if ch.Url == "" {
+            return fmt.Errorf("Notifier channel %s must have a url", ch.Name)
+        }
+    case NotifierTypeSmtp:
+        if ch.SmtpAddr == "" || ch.SmtpFrom == "" || len(ch.SmtpTo) == 0 {
+            return fmt.Errorf("Notifier channel %s must have smtp.addr, smtp.from, and smtp.to", ch.Name)
+        }
+    case NotifierTypeExec:
+        if len(ch.Command) == 0 {
+            return fmt.Errorf("Notifier channel %s must have a command", ch.Name)
+        }
+    default:
+        return fmt.Errorf("Notifier channel %s has an unknown type %q", ch.Name, ch.Type)
+    }
+    for _, text := range []string{ch.body(), ch.Subject} {
+        if _, err := parseNotifierTemplate(text); err != nil {
+            return fmt.Errorf("Notifier channel %s: %v", ch.Name, err)
+        }
+    }
+    return nil
+
+}
+
+func(rt NotifierRoute) matches(ev alertEvent, clTags string) bool {
+
+    if rt.Tags != "" {
+        found := false
+        for _, tag := range SplitWhitespace(rt.Tags) {
+            for _, clTag := range SplitWhitespace(clTags) {
+                found = found || tag == clTag
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    switch {
+    case rt.Key != "" && !matchQueryPattern(rt.Key, ev.Key),
+        rt.Rule != "" && !matchQueryPattern(rt.Rule, ev.Rule),
+        rt.Severity != "" && rt.Severity != ev.Severity:
+        return false
+    }
+    return true
+
+}
+
+var notifierTemplateFuncs = template.FuncMap{
+    "json": func(v interface{}) (string, error) {
+        p, err := json.Marshal(v)
+        return string(p), err
+    },
+}
+var parsedNotifierTemplates = make(map[string] *template.Template)
+var parsedNotifierTemplatesMu sync.Mutex
+
+func parseNotifierTemplate(text string) (*template.Template, error) {
+
+    parsedNotifierTemplatesMu.Lock()
+    defer parsedNotifierTemplatesMu.Unlock()
+
+    if tmpl, ok := parsedNotifierTemplates[text]; ok {
+        return tmpl, nil
+    }
+    tmpl, err := template.New("notifier").Funcs(notifierTemplateFuncs).Parse(text)
+    if err != nil {
+        return nil, err
+    }
+    parsedNotifierTemplates[text] = tmpl
+    return tmpl, nil
+
+}
+
+func executeNotifierTemplate(text string, ev alertEvent) (string, error) {
+    tmpl, err := parseNotifierTemplate(text)
+    if err != nil {
+        return "", err
+    }
+    buf := bytes.NewBuffer(nil)
+    err  = tmpl.Execute(buf, ev)
+    return buf.String(), err
+}
+
+// Returns the channels that the event goes to
+func(srv *Server) routeAlertEvent(ev alertEvent) []NotifierChannel {
+
+    channels := srv.config.AlertChannels
+    routed   := []NotifierChannel{}
+    if srv.config.WebhookUrl != "" {
+        routed = append(routed, NotifierChannel{
+            Name: notifierLegacyWebhookName,
+            Type: NotifierTypeWebhook,
+            Url:  srv.config.WebhookUrl,
+        })
+    }
+
+    if len(srv.config.AlertRoutes) == 0 {
+        return append(routed, channels...)
+    }
+
+    clTags := srv.clientConfig.InfoMap[ev.ClientId].Tags
+    added  := make(map[string] bool)
+    for _, rt := range srv.config.AlertRoutes {
+        if !rt.matches(ev, clTags) {
+            continue
+        }
+        for _, name := range rt.Channels {
+            found := false
+            for _, ch := range channels {
+                if ch.Name != name {
+                    continue
+                }
+                found = true
+                if !added[name] {
+                    routed = append(routed, ch)
+                    added[name] = true
+                }
+            }
+            if !found {
+                EventLogger.Warnln("Notifier channel", name, "was not found")
+            }
+        }
+        if !rt.Continue {
+            break
+        }
+    }
+    return routed
+
+}
+
+// Delivers the events to their channels in the background, except the silenced
+func(srv *Server) notifyAlertEvents(events []alertEvent) {
+    now := time.Now().Unix()
+    for _, ev := range events {
+        if srv.isAlertSilenced(ev, now) {
+            EventLogger.Infoln("Silenced", ev.Status, ev.Rule, ev.ClientId, ev.Key)
+            srv.appendAlertHistory(newAlertNotificationEntry(ev, "", AlertHistoryOutcomeSilenced, 0, nil))
+            continue
+        }
+        for _, ch := range srv.routeAlertEvent(ev) {
+            srv.notifications.Add(1)
+            go func(ch NotifierChannel, ev alertEvent) {
+                defer srv.notifications.Done()
+                attempts, err := srv.deliverAlertEvent(ch, ev)
+                outcome       := AlertHistoryOutcomeDelivered
+                if err != nil {
+                    outcome = AlertHistoryOutcomeFailed
+                    EventLogger.Warnln("Failed to notify", ch.Name, "of", ev.Rule, ev.ClientId, ev.Key, err)
+                }
+                srv.appendAlertHistory(newAlertNotificationEntry(ev, ch.Name, outcome, attempts, err))
+            }(ch, ev)
+        }
+    }
+}
+
+// Delivers the event to the channel, retrying with backoff, and returns the
+// number of attempts
+func(srv *Server) deliverAlertEvent(ch NotifierChannel, ev alertEvent) (attempts int, err error) {
+    backoff := time.Second * time.Duration(srv.config.AlertRetryBackoff)
+    for i := 0; ; i++ {
+        err = sendNotification(ch, ev)
+        if err == nil || i >= srv.config.AlertRetries {
+            return i + 1, err
+        }
+        time.Sleep(backoff)
+        backoff *= 2
+    }
+}
+
+func sendNotification(ch NotifierChannel, ev alertEvent) error {
+
+    body, err := executeNotifierTemplate(ch.body(), ev)
+    if err != nil {
+        return err
+    }
+
+    switch ch.Type {
+    case NotifierTypeWebhook:
+        return postNotification(ch.Url, ch.Headers, body)
+    case NotifierTypeSlack:
+        p, _ := json.Marshal(map[string] string{"text": body})
+        return postNotification(ch.Url, nil, string(p))
+    case NotifierTypeSmtp:
+        subject, err := executeNotifierTemplate(ch.Subject, ev)
+        if err != nil {
+            return err
+        }
+        return mailNotification(ch, subject, body)
+    case NotifierTypeExec:
+        ctx, cancel := context.WithTimeout(context.Background(), notifierTimeout)
+        defer cancel()
+        cmd      := exec.CommandContext(ctx, ch.Command[0], ch.Command[1:]...)
+        cmd.Stdin = strings.NewReader(body)
+        out, err := cmd.CombinedOutput()
+        if err != nil {
+            return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+        }
+        return nil
+    }
+    return fmt.Errorf("Unknown notifier type %q", ch.Type)
+
+}
+
+func postNotification(url string, headers map[string] string, body string) error {
+
+    req, err := http.NewRequest("POST", url, strings.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    for k, v := range headers {
+        req.Header.Set(k, v)
+    }
+
+    client   := http.Client{Timeout: notifierTimeout}
+    rsp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    rsp.Body.Close()
+
+    // The receiver must reply with 2xx
+    if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+        return fmt.Errorf("status code %d", rsp.StatusCode)
+    }
+    return nil
+
+}
+
+func mailNotification(ch NotifierChannel, subject, body string) error {
+
+    var auth smtp.Auth
+    if ch.SmtpUsername != "" {
+        host, _, err := net.SplitHostPort(ch.SmtpAddr)
+        if err != nil {
+            return err
+        }
+        auth = smtp.PlainAuth("", ch.SmtpUsername, ch.SmtpPassword, host)
+    }
+
+    msg := bytes.NewBuffer(nil)
+    fmt.Fprintf(msg, "From: %s\r\n", ch.SmtpFrom)
+    fmt.Fprintf(msg, "To: %s\r\n", strings.Join(ch.SmtpTo, ", "))
+    fmt.Fprintf(msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject))
+    fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+    msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+    return smtp.SendMail(ch.SmtpAddr, auth, ch.SmtpFrom, ch.SmtpTo, msg.Bytes())
+
+}
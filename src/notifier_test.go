@@ -0,0 +1,189 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+)
+
+func TestRouteAlertEvent(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.clientConfig.InfoMap["cl-9"] = ClientInfo{Tags: "db test"}
+    srv.config.WebhookUrl    = "http://127.0.0.1:1/legacy"
+    srv.config.AlertChannels = []NotifierChannel{
+        {Name: "ops", Type: NotifierTypeWebhook, Url: "http://127.0.0.1:1/ops"},
+        {Name: "dba", Type: NotifierTypeSlack, Url: "http://127.0.0.1:1/dba"},
+        {Name: "pager", Type: NotifierTypeExec, Command: []string{"true"}},
+    }
+    srv.config.AlertRoutes = []NotifierRoute{
+        {Severity: "critical", Channels: []string{"pager"}, Continue: true},
+        {Tags: "db", Key: "disk*", Channels: []string{"dba", "pager"}},
+        {Channels: []string{"ops"}},
+    }
+
+    names := func(ev alertEvent) string {
+        ret := []string{}
+        for _, ch := range srv.routeAlertEvent(ev) {
+            ret = append(ret, ch.Name)
+        }
+        return strings.Join(ret, " ")
+    }
+    for _, c := range []struct {
+        ev       alertEvent
+        expected string
+    }{
+        {alertEvent{ClientId: "cl-0", Key: "load", Severity: "warning"}, "alarm.webhookUrl ops"},
+        {alertEvent{ClientId: "cl-0", Key: "disk-usage", Severity: "warning"}, "alarm.webhookUrl ops"},
+        {alertEvent{ClientId: "cl-9", Key: "disk-usage", Severity: "warning"}, "alarm.webhookUrl dba pager"},
+        {alertEvent{ClientId: "cl-9", Key: "disk-usage", Severity: "critical"}, "alarm.webhookUrl pager dba"},
+        {alertEvent{ClientId: "cl-0", Key: "load", Severity: "critical"}, "alarm.webhookUrl pager ops"},
+    } {
+        if got := names(c.ev); got != c.expected {
+            t.Errorf("%+v: expected %q, got %q", c.ev, c.expected, got)
+        }
+    }
+
+    srv.config.AlertRoutes = nil
+    if got := names(alertEvent{}); got != "alarm.webhookUrl ops dba pager" {
+        t.Errorf("Expected every channel without routes, got %q", got)
+    }
+
+}
+
+// Accepts a single mail and sends its data to the channel
+func t_serveSmtp(t *testing.T, ln net.Listener, mails chan<- string) {
+
+    conn, err := ln.Accept()
+    if err != nil {
+        return
+    }
+    defer conn.Close()
+
+    rd    := bufio.NewReader(conn)
+    reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+    reply("220 localhost ESMTP")
+    data  := []string{}
+    for inData := false; ; {
+        line, err := rd.ReadString('\n')
+        if err != nil {
+            return
+        }
+        line = strings.TrimRight(line, "\r\n")
+        switch {
+        case inData && line == ".":
+            inData = false
+            mails <- strings.Join(data, "\n")
+            reply("250 OK")
+        case inData:
+            data = append(data, line)
+        case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+            reply("250 localhost")
+        case line == "DATA":
+            inData = true
+            reply("354 Go ahead")
+        case line == "QUIT":
+            reply("221 Bye")
+            return
+        default: // MAIL, RCPT, and others
+            reply("250 OK")
+        }
+    }
+
+}
+
+func TestNotifierChannels(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    // Webhook that fails the first request, and slack
+    mu       := sync.Mutex{}
+    requests := make(map[string] []string)
+    hsrv     := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        p, _ := ioutil.ReadAll(r.Body)
+        mu.Lock()
+        defer mu.Unlock()
+        requests[r.URL.Path] = append(requests[r.URL.Path], r.Header.Get("X-Token") + " " + string(p))
+        if r.URL.Path == "/hook" && len(requests[r.URL.Path]) == 1 {
+            w.WriteHeader(503)
+            return
+        }
+        w.WriteHeader(204)
+    }))
+    defer hsrv.Close()
+
+    // Smtp
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    mails := make(chan string, 1)
+    go t_serveSmtp(t, ln, mails)
+
+    // Exec
+    execOut := srv.config.AlertStateFile + ".exec"
+
+    srv.config.AlertRetries      = 2
+    srv.config.AlertRetryBackoff = 1
+    srv.config.AlertChannels     = []NotifierChannel{
+        {
+            Name: "hook", Type: NotifierTypeWebhook, Url: hsrv.URL + "/hook",
+            Headers: map[string] string{"X-Token": "secret"},
+            Body:    `{"text": {{json .Summary}}, "value": {{.Value}}}`,
+        },
+        {Name: "chat", Type: NotifierTypeSlack, Url: hsrv.URL + "/chat"},
+        {Name: "raw", Type: NotifierTypeWebhook, Url: hsrv.URL + "/raw"},
+        {
+            Name: "mail", Type: NotifierTypeSmtp, SmtpAddr: ln.Addr().String(),
+            SmtpFrom: "telescribe@localhost", SmtpTo: []string{"ops@localhost"},
+            Subject: DefaultNotifierChannel.Subject,
+        },
+        {Name: "script", Type: NotifierTypeExec, Command: []string{"sh", "-c", "cat > " + execOut}},
+    }
+    for _, ch := range srv.config.AlertChannels {
+        if err := ch.Validate(); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    ev := alertEvent{
+        Status: AlertStatusFiring, Rule: "fatalRange", ClientId: "cl-0", Key: "load",
+        Value: 12.5, Since: 60, Timestamp: 120, Severity: "critical", Summary: "load of cl-0 is 12.5",
+    }
+    srv.notifyAlertEvents([]alertEvent{ev})
+    srv.notifications.Wait()
+
+    if hook := requests["/hook"]; len(hook) != 2 ||
+        hook[1] != `secret {"text": "load of cl-0 is 12.5", "value": 12.5}` {
+        t.Errorf("Unexpected webhook requests %q", hook)
+    }
+    if chat := requests["/chat"]; len(chat) != 1 ||
+        chat[0] != ` {"text":"[critical] load of cl-0 is 12.5 (firing)"}` {
+        t.Errorf("Unexpected slack requests %q", chat)
+    }
+    received := alertEvent{}
+    if raw := requests["/raw"]; len(raw) != 1 ||
+        json.Unmarshal([]byte(raw[0][1:]), &received) != nil || received.Summary != ev.Summary {
+        t.Errorf("Unexpected webhook requests %q", raw)
+    }
+    mail := <-mails
+    if !strings.Contains(mail, "Subject: [critical] load of cl-0 is 12.5 (firing)") ||
+        !strings.Contains(mail, "To: ops@localhost") {
+        t.Errorf("Unexpected mail %q", mail)
+    }
+    received = alertEvent{}
+    if p, _ := ioutil.ReadFile(execOut); json.Unmarshal(p, &received) != nil || received.Key != "load" {
+        t.Errorf("Unexpected standard input %q", p)
+    }
+
+}
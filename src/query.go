@@ -0,0 +1,703 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    queryMaxPoints = 10000 // Per series
+)
+
+/*
+
+Query expressions derive series from the monitor data at query time, without
+storing them:
+
+expr     = term { ("+" | "-") term }
+term     = unary { ("*" | "/") unary }
+unary    = "-" unary | primary
+primary  = number | duration | "(" expr ")" | call | selector
+call     = function "(" expr { "," expr } ")"
+selector = base [ "(" param ")" ] [ "[" idx "]" ] [ "{" client "}" ]
+
+A selector is a monitor key whose param and idx may contain the wildcards *
+and ?, followed by the client id, which may contain them as well.
+A selector without a param or an idx matches only the monitor keys without
+them, and a selector without a client matches the clients of the query. As
+monitor keys contain hyphens, the minus operator must be surrounded by spaces.
+A duration is a number followed by one of s, m, h, d, w, and y.
+
+cpu-usage[*]                  Every cpu of every client
+network-in[eth0]{web-*}       eth0 of the clients whose ids start with web-
+rate(network-in[eth0])        Bytes per second
+sum(cpu-usage[*])             The sum over every cpu of every client
+memory-usage / memory-size * 100
+max_over_time(load, 1h)
+
+The series are evaluated on the points of the query, which divide the range
+from from to to into steps of per. The point of a selector is the mean of the
+data within its step, which is read from the rollups when per is at least as
+long as one of their resolutions, as in monitorDataCsv.
+
+The operators work on numbers and series alike. Between two lists of series,
+the series of the same client, param, and idx are paired, unless either list
+has only one series, which is then paired with every series of the other.
+
+*/
+
+type queryPoint struct {
+    Value float64 // NaN if there are no data
+    Sum   float64
+    Per   float64 // The seconds that the data stand for
+}
+
+type querySeries struct {
+    ClientId string
+    Key      string // The monitor key, or the expression that derived the series
+    Param    string
+    Idx      string
+    Points   []queryPoint
+    prec     int // The precedence of the operator in Key, for parentheses
+}
+
+type QueryFilter struct {
+    ClientIds []string // The clients of the store when empty
+    From      int64
+    To        int64
+    Per       int64
+}
+
+// A value is either a number or a list of series
+type queryValue struct {
+    number   float64
+    isNumber bool
+    series   []querySeries
+}
+
+type queryContext struct {
+    srv   *Server
+    from  int64
+    per   int64
+    n     int
+    clIds []string
+    keep  func(clId, mKey string) bool
+}
+
+// PARSER ---
+
+type queryNode interface {
+    eval(qc *queryContext) queryValue
+}
+
+type queryNumber float64
+
+type querySelector struct {
+    base, param, idx, client string
+}
+
+type queryCall struct {
+    name string
+    args []queryNode
+    text string
+}
+
+type queryBinary struct {
+    op   byte
+    l, r queryNode
+}
+
+type queryParser struct {
+    src string
+    pos int
+}
+
+func isQueryNameByte(c byte) bool {
+    return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+        strings.IndexByte("_-.:", c) != -1
+}
+
+// Parses the query expression
+func ParseQuery(expr string) (node queryNode, err error) {
+
+    defer Catch(&err)
+
+    qp := &queryParser{src: expr}
+    node = qp.expr()
+    qp.skipSpace()
+    Assert(qp.pos == len(qp.src), qp.errorf("Unexpected %q", qp.src[qp.pos:]))
+    return node, nil
+
+}
+
+func(qp *queryParser) errorf(format string, args ...interface{}) string {
+    return fmt.Sprintf("Query at %d: ", qp.pos) + fmt.Sprintf(format, args...)
+}
+
+func(qp *queryParser) skipSpace() {
+    for qp.pos < len(qp.src) && strings.IndexByte(" \t\r\n", qp.src[qp.pos]) != -1 {
+        qp.pos++
+    }
+}
+
+// Returns the next byte after spaces, or 0 at the end
+func(qp *queryParser) peek() byte {
+    qp.skipSpace()
+    if qp.pos == len(qp.src) {
+        return 0
+    }
+    return qp.src[qp.pos]
+}
+
+func(qp *queryParser) expect(c byte) {
+    Assert(qp.peek() == c, qp.errorf("Expected %q", c))
+    qp.pos++
+}
+
+func(qp *queryParser) expr() queryNode {
+    node := qp.term()
+    for {
+        switch op := qp.peek(); op {
+        case '+', '-':
+            qp.pos++
+            node = queryBinary{op, node, qp.term()}
+        default:
+            return node
+        }
+    }
+}
+
+func(qp *queryParser) term() queryNode {
+    node := qp.unary()
+    for {
+        switch op := qp.peek(); op {
+        case '*', '/':
+            qp.pos++
+            node = queryBinary{op, node, qp.unary()}
+        default:
+            return node
+        }
+    }
+}
+
+func(qp *queryParser) unary() queryNode {
+    if qp.peek() == '-' {
+        qp.pos++
+        return queryBinary{'*', queryNumber(-1), qp.unary()}
+    }
+    return qp.primary()
+}
+
+func(qp *queryParser) primary() queryNode {
+
+    start := qp.pos
+    c     := qp.peek()
+    switch {
+    case c == '(':
+        qp.pos++
+        node := qp.expr()
+        qp.expect(')')
+        return node
+    case c >= '0' && c <= '9' || c == '.':
+        return qp.number()
+    case c == 0 || !isQueryNameByte(c):
+        panic(errors.New(qp.errorf("Unexpected %q", qp.src[qp.pos:])))
+    }
+
+    name := qp.name()
+    if _, ok := queryFunctions[name]; ok && qp.peek() == '(' {
+        qp.pos++
+        call := queryCall{name: name}
+        for {
+            call.args = append(call.args, qp.expr())
+            if qp.peek() != ',' {
+                break
+            }
+            qp.pos++
+        }
+        qp.expect(')')
+        call.text = strings.TrimSpace(qp.src[start:qp.pos])
+        return call
+    }
+
+    // The param, idx, and client follow the base without spaces
+    sel := querySelector{base: name}
+    if qp.pos < len(qp.src) && qp.src[qp.pos] == '(' {
+        sel.param = qp.enclosed('(', ')')
+    }
+    if qp.pos < len(qp.src) && qp.src[qp.pos] == '[' {
+        sel.idx = qp.enclosed('[', ']')
+    }
+    if qp.pos < len(qp.src) && qp.src[qp.pos] == '{' {
+        sel.client = qp.enclosed('{', '}')
+    }
+    return sel
+
+}
+
+func(qp *queryParser) name() string {
+    start := qp.pos
+    for qp.pos < len(qp.src) && isQueryNameByte(qp.src[qp.pos]) {
+        qp.pos++
+    }
+    return qp.src[start:qp.pos]
+}
+
+func(qp *queryParser) number() queryNode {
+
+    start := qp.pos
+    for qp.pos < len(qp.src) && (qp.src[qp.pos] >= '0' && qp.src[qp.pos] <= '9' || qp.src[qp.pos] == '.') {
+        qp.pos++
+    }
+    f, err := strconv.ParseFloat(qp.src[start:qp.pos], 64)
+    Assert(err == nil, qp.errorf("Bad number %q", qp.src[start:qp.pos]))
+
+    // Duration
+    if qp.pos < len(qp.src) {
+        if unit, ok := retentionUnits[qp.src[qp.pos]]; ok {
+            qp.pos++
+            f *= float64(unit)
+        }
+    }
+    Assert(qp.pos == len(qp.src) || !isQueryNameByte(qp.src[qp.pos]), qp.errorf("Bad number"))
+    return queryNumber(f)
+
+}
+
+// Returns the string between open and close, which may be quoted
+func(qp *queryParser) enclosed(open, close byte) string {
+
+    qp.pos++ // open
+    var s string
+    if qp.pos < len(qp.src) && qp.src[qp.pos] == '"' {
+        quoted, err := strconv.QuotedPrefix(qp.src[qp.pos:])
+        Assert(err == nil, qp.errorf("Bad quoted string"))
+        s, _    = strconv.Unquote(quoted)
+        qp.pos += len(quoted)
+    } else {
+        end := strings.IndexByte(qp.src[qp.pos:], close)
+        Assert(end != -1, qp.errorf("Expected %q", close))
+        s       = qp.src[qp.pos:qp.pos + end]
+        qp.pos += end
+    }
+    Assert(qp.pos < len(qp.src) && qp.src[qp.pos] == close, qp.errorf("Expected %q", close))
+    qp.pos++
+    return s
+
+}
+
+// EVALUATION ---
+
+// Matches s against the pattern of * and ?, which match any characters
+// including slashes; on a mismatch, only the last * takes one more character,
+// so that the time is bounded by the product of the lengths
+func matchQueryPattern(pattern, s string) bool {
+
+    p, i        := 0, 0
+    star, match := -1, 0
+    for i < len(s) {
+        switch {
+        case p < len(pattern) && pattern[p] == '*':
+            star, match = p, i
+            p++
+        case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+            p++
+            i++
+        case star != -1:
+            match++
+            p, i = star + 1, match
+        default:
+            return false
+        }
+    }
+    for p < len(pattern) && pattern[p] == '*' {
+        p++
+    }
+    return p == len(pattern)
+
+}
+
+func(n queryNumber) eval(qc *queryContext) queryValue {
+    return queryValue{number: float64(n), isNumber: true}
+}
+
+func(sel querySelector) eval(qc *queryContext) queryValue {
+
+    ret := queryValue{series: []querySeries{}}
+    for _, clId := range qc.clIds {
+
+        if sel.client != "" && !matchQueryPattern(sel.client, clId) {
+            continue
+        }
+        mKeys, _ := qc.srv.monitorDataStore.Keys(clId)
+        sort.Strings(mKeys)
+        for _, mKey := range mKeys {
+            base, param, idx := ParseMonitorKey(mKey)
+            if base != sel.base ||
+                !matchQueryPattern(sel.param, param) ||
+                !matchQueryPattern(sel.idx, idx) ||
+                (qc.keep != nil && !qc.keep(clId, mKey)) {
+                continue
+            }
+            ret.series = append(ret.series, querySeries{
+                ClientId: clId, Key: mKey, Param: param, Idx: idx,
+                Points:   qc.points(clId, mKey),
+            })
+        }
+
+    }
+    return ret
+
+}
+
+// Returns the points of the monitor key of the client
+func(qc *queryContext) points(clId, mKey string) []queryPoint {
+    buckets := qc.srv.getMonitorDataBuckets(clId, mKey, monitorAggregateKeyMean, qc.from, qc.per, qc.n)
+    points  := make([]queryPoint, qc.n)
+    for i, b := range buckets {
+        points[i] = queryPoint{b.valueOf(monitorAggregateKeyMean), b.Value, b.Per}
+    }
+    return points
+}
+
+func(call queryCall) eval(qc *queryContext) queryValue {
+    return queryFunctions[call.name](qc, call)
+}
+
+// Returns the series of the argument, which must not be a number
+func(call queryCall) seriesArg(qc *queryContext, i int) []querySeries {
+    v := call.args[i].eval(qc)
+    Assert(!v.isNumber, fmt.Sprintf("%s takes series, not a number", call.name))
+    return v.series
+}
+
+func(call queryCall) numberArg(qc *queryContext, i int) float64 {
+    v := call.args[i].eval(qc)
+    Assert(v.isNumber, fmt.Sprintf("%s takes a number as the argument %d", call.name, i + 1))
+    return v.number
+}
+
+func(call queryCall) assertArgc(argc int) {
+    Assert(len(call.args) == argc, fmt.Sprintf("%s takes %d arguments", call.name, argc))
+}
+
+func(b queryBinary) eval(qc *queryContext) queryValue {
+
+    l, r := b.l.eval(qc), b.r.eval(qc)
+    var fn func(x, y float64) float64
+    switch b.op {
+    case '+': fn = func(x, y float64) float64 { return x + y }
+    case '-': fn = func(x, y float64) float64 { return x - y }
+    case '*': fn = func(x, y float64) float64 { return x * y }
+    case '/': fn = func(x, y float64) float64 { return x / y }
+    }
+    prec := 1
+    if b.op == '*' || b.op == '/' {
+        prec = 2
+    }
+
+    if l.isNumber && r.isNumber {
+        return queryValue{number: fn(l.number, r.number), isNumber: true}
+    }
+
+    // Pairs
+    type pair struct {
+        l, r querySeries
+    }
+    pairs := []pair{}
+    asSeries := func(v queryValue) []querySeries {
+        if !v.isNumber {
+            return v.series
+        }
+        points := make([]queryPoint, qc.n)
+        for i := range points {
+            points[i].Value = v.number
+        }
+        return []querySeries{{Key: formatOpenMetricsFloat(v.number), Points: points}}
+    }
+    ls, rs := asSeries(l), asSeries(r)
+    switch {
+    case l.isNumber, r.isNumber, len(ls) == 1, len(rs) == 1:
+        for _, lse := range ls {
+            for _, rse := range rs {
+                pairs = append(pairs, pair{lse, rse})
+            }
+        }
+    default:
+        labels := func(se querySeries) string {
+            return se.ClientId + "\x00" + se.Param + "\x00" + se.Idx
+        }
+        rMap := make(map[string] querySeries)
+        for _, rse := range rs {
+            _, dup := rMap[labels(rse)]
+            Assert(!dup, fmt.Sprintf("Several series of %s match the same series", rse.Key))
+            rMap[labels(rse)] = rse
+        }
+        for _, lse := range ls {
+            if rse, ok := rMap[labels(lse)]; ok {
+                pairs = append(pairs, pair{lse, rse})
+            }
+        }
+    }
+
+    ret := queryValue{series: make([]querySeries, 0, len(pairs))}
+    for _, p := range pairs {
+        lKey, rKey := p.l.Key, p.r.Key
+        if p.l.prec > 0 && p.l.prec < prec {
+            lKey = "(" + lKey + ")"
+        }
+        if p.r.prec > 0 && p.r.prec <= prec {
+            rKey = "(" + rKey + ")"
+        }
+        se := querySeries{
+            ClientId: p.l.ClientId, Param: p.l.Param, Idx: p.l.Idx,
+            Key:      lKey + " " + string(b.op) + " " + rKey,
+            Points:   make([]queryPoint, qc.n),
+            prec:     prec,
+        }
+        if se.ClientId == "" {
+            se.ClientId, se.Param, se.Idx = p.r.ClientId, p.r.Param, p.r.Idx
+        }
+        for i := range se.Points {
+            se.Points[i].Value = fn(p.l.Points[i].Value, p.r.Points[i].Value)
+        }
+        ret.series = append(ret.series, se)
+    }
+    return ret
+
+}
+
+// FUNCTIONS ---
+
+type queryFunction func(qc *queryContext, call queryCall) queryValue
+
+var queryFunctions map[string] queryFunction
+
+func init() {
+    queryFunctions = map[string] queryFunction{
+        "rate":          queryRate,
+        "abs":           queryAbs,
+        "sum":           queryAggregation(monitorAggregateKeySum),
+        "avg":           queryAggregation(monitorAggregateKeyMean),
+        "min":           queryAggregation(monitorAggregateKeyMin),
+        "max":           queryAggregation(monitorAggregateKeyMax),
+        "count":         queryAggregation("count"),
+        "sum_over_time": queryOverTime(monitorAggregateKeySum),
+        "avg_over_time": queryOverTime(monitorAggregateKeyMean),
+        "min_over_time": queryOverTime(monitorAggregateKeyMin),
+        "max_over_time": queryOverTime(monitorAggregateKeyMax),
+    }
+}
+
+// Returns the function that applies fn to the values of every series
+func queryEach(qc *queryContext, call queryCall, fn func(points []queryPoint, i int) float64) queryValue {
+    series := call.seriesArg(qc, 0)
+    ret    := queryValue{series: make([]querySeries, len(series))}
+    for j, se := range series {
+        derived := se
+        derived.Key    = call.name + "(" + se.Key + ")"
+        derived.Points = make([]queryPoint, qc.n)
+        derived.prec   = 0
+        for i := range derived.Points {
+            derived.Points[i].Value = fn(se.Points, i)
+        }
+        ret.series[j] = derived
+    }
+    return ret
+}
+
+// Returns the values per second of a selector, as values are the amounts
+// during their pers
+func queryRate(qc *queryContext, call queryCall) queryValue {
+    call.assertArgc(1)
+    _, ok := call.args[0].(querySelector)
+    Assert(ok, "rate takes a selector")
+    return queryEach(qc, call, func(points []queryPoint, i int) float64 {
+        if points[i].Per == 0 {
+            return math.NaN()
+        }
+        return points[i].Sum / points[i].Per
+    })
+}
+
+func queryAbs(qc *queryContext, call queryCall) queryValue {
+    call.assertArgc(1)
+    return queryEach(qc, call, func(points []queryPoint, i int) float64 {
+        return math.Abs(points[i].Value)
+    })
+}
+
+// Aggregates the values of the series at each point, leaving out NaN
+func aggregateQueryValues(agrg string, values []float64) float64 {
+    md := MonitorData{}
+    for _, val := range values {
+        if !math.IsNaN(val) {
+            md = append(md, MonitorDatum{Value: val})
+        }
+    }
+    if agrg == "count" {
+        return float64(len(md))
+    }
+    if len(md) == 0 {
+        return math.NaN()
+    }
+    return monitorAggregateTypesMap[agrg](md)
+}
+
+// Returns the function that aggregates the series into one
+func queryAggregation(agrg string) queryFunction {
+    return func(qc *queryContext, call queryCall) queryValue {
+
+        call.assertArgc(1)
+        series := call.seriesArg(qc, 0)
+        if len(series) == 0 {
+            return queryValue{series: []querySeries{}}
+        }
+
+        // The labels that every series shares remain
+        se := querySeries{
+            ClientId: series[0].ClientId, Param: series[0].Param, Idx: series[0].Idx,
+            Key:      call.text,
+            Points:   make([]queryPoint, qc.n),
+        }
+        for _, other := range series[1:] {
+            if other.ClientId != se.ClientId {
+                se.ClientId = ""
+            }
+            if other.Param != se.Param {
+                se.Param = ""
+            }
+            if other.Idx != se.Idx {
+                se.Idx = ""
+            }
+        }
+
+        values := make([]float64, len(series))
+        for i := range se.Points {
+            for j := range series {
+                values[j] = series[j].Points[i].Value
+            }
+            se.Points[i].Value = aggregateQueryValues(agrg, values)
+        }
+        return queryValue{series: []querySeries{se}}
+
+    }
+}
+
+// Returns the function that aggregates each series over the window of the
+// second argument in seconds
+func queryOverTime(agrg string) queryFunction {
+    return func(qc *queryContext, call queryCall) queryValue {
+
+        call.assertArgc(2)
+        window := call.numberArg(qc, 1)
+        Assert(window > 0, call.name + " takes a positive window")
+        w := int(math.Ceil(window / float64(qc.per)))
+
+        ret := queryEach(qc, call, func(points []queryPoint, i int) float64 {
+            start := i - w + 1
+            if start < 0 {
+                start = 0
+            }
+            values := make([]float64, 0, i - start + 1)
+            for _, p := range points[start:i + 1] {
+                values = append(values, p.Value)
+            }
+            return aggregateQueryValues(agrg, values)
+        })
+        for i := range ret.series {
+            ret.series[i].Key = strings.TrimSuffix(ret.series[i].Key, ")") +
+                ", " + strconv.FormatFloat(window, 'g', -1, 64) + "s)"
+        }
+        return ret
+
+    }
+}
+
+// QUERY ---
+
+// Evaluates the query expression; keep, if not nil, decides which monitor keys
+// are read
+func(srv *Server) EvaluateQuery(
+    expr string, filter QueryFilter, keep func(clId, mKey string) bool,
+) (ret []querySeries, err error) {
+
+    defer Catch(&err)
+
+    node, err := ParseQuery(expr)
+    Try(err)
+
+    Assert(filter.Per > 0, "The per must be positive")
+    Assert(filter.To > filter.From, "The range must not be empty")
+    n := (filter.To - filter.From + filter.Per - 1) / filter.Per
+    Assert(n <= queryMaxPoints, fmt.Sprintf("The query yields more than %d points", queryMaxPoints))
+
+    qc := &queryContext{
+        srv:   srv,
+        from:  filter.From,
+        per:   filter.Per,
+        n:     int(n),
+        clIds: filter.ClientIds,
+        keep:  keep,
+    }
+    if len(qc.clIds) == 0 {
+        qc.clIds = srv.monitorDataStore.ClientIds()
+    }
+    sort.Strings(qc.clIds)
+
+    v := node.eval(qc)
+    if v.isNumber {
+        points := make([]queryPoint, qc.n)
+        for i := range points {
+            points[i].Value = v.number
+        }
+        return []querySeries{{Key: strings.TrimSpace(expr), Points: points}}, nil
+    }
+
+    // Series without any values are left out
+    ret = []querySeries{}
+    for _, se := range v.series {
+        for _, p := range se.Points {
+            if !math.IsNaN(p.Value) {
+                ret = append(ret, se)
+                break
+            }
+        }
+    }
+    sort.SliceStable(ret, func(i, j int) bool {
+        if ret[i].ClientId != ret[j].ClientId {
+            return ret[i].ClientId < ret[j].ClientId
+        }
+        return ret[i].Key < ret[j].Key
+    })
+    return ret, nil
+
+}
+
+// Writes the series as rows of the format, in which the series that are
+// derived from several clients have no client id
+func writeQuerySeries(w io.Writer, format string, series []querySeries, filter QueryFilter) (err error) {
+
+    defer Catch(&err)
+
+    Assert(isMonitorDataFormat(format), "Unknown format: " + format)
+
+    rw := newMonitorDataRowWriter(w, format)
+    for _, se := range series {
+        for i, p := range se.Points {
+            rw.Write(se.ClientId, se.Key, MonitorDatum{
+                filter.From + int64(i + 1) * filter.Per, p.Value, int32(filter.Per),
+            })
+        }
+        rw.Flush()
+    }
+    return rw.Close()
+
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "bytes"
+    "math"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestParseQuery(t *testing.T) {
+
+    for _, expr := range []string{
+        "load",
+        "cpu-usage[*]{cl-*}",
+        `dev-usage("/dev/sda")[0]`,
+        "rate(network-in[eth0]) * 8",
+        "sum(cpu-usage[*]) / count(cpu-usage[*])",
+        "-load + (memory-usage - 1) * 2.5",
+        "max_over_time(load, 1h)",
+    } {
+        if _, err := ParseQuery(expr); err != nil {
+            t.Errorf("%s: %v", expr, err)
+        }
+    }
+
+    for _, expr := range []string{
+        "",
+        "load +",
+        "sum(load",
+        "cpu-usage[0",
+        "5x",
+        "load load",
+        "load # 1",
+    } {
+        if _, err := ParseQuery(expr); err == nil {
+            t.Errorf("%s: expected an error", expr)
+        }
+    }
+
+}
+
+func TestMatchQueryPattern(t *testing.T) {
+
+    for _, c := range []struct {
+        pattern, s string
+        expected   bool
+    }{
+        {"", "", true},
+        {"", "a", false},
+        {"*", "", true},
+        {"*", "/dev/sda", true},
+        {"cl-*", "cl-0", true},
+        {"cl-*", "db-0", false},
+        {"cl-?", "cl-10", false},
+        {"*-usage*", "cpu-usage[0]", true},
+        {"a*b*c", "aXbYbZc", true},
+        {"a*b*c", "aXcYb", false},
+        {"**a", "ba", true},
+        {"?*?", "a", false},
+    } {
+        if got := matchQueryPattern(c.pattern, c.s); got != c.expected {
+            t.Errorf("%q %q: expected %v", c.pattern, c.s, c.expected)
+        }
+    }
+
+    // Exponential with backtracking at every *
+    start := time.Now()
+    if matchQueryPattern("*a*a*a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 200)) {
+        t.Error("expected no match")
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("took %v", elapsed)
+    }
+
+}
+
+func TestEvaluateQuery(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    for ts := int64(60); ts <= 240; ts += 60 {
+        srv.recordValueMap("cl-0", ts, map[string] interface{}{
+            "cpu-usage[0]": 10.0, "cpu-usage[1]": 30.0,
+            "cpu-usage[2]": 70.0,
+            "network-in[eth0]": 600.0, "memory-usage": 2.0, "memory-size": 8.0,
+            "load": float64(ts / 60),
+        }, 60)
+        srv.recordValueMap("cl-1", ts, map[string] interface{}{
+            "cpu-usage[0]": 50.0, "memory-usage": 4.0, "memory-size": 8.0,
+        }, 60)
+    }
+
+    filter := QueryFilter{From: 0, To: 240, Per: 120}
+    eval   := func(expr string) []querySeries {
+        series, err := srv.EvaluateQuery(expr, filter, func(clId, mKey string) bool {
+            return mKey != "cpu-usage[2]"
+        })
+        if err != nil {
+            t.Fatalf("%s: %v", expr, err)
+        }
+        return series
+    }
+    values := func(se querySeries) []float64 {
+        ret := []float64{}
+        for _, p := range se.Points {
+            ret = append(ret, p.Value)
+        }
+        return ret
+    }
+    equal := func(expr string, series []querySeries, clId, key string, expected ...float64) {
+        for _, se := range series {
+            if se.ClientId != clId || se.Key != key {
+                continue
+            }
+            got := values(se)
+            for i := range expected {
+                if math.Abs(got[i] - expected[i]) > 1e-9 {
+                    t.Errorf("%s: %s %s: expected %v, got %v", expr, clId, key, expected, got)
+                }
+            }
+            return
+        }
+        t.Errorf("%s: no series %s %s in %+v", expr, clId, key, series)
+    }
+
+    series := eval("cpu-usage[*]")
+    if len(series) != 3 { // cpu-usage[2] is not permitted
+        t.Errorf("expected 3 series, got %d", len(series))
+    }
+    equal("selector", series, "cl-1", "cpu-usage[0]", 50, 50)
+    equal("client", eval("cpu-usage[*]{cl-1}"), "cl-1", "cpu-usage[0]", 50, 50)
+    equal("rate", eval("rate(network-in[eth0])"), "cl-0", "rate(network-in[eth0])", 10, 10)
+    equal("sum", eval("sum(cpu-usage[*])"), "", "sum(cpu-usage[*])", 90, 90)
+    equal("sum client", eval("sum(cpu-usage[*]{cl-0})"), "cl-0", "sum(cpu-usage[*]{cl-0})", 40, 40)
+    equal("arithmetic", eval("memory-usage / memory-size * 100"), "cl-1", "memory-usage / memory-size * 100", 50, 50)
+    equal("parentheses", eval("100 * (memory-usage - memory-size)"), "cl-0", "100 * (memory-usage - memory-size)", -600, -600)
+    equal("over time", eval("max_over_time(load, 240)"), "cl-0", "max_over_time(load, 240s)", 1.5, 3.5)
+    equal("number", eval("1 + 2"), "", "1 + 2", 3, 3)
+
+    for _, expr := range []string{"sum(1)", "rate(load * 2)", "max_over_time(load, load)"} {
+        if _, err := srv.EvaluateQuery(expr, filter, nil); err == nil {
+            t.Errorf("%s: expected an error", expr)
+        }
+    }
+    if _, err := srv.EvaluateQuery("load", QueryFilter{From: 0, To: 1e9, Per: 1}, nil); err == nil {
+        t.Error("expected an error for too many points")
+    }
+
+    // Rows
+    buf := bytes.NewBuffer(nil)
+    if err := writeQuerySeries(buf, monitorDataFormatCsv, eval("sum(cpu-usage[*])"), filter); err != nil {
+        t.Fatal(err)
+    }
+    if expected := "client,key,timestamp,value,per\n,sum(cpu-usage[*]),120,90,120\n,sum(cpu-usage[*]),240,90,120\n"; buf.String() != expected {
+        t.Errorf("unexpected csv\n%s", buf.String())
+    }
+    if strings.Contains(buf.String(), "70") {
+        t.Error("unexpected key")
+    }
+
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math"
+    "net"
+    "sort"
+    "strings"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    remoteWriteNameLabel  = "__name__"
+    remoteWriteAliasLabel = "alias"
+    remoteWriteMaxSize    = 32 << 20 // Decoded bytes
+)
+
+/*
+
+The remote-write receiver accepts the WriteRequest of the Prometheus remote
+write protocol, which is protobuf encoded and compressed in the snappy block
+format, and records the samples as the values of the clients.
+
+message WriteRequest { repeated TimeSeries timeseries = 1; ... }
+message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; ... }
+message Label        { string name = 1; string value = 2; }
+message Sample       { double value = 1; int64 timestamp = 2; }
+
+Each series is mapped onto a client by the label of remoteWrite.clientLabel:
+the client whose id is the value, or else the client whose host is the value
+without the port, narrowed down by the label alias if there are several. Series
+of hosts that are not in the client config are dropped, as the hosts that are
+not whitelisted.
+
+The monitor key of a series is its name, with the rest of the labels, except
+the client label, the label alias, and remoteWrite.dropLabels, as its param in
+the form of name=value joined by commas in the order of names. Series whose
+monitor keys have no monitor config for their clients are dropped.
+
+node_load1{instance="web-1:9100",job="node"}
+=> client web-1, key node_load1
+node_filesystem_avail_bytes{instance="web-1:9100",job="node",mountpoint="/"}
+=> client web-1, key node_filesystem_avail_bytes(mountpoint=/)
+
+As samples carry no per, the per of a sample is the time since the previous
+datum of its monitor key, or the monitor interval of the client rule for the
+first one.
+
+*/
+
+type remoteWriteSample struct {
+    Value     float64
+    Timestamp int64 // Milliseconds
+}
+
+type remoteWriteSeries struct {
+    Labels  map[string] string
+    Samples []remoteWriteSample
+}
+
+type RemoteWriteReport struct {
+    Recorded int // Samples
+    Dropped  int // Samples
+}
+
+// Maps the series onto a client id and a monitor key
+func(srv *Server) mapRemoteWriteSeries(series remoteWriteSeries) (clId, mKey string, ok bool) {
+
+    name     := series.Labels[remoteWriteNameLabel]
+    clLabel  := srv.config.RemoteWriteClientLabel
+    clValue  := series.Labels[clLabel]
+    alias, hasAlias := series.Labels[remoteWriteAliasLabel]
+    if name == "" || clValue == "" {
+        return
+    }
+
+    // Client
+    infoMap := srv.clientConfig.InfoMap
+    if _, exists := infoMap[clValue]; exists {
+        clId = clValue
+    } else {
+        host := clValue
+        if h, _, err := net.SplitHostPort(clValue); err == nil {
+            host = h
+        }
+        candidates := []string{}
+        for id, clInfo := range infoMap {
+            if strings.EqualFold(clInfo.Host, host) && (!hasAlias || clInfo.Alias == alias) {
+                candidates = append(candidates, id)
+            }
+        }
+        if len(candidates) != 1 {
+            return
+        }
+        clId = candidates[0]
+    }
+
+    // Monitor key
+    dropped := map[string] bool{
+        remoteWriteNameLabel: true, clLabel: true, remoteWriteAliasLabel: true,
+    }
+    for _, label := range srv.config.RemoteWriteDropLabels {
+        dropped[label] = true
+    }
+    params := []string{}
+    for label, value := range series.Labels {
+        if !dropped[label] {
+            params = append(params, label + "=" + value)
+        }
+    }
+    sort.Strings(params)
+    mKey = FormatMonitorKey(name, strings.Join(params, ","), "")
+
+    if _, configured := srv.getClientMonitorConfig(clId, mKey); !configured {
+        return "", "", false
+    }
+    return clId, mKey, true
+
+}
+
+// Records the series of a WriteRequest; keep, if not nil, decides which
+// monitor keys are recorded
+func(srv *Server) RecordRemoteWrite(compressed []byte, keep func(clId, mKey string) bool) (report RemoteWriteReport, err error) {
+
+    defer Catch(&err)
+
+    p, err := decodeSnappyBlock(compressed, remoteWriteMaxSize)
+    Try(err)
+    seriesList, err := decodeRemoteWriteRequest(p)
+    Try(err)
+
+    for _, series := range seriesList {
+
+        clId, mKey, ok := srv.mapRemoteWriteSeries(series)
+        if !ok || (keep != nil && !keep(clId, mKey)) {
+            report.Dropped += len(series.Samples)
+            continue
+        }
+
+        sort.Slice(series.Samples, func(i, j int) bool {
+            return series.Samples[i].Timestamp < series.Samples[j].Timestamp
+        })
+        clInfo   := srv.clientConfig.InfoMap[clId]
+        interval := int32(srv.clientConfig.RuleMap.Get(clInfo.Tags).MonitorInterval)
+        for _, sample := range series.Samples {
+            ts  := sample.Timestamp / 1000
+            per := interval
+            if last, ok := srv.monitorDataStore.LastTimestamp(clId, mKey); ok && last < ts {
+                per = int32(ts - last)
+            }
+            srv.RecordValueMap(clId, ts, map[string] interface{}{mKey: sample.Value}, per)
+            report.Recorded++
+        }
+
+    }
+
+    return report, nil
+
+}
+
+// SNAPPY ---
+
+// Decodes data in the snappy block format
+func decodeSnappyBlock(src []byte, maxSize int) (dst []byte, err error) {
+
+    defer Catch(&err)
+
+    length, n := binary.Uvarint(src)
+    Assert(n > 0, "Bad snappy length")
+    Assert(length <= uint64(maxSize), fmt.Sprintf("Snappy data exceed %d bytes", maxSize))
+    src = src[n:]
+    dst = make([]byte, 0, length)
+
+    for len(src) > 0 {
+
+        tag := src[0]
+        switch tag & 0x03 {
+        case 0x00: // Literal
+            l := int(tag >> 2)
+            src = src[1:]
+            if l >= 60 {
+                size := l - 59
+                Assert(len(src) >= size, "Bad snappy literal")
+                l = 0
+                for i := size - 1; i >= 0; i-- {
+                    l = l << 8 | int(src[i])
+                }
+                src = src[size:]
+            }
+            l++
+            Assert(l > 0 && len(src) >= l && len(dst) + l <= int(length), "Bad snappy literal")
+            dst = append(dst, src[:l]...)
+            src = src[l:]
+            continue
+        }
+
+        var l, offset int
+        switch tag & 0x03 {
+        case 0x01:
+            Assert(len(src) >= 2, "Bad snappy copy")
+            l      = 4 + int(tag >> 2 & 0x07)
+            offset = int(tag & 0xe0) << 3 | int(src[1])
+            src    = src[2:]
+        case 0x02:
+            Assert(len(src) >= 3, "Bad snappy copy")
+            l      = 1 + int(tag >> 2)
+            offset = int(binary.LittleEndian.Uint16(src[1:3]))
+            src    = src[3:]
+        case 0x03:
+            Assert(len(src) >= 5, "Bad snappy copy")
+            l      = 1 + int(tag >> 2)
+            offset = int(binary.LittleEndian.Uint32(src[1:5]))
+            src    = src[5:]
+        }
+        Assert(offset > 0 && offset <= len(dst) && len(dst) + l <= int(length), "Bad snappy copy")
+
+        // Copies can overlap themselves
+        start := len(dst) - offset
+        for i := 0; i < l; i++ {
+            dst = append(dst, dst[start + i])
+        }
+
+    }
+
+    Assert(len(dst) == int(length), "Snappy length mismatch")
+    return dst, nil
+
+}
+
+// PROTOBUF ---
+
+type protobufReader struct {
+    p []byte
+}
+
+func(pr *protobufReader) varint() uint64 {
+    v, n := binary.Uvarint(pr.p)
+    Assert(n > 0, "Bad protobuf varint")
+    pr.p = pr.p[n:]
+    return v
+}
+
+// Returns the field number and the wire type of the next field
+func(pr *protobufReader) next() (int, int) {
+    key := pr.varint()
+    return int(key >> 3), int(key & 0x07)
+}
+
+func(pr *protobufReader) bytes() []byte {
+    l := pr.varint()
+    Assert(l <= uint64(len(pr.p)), "Bad protobuf length")
+    ret := pr.p[:l]
+    pr.p = pr.p[l:]
+    return ret
+}
+
+func(pr *protobufReader) fixed64() uint64 {
+    Assert(len(pr.p) >= 8, "Bad protobuf fixed64")
+    v := binary.LittleEndian.Uint64(pr.p)
+    pr.p = pr.p[8:]
+    return v
+}
+
+func(pr *protobufReader) skip(wireType int) {
+    switch wireType {
+    case 0:
+        pr.varint()
+    case 1:
+        pr.fixed64()
+    case 2:
+        pr.bytes()
+    case 5:
+        Assert(len(pr.p) >= 4, "Bad protobuf fixed32")
+        pr.p = pr.p[4:]
+    default:
+        panic(fmt.Errorf("Unsupported protobuf wire type %d", wireType))
+    }
+}
+
+func decodeRemoteWriteRequest(p []byte) (ret []remoteWriteSeries, err error) {
+
+    defer Catch(&err)
+
+    ret = []remoteWriteSeries{}
+    req := &protobufReader{p}
+    for len(req.p) > 0 {
+
+        field, wireType := req.next()
+        if field != 1 || wireType != 2 {
+            req.skip(wireType)
+            continue
+        }
+
+        series := remoteWriteSeries{Labels: make(map[string] string)}
+        ts     := &protobufReader{req.bytes()}
+        for len(ts.p) > 0 {
+
+            field, wireType := ts.next()
+            switch {
+            case field == 1 && wireType == 2: // Label
+                label := &protobufReader{ts.bytes()}
+                var name, value string
+                for len(label.p) > 0 {
+                    field, wireType := label.next()
+                    switch {
+                    case field == 1 && wireType == 2:
+                        name = string(label.bytes())
+                    case field == 2 && wireType == 2:
+                        value = string(label.bytes())
+                    default:
+                        label.skip(wireType)
+                    }
+                }
+                series.Labels[name] = value
+            case field == 2 && wireType == 2: // Sample
+                sample := &protobufReader{ts.bytes()}
+                var s remoteWriteSample
+                for len(sample.p) > 0 {
+                    field, wireType := sample.next()
+                    switch {
+                    case field == 1 && wireType == 1:
+                        s.Value = math.Float64frombits(sample.fixed64())
+                    case field == 2 && wireType == 0:
+                        s.Timestamp = int64(sample.varint())
+                    default:
+                        sample.skip(wireType)
+                    }
+                }
+                series.Samples = append(series.Samples, s)
+            default:
+                ts.skip(wireType)
+            }
+
+        }
+        ret = append(ret, series)
+
+    }
+
+    return ret, nil
+
+}
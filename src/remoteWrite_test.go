@@ -0,0 +1,132 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "math"
+    "testing"
+)
+
+func t_protobufField(field, wireType int, p []byte) []byte {
+    buf := binary.AppendUvarint(nil, uint64(field << 3 | wireType))
+    if wireType == 2 {
+        buf = binary.AppendUvarint(buf, uint64(len(p)))
+    }
+    return append(buf, p...)
+}
+
+func t_encodeRemoteWriteRequest(seriesList []remoteWriteSeries) []byte {
+    req := []byte{}
+    for _, series := range seriesList {
+        ts := []byte{}
+        for name, value := range series.Labels {
+            label := append(t_protobufField(1, 2, []byte(name)), t_protobufField(2, 2, []byte(value))...)
+            ts = append(ts, t_protobufField(1, 2, label)...)
+        }
+        for _, s := range series.Samples {
+            sample := t_protobufField(1, 1, binary.LittleEndian.AppendUint64(nil, math.Float64bits(s.Value)))
+            sample  = append(sample, t_protobufField(2, 0, binary.AppendUvarint(nil, uint64(s.Timestamp)))...)
+            ts = append(ts, t_protobufField(2, 2, sample)...)
+        }
+        req = append(req, t_protobufField(1, 2, ts)...)
+    }
+    return req
+}
+
+// Encodes in literals only, which is valid snappy
+func t_encodeSnappyLiterals(p []byte) []byte {
+    buf := binary.AppendUvarint(nil, uint64(len(p)))
+    for len(p) > 0 {
+        l := len(p)
+        if l > 256 {
+            l = 256
+        }
+        if l <= 60 {
+            buf = append(buf, byte(l - 1) << 2)
+        } else {
+            buf = append(buf, 60 << 2, byte(l - 1))
+        }
+        buf = append(buf, p[:l]...)
+        p = p[l:]
+    }
+    return buf
+}
+
+func TestDecodeSnappyBlock(t *testing.T) {
+    // "abcd" followed by an overlapping copy of 8 bytes at offset 4, and a
+    // 2-byte-offset copy of 3 bytes at offset 12
+    src := []byte{15, 3 << 2, 'a', 'b', 'c', 'd', 0x01 | (8 - 4) << 2, 4, 0x02 | (3 - 1) << 2, 12, 0}
+    dst, err := decodeSnappyBlock(src, 1 << 20)
+    if err != nil || string(dst) != "abcdabcdabcdabc" {
+        t.Errorf("unexpected %q %v", dst, err)
+    }
+    if _, err = decodeSnappyBlock([]byte{10, 0x01, 9}, 1 << 20); err == nil {
+        t.Error("expected an error for an offset beyond the data")
+    }
+    if _, err = decodeSnappyBlock([]byte{0xff, 0xff, 0xff, 0x7f}, 1 << 20); err == nil {
+        t.Error("expected an error for too large data")
+    }
+}
+
+func TestRecordRemoteWrite(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    fsKey := FormatMonitorKey("node_filesystem_avail_bytes", "mountpoint=/", "")
+    rule  := srv.clientConfig.RuleMap["test"]
+    rule.MonitorInterval = 60
+    rule.MonitorConfigMap["node_load1"] = MonitorConfig{}
+    rule.MonitorConfigMap[fsKey]        = MonitorConfig{}
+    srv.clientConfig.RuleMap["test"] = rule
+    srv.clientConfig.InfoMap["cl-0"] = ClientInfo{Host: "web-1", Alias: "default", Tags: "test"}
+
+    req := t_encodeRemoteWriteRequest([]remoteWriteSeries{
+        {
+            Labels:  map[string] string{"__name__": "node_load1", "instance": "web-1:9100", "job": "node"},
+            Samples: []remoteWriteSample{{1.5, 1600000060000}, {0.5, 1600000000000}},
+        },
+        {
+            Labels:  map[string] string{"__name__": "node_filesystem_avail_bytes", "instance": "cl-0", "mountpoint": "/"},
+            Samples: []remoteWriteSample{{1e9, 1600000000500}},
+        },
+        { // Not configured
+            Labels:  map[string] string{"__name__": "node_load5", "instance": "web-1:9100"},
+            Samples: []remoteWriteSample{{1, 1600000000000}},
+        },
+        { // Not whitelisted
+            Labels:  map[string] string{"__name__": "node_load1", "instance": "db-1:9100"},
+            Samples: []remoteWriteSample{{1, 1600000000000}},
+        },
+    })
+
+    report, err := srv.RecordRemoteWrite(t_encodeSnappyLiterals(req), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Recorded != 3 || report.Dropped != 2 {
+        t.Errorf("unexpected report %+v", report)
+    }
+
+    load := srv.monitorDataStore.InMemory("cl-0", "node_load1")
+    if len(load) != 2 || load[0] != (MonitorDatum{1600000000, 0.5, 60}) || load[1] != (MonitorDatum{1600000060, 1.5, 60}) {
+        t.Errorf("unexpected data %v", load)
+    }
+    if fs := srv.monitorDataStore.InMemory("cl-0", fsKey); len(fs) != 1 || fs[0].Value != 1e9 {
+        t.Errorf("unexpected data %v", fs)
+    }
+
+    // Permissions
+    report, err = srv.RecordRemoteWrite(t_encodeSnappyLiterals(req), func(clId, mKey string) bool {
+        return mKey != "node_load1"
+    })
+    if err != nil || report.Recorded != 1 || report.Dropped != 4 {
+        t.Errorf("unexpected report %+v %v", report, err)
+    }
+
+    // Malformed
+    if _, err = srv.RecordRemoteWrite(t_encodeSnappyLiterals(bytes.Repeat([]byte{0xff}, 10)), nil); err == nil {
+        t.Error("expected an error for a malformed request")
+    }
+
+}
@@ -1,19 +1,21 @@
 package main
 
 import (
-    "bufio"
     "bytes"
     "crypto/sha256"
+    "crypto/tls"
     "encoding/binary"
     "encoding/json"
     "fmt"
     "io"
     "io/ioutil"
     "net"
-    "net/http"
     "math"
     "os"
+    "path/filepath"
+    "sort"
     "strings"
+    "sync"
     "time"
 
     . "github.com/hjjg200/go-act"
@@ -44,16 +46,37 @@ type ServerConfig struct { // srvCfg
     GapThresholdTime    int    `json:"monitor.gapThresholdTime"` // (minutes)
     DecimationThreshold int    `json:"monitor.decimationThreshold"`
     DecimationInterval  int    `json:"monitor.decimationInterval"` // (minutes)
-    DataIndexesFile     string `json:"monitor.dataIndexesFile"`
+    DataIndexesDir      string `json:"monitor.dataIndexesDir"`
+    DataIndexesFile     string `json:"monitor.dataIndexesFile"` // Legacy, migrated to DataIndexesDir
     DataChunkLength     int    `json:"monitor.dataChunkLength"`
+    RetentionInterval   int    `json:"monitor.retentionInterval"` // (minutes)
+    WalSyncInterval     int    `json:"monitor.walSyncInterval"` // (seconds)
+    RollupTiers         []int     `json:"monitor.rollupTiers"` // (minutes)
+    RollupRetention     Retention `json:"monitor.rollupRetention"`
+    RollupIndexesDir    string    `json:"monitor.rollupIndexesDir"`
+    RollupIndexesFile   string    `json:"monitor.rollupIndexesFile"` // Legacy, migrated to RollupIndexesDir
+    // Remote write
+    RemoteWriteClientLabel string   `json:"remoteWrite.clientLabel"`
+    RemoteWriteDropLabels  []string `json:"remoteWrite.dropLabels"`
     // Web
     Web                 WebConfig `json:"web"`
     // Network
     Bind                string `json:"network.bind"`
     Port                int    `json:"network.port"`
     Tickrate            int    `json:"network.tickrate"` // (hz)
+    IdleTimeout         int    `json:"network.idleTimeout"` // (seconds)
     // Alarm
-    WebhookUrl          string `json:"alarm.webhookUrl"`
+    WebhookUrl              string            `json:"alarm.webhookUrl"`
+    AlertRepeatInterval     int               `json:"alert.repeatInterval"` // (minutes)
+    AlertEvaluationInterval int               `json:"alert.evaluationInterval"` // (seconds)
+    AlertStateFile          string            `json:"alert.stateFile"`
+    AlertHistoryFile        string            `json:"alert.historyFile"`
+    AlertHistoryRetention   Retention         `json:"alert.historyRetention"`
+    AlertClientDownGrace    int               `json:"alert.clientDownGrace"` // (seconds)
+    AlertChannels           []NotifierChannel `json:"alert.channels"`
+    AlertRoutes             []NotifierRoute   `json:"alert.routes"`
+    AlertRetries            int               `json:"alert.retries"`
+    AlertRetryBackoff       int               `json:"alert.retryBackoff"` // (seconds)
 }
 
 var DefaultServerConfig = ServerConfig{
@@ -82,16 +105,37 @@ var DefaultServerConfig = ServerConfig{
     GapThresholdTime:    15,
     DecimationThreshold: 1500,
     DecimationInterval:  10,
+    DataIndexesDir:      "./dataIndexes.d",
     DataIndexesFile:     "./dataIndexes.json",
     DataChunkLength:     1000, // 20 kB per chunk
+    RetentionInterval:   60,
+    WalSyncInterval:     1,
+    RollupTiers:         []int{10, 60},
+    RollupRetention:     "1y",
+    RollupIndexesDir:    "./rollupIndexes.d",
+    RollupIndexesFile:   "./rollupIndexes.json",
+    // Remote write
+    RemoteWriteClientLabel: "instance",
+    RemoteWriteDropLabels:  []string{"job"},
     // Web
     Web:                 DefaultWebConfig,
     // Network
     Bind:                "0.0.0.0",
     Port:                1226,
     Tickrate:            60,
+    IdleTimeout:         120,
     // Alarm
-    WebhookUrl:          "",
+    WebhookUrl:              "",
+    AlertRepeatInterval:     60,
+    AlertEvaluationInterval: 60,
+    AlertStateFile:          "./alertState.json",
+    AlertHistoryFile:        "./alertHistory.jsonl",
+    AlertHistoryRetention:   "90d",
+    AlertClientDownGrace:    300,
+    AlertChannels:           []NotifierChannel{},
+    AlertRoutes:             []NotifierRoute{},
+    AlertRetries:            3,
+    AlertRetryBackoff:       5,
 }
 
 
@@ -208,13 +252,23 @@ func(srv *Server) UpdateClientMetaLastConnection(clId string, ts int64) error {
 func(srv *Server) AppendClientMetaGaps(clId string, from, to int64) error {
     return srv.appendClientMetaInt64Slice(clId, clientMetaKeyGaps, []int64{from, to})
 }
+// Updates the last connection only when the given timestamp is more recent,
+// as backfilled records carry timestamps from the past
+func(srv *Server) AdvanceClientMetaLastConnection(clId string, ts int64) error {
+    lastConnection, ok := srv.GetClientMetaLastConnection(clId)
+    if ok && lastConnection >= ts {
+        return nil
+    }
+    return srv.UpdateClientMetaLastConnection(clId, ts)
+}
 
 
 // CLIENT CONFIG ---
 
 type ClientConfig struct { // clCfg
-    InfoMap ClientInfoMap `json:"infoMap"`
-    RuleMap ClientRuleMap `json:"ruleMap"`
+    InfoMap    ClientInfoMap `json:"infoMap"`
+    RuleMap    ClientRuleMap `json:"ruleMap"`
+    AlertRules []AlertRule   `json:"alertRules"` // For every client
 }
 
 var DefaultClientInfo = ClientInfo{
@@ -226,6 +280,12 @@ var DefaultClientInfo = ClientInfo{
 var DefaultClientRule = ClientRule{
     MonitorConfigMap: MonitorConfigMap{},
     MonitorInterval: 60,
+    SpoolMaxSize: 10240, // 10 MB
+    SpoolMaxAge: 60 * 24, // 1 day
+    BatchLength: 1,
+    Persistent: false,
+    HeartbeatInterval: 30,
+    Retention: "", // Forever
 }
 
 var DefaultMonitorConfig = MonitorConfig{
@@ -235,6 +295,18 @@ var DefaultMonitorConfig = MonitorConfig{
     Format: "",
     FatalRange: "",
     WarningRange: "",
+    Retention: "",
+    AlertFor: "",
+    ResolveRange: "",
+    RateWindow: "",
+    RateWarningRange: "",
+    RateFatalRange: "",
+    FullWindow: "",
+    FullAt: 0,
+    FullWarningTime: "",
+    FullFatalTime: "",
+    AbsentWarningTime: "",
+    AbsentFatalTime: "",
 }
 
 var DefaultClientConfig = ClientConfig{
@@ -308,21 +380,36 @@ var DefaultClientConfig = ClientConfig{
 type Server struct { // srv
     config                      ServerConfig
     cachedExecutable            []byte
-    httpListener                net.Listener
+    httpListener                *connListener // Connections handed over by the main listener
+    plainHttpListener           *connListener // Plain HTTP connections while TLS is set
+    httpTlsConfig               *tls.Config // Nil unless TLS is set
     httpRouter                  *httpRouter
+    connThrottle                *hostThrottle // Spaces the connections of each host
     authFingerprint             string
     clientConfig                ClientConfig
     clientConfigVersion         map[string/* clId */] string
-    clientMonitorDataMap        map[string/* clId */] MonitorDataMap // In-memory monitor data
-    clientMonitorDataIndexesMap map[string/* clId */] MonitorDataIndexesMap // Stored monitor data
+    monitorDataStore            *MonitorDataStore // In-memory and stored monitor data
+    storeMu                     sync.Mutex // Serializes storing cycles
+    monitorWal                  *MonitorWal // Data that are not stored in chunks yet
+    rollupStore                 *MonitorDataStore // Downsampled monitor data
+    monitorWindows              *monitorWindowStore // Recent data of the keys judged over windows
+    sampleStream                *sampleStream // Subscribers to the recorded values
+    alertManager                *alertManager
+    notifications               sync.WaitGroup // Deliveries of alert events
+    silences                    *silenceStore
+    alertHistoryMu              sync.Mutex // Appends to the alert history
     configParser                *config.Parser
     clientConfigParser          *config.Parser
 }
 
 func NewServer() *Server {
     srv := &Server{
-        clientMonitorDataMap: make(map[string/* clId */] MonitorDataMap),
-        clientMonitorDataIndexesMap: make(map[string/* clId */] MonitorDataIndexesMap),
+        monitorDataStore: NewMonitorDataStore(),
+        rollupStore:      NewMonitorDataStore(),
+        monitorWindows:   newMonitorWindowStore(),
+        sampleStream:     newSampleStream(),
+        alertManager:     newAlertManager(),
+        silences:         newSilenceStore(),
     }
     return srv
 }
@@ -340,10 +427,56 @@ func (srv *Server) setConfigValidators() (err error) {
     Try(cp.Validator(&DefaultServerConfig.GapThresholdTime, vAboveZero))
     Try(cp.Validator(&DefaultServerConfig.DecimationThreshold, vAboveZero))
     Try(cp.Validator(&DefaultServerConfig.DecimationInterval, vAboveZero))
+    Try(cp.Validator(&DefaultServerConfig.RetentionInterval, vAboveZero))
+    Try(cp.Validator(&DefaultServerConfig.WalSyncInterval, func(v int) bool {
+        return v >= 0
+    }))
+    Try(cp.Validator(&DefaultServerConfig.RollupTiers, func(v []int) bool {
+        for _, t := range v {
+            if t <= 0 {return false}
+        }
+        return true
+    }))
+    vRetention := func(rt Retention) bool {
+        _, err := rt.Seconds()
+        return err == nil
+    }
+    Try(cp.Validator(&DefaultServerConfig.RollupRetention, vRetention))
+    Try(cp.Validator(&DefaultServerConfig.AlertHistoryRetention, vRetention))
+    Try(cp.Validator(&DefaultServerConfig.RemoteWriteClientLabel, func(v string) bool {
+        return v != ""
+    }))
     Try(cp.Validator(&DefaultServerConfig.Port, func(v int) bool {
         return v >= 0 && v <= 65535
     }))
     Try(cp.Validator(&DefaultServerConfig.Tickrate, vAboveZero))
+    Try(cp.Validator(&DefaultServerConfig.IdleTimeout, vAboveZero))
+    Try(cp.Validator(&DefaultServerConfig.AlertRepeatInterval, func(v int) bool {
+        return v >= 0
+    }))
+    Try(cp.Validator(&DefaultServerConfig.AlertEvaluationInterval, vAboveZero))
+    Try(cp.Validator(&DefaultServerConfig.AlertChannels, func(v []NotifierChannel) bool {
+        names := make(map[string] bool)
+        for _, ch := range v {
+            err := ch.Validate()
+            if err == nil && names[ch.Name] {
+                err = fmt.Errorf("Notifier channel %s is duplicate", ch.Name)
+            }
+            if err != nil {
+                EventLogger.Warnln(err)
+                return false
+            }
+            names[ch.Name] = true
+        }
+        return true
+    }))
+    Try(cp.Validator(&DefaultServerConfig.AlertRetries, func(v int) bool {
+        return v >= 0
+    }))
+    Try(cp.Validator(&DefaultServerConfig.AlertRetryBackoff, vAboveZero))
+    Try(cp.Validator(&DefaultServerConfig.AlertClientDownGrace, func(v int) bool {
+        return v >= 0
+    }))
     Try(cp.Validator(&DefaultServerConfig.Web.Durations, func(v []int) bool {
         for _, d := range v {
             if d <= 0 {return false}
@@ -403,6 +536,48 @@ func(srv *Server) setClientConfigValidators() (err error) {
     Try(cp.Validator(&DefaultClientRule.MonitorInterval, func(i int) bool {
         return i > 0
     }))
+    vNotNegative := func(i int) bool {return i >= 0}
+    Try(cp.Validator(&DefaultClientRule.SpoolMaxSize, vNotNegative))
+    Try(cp.Validator(&DefaultClientRule.SpoolMaxAge, vNotNegative))
+    Try(cp.Validator(&DefaultClientRule.BatchLength, func(i int) bool {
+        return i > 0
+    }))
+    Try(cp.Validator(&DefaultClientRule.HeartbeatInterval, func(i int) bool {
+        return i > 0
+    }))
+    vRetention := func(rt Retention) bool {
+        _, err := rt.Seconds()
+        return err == nil
+    }
+    Try(cp.Validator(&DefaultClientRule.Retention, vRetention))
+    Try(cp.Validator(&DefaultMonitorConfig.Retention, vRetention))
+    Try(cp.Validator(&DefaultMonitorConfig.AlertFor, vRetention))
+    for _, rt := range []*Retention{
+        &DefaultMonitorConfig.RateWindow,
+        &DefaultMonitorConfig.FullWindow,
+        &DefaultMonitorConfig.FullWarningTime,
+        &DefaultMonitorConfig.FullFatalTime,
+        &DefaultMonitorConfig.AbsentWarningTime,
+        &DefaultMonitorConfig.AbsentFatalTime,
+    } {
+        Try(cp.Validator(rt, vRetention))
+    }
+    vRange := func(rng Range) bool {
+        return rng == "" || rng.Validate() == nil
+    }
+    Try(cp.Validator(&DefaultMonitorConfig.RateWarningRange, vRange))
+    Try(cp.Validator(&DefaultMonitorConfig.RateFatalRange, vRange))
+    vAlertRules := func(rules []AlertRule) bool {
+        for _, rule := range rules {
+            if err := rule.Validate(); err != nil {
+                EventLogger.Warnln(err)
+                return false
+            }
+        }
+        return true
+    }
+    Try(cp.Validator(&DefaultClientConfig.AlertRules, vAlertRules))
+    Try(cp.Validator(&DefaultClientRule.AlertRules, vAlertRules))
 
     return nil
 
@@ -487,13 +662,14 @@ func(srv *Server) Addr() string {
     return fmt.Sprintf("%s:%d", srv.config.Bind, srv.config.Port)
 }
 
-func(srv *Server) Start() (err error) {
+func(srv *Server) loadConfigs() (err error) {
 
     defer Catch(&err)
 
     // Server config
     configParser, err := config.NewParser(&DefaultServerConfig)
     Try(err)
+    Try(configParser.ChildDefaults(&DefaultNotifierChannel, &DefaultNotifierRoute))
     srv.configParser = configParser
     Try(srv.setConfigValidators())
     Try(srv.LoadConfig(flServerConfigPath))
@@ -503,13 +679,24 @@ func(srv *Server) Start() (err error) {
     clientConfigParser, err := config.NewParser(&DefaultClientConfig)
     Try(err)
     Try(clientConfigParser.ChildDefaults(
-        &DefaultClientInfo, &DefaultClientRule, &DefaultMonitorConfig,
+        &DefaultClientInfo, &DefaultClientRule, &DefaultMonitorConfig, &DefaultAlertRule,
     ))
     srv.clientConfigParser = clientConfigParser
     Try(srv.setClientConfigValidators())
     Try(srv.loadClientConfig())
     EventLogger.Infoln("Loaded client config")
 
+    return nil
+
+}
+
+func(srv *Server) Start() (err error) {
+
+    defer Catch(&err)
+
+    // Configs
+    Try(srv.loadConfigs())
+
     // Private key
     Try(srv.checkAuthPrivateKey())
     EventLogger.Infoln("The fingerprint of the authentication public key is:")
@@ -521,13 +708,27 @@ func(srv *Server) Start() (err error) {
 
     // Read stored monitor data
     Try(srv.readClientMonitorIndexesMap())
+    Try(srv.readMonitorRollupIndexes())
     EventLogger.Infoln("Read the monitor data indexes")
 
     // Ensure directories
     Try(EnsureDirectory(srv.config.DataStoreDir))
+    Try(EnsureDirectory(srv.monitorRollupDir()))
     Try(EnsureDirectory(srv.config.ClientMetaDir))
     EventLogger.Infoln("Ensured necessary directories")
 
+    // Recover data that were not stored before the last shutdown
+    Try(srv.replayMonitorWal())
+
+    // Alerts
+    Try(srv.readAlertStates())
+    EventLogger.Infoln("Read the alert states")
+    Try(srv.readSilences())
+    EventLogger.Infoln("Read the silences")
+
+    // TLS
+    Try(srv.loadHttpTlsConfig())
+
     // Network
     addr    := srv.Addr()
     ln, err := net.Listen("tcp", addr)
@@ -544,6 +745,14 @@ func(srv *Server) Start() (err error) {
         }()
         Try(srv.StoreClientMonitorDataMap(true))
         EventLogger.Infoln("Stored client monitor data")
+        Try(srv.StoreMonitorRollups(true))
+        EventLogger.Infoln("Stored monitor rollups")
+        if srv.monitorWal != nil {
+            Try(srv.monitorWal.Close())
+        }
+        srv.alertManager.writeMu.Lock()
+        defer srv.alertManager.writeMu.Unlock()
+        Try(srv.writeAlertStates(srv.alertManager.States()))
 
     })
 
@@ -558,6 +767,14 @@ func(srv *Server) Start() (err error) {
             err := srv.StoreClientMonitorDataMap(false)
             timer.Stop()
 
+            // Rollups
+            if err == nil {
+                err = srv.BuildMonitorRollups()
+            }
+            if err == nil {
+                err = srv.StoreMonitorRollups(false)
+            }
+
             // Task done
             railSwitch.Proceed(threadMain)
 
@@ -572,6 +789,63 @@ func(srv *Server) Start() (err error) {
     }()
     EventLogger.Infoln("Started monitor data caching thread")
 
+    // Retention thread
+    go func() {
+
+        itv := time.Minute * time.Duration(srv.config.RetentionInterval)
+
+        for Sleep(itv) && railSwitch.Queue(threadMain, 1) {
+
+            report, err := srv.EnforceMonitorDataRetention(false)
+
+            // Task done
+            railSwitch.Proceed(threadMain)
+
+            // The alert history has a lock of its own
+            if removed, err := srv.PruneAlertHistory(time.Now().Unix()); err != nil {
+                EventLogger.Warnln("Failed to prune the alert history:", err)
+            } else if removed > 0 {
+                EventLogger.Infoln("Removed", removed, "expired alert history entries")
+            }
+
+            if err != nil {
+                EventLogger.Warnln(err)
+                continue
+            }
+            if report.RemovedData > 0 {
+                EventLogger.Infoln(
+                    "Removed", report.RemovedData, "expired monitor data, freeing", report.FreedBytes, "bytes",
+                )
+            }
+
+        }
+
+    }()
+    EventLogger.Infoln("Started monitor data retention thread")
+
+    // Alert evaluation thread
+    go func() {
+
+        itv := time.Second * time.Duration(srv.config.AlertEvaluationInterval)
+
+        for Sleep(itv) && railSwitch.Queue(threadMain, 1) {
+
+            now          := time.Now().Unix()
+            observations := srv.observeAlertExpressions(now)
+            observations  = append(observations, srv.observeClientsDown(now)...)
+            observations  = append(observations, srv.observeAbsentValues()...)
+            events       := srv.advanceAlerts(observations)
+
+            // Task done
+            railSwitch.Proceed(threadMain)
+
+            srv.notifyAlertEvents(events)
+
+        }
+
+    }()
+    EventLogger.Infoln("Started alert evaluation thread")
+
     // Client Config Version Update
     go func() {
 
@@ -646,16 +920,19 @@ func(srv *Server) Start() (err error) {
     }
 
     // Http
-    go srv.startHttpServer()
+    srv.httpListener      = newConnListener(ln.Addr())
+    srv.plainHttpListener = newConnListener(ln.Addr())
+    go func() {
+        err := srv.startHttpServer()
+        EventLogger.Warnln("The HTTP server stopped:", err)
+    }()
     EventLogger.Infoln("Started HTTP server")
 
     // Main
     EventLogger.Infoln("Successfully started the server")
+    srv.connThrottle = newHostThrottle(time.Second / time.Duration(srv.config.Tickrate))
     for {
 
-        // Sleep
-        time.Sleep(time.Duration(1000.0 / float64(srv.config.Tickrate)) * time.Millisecond)
-
         // Connection
         conn, err := ln.Accept()
         if err != nil {
@@ -663,69 +940,7 @@ func(srv *Server) Start() (err error) {
             continue
         }
 
-        go func() {
-
-            host, _ := HostnameOf(conn)
-            defer func() {
-                if r := recover(); r != nil {
-                    EventLogger.Warnln(host, r)
-                }
-            }()
-
-            rd := bufio.NewReader(conn)
-
-            // Start line
-            startLine, err := rd.ReadString('\n')
-            if err == io.EOF { return }
-            Assert(err == nil, "Unexpected start line: " + startLine)
-
-            // Read rest bytes without advancing the reader
-            rest, err := rd.Peek(rd.Buffered()) 
-            Try(err)
-
-            // Bytes that are already read
-            already := append([]byte(startLine), rest...)
-
-            switch {
-            case strings.Contains(startLine, "HTTP"):
-
-                // HTTP
-                proxy, err := net.Dial("tcp", srv.HttpAddr())
-                Try(err)
-
-                // Source reader
-                src := bufio.NewReader(io.MultiReader(bytes.NewReader(already), conn))
-                go connCopy(conn, proxy) // Proxy -> Conn
-
-                // Keep connection open and stream requests continuously
-                for {
-
-                    // Look for requests
-                    req, err := http.ReadRequest(src)
-                    if err == io.EOF {
-                        return
-                    } else if err != nil {
-                        panic(err)
-                    }
-
-                    // New request
-                    AccessLogger.Infoln(host, req.Method, req.URL.Path, req.Proto)
-                    req.WriteProxy(proxy) // Conn -> Proxy
-
-                }
-
-            case strings.Contains(startLine, "TELESCRIBE"):
-
-                // TELESCRIBE
-                s := NewSession(conn)
-
-                // Prepend raw input
-                s.PrependRawInput(bytes.NewReader(already))
-                Try(srv.HandleSession(s))
-
-            default:
-            }
-        }()
+        go srv.serveConn(conn)
     }
 
     err = fmt.Errorf("Server terminated")
@@ -733,24 +948,48 @@ func(srv *Server) Start() (err error) {
 
 }
 
-func(srv *Server) readClientMonitorIndexesMap() (err error) {
+func(srv *Server) readClientMonitorIndexesMap() error {
+    return readMonitorDataIndexes(srv.monitorDataStore, srv.config.DataIndexesDir, srv.config.DataIndexesFile)
+}
+
+func(srv *Server) replayMonitorWal() (err error) {
 
     defer Catch(&err)
 
-    fn := srv.config.DataIndexesFile
-    f, err := os.OpenFile(fn, os.O_RDONLY, 0600)
-    
-    // Check existence
-    if os.IsNotExist(err) {
-        return TouchFile(fn, 0600)
-    }
+    wal, err := OpenMonitorWal(
+        filepath.Join(srv.config.DataStoreDir, monitorWalDirName),
+        time.Second * time.Duration(srv.config.WalSyncInterval),
+    )
     Try(err)
 
-    // JSON
-    dec := json.NewDecoder(f)
-    Try(dec.Decode(&srv.clientMonitorDataIndexesMap))
+    // Data that are already in chunks are skipped since the process could
+    // have ended after storing chunks but before the checkpoint
+    mdStore    := srv.monitorDataStore
+    indexesMap := make(map[string] MonitorDataIndexes)
+    replayed   := 0
+    Try(wal.Replay(func(clId, mKey string, datum MonitorDatum) {
+        k := clId + "/" + mKey
+        indexes, ok := indexesMap[k]
+        if !ok {
+            indexes       = mdStore.Indexes(clId, mKey)
+            indexesMap[k] = indexes
+        }
+        for _, index := range indexes {
+            if index.From <= datum.Timestamp && datum.Timestamp <= index.To {
+                return
+            }
+        }
+        if mdStore.Put(clId, mKey, datum, srv.config.MaxDataLength) {
+            replayed++
+        }
+    }))
+    EventLogger.Infoln("Replayed", replayed, "monitor data from the write-ahead log")
 
-    return f.Close()
+    // Compact the replayed segments into one
+    Try(wal.Checkpoint(mdStore.InMemoryMap))
+    srv.monitorWal = wal
+
+    return nil
 
 }
 
@@ -764,39 +1003,56 @@ func(srv *Server) GetClientIds() []string {
 }
 
 func(srv *Server) GetClientMonitorDataKeys(clId string) ([]string, bool) {
-    m := make(map[string] struct{})
-    // Index
-    indexes, ok1 := srv.clientMonitorDataIndexesMap[clId]
-    for mKey := range indexes {m[mKey] = struct{}{}}
-    // In-memory
-    inMem, ok2 := srv.clientMonitorDataMap[clId]
-    for mKey := range inMem   {m[mKey] = struct{}{}}
-
-    if !(ok1 || ok2) {return nil, false}
-    //
-    ret := []string{}
-    for mKey := range m {ret = append(ret, mKey)}
-    return ret, true
+    return srv.monitorDataStore.Keys(clId)
 }
 
-func(srv *Server) GetClientMonitorDataLength(clId, mKey string) int {
+// Returns the latest datum and its status of each monitor key of the client;
+// keep, if not nil, decides which monitor keys are included
+func(srv *Server) GetClientItemStatusMap(clId string, keep func(mKey string) bool) (ClientItemStatusMap, bool) {
 
-    sum := 0
-    
-    // Indexes
-    indexes := srv.clientMonitorDataIndexesMap[clId][mKey]
-    for _, index := range indexes {
-        sum += index.Length
+    mKeys, ok := srv.GetClientMonitorDataKeys(clId)
+    if !ok {
+        return nil, false
     }
 
-    // In-memory
-    inMem := srv.clientMonitorDataMap[clId][mKey]
-    sum += len(inMem)
+    latest, _ := srv.getClientLastTimestamp(clId)
+    ret       := make(ClientItemStatusMap)
+    for _, mKey := range mKeys {
+        if keep != nil && !keep(mKey) {
+            continue
+        }
 
-    return sum
+        // Config
+        mCfg, ok := srv.getClientMonitorConfig(clId, mKey)
+        if !ok {
+            EventLogger.Warnln("Monitor config for", mKey, "was not found")
+        }
+
+        length := srv.GetClientMonitorDataLength(clId, mKey)
+        if length == 0 {
+            continue
+        }
+        last   := srv.GetClientMonitorDataSlice(clId, mKey, length - 1, length)[0]
+        status := srv.statusOfMonitorValue(clId, mKey, mCfg, last.Timestamp, last.Value)
+        if _, absent := srv.absenceOfMonitorKey(clId, mKey, mCfg, latest); absent > status {
+            status = absent
+        }
+        ret[mKey] = ClientItemStatus{
+            Timestamp: last.Timestamp,
+            Value:     last.Value,
+            Per:       last.Per,
+            Status:    status,
+        }
+    }
+
+    return ret, true
 
 }
 
+func(srv *Server) GetClientMonitorDataLength(clId, mKey string) int {
+    return srv.monitorDataStore.Length(clId, mKey)
+}
+
 func(srv *Server) GetClientMonitorDataSlice(clId, mKey string, from, to int) MonitorData {
 
     base  := 0 // cursor
@@ -830,7 +1086,7 @@ func(srv *Server) GetClientMonitorDataSlice(clId, mKey string, from, to int) Mon
     }
     
     // Indexes
-    indexes := srv.clientMonitorDataIndexesMap[clId][mKey]
+    indexes, inMem := srv.monitorDataStore.Snapshot(clId, mKey)
     for _, index := range indexes {
         p1, p2 := advance(index.Length)
         if p1 != p2 { // read file only when not empty
@@ -844,7 +1100,6 @@ func(srv *Server) GetClientMonitorDataSlice(clId, mKey string, from, to int) Mon
     }
 
     // In-memory
-    inMem := srv.clientMonitorDataMap[clId][mKey]
     if len(inMem) > 0 {
         p1, p2 := advance(len(inMem))
         slice   = append(slice, inMem[p1:p2]...)
@@ -854,20 +1109,104 @@ func(srv *Server) GetClientMonitorDataSlice(clId, mKey string, from, to int) Mon
 
 }
 
-func(srv *Server) GetMonitorDataForIndex(uuid string) (MonitorData, error) {
+// Rewrites the stored chunks of older versions in the current version and
+// labels them with the keys found in the indexes; the file names are kept as
+// they are referenced by the indexes
+func(srv *Server) MigrateMonitorDataStore() (err error) {
 
-    fn := srv.config.DataStoreDir + "/" + uuid + dataStoreExt
-    f, err := os.OpenFile(fn, os.O_RDONLY, 0600)
-    if err != nil {
-        return nil, err
+    defer Catch(&err)
+
+    Try(srv.loadConfigs())
+    Try(srv.readClientMonitorIndexesMap())
+    Try(srv.readMonitorRollupIndexes())
+
+    Try(migrateMonitorDataChunks(srv.monitorDataStore, srv.config.DataStoreDir))
+    Try(migrateMonitorDataChunks(srv.rollupStore, srv.monitorRollupDir()))
+    return nil
+
+}
+
+func migrateMonitorDataChunks(mdStore *MonitorDataStore, dir string) (err error) {
+
+    defer Catch(&err)
+
+    fis, err := ioutil.ReadDir(dir)
+    if os.IsNotExist(err) {
+        return nil
     }
+    Try(err)
+
+    // Owners of each chunk; chunks shared by several keys are left unlabeled
+    type owner struct { clId, key string }
+    owners := make(map[string/* uuid */] []owner)
+    for clId, mdIdxMap := range mdStore.IndexesMap() {
+        for key, indexes := range mdIdxMap {
+            for _, index := range indexes {
+                owners[index.Uuid] = append(owners[index.Uuid], owner{clId, key})
+            }
+        }
+    }
+
+    migrated, total := 0, 0
+    before, after   := int64(0), int64(0)
+    for _, fi := range fis {
+
+        if fi.IsDir() || filepath.Ext(fi.Name()) != dataStoreExt {
+            continue
+        }
+        total++
+
+        uuid   := strings.TrimSuffix(fi.Name(), dataStoreExt)
+        fn     := filepath.Join(dir, fi.Name())
+        p, err := ioutil.ReadFile(fn)
+        Try(err)
+
+        _, _, labeled, md, err := decodeMonitorDataChunk(p)
+        if err != nil {
+            EventLogger.Warnln("Skipping", fi.Name(), "as it could not be read:", err)
+            continue
+        }
+
+        var chunk []byte
+        switch {
+        case len(owners[uuid]) == 1 && !labeled:
+            o    := owners[uuid][0]
+            chunk = encodeMonitorDataChunk(o.clId, o.key, md)
+        case !labeled && MonitorDataVersionOf(p) != MonitorDatumVersion:
+            chunk = SerializeMonitorData(md)
+        default:
+            continue
+        }
+        Try(rewriteFile(fn, bytes.NewReader(chunk)))
 
-    p, err := ioutil.ReadAll(f)
+        migrated++
+        before += int64(len(p))
+        after  += int64(len(chunk))
+
+    }
+
+    EventLogger.Infoln("Migrated", migrated, "of", total, "monitor data chunks in", dir)
+    EventLogger.Infoln("Chunk size changed from", before, "to", after, "bytes")
+    return nil
+
+}
+
+func(srv *Server) GetMonitorDataForIndex(uuid string) (MonitorData, error) {
+    return readMonitorDataChunk(srv.config.DataStoreDir, uuid)
+}
+
+func monitorDataChunkPath(dir, uuid string) string {
+    return filepath.Join(dir, uuid + dataStoreExt)
+}
+
+func readMonitorDataChunk(dir, uuid string) (MonitorData, error) {
+
+    p, err := ioutil.ReadFile(monitorDataChunkPath(dir, uuid))
     if err != nil {
         return nil, err
     }
 
-    part, err := DeserializeMonitorData(p)
+    _, _, _, part, err := decodeMonitorDataChunk(p)
     if err != nil {
         return nil, err
     }
@@ -936,16 +1275,15 @@ func(srv *Server) FprintClientMonitorDataMinMax(w io.Writer, clId, mKey string)
     min, max := math.Inf(0), math.Inf(-1)
 
     // Indexes
-    mdIndexes, ok := srv.clientMonitorDataIndexesMap[clId][mKey]
-    if ok {
+    mdIndexes, md := srv.monitorDataStore.Snapshot(clId, mKey)
+    if len(mdIndexes) > 0 {
         m, M := mdIndexes.MinMax()
         if m < min {min = m}
         if M > max {max = M}
     }
 
     // In-memory
-    md, ok := srv.clientMonitorDataMap[clId][mKey]
-    if ok {
+    if len(md) > 0 {
         m, M := md.MinMax()
         if m < min {min = m}
         if M > max {max = M}
@@ -982,8 +1320,11 @@ func(srv *Server) FprintClientMonitorDataCsvFilter(w io.Writer, clId, mKey strin
     }
 
     // Cache and flush
-    cache := MonitorData{}
-    flush := func() {
+    // + counts hold how many raw data each cached datum stands for, which
+    //   are not 1 for rollups
+    cache  := MonitorData{}
+    counts := []float64{}
+    flush  := func() {
         if len(cache) == 0 {
             return
         }
@@ -991,6 +1332,14 @@ func(srv *Server) FprintClientMonitorDataCsvFilter(w io.Writer, clId, mKey strin
         ts  := cache.To()
         val := agrgFn(cache)
         per := cache.Duration()
+        if filter.Type == monitorAggregateKeyMean {
+            // Cached values are sums for rollups
+            count := 0.0
+            for _, c := range counts {
+                count += c
+            }
+            val = monitorAggregateSum(cache) / count
+        }
         if filter.EqualWeight { // TODO equal weight changes max and min value
             val *= float64(filter.Per) / float64(per)
             per  = int64(filter.Per)
@@ -999,10 +1348,11 @@ func(srv *Server) FprintClientMonitorDataCsvFilter(w io.Writer, clId, mKey strin
             w, "%d,%f,%d\n",
             ts, val, per,
         )
-        cache = MonitorData{}
+        cache  = MonitorData{}
+        counts = []float64{}
     }
     lastTo := int64(0)
-    put := func(datum MonitorDatum) {
+    put := func(datum MonitorDatum, count float64) {
         if filter.From > datum.Timestamp || filter.To < datum.Timestamp {
             return
         }
@@ -1018,6 +1368,7 @@ func(srv *Server) FprintClientMonitorDataCsvFilter(w io.Writer, clId, mKey strin
         }
         
         cache  = append(cache, datum)
+        counts = append(counts, count)
         lastTo = cache.To()
         // When the put data's duration exceed or match the per
         if cache.Duration() >= int64(filter.Per) {
@@ -1025,11 +1376,23 @@ func(srv *Server) FprintClientMonitorDataCsvFilter(w io.Writer, clId, mKey strin
         }
     }
 
+    // Rollups are used as far as they are built when the per is coarse enough
+    rawFrom := filter.From
+    if res := srv.pickMonitorRollupResolution(filter.Per); res > 0 {
+        rolled, rolledCounts := srv.getMonitorRollupRange(clId, mKey, res, filter.Type, filter.From, filter.To)
+        for i, datum := range rolled {
+            put(datum, rolledCounts[i])
+        }
+        if watermark := srv.monitorRollupWatermark(clId, mKey, res); watermark > rawFrom {
+            rawFrom = watermark
+        }
+    }
+
     // Indexes
-    mdIndexes := srv.clientMonitorDataIndexesMap[clId][mKey]
+    mdIndexes, inMem := srv.monitorDataStore.Snapshot(clId, mKey)
     for _, mi := range mdIndexes {func() {
 
-        if mi.To < filter.From || mi.From > filter.To {
+        if mi.To < rawFrom || mi.From > filter.To {
             return
         }
 
@@ -1044,18 +1407,28 @@ func(srv *Server) FprintClientMonitorDataCsvFilter(w io.Writer, clId, mKey strin
             return
         }
 
+        // Backfilled data that are not merged into the chunks yet
+        if n := sort.Search(len(inMem), func(i int) bool {
+            return inMem[i].Timestamp > mi.To
+        }); n > 0 {
+            part, inMem = part.Merge(inMem[:n]), inMem[n:]
+        }
+
         // Write
         for _, datum := range part {
-            put(datum)
+            if datum.Timestamp >= rawFrom {
+                put(datum, 1)
+            }
         }
 
     }()}
 
     // In-memory data
-    inMem := srv.clientMonitorDataMap[clId][mKey]
-    if len(inMem) > 0 && inMem.To() > filter.From {
+    if len(inMem) > 0 && inMem.To() > rawFrom {
         for _, datum := range inMem {
-            put(datum)
+            if datum.Timestamp >= rawFrom {
+                put(datum, 1)
+            }
         }
     }
 
@@ -1066,19 +1439,44 @@ func(srv *Server) FprintClientMonitorDataCsvFilter(w io.Writer, clId, mKey strin
 
 func(srv *Server) StoreClientMonitorDataMap(forced bool) (err error) {
 
-    // TODO: store the in-memory values into indexes at cleanup
+    srv.storeMu.Lock()
+    defer srv.storeMu.Unlock()
+    defer Catch(&err)
+
+    mdStore := srv.monitorDataStore
+    Try(srv.storeMonitorDataStore(
+        mdStore, srv.config.DataStoreDir, srv.config.DataIndexesDir, forced, true,
+    ))
+
+    // Only the data that remain in memory are kept in the write-ahead log
+    if srv.monitorWal != nil {
+        Try(srv.monitorWal.Checkpoint(mdStore.InMemoryMap))
+    }
+
+    return
+
+}
+
+// Writes the in-memory data of the store to chunks in dir and then appends
+// their indexes to indexesDir; the caller must hold storeMu
+// + Backfilled data that are not later than the stored data of their keys are
+//   merged into the chunks instead, and the indexes of their clients are
+//   rewritten, so that the indexes of each key stay in timestamp order
+func(srv *Server) storeMonitorDataStore(
+    mdStore *MonitorDataStore, dir, indexesDir string, forced, configuredOnly bool,
+) (err error) {
 
     defer Catch(&err)
 
-    // Current indexes
-    clMdIdxMap := srv.clientMonitorDataIndexesMap
+    Try(EnsureDirectory(dir))
 
-    for clId, mdMap := range srv.clientMonitorDataMap {
+    // Copies of the in-memory data
+    inMemMap  := mdStore.InMemoryMap()
+    added     := make(map[string/* clId */] MonitorDataIndexesMap)
+    rewritten := make(map[string/* clId */] struct{})
+    obsolete  := []string{} // uuids of the rewritten chunks
 
-        // Check indexes
-        if _, ok := clMdIdxMap[clId]; !ok {
-            clMdIdxMap[clId] = make(MonitorDataIndexesMap)
-        }
+    for clId, mdMap := range inMemMap {
         
         for mKey, mData := range mdMap {func() {
 
@@ -1088,22 +1486,35 @@ func(srv *Server) StoreClientMonitorDataMap(forced bool) (err error) {
                 }
             }()
 
-            // Check indexes
-            indexes := MonitorDataIndexes{}
-            if _, ok := clMdIdxMap[clId][mKey]; ok {
-                indexes = clMdIdxMap[clId][mKey]
-            }
-
             // Check config
             _, ok := srv.getClientMonitorConfig(clId, mKey)
             switch {
-            case !ok: // Ignore items with no config
+            case configuredOnly && !ok: // Ignore items with no config
                 //mCfg.Constant: // Ignore constant items
                 return
             }
 
+            // Late data
+            // + The in-memory data are in timestamp order, so the ones that are
+            //   not later than the last chunk come first
+            prior    := mdStore.Indexes(clId, mKey)
+            late     := MonitorData{}
+            merged   := MonitorDataIndexes(nil)
+            if len(prior) > 0 {
+                lastTo := prior[len(prior) - 1].To
+                n      := sort.Search(len(mData), func(i int) bool {
+                    return mData[i].Timestamp > lastTo
+                })
+                late, mData = mData[:n], mData[n:]
+            }
+            if len(late) > 0 {
+                var uuids []string
+                merged, uuids = mergeMonitorDataChunks(dir, clId, mKey, prior, late)
+                obsolete = append(obsolete, uuids...)
+            }
+
             // Vars
-            stored    := MonitorData{}
+            indexes   := MonitorDataIndexes{}
             lenChunk  := srv.config.DataChunkLength
             lenStored := 0
 
@@ -1117,7 +1528,7 @@ func(srv *Server) StoreClientMonitorDataMap(forced bool) (err error) {
             }
 
             // Separate
-            stored, srv.clientMonitorDataMap[clId][mKey] = mData[:lenStored], mData[lenStored:]
+            stored := mData[:lenStored]
 
             // Function
             cursor := 0
@@ -1133,16 +1544,12 @@ func(srv *Server) StoreClientMonitorDataMap(forced bool) (err error) {
                     end = len(stored)
                 }
 
-                part    := stored[start:end]
-                index   := CreateIndexForMonitorData(part)
-                indexes  = indexes.Append(index)
+                part     := stored[start:end]
+                index, p := createMonitorDataChunk(clId, mKey, part)
+                indexes   = indexes.Append(index)
 
                 // Store
-                fn     := srv.config.DataStoreDir + "/" + index.Uuid + dataStoreExt
-                f, err := os.OpenFile(fn, os.O_CREATE | os.O_WRONLY, 0600)
-                Try(err)
-                f.Write(SerializeMonitorData(part))
-                f.Close()
+                Try(rewriteFile(monitorDataChunkPath(dir, index.Uuid), bytes.NewReader(p)))
 
                 // Advance
                 cursor += length
@@ -1153,89 +1560,160 @@ func(srv *Server) StoreClientMonitorDataMap(forced bool) (err error) {
             // Do
             for advance(lenChunk) {}
 
-            // Index each
-            /*
-            for i := 0; i < quotient; i++ {
-                start   := i * lenChunk
-                part    := stored[start:start + lenChunk]
-                index   := CreateIndexForMonitorData(part)
-                indexes  = indexes.Append(index)
-
-                // Store
-                fn := srv.config.DataStoreDir + "/" + index.Uuid + dataStoreExt
-                f, err := os.OpenFile(fn, os.O_CREATE | os.O_WRONLY, 0600)
-                Try(err)
-                f.Write(SerializeMonitorData(part))
-                f.Close()
-            }
-            */
-
             // Assign
-            clMdIdxMap[clId][mKey] = indexes
+            // + The chunk files are written before the indexes are updated so that
+            //   readers never see an index without its file
+            if len(late) > 0 {
+                stored = append(append(MonitorData{}, late...), stored...)
+                mdStore.PersistRewritten(clId, mKey, stored, merged.Append(indexes...))
+                rewritten[clId] = struct{}{}
+                return
+            }
+            mdStore.Persist(clId, mKey, stored, indexes)
+            if len(indexes) > 0 {
+                if added[clId] == nil {
+                    added[clId] = make(MonitorDataIndexesMap)
+                }
+                added[clId][mKey] = indexes
+            }
 
         }()}
 
     }
 
     // Store new indexes
-    buf := bytes.NewBuffer(nil)
-    enc := json.NewEncoder(buf)
-    enc.Encode(clMdIdxMap)
-    Try(rewriteFile(srv.config.DataIndexesFile, buf))
+    // + The clients whose chunks were rewritten have their indexes rewritten
+    //   as a whole
+    clIds := make([]string, 0, len(rewritten))
+    for clId := range rewritten {
+        delete(added, clId)
+        clIds = append(clIds, clId)
+    }
+    Try(appendMonitorDataIndexes(indexesDir, added))
+    if len(clIds) == 0 {
+        return nil
+    }
+    Try(writeMonitorDataIndexes(mdStore, indexesDir, clIds))
+
+    // Remove the rewritten chunks last, as retention does, unless another
+    // index still refers to them
+    referenced := make(map[string] struct{})
+    for _, mdIdxMap := range mdStore.IndexesMap() {
+        for _, indexes := range mdIdxMap {
+            for _, index := range indexes {
+                referenced[index.Uuid] = struct{}{}
+            }
+        }
+    }
+    for _, uuid := range obsolete {
+        if _, ok := referenced[uuid]; ok {
+            continue
+        }
+        err := os.Remove(monitorDataChunkPath(dir, uuid))
+        if err != nil && !os.IsNotExist(err) {
+            EventLogger.Warnln("Failed to remove a rewritten chunk:", err)
+        }
+    }
+    return nil
+
+}
 
-    // Replace
-    //srv.clientMonitorDataIndexesMap = clMdIdxMap
+// Merges the late data into the chunks of the indexes that they fall into,
+// and into new chunks for those between the chunks; returns the indexes that
+// replace the given ones and the uuids of the chunks that were rewritten
+// + Every late datum must not be later than the last chunk; a datum with the
+//   same timestamp as a stored one is dropped
+func mergeMonitorDataChunks(
+    dir, clId, mKey string, indexes MonitorDataIndexes, late MonitorData,
+) (merged MonitorDataIndexes, obsolete []string) {
+
+    write := func(md MonitorData) {
+        index, p := createMonitorDataChunk(clId, mKey, md)
+        Try(rewriteFile(monitorDataChunkPath(dir, index.Uuid), bytes.NewReader(p)))
+        merged = append(merged, index)
+    }
 
-    return
+    merged = make(MonitorDataIndexes, 0, len(indexes) + 1)
+    for _, index := range indexes {
+
+        // Before the chunk
+        n := sort.Search(len(late), func(i int) bool {
+            return late[i].Timestamp >= index.From
+        })
+        if n > 0 {
+            write(late[:n])
+            late = late[n:]
+        }
+
+        // Within the chunk
+        n = sort.Search(len(late), func(i int) bool {
+            return late[i].Timestamp > index.To
+        })
+        if n == 0 {
+            merged = append(merged, index)
+            continue
+        }
+        md, err := readMonitorDataChunk(dir, index.Uuid)
+        Try(err)
+        combined := md.Merge(late[:n])
+        late      = late[n:]
+        if len(combined) == len(md) {
+            // Only duplicates
+            merged = append(merged, index)
+            continue
+        }
+        write(combined)
+        obsolete = append(obsolete, index.Uuid)
+
+    }
+
+    return merged, obsolete
 
 }
 
 func(srv *Server) RecordValueMap(clId string, timestamp int64, valMap map[string] interface{}, per int32) {
 
-    // Ensure
-    _, ok := srv.clientMonitorDataMap[clId]
-    if !ok {
-        srv.clientMonitorDataMap[clId] = make(MonitorDataMap)
+    recorded := srv.recordValueMap(clId, timestamp, valMap, per)
+
+    // Streams
+    srv.sampleStream.Publish(recorded)
+
+    // Alerts
+    if events := srv.evaluateAlerts(recorded); len(events) > 0 {
+        srv.notifyAlertEvents(events)
     }
 
-    //
-    fatalValues := make(map[string] float64)
-    appendValue := func(mKey string, val float64) {
+}
 
-        short, ok := srv.clientMonitorDataMap[clId][mKey]
-        if !ok {
-            short = make(MonitorData, 0)
-        }
+// Records backfilled records in timestamp order without evaluating alerts for
+// values from the past
+func(srv *Server) RecordBackfill(clId string, recs MonitorRecords) {
+    sort.Sort(recs)
+    for _, rec := range recs {
+        srv.recordValueMap(clId, rec.Timestamp, rec.ValueMap, rec.Per)
+    }
+}
 
-        // Trim Data
-        if len(short) > srv.config.MaxDataLength {
-            // Get MaxLength - 1 items
-            start := len(short) - srv.config.MaxDataLength + 1
-            short  = short[start:]
-        }
+// Records the values and returns the values that were recorded
+func(srv *Server) recordValueMap(
+    clId string, timestamp int64, valMap map[string] interface{}, per int32,
+) []monitorWalEntry {
 
-        // Append
-        srv.clientMonitorDataMap[clId][mKey] = append(
-            short,
-            MonitorDatum{
-                Timestamp: timestamp,
-                Value:     val,
-                Per:       per,
-            },
-        )
+    //
+    walEntries := make([]monitorWalEntry, 0, len(valMap))
+    appendValue := func(mKey string, val float64) {
 
-        // Check Status
-        cfg, ok := srv.getClientMonitorConfig(clId, mKey)
-        if !ok {
-            EventLogger.Warnln("Monitor config for", mKey, "was not found")
-            return
+        datum := MonitorDatum{
+            Timestamp: timestamp,
+            Value:     val,
+            Per:       per,
         }
-
-        // Fatal Check
-        st := cfg.StatusOf(val)
-        if st == MonitorStatusFatal {
-            fatalValues[mKey] = val
+        if !srv.monitorDataStore.Put(clId, mKey, datum, srv.config.MaxDataLength) {
+            // Already recorded
+            return
         }
+        srv.monitorWindows.Put(clId, mKey, datum)
+        walEntries = append(walEntries, monitorWalEntry{clId, mKey, datum})
 
     }
 
@@ -1253,59 +1731,15 @@ func(srv *Server) RecordValueMap(clId string, timestamp int64, valMap map[string
         }
     }
 
-    // Send webhook
-    go func() {
-        err := srv.sendAlarmWebhook(clId, timestamp, fatalValues)
+    // Write-ahead log
+    if srv.monitorWal != nil {
+        err := srv.monitorWal.Append(walEntries)
         if err != nil {
-            EventLogger.Warnln("Failed to send webhook:", err)
+            EventLogger.Warnln("Failed to append to the write-ahead log:", err)
         }
-    }()
-
-}
-
-// WEBHOOK ---
-
-type alarmWebhook struct {
-    ClientId    string `json:"clientId"`
-    Timestamp   int64 `json:"timestamp"`
-    FatalValues map[string] float64 `json:"fatalValues"`
-}
-func(srv *Server) sendAlarmWebhook(clId string, timestamp int64, fatalValues map[string] float64) error {
-
-    // Empty values
-    if len(fatalValues) == 0 {
-        return nil
     }
 
-    // Empty URL
-    url := srv.config.WebhookUrl
-    if url == "" {
-        return nil
-    }
-
-    // Body
-    aw := alarmWebhook{
-        ClientId:    clId,
-        Timestamp:   timestamp,
-        FatalValues: fatalValues,
-    }
-    body, _ := json.Marshal(aw)
-
-    // Request
-    rsp, err := http.Post(
-        url, "application/json", bytes.NewReader(body),
-    )
-    if err != nil {
-        return err
-    }
-
-    // Check Response
-    if rsp.StatusCode != 200 {
-        // Webhook Receiver must reply back with 200
-        return fmt.Errorf("status code %d", rsp.StatusCode)
-    }
-
-    return nil
+    return walEntries
 
 }
 
@@ -1339,13 +1773,11 @@ func(srv *Server) getClientMonitorConfig(clId string, mKey string) (MonitorConfi
 
 func(srv *Server) HandleSession(s *Session) (err error) {
 
-    logParams := make([]interface{}, 0)
     defer Catch(&err)
 
     // Get Address
     host, err := s.RemoteHost()
     Try(err)
-    logParams = append(logParams, host)
 
     // Check Whitelisted
     clCfg       := srv.clientConfig
@@ -1363,10 +1795,38 @@ func(srv *Server) HandleSession(s *Session) (err error) {
         return fmt.Errorf("%s [non-whitelisted] tried to establish a connection", host)
     }
 
-    clRsp, err := s.NextResponse()
-    Try(err)
+    // Persistent connections keep sending responses until they are idle
+    idleTimeout := time.Second * time.Duration(srv.config.IdleTimeout)
+    for handled := 0; ; handled++ {
+
+        clRsp, err := s.NextResponse()
+        if handled > 0 && err != nil {
+            // Closed by the client or timed out
+            EventLogger.Debugln(debugSessionMay15, host, "persistent connection ended:", err)
+            return nil
+        }
+        Try(err)
+
+        keepAlive, err := srv.handleClientResponse(s, host, clRsp)
+        Try(err)
+        if !keepAlive {
+            return nil
+        }
+
+        Try(s.SetReadDeadline(time.Now().Add(idleTimeout)))
+
+    }
+
+}
+
+// Handles a response from a whitelisted host and returns whether the client
+// wants to keep the connection open
+func(srv *Server) handleClientResponse(s *Session, host string, clRsp Response) (keepAlive bool, err error) {
+
+    defer Catch(&err)
 
     // Rule
+    clCfg := srv.clientConfig
     var clId   string
     var clInfo ClientInfo
     alias := clRsp.String("alias")
@@ -1377,10 +1837,10 @@ func(srv *Server) HandleSession(s *Session) (err error) {
             break
         }
     }
-    AccessLogger.Infoln(clInfo.Alias, "from", clInfo.Host, "connected")
+    AccessLogger.Infoln(clInfo.Alias, "from", clInfo.Host, clRsp.Name())
     Assert(clId != "", "Client must be configured in the config")
-    logParams  = append(logParams, clId)
     clRule    := clCfg.RuleMap.Get(clInfo.Tags)
+    keepAlive  = clRsp.Bool("keepAlive")
 
     // Version Check
     ver := clRsp.String("version")
@@ -1412,14 +1872,28 @@ func(srv *Server) HandleSession(s *Session) (err error) {
         Try(s.WriteResponse(srvRsp))
 
         // Meta
+        // + The data since spoolFrom is going to be backfilled by the client
+        //   so the gap ends there
         timestamp := time.Now().Unix()
+        gapEnd    := timestamp
+        spoolFrom := clRsp.Int64("spoolFrom")
+        if spoolFrom > 0 && spoolFrom < gapEnd {
+            gapEnd = spoolFrom
+        }
         lastConnection, ok := srv.GetClientMetaLastConnection(clId)
-        if ok {
-            Try(srv.AppendClientMetaGaps(clId, lastConnection, timestamp))
+        if ok && gapEnd > lastConnection {
+            Try(srv.AppendClientMetaGaps(clId, lastConnection, gapEnd))
         }
         Try(srv.UpdateClientMetaLastHello(clId, timestamp))
+        srv.recoverClientDown(clId, timestamp)
 
-        return nil
+        return false, nil
+
+    case "heartbeat":
+
+        // Heartbeats only keep persistent connections alive
+        Try(s.WriteResponse(NewResponse("ok")))
+        return keepAlive, nil
 
     case "monitor-record":
         
@@ -1430,11 +1904,37 @@ func(srv *Server) HandleSession(s *Session) (err error) {
         srv.RecordValueMap(clId, timestamp, valMap, per)
 
         // Meta
-        srv.UpdateClientMetaLastConnection(clId, timestamp)
+        srv.AdvanceClientMetaLastConnection(clId, timestamp)
+
+    case "monitor-batch":
+
+        recs := MonitorRecords{}
+        Try(clRsp.Decode("records", &recs))
+        sort.Sort(recs)
+        for _, rec := range recs {
+            srv.RecordValueMap(clId, rec.Timestamp, rec.ValueMap, rec.Per)
+        }
+
+        // Meta
+        if len(recs) > 0 {
+            srv.AdvanceClientMetaLastConnection(clId, recs[len(recs) - 1].Timestamp)
+        }
+
+    case "monitor-backfill":
+
+        recs := MonitorRecords{}
+        Try(clRsp.Decode("records", &recs))
+        srv.RecordBackfill(clId, recs)
+
+        // Meta
+        if len(recs) > 0 {
+            srv.AdvanceClientMetaLastConnection(clId, recs[len(recs) - 1].Timestamp)
+        }
 
     default:
         panic("Unknown response")
     }
+    srv.recoverClientDown(clId, time.Now().Unix())
 
     // Post Handling
 
@@ -1455,12 +1955,12 @@ func(srv *Server) HandleSession(s *Session) (err error) {
         srvRsp.Set("rule", ruleBytes)
         srvRsp.Set("configVersion", srv.clientConfigVersion[clId])
         Try(s.WriteResponse(srvRsp))
-        return nil
+        return keepAlive, nil
     }
 
     // OK
     srvRsp := NewResponse("ok")
     Try(s.WriteResponse(srvRsp))
-    return nil
+    return keepAlive, nil
 
 }
\ No newline at end of file
@@ -68,6 +68,7 @@ type Session struct {
 }
 
 var cachedSessionInfos map[string] *SessionInfo
+var sessionInfosMu sync.Mutex // Guards cachedSessionInfos and sessionAutoIncrement
 var sessionKnownHosts map[string] *p256.PublicKey // P256 public key
 var sessionAuthPriv *p256.PrivateKey // P256 private key
 
@@ -75,18 +76,13 @@ func init() {
     cachedSessionInfos = make(map[string] *SessionInfo)
     go func() {
         for {
-            buf := make(map[string] *SessionInfo)
-            // Concurrent delete
-            // Copy
-            for k, si := range cachedSessionInfos { buf[k] = si }
-            // Delete
-            for k, si := range buf {
+            sessionInfosMu.Lock()
+            for k, si := range cachedSessionInfos {
                 if si.IsExpired() {
-                    delete(buf, k)
+                    delete(cachedSessionInfos, k)
                 }
             }
-            // Assign
-            cachedSessionInfos = buf
+            sessionInfosMu.Unlock()
             time.Sleep(sessionLifetime)
         }
     }()
@@ -100,10 +96,13 @@ func NewSession(conn net.Conn) *Session {
 
 func NewSessionInfo() (*SessionInfo) {
 
-    sessionAutoIncrement++
-    id := new(big.Int).SetInt64(sessionAutoIncrement).Bytes()
     priv := p256.GenerateKey()
 
+    sessionInfosMu.Lock()
+    defer sessionInfosMu.Unlock()
+
+    sessionAutoIncrement++
+    id := new(big.Int).SetInt64(sessionAutoIncrement).Bytes()
     si := &SessionInfo{
         id: id,
         ephmPriv: priv,
@@ -245,6 +244,10 @@ func (s *Session) SetConn(conn net.Conn) {
     s.conn = conn
 }
 
+func (s *Session) SetReadDeadline(t time.Time) error {
+    return s.conn.SetReadDeadline(t)
+}
+
 func (s *Session) IsExpired() bool {
     if s.info == nil {
         return true
@@ -276,7 +279,7 @@ func (s *Session) WriteEncrypted(p []byte) (i int, err error) {
     encrypted := aesgcm.Encrypt(s.info.ephmMaster, p)
     Try(writeByteSlicePacket(s.conn, s.info.id))
     Try(writeByteSlicePacket(s.conn, encrypted))
-    return s.conn.Write(encrypted)
+    return len(p), nil
 }
 
 func (s *Session) Read(p []byte) (int, error) {
@@ -324,7 +327,9 @@ func (s *Session) read(p []byte, nested bool) (int, error) {
         }
         if s.info == nil {
             // No info yet, look for cached session
+            sessionInfosMu.Lock()
             si, ok := cachedSessionInfos[string(sessionId)]
+            sessionInfosMu.Unlock()
             if !ok {
                 s.writeRecordHeader(packetTypeSessionNotFound)
                 return 0, fmt.Errorf("Session not found")
@@ -684,13 +689,14 @@ type PacketRecordHeader struct {
 func (s *Session) readRecordHeader() (PacketRecordHeader, error) {
     prhl := packeRecordtHeaderLen
     p := make([]byte, prhl)
-    n, err := s.rawInput.Read(p)
+    // Headers can arrive in pieces on long-lived connections
+    n, err := io.ReadFull(s.rawInput, p)
+    if err == io.ErrUnexpectedEOF || (err == nil && n != prhl) {
+        return PacketRecordHeader{}, fmt.Errorf("Record header too short")
+    }
     if err != nil {
         return PacketRecordHeader{}, err
     }
-    if n != prhl {
-        return PacketRecordHeader{}, fmt.Errorf("Record header too short")
-    }
 
     // Check
     if string(p[:10]) != packetRecordHeaderStart ||
@@ -826,11 +832,25 @@ func (rp *Response) Int64(key string) int64 {
     return int64(v)
 }
 
+func (rp *Response) Bool(key string) (b bool) {
+    b, _ = rp.args[key].(bool)
+    return
+}
+
 func (rp *Response) Float64(key string) (f float64) {
     f, _ = rp.args[key].(float64)
     return
 }
 
+// Decodes a composite value such as an array of objects into v
+func (rp *Response) Decode(key string, v interface{}) error {
+    j, err := json.Marshal(rp.args[key])
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(j, v)
+}
+
 func (rp *Response) Bytes(key string) []byte {
     // Json uses base64 to encode []byte
     b, err := base64.StdEncoding.DecodeString(rp.String(key))
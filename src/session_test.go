@@ -0,0 +1,77 @@
+package main
+
+import (
+    "net"
+    "testing"
+    "./log"
+    "./secret/p256"
+)
+
+// Several responses must be able to be exchanged over a single connection
+func TestSessionPersistentExchange(t *testing.T) {
+
+    EventLogger = &log.Logger{}
+
+    sessionAuthPriv   = p256.GenerateKey()
+    sessionKnownHosts = map[string] *p256.PublicKey{
+        "127.0.0.1": &sessionAuthPriv.PublicKey,
+    }
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+
+    const rounds = 3
+    done := make(chan error, 1)
+    go func() {
+        conn, err := ln.Accept()
+        if err != nil {
+            done <- err
+            return
+        }
+        defer conn.Close()
+        s := NewSession(conn)
+        for i := 0; i < rounds; i++ {
+            clRsp, err := s.NextResponse()
+            if err != nil {
+                done <- err
+                return
+            }
+            srvRsp := NewResponse("ok")
+            srvRsp.Set("seq", clRsp.Int("seq"))
+            if err = s.WriteResponse(srvRsp); err != nil {
+                done <- err
+                return
+            }
+        }
+        done <- nil
+    }()
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    s := NewSession(conn)
+    for i := 0; i < rounds; i++ {
+        clRsp := NewResponse("heartbeat")
+        clRsp.Set("seq", i)
+        if err = s.WriteResponse(clRsp); err != nil {
+            t.Fatal(err)
+        }
+        srvRsp, err := s.NextResponse()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if srvRsp.Name() != "ok" || srvRsp.Int("seq") != i {
+            t.Fatalf("round %d: unexpected response %s %v", i, srvRsp.Name(), srvRsp.Args())
+        }
+    }
+
+    if err = <-done; err != nil {
+        t.Fatal(err)
+    }
+
+}
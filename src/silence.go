@@ -0,0 +1,370 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    silencesFileName = "silences.json"
+    silenceIdLength  = 12
+)
+
+var maintenanceWindowDays = map[string] time.Weekday{
+    "sun": time.Sunday,
+    "mon": time.Monday,
+    "tue": time.Tuesday,
+    "wed": time.Wednesday,
+    "thu": time.Thursday,
+    "fri": time.Friday,
+    "sat": time.Saturday,
+}
+
+/*
+
+Silences and maintenance windows keep the alert events that they match from
+being notified, while the values are recorded and the alerts advance as usual.
+They match the events by the pattern of client ids, the tags of the clients,
+and the pattern of monitor keys, of which the empty ones match every event; *
+and ? match any characters in the patterns.
+
+A silence is in effect from startsAt to endsAt, and is expired by setting its
+endsAt to the time of the expiry; expired silences are kept for the record:
+
+{
+  "id": "f3Xa9Kq2LmPz",
+  "clientId": "web-*",
+  "tags": "",
+  "key": "cpu-usage*",
+  "startsAt": 1600000000,
+  "endsAt": 1600007200,
+  "author": "user1",
+  "comment": "Patching the web servers",
+  "createdAt": 1599999000
+}
+
+A maintenance window recurs on the days, mon through sun or every day when
+empty, from the start time of the day in the location for the duration:
+
+{
+  "id": "b7Rt2YwQ0cNe",
+  "clientId": "",
+  "tags": "db",
+  "key": "",
+  "days": ["sun"],
+  "start": "02:00",
+  "duration": "3h",
+  "location": "Asia/Seoul",
+  "author": "user1",
+  "comment": "Weekly backups",
+  "createdAt": 1599999000
+}
+
+Both are written to silences.json in the client meta directory whenever they
+change.
+
+*/
+
+type Silence struct {
+    Id        string `json:"id"`
+    ClientId  string `json:"clientId"` // The pattern of client ids
+    Tags      string `json:"tags"` // Any of the tags of the client
+    Key       string `json:"key"` // The pattern of monitor keys
+    StartsAt  int64  `json:"startsAt"`
+    EndsAt    int64  `json:"endsAt"`
+    Author    string `json:"author"`
+    Comment   string `json:"comment"`
+    CreatedAt int64  `json:"createdAt"`
+}
+
+type MaintenanceWindow struct {
+    Id        string    `json:"id"`
+    ClientId  string    `json:"clientId"`
+    Tags      string    `json:"tags"`
+    Key       string    `json:"key"`
+    Days      []string  `json:"days"`
+    Start     string    `json:"start"` // HH:MM
+    Duration  Retention `json:"duration"`
+    Location  string    `json:"location"` // The local time of the server when empty
+    Author    string    `json:"author"`
+    Comment   string    `json:"comment"`
+    CreatedAt int64     `json:"createdAt"`
+}
+
+type silenceStore struct {
+    mu                 sync.RWMutex
+    Silences           []Silence           `json:"silences"`
+    MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows"`
+}
+
+func newSilenceStore() *silenceStore {
+    return &silenceStore{
+        Silences:           []Silence{},
+        MaintenanceWindows: []MaintenanceWindow{},
+    }
+}
+
+// Returns whether the event of the client of the tags is matched
+func matchSilence(clIdPattern, tags, keyPattern string, ev alertEvent, clTags string) bool {
+
+    if clIdPattern != "" && !matchQueryPattern(clIdPattern, ev.ClientId) {
+        return false
+    }
+    if keyPattern != "" && !matchQueryPattern(keyPattern, ev.Key) {
+        return false
+    }
+    if tags != "" {
+        for _, tag := range SplitWhitespace(tags) {
+            for _, clTag := range SplitWhitespace(clTags) {
+                if tag == clTag {
+                    return true
+                }
+            }
+        }
+        return false
+    }
+    return true
+
+}
+
+func(sl Silence) Validate() error {
+    switch {
+    case sl.ClientId == "" && sl.Tags == "" && sl.Key == "":
+        return fmt.Errorf("A silence must match by at least one of clientId, tags, and key")
+    case sl.EndsAt <= sl.StartsAt:
+        return fmt.Errorf("A silence must end after it starts")
+    }
+    return nil
+}
+
+func(sl Silence) IsActive(now int64) bool {
+    return sl.StartsAt <= now && now < sl.EndsAt
+}
+
+func(mw MaintenanceWindow) location() (*time.Location, error) {
+    if mw.Location == "" {
+        return time.Local, nil
+    }
+    return time.LoadLocation(mw.Location)
+}
+
+// Returns the hour and the minute of the start
+func(mw MaintenanceWindow) startOfDay() (int, int, error) {
+    var h, m int
+    _, err := fmt.Sscanf(mw.Start, "%d:%d", &h, &m)
+    if err != nil || h < 0 || h > 23 || m < 0 || m > 59 || len(mw.Start) != 5 {
+        return 0, 0, fmt.Errorf("The start of a maintenance window must be HH:MM")
+    }
+    return h, m, nil
+}
+
+func(mw MaintenanceWindow) Validate() error {
+
+    if mw.ClientId == "" && mw.Tags == "" && mw.Key == "" {
+        return fmt.Errorf("A maintenance window must match by at least one of clientId, tags, and key")
+    }
+    for _, day := range mw.Days {
+        if _, ok := maintenanceWindowDays[day]; !ok {
+            return fmt.Errorf("Unknown day %q", day)
+        }
+    }
+    if _, _, err := mw.startOfDay(); err != nil {
+        return err
+    }
+    if sec, err := mw.Duration.Seconds(); err != nil || sec == 0 {
+        return fmt.Errorf("The duration of a maintenance window must be given, e.g., 2h")
+    }
+    if _, err := mw.location(); err != nil {
+        return err
+    }
+    return nil
+
+}
+
+func(mw MaintenanceWindow) IsActive(now int64) bool {
+
+    loc, err1    := mw.location()
+    h, m, err2   := mw.startOfDay()
+    duration, _  := mw.Duration.Seconds()
+    if err1 != nil || err2 != nil || duration <= 0 {
+        return false
+    }
+
+    // The windows that started on the days as long ago as the duration
+    t := time.Unix(now, 0).In(loc)
+    for back := 0; int64(back - 1) * 86400 < duration; back++ {
+        day   := t.AddDate(0, 0, -back)
+        start := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, loc)
+        if !mw.isOn(start.Weekday()) {
+            continue
+        }
+        if from := start.Unix(); from <= now && now < from + duration {
+            return true
+        }
+    }
+    return false
+
+}
+
+func(mw MaintenanceWindow) isOn(wd time.Weekday) bool {
+    if len(mw.Days) == 0 {
+        return true
+    }
+    for _, day := range mw.Days {
+        if maintenanceWindowDays[day] == wd {
+            return true
+        }
+    }
+    return false
+}
+
+// Returns whether the event is kept from being notified at the time
+func(srv *Server) isAlertSilenced(ev alertEvent, now int64) bool {
+
+    ss := srv.silences
+    ss.mu.RLock()
+    defer ss.mu.RUnlock()
+
+    clTags := srv.clientConfig.InfoMap[ev.ClientId].Tags
+    for _, sl := range ss.Silences {
+        if sl.IsActive(now) && matchSilence(sl.ClientId, sl.Tags, sl.Key, ev, clTags) {
+            return true
+        }
+    }
+    for _, mw := range ss.MaintenanceWindows {
+        if matchSilence(mw.ClientId, mw.Tags, mw.Key, ev, clTags) && mw.IsActive(now) {
+            return true
+        }
+    }
+    return false
+
+}
+
+func(srv *Server) silencesPath() string {
+    return srv.config.ClientMetaDir + "/" + silencesFileName
+}
+
+func(srv *Server) readSilences() (err error) {
+
+    defer Catch(&err)
+
+    p, err := ioutil.ReadFile(srv.silencesPath())
+    if os.IsNotExist(err) {
+        return nil
+    }
+    Try(err)
+
+    ss := srv.silences
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    Try(json.Unmarshal(p, ss))
+
+    return nil
+
+}
+
+// Writes the silences; the caller must hold the lock of the silences
+func(srv *Server) writeSilences() error {
+    p, err := json.MarshalIndent(srv.silences, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err = EnsureDirectory(srv.config.ClientMetaDir); err != nil {
+        return err
+    }
+    return rewriteFile(srv.silencesPath(), bytes.NewReader(p))
+}
+
+// Returns copies of the silences and the maintenance windows
+func(srv *Server) GetSilences() ([]Silence, []MaintenanceWindow) {
+    ss := srv.silences
+    ss.mu.RLock()
+    defer ss.mu.RUnlock()
+    return append([]Silence{}, ss.Silences...), append([]MaintenanceWindow{}, ss.MaintenanceWindows...)
+}
+
+// Adds the silence with a new id and returns it
+func(srv *Server) AddSilence(sl Silence) (Silence, error) {
+
+    if err := sl.Validate(); err != nil {
+        return sl, err
+    }
+    sl.Id        = RandomAlphaNum(silenceIdLength)
+    sl.CreatedAt = time.Now().Unix()
+
+    ss := srv.silences
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    ss.Silences = append(ss.Silences, sl)
+    return sl, srv.writeSilences()
+
+}
+
+// Ends the silence at the time if it has not ended yet
+func(srv *Server) ExpireSilence(id string, now int64) (Silence, bool, error) {
+
+    ss := srv.silences
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+
+    for i := range ss.Silences {
+        sl := &ss.Silences[i]
+        if sl.Id != id {
+            continue
+        }
+        if sl.EndsAt > now {
+            sl.EndsAt = now
+            if sl.StartsAt > now {
+                sl.StartsAt = now
+            }
+            return *sl, true, srv.writeSilences()
+        }
+        return *sl, true, nil
+    }
+    return Silence{}, false, nil
+
+}
+
+// Adds the maintenance window with a new id and returns it
+func(srv *Server) AddMaintenanceWindow(mw MaintenanceWindow) (MaintenanceWindow, error) {
+
+    for i := range mw.Days {
+        mw.Days[i] = strings.ToLower(mw.Days[i])
+    }
+    if err := mw.Validate(); err != nil {
+        return mw, err
+    }
+    mw.Id        = RandomAlphaNum(silenceIdLength)
+    mw.CreatedAt = time.Now().Unix()
+
+    ss := srv.silences
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    ss.MaintenanceWindows = append(ss.MaintenanceWindows, mw)
+    return mw, srv.writeSilences()
+
+}
+
+func(srv *Server) DeleteMaintenanceWindow(id string) (bool, error) {
+
+    ss := srv.silences
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+
+    for i, mw := range ss.MaintenanceWindows {
+        if mw.Id == id {
+            ss.MaintenanceWindows = append(ss.MaintenanceWindows[:i], ss.MaintenanceWindows[i + 1:]...)
+            return true, srv.writeSilences()
+        }
+    }
+    return false, nil
+
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "./log"
+)
+
+func TestSilenceMatching(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    srv.clientConfig.InfoMap["web-1"] = ClientInfo{Tags: "web test"}
+    srv.silences.Silences = []Silence{
+        {ClientId: "web-*", Key: "cpu-usage*", StartsAt: 100, EndsAt: 200},
+        {Tags: "db", StartsAt: 0, EndsAt: 1000},
+    }
+    srv.clientConfig.InfoMap["db-1"] = ClientInfo{Tags: "db"}
+
+    for _, c := range []struct {
+        ev       alertEvent
+        now      int64
+        expected bool
+    }{
+        {alertEvent{ClientId: "web-1", Key: "cpu-usage"}, 150, true},
+        {alertEvent{ClientId: "web-1", Key: "cpu-usage"}, 200, false},
+        {alertEvent{ClientId: "web-1", Key: "cpu-usage"}, 99, false},
+        {alertEvent{ClientId: "web-1", Key: "load"}, 150, false},
+        {alertEvent{ClientId: "cl-0", Key: "cpu-usage"}, 150, false},
+        {alertEvent{ClientId: "db-1", Key: "load"}, 500, true},
+        {alertEvent{ClientId: "db-1", Key: "load"}, 1000, false},
+    } {
+        if got := srv.isAlertSilenced(c.ev, c.now); got != c.expected {
+            t.Errorf("%+v at %d: expected %v", c.ev, c.now, c.expected)
+        }
+    }
+
+    for _, invalid := range []Silence{
+        {StartsAt: 0, EndsAt: 100},
+        {Key: "load", StartsAt: 100, EndsAt: 100},
+    } {
+        if err := invalid.Validate(); err == nil {
+            t.Errorf("%+v: expected an error", invalid)
+        }
+    }
+
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+
+    loc := time.FixedZone("test", 9 * 3600)
+    at  := func(day, h, m int) int64 {
+        // 2020-03-01 is a sunday
+        return time.Date(2020, 3, day, h, m, 0, 0, loc).Unix()
+    }
+    mw := MaintenanceWindow{
+        Key:      "load",
+        Days:     []string{"sun", "wed"},
+        Start:    "23:00",
+        Duration: "3h",
+    }
+
+    // The location is set after validating as the fixed zone is not loadable
+    if err := mw.Validate(); err != nil {
+        t.Fatal(err)
+    }
+    origLocal := time.Local
+    time.Local = loc
+    defer func() { time.Local = origLocal }()
+
+    for _, c := range []struct {
+        now      int64
+        expected bool
+    }{
+        {at(1, 22, 59), false},
+        {at(1, 23, 0), true},
+        {at(2, 1, 59), true}, // Monday, continued from sunday
+        {at(2, 2, 0), false},
+        {at(2, 23, 30), false},
+        {at(4, 23, 30), true},
+        {at(8, 23, 30), true},
+    } {
+        if got := mw.IsActive(c.now); got != c.expected {
+            t.Errorf("%s: expected %v", time.Unix(c.now, 0).In(loc), c.expected)
+        }
+    }
+
+    // Every day, longer than a day
+    mw.Days     = nil
+    mw.Duration = "30h"
+    if !mw.IsActive(at(3, 4, 0)) || !mw.IsActive(at(4, 4, 59)) {
+        t.Error("Expected the window of every day to be active")
+    }
+
+    for _, invalid := range []MaintenanceWindow{
+        {Start: "02:00", Duration: "1h"},
+        {Key: "load", Days: []string{"someday"}, Start: "02:00", Duration: "1h"},
+        {Key: "load", Start: "2:00", Duration: "1h"},
+        {Key: "load", Start: "24:00", Duration: "1h"},
+        {Key: "load", Start: "02:00"},
+        {Key: "load", Start: "02:00", Duration: "1h", Location: "Nowhere/Nothing"},
+    } {
+        if err := invalid.Validate(); err == nil {
+            t.Errorf("%+v: expected an error", invalid)
+        }
+    }
+
+}
+
+func TestSilencedNotifications(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    mu       := sync.Mutex{}
+    requests := []string{}
+    hsrv     := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        p, _ := ioutil.ReadAll(r.Body)
+        mu.Lock()
+        defer mu.Unlock()
+        requests = append(requests, string(p))
+    }))
+    defer hsrv.Close()
+
+    srv.config.AlertRepeatInterval = 0
+    srv.config.AlertChannels       = []NotifierChannel{
+        {Name: "hook", Type: NotifierTypeWebhook, Url: hsrv.URL, Body: "{{.Key}}"},
+    }
+    srv.clientConfig.RuleMap["test"].MonitorConfigMap["load"] = MonitorConfig{FatalRange: "8:"}
+
+    now := time.Now().Unix()
+    _, err := srv.AddSilence(Silence{ClientId: "cl-0", StartsAt: now - 60, EndsAt: now + 3600})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The values are recorded and the alerts fire while silenced
+    for _, clId := range []string{"cl-0", "cl-1"} {
+        events := srv.evaluateAlerts(srv.recordValueMap(clId, 60, map[string] interface{}{"load": 9.0}, 60))
+        if len(events) != 1 {
+            t.Fatalf("Expected %s to fire, got %+v", clId, events)
+        }
+        srv.notifyAlertEvents(events)
+    }
+    srv.notifications.Wait()
+
+    if len(requests) != 1 || requests[0] != "load" {
+        t.Errorf("Expected only cl-1 to be notified, got %q", requests)
+    }
+    if len(srv.alertManager.States()) != 2 {
+        t.Errorf("Expected both alerts to be firing")
+    }
+    if n := srv.monitorDataStore.Length("cl-0", "load"); n != 1 {
+        t.Errorf("Expected the value to be recorded, got %d values", n)
+    }
+
+}
+
+func TestSilenceApi(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+    AccessLogger = &log.Logger{}
+
+    password := fmt.Sprintf("%x", Sha256Sum([]byte("password")))
+    srv.config.HttpUsers = []HttpUser{
+        {Name: "admin", Password: password, Permissions: []string{"api/v1.*"}},
+        {Name: "viewer", Password: password, Permissions: []string{"api/v1.get.silences"}},
+    }
+    srv.populateHttpRouter()
+    hsrv := httptest.NewServer(srv)
+    defer hsrv.Close()
+
+    request := func(user, method, path, body string) (int, map[string] json.RawMessage) {
+        req, _ := http.NewRequest(method, hsrv.URL + "/api/v1/" + path, strings.NewReader(body))
+        req.SetBasicAuth(user, "password")
+        rsp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer rsp.Body.Close()
+        ret  := make(map[string] json.RawMessage)
+        p, _ := ioutil.ReadAll(rsp.Body)
+        json.Unmarshal(p, &ret)
+        return rsp.StatusCode, ret
+    }
+
+    // Silences
+    st, _ := request("viewer", "POST", "silences", `{"key": "load", "startsAt": 0, "endsAt": 9999999999}`)
+    if st != 403 {
+        t.Errorf("Expected 403, got %d", st)
+    }
+    st, _ = request("admin", "POST", "silences", `{"startsAt": 0, "endsAt": 9999999999}`)
+    if st != 400 {
+        t.Errorf("Expected 400, got %d", st)
+    }
+    st, ret := request("admin", "POST", "silences", `{"key": "load", "startsAt": 0, "endsAt": 9999999999, "comment": "patch"}`)
+    sl      := Silence{}
+    if st != 200 || json.Unmarshal(ret["silence"], &sl) != nil || sl.Id == "" || sl.Author != "admin" {
+        t.Fatalf("Unexpected response %d %s", st, ret["silence"])
+    }
+
+    st, ret  = request("viewer", "GET", "silences", "")
+    silences := []Silence{}
+    if st != 200 || json.Unmarshal(ret["silences"], &silences) != nil || len(silences) != 1 {
+        t.Fatalf("Unexpected response %d %s", st, ret["silences"])
+    }
+    if !srv.isAlertSilenced(alertEvent{ClientId: "cl-0", Key: "load"}, time.Now().Unix()) {
+        t.Error("Expected the silence to be in effect")
+    }
+
+    if st, _ = request("admin", "POST", "expireSilence/nothing", ""); st != 404 {
+        t.Errorf("Expected 404, got %d", st)
+    }
+    if st, _ = request("admin", "POST", "expireSilence/" + sl.Id, ""); st != 200 {
+        t.Errorf("Expected 200, got %d", st)
+    }
+    if srv.isAlertSilenced(alertEvent{ClientId: "cl-0", Key: "load"}, time.Now().Unix()) {
+        t.Error("Expected the silence to be expired")
+    }
+
+    // Maintenance windows
+    st, ret = request("admin", "POST", "maintenanceWindows",
+        `{"tags": "test", "days": ["Sun"], "start": "02:00", "duration": "2h", "location": "UTC"}`)
+    mw     := MaintenanceWindow{}
+    if st != 200 || json.Unmarshal(ret["maintenanceWindow"], &mw) != nil || mw.Days[0] != "sun" {
+        t.Fatalf("Unexpected response %d %s", st, ret["maintenanceWindow"])
+    }
+    if st, _ = request("viewer", "GET", "maintenanceWindows", ""); st != 403 {
+        t.Errorf("Expected 403, got %d", st)
+    }
+
+    // Persisted
+    reloaded := NewServer()
+    reloaded.config = srv.config
+    if err := reloaded.readSilences(); err != nil {
+        t.Fatal(err)
+    }
+    silences, windows := reloaded.GetSilences()
+    if len(silences) != 1 || silences[0].EndsAt > time.Now().Unix() || len(windows) != 1 || windows[0].Id != mw.Id {
+        t.Errorf("Unexpected silences %+v %+v", silences, windows)
+    }
+
+    if st, _ = request("admin", "POST", "deleteMaintenanceWindow/" + mw.Id, ""); st != 204 {
+        t.Errorf("Expected 204, got %d", st)
+    }
+    if _, windows = srv.GetSilences(); len(windows) != 0 {
+        t.Errorf("Expected the window to be deleted, got %+v", windows)
+    }
+
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "./config"
+    . "github.com/hjjg200/go-act"
+)
+
+const (
+    snapshotVersion              = 1
+    snapshotManifestName         = "manifest.json"
+    snapshotServerConfigName     = "serverConfig.json"
+    snapshotClientConfigName     = "clientConfig.json"
+    snapshotAuthPrivateKeyName   = "serverAuth.priv"
+    snapshotDataStoreDirName     = "serverStore.d"
+    snapshotDataIndexesDirName   = "dataIndexes.d"
+    snapshotRollupIndexesDirName = "rollupIndexes.d"
+    snapshotClientMetaDirName    = "clientMeta.d"
+)
+
+/*
+
+A snapshot is a gzipped tarball of the state of the server at a point in time:
+
+manifest.json       The version, the time, and the sha256 sum of every file
+serverConfig.json
+clientConfig.json
+serverAuth.priv     The private key that clients know the server by, only when
+                    asked for by -snapshot_auth_key
+serverStore.d/      The chunks, including the rollups, without the write-ahead log
+dataIndexes.d/
+rollupIndexes.d/
+clientMeta.d/
+
+The in-memory data are stored before the snapshot is taken, and the store is
+locked while it is archived, so that the chunks and the indexes are consistent
+with each other. The values recorded in the meantime remain in memory.
+
+The snapshots served by the API never contain the private key, so that the
+permission to download them does not let anyone impersonate the server.
+
+A snapshot is restored by extracting it to a staging directory, checking the
+sums of the files and the integrity of the stores, and then moving the files to
+the paths of the server config in the snapshot, none of which may exist. Orphan
+and overlapping chunks, which lose no data, are only warned about.
+
+*/
+
+type SnapshotManifest struct {
+    Version    int                           `json:"version"`
+    AppVersion string                        `json:"appVersion"`
+    Timestamp  int64                         `json:"timestamp"`
+    Checksums  map[string/* path */] string `json:"checksums"`
+}
+
+// Returns the names in the snapshot and the paths of the server
+func(srv *Server) snapshotEntries(withAuthKey bool) [][2]string {
+    entries := [][2]string{
+        {snapshotServerConfigName, flServerConfigPath},
+        {snapshotClientConfigName, srv.config.ClientConfigPath},
+        {snapshotDataStoreDirName, srv.config.DataStoreDir},
+        {snapshotDataIndexesDirName, srv.config.DataIndexesDir},
+        {snapshotRollupIndexesDirName, srv.config.RollupIndexesDir},
+        {snapshotClientMetaDirName, srv.config.ClientMetaDir},
+    }
+    if withAuthKey {
+        entries = append(entries, [2]string{snapshotAuthPrivateKeyName, srv.config.AuthPrivateKeyPath})
+    }
+    return entries
+}
+
+// Writes a snapshot of the running server, with the private key of the server
+// only when withAuthKey is true
+func(srv *Server) Snapshot(w io.Writer, withAuthKey bool) (manifest SnapshotManifest, err error) {
+
+    defer Catch(&err)
+
+    // Store everything in memory
+    Try(srv.StoreClientMonitorDataMap(true))
+    Try(srv.BuildMonitorRollups())
+    Try(srv.StoreMonitorRollups(true))
+
+    srv.storeMu.Lock()
+    defer srv.storeMu.Unlock()
+
+    manifest = SnapshotManifest{
+        Version:    snapshotVersion,
+        AppVersion: Version,
+        Timestamp:  time.Now().Unix(),
+        Checksums:  make(map[string] string),
+    }
+
+    gw := gzip.NewWriter(w)
+    tw := tar.NewWriter(gw)
+    walDir := filepath.Join(srv.config.DataStoreDir, monitorWalDirName)
+
+    add := func(name string, p []byte, mode os.FileMode) {
+        Try(tw.WriteHeader(&tar.Header{
+            Name:    name,
+            Mode:    int64(mode.Perm()),
+            Size:    int64(len(p)),
+            ModTime: time.Unix(manifest.Timestamp, 0),
+        }))
+        _, err := tw.Write(p)
+        Try(err)
+        manifest.Checksums[name] = fmt.Sprintf("%x", Sha256Sum(p))
+    }
+
+    for _, entry := range srv.snapshotEntries(withAuthKey) {
+
+        name, root := entry[0], entry[1]
+        Try(filepath.Walk(root, func(fn string, fi os.FileInfo, err error) error {
+            switch {
+            case os.IsNotExist(err) && fn == root:
+                return nil
+            case err != nil:
+                return err
+            case fi.IsDir() && fn == walDir:
+                return filepath.SkipDir
+            case fi.IsDir(), !fi.Mode().IsRegular(), strings.HasSuffix(fn, ".tmp"):
+                return nil
+            }
+
+            rel, err := filepath.Rel(root, fn)
+            if err != nil {
+                return err
+            }
+            // Files are read whole, as some of them are appended to in the meantime
+            p, err := ioutil.ReadFile(fn)
+            if err != nil {
+                return err
+            }
+            add(path.Join(name, filepath.ToSlash(rel)), p, fi.Mode())
+            return nil
+        }))
+
+    }
+
+    // The manifest comes last
+    p, err := json.MarshalIndent(manifest, "", "  ")
+    Try(err)
+    add(snapshotManifestName, p, 0600)
+    delete(manifest.Checksums, snapshotManifestName)
+
+    Try(tw.Close())
+    return manifest, gw.Close()
+
+}
+
+// Writes a snapshot to the file, or to the standard output if fn is -, without
+// starting the server
+func(srv *Server) SnapshotFile(fn string, withAuthKey bool) (err error) {
+
+    defer Catch(&err)
+
+    Try(srv.loadConfigs())
+    Try(srv.readClientMonitorIndexesMap())
+    Try(srv.readMonitorRollupIndexes())
+    Try(EnsureDirectory(srv.config.DataStoreDir))
+    Try(EnsureDirectory(srv.monitorRollupDir()))
+
+    // The data in the write-ahead log are stored as well
+    Try(srv.replayMonitorWal())
+    defer srv.monitorWal.Close()
+
+    var w io.Writer = os.Stdout
+    if fn != "-" {
+        f, err := os.OpenFile(fn, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+        Try(err)
+        defer f.Close()
+        w = f
+    }
+
+    manifest, err := srv.Snapshot(w, withAuthKey)
+    Try(err)
+    EventLogger.Infoln("Wrote a snapshot of", len(manifest.Checksums), "files")
+    return nil
+
+}
+
+// RESTORE ---
+
+// Restores the snapshot file to the paths of the server config in it
+func(srv *Server) RestoreSnapshot(fn string) (err error) {
+
+    defer Catch(&err)
+
+    // Staging
+    stage, err := ioutil.TempDir(filepath.Dir(flServerConfigPath), ".telescribe-restore")
+    Try(err)
+    defer os.RemoveAll(stage)
+
+    f, err := os.Open(fn)
+    Try(err)
+    defer f.Close()
+    sums, err := extractSnapshot(f, stage)
+    Try(err)
+
+    // Manifest
+    manifest := SnapshotManifest{}
+    p, err   := ioutil.ReadFile(filepath.Join(stage, snapshotManifestName))
+    Assert(err == nil, "The snapshot has no manifest")
+    Try(json.Unmarshal(p, &manifest))
+    Assert(manifest.Version == snapshotVersion, fmt.Sprintf("Unknown snapshot version %d", manifest.Version))
+    delete(sums, snapshotManifestName)
+    Assert(len(sums) == len(manifest.Checksums), "The files of the snapshot do not match its manifest")
+    for name, sum := range manifest.Checksums {
+        Assert(sums[name] == sum, "Checksum mismatch: " + name)
+    }
+
+    // Server config
+    p, err = ioutil.ReadFile(filepath.Join(stage, snapshotServerConfigName))
+    Assert(err == nil, "The snapshot has no server config")
+    configParser, err := config.NewParser(&DefaultServerConfig)
+    Try(err)
+    srv.configParser = configParser
+    Try(srv.setConfigValidators())
+    Try(srv.configParser.Parse(p, &srv.config))
+
+    // Stores
+    storeDir := filepath.Join(stage, snapshotDataStoreDirName)
+    for _, paths := range [][2]string{
+        {storeDir, filepath.Join(stage, snapshotDataIndexesDirName)},
+        {filepath.Join(storeDir, monitorRollupDirName), filepath.Join(stage, snapshotRollupIndexesDirName)},
+    } {
+        report, err := fsckMonitorDataStore(paths[0], paths[1], "", false)
+        Try(err)
+        Assert(report.intact(), "The stores of the snapshot are not intact: " + fmt.Sprint(report))
+        if !report.ok() {
+            EventLogger.Warnln(
+                "The store", filepath.Base(paths[0]), "of the snapshot has", len(report.Orphans), "orphan and",
+                len(report.Overlapping), "overlapping chunks; run -fsck after restoring to see them",
+            )
+        }
+    }
+
+    // Destinations
+    // + The private key is restored only when the snapshot has it
+    entries := [][2]string{}
+    for _, entry := range srv.snapshotEntries(true) {
+        if _, err := os.Stat(filepath.Join(stage, entry[0])); err == nil {
+            entries = append(entries, entry)
+        }
+    }
+    for _, entry := range entries {
+        fis, err := ioutil.ReadDir(entry[1])
+        switch {
+        case os.IsNotExist(err):
+        case err == nil && len(fis) == 0: // Empty directory
+        default:
+            panic(fmt.Errorf("%s already exists; move it away to restore the snapshot", entry[1]))
+        }
+    }
+
+    // Move
+    for _, entry := range entries {
+        src := filepath.Join(stage, entry[0])
+        Try(EnsureDirectory(filepath.Dir(entry[1])))
+        os.Remove(entry[1]) // Empty directory
+        Try(os.Rename(src, entry[1]))
+        if entry[0] == snapshotAuthPrivateKeyName {
+            // The server refuses the key in any other mode
+            Try(os.Chmod(entry[1], 0400))
+        }
+    }
+
+    EventLogger.Infoln(
+        "Restored the snapshot taken at", time.Unix(manifest.Timestamp, 0).Format(time.RFC3339),
+        "with", len(manifest.Checksums), "files",
+    )
+    return nil
+
+}
+
+// Extracts the regular files of the snapshot to dir and returns their sums
+func extractSnapshot(r io.Reader, dir string) (sums map[string] string, err error) {
+
+    defer Catch(&err)
+
+    gr, err := gzip.NewReader(r)
+    Try(err)
+    tr := tar.NewReader(gr)
+
+    sums = make(map[string] string)
+    for {
+
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        Try(err)
+
+        switch hdr.Typeflag {
+        case tar.TypeDir:
+            continue
+        case tar.TypeReg, tar.TypeRegA:
+        default:
+            panic(fmt.Errorf("Unexpected entry %s", hdr.Name))
+        }
+
+        name := path.Clean(hdr.Name)
+        Assert(
+            !path.IsAbs(name) && name != ".." && !strings.HasPrefix(name, "../"),
+            "Unsafe path in the snapshot: " + hdr.Name,
+        )
+
+        p, err := ioutil.ReadAll(tr)
+        Try(err)
+        fn := filepath.Join(dir, filepath.FromSlash(name))
+        Try(EnsureDirectory(filepath.Dir(fn)))
+        Try(ioutil.WriteFile(fn, p, 0600))
+        sums[name] = fmt.Sprintf("%x", Sha256Sum(p))
+
+    }
+
+    return sums, nil
+
+}
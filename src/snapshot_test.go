@@ -0,0 +1,109 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+
+    dir := filepath.Dir(srv.config.DataStoreDir)
+    srv.config.ClientConfigPath   = filepath.Join(dir, "clientConfig.json")
+    srv.config.AuthPrivateKeyPath = filepath.Join(dir, "serverAuth.priv")
+
+    prevPath := flServerConfigPath
+    flServerConfigPath = filepath.Join(dir, "serverConfig.json")
+    defer func() { flServerConfigPath = prevPath }()
+
+    for fn, v := range map[string] interface{}{
+        flServerConfigPath: srv.config, srv.config.ClientConfigPath: srv.clientConfig,
+    } {
+        p, _ := json.Marshal(v)
+        if err := ioutil.WriteFile(fn, p, 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    ioutil.WriteFile(srv.config.AuthPrivateKeyPath, []byte("key"), 0600)
+
+    for ts := int64(60); ts <= 240 * 60; ts += 60 {
+        srv.RecordValueMap("cl-0", ts, map[string] interface{}{"load": float64(ts)}, 60)
+    }
+
+    // An orphan chunk, as left by an interrupted retention
+    _, orphan := createMonitorDataChunk("cl-0", "load", MonitorData{{1, 1, 60}})
+    ioutil.WriteFile(filepath.Join(srv.config.DataStoreDir, "orphan" + dataStoreExt), orphan, 0600)
+
+    // The private key is left out unless asked for
+    buf := bytes.NewBuffer(nil)
+    manifest, err := srv.Snapshot(buf, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := manifest.Checksums[snapshotAuthPrivateKeyName]; ok {
+        t.Error("the private key must be left out")
+    }
+    buf.Reset()
+    manifest, err = srv.Snapshot(buf, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := manifest.Checksums[snapshotAuthPrivateKeyName]; !ok {
+        t.Error("the private key must be included")
+    }
+    if len(srv.monitorDataStore.InMemory("cl-0", "load")) != 0 {
+        t.Error("the in-memory data must be stored")
+    }
+    snapshot := filepath.Join(dir, "snapshot.tar.gz")
+    ioutil.WriteFile(snapshot, buf.Bytes(), 0600)
+
+    // The paths exist
+    if err = NewServer().RestoreSnapshot(snapshot); err == nil || !strings.Contains(err.Error(), "already exists") {
+        t.Fatal("expected an error for existing paths, got", err)
+    }
+
+    for _, entry := range srv.snapshotEntries(true) {
+        os.RemoveAll(entry[1])
+    }
+    restored := NewServer()
+    if err = restored.RestoreSnapshot(snapshot); err != nil {
+        t.Fatal(err)
+    }
+    for name := range manifest.Checksums {
+        if !strings.HasPrefix(name, snapshotDataStoreDirName + "/") {
+            continue
+        }
+        rel := strings.TrimPrefix(name, snapshotDataStoreDirName + "/")
+        if _, err = os.Stat(filepath.Join(srv.config.DataStoreDir, rel)); err != nil {
+            t.Error("missing restored file:", err)
+        }
+    }
+    if fi, err := os.Stat(srv.config.AuthPrivateKeyPath); err != nil || fi.Mode().Perm() != 0400 {
+        t.Error("expected the private key to be restored in the mode 400:", err)
+    }
+    if err = restored.readClientMonitorIndexesMap(); err != nil {
+        t.Fatal(err)
+    }
+    if l := restored.GetClientMonitorDataLength("cl-0", "load"); l != 240 {
+        t.Errorf("expected 240 data after restore, got %d", l)
+    }
+
+    // Tampered
+    for _, entry := range srv.snapshotEntries(true) {
+        os.RemoveAll(entry[1])
+    }
+    p := buf.Bytes()
+    p[len(p) / 2] ^= 0xff
+    ioutil.WriteFile(snapshot, p, 0600)
+    if err = NewServer().RestoreSnapshot(snapshot); err == nil {
+        t.Error("expected an error for a tampered snapshot")
+    }
+
+}
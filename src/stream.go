@@ -0,0 +1,162 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "sync"
+    "time"
+)
+
+const (
+    streamBufferLength    = 256
+    streamMaxSubscribers  = 100
+    streamHeartbeatPeriod = 15 * time.Second
+)
+
+/*
+
+The values that RecordValueMap records are published to the subscribers of the
+stream, which are served as Server-Sent Events:
+
+event: sample
+data: {"client":"cl-1","key":"cpu-usage[0]","timestamp":1600000060,"value":12.5,"per":60}
+
+event: dropped
+data: {"dropped":12}
+
+: heartbeat
+
+The data of a sample are of the same shape as the rows of json lines exports.
+Publishing never blocks recording; when the buffer of a subscriber is full, its
+samples are dropped, and the number of the dropped samples is sent before the
+next sample. Heartbeats are sent while there are no samples, so that the
+subscribers that are gone are noticed.
+
+Server-Sent Events are plain HTTP responses that are written over time, which
+the HTTP server writes to the connections of the main listener directly.
+
+*/
+
+type sampleStream struct {
+    mu          sync.RWMutex
+    subscribers map[*sampleSubscriber] struct{}
+}
+
+type sampleSubscriber struct {
+    keep    func(clId, mKey string) bool // Called by the publishers concurrently
+    ch      chan monitorDataRow
+    mu      sync.Mutex
+    dropped int
+}
+
+func newSampleStream() *sampleStream {
+    return &sampleStream{
+        subscribers: make(map[*sampleSubscriber] struct{}),
+    }
+}
+
+// Returns a subscriber to the samples that keep decides to include, or nil if
+// there are too many subscribers
+func(ss *sampleStream) Subscribe(keep func(clId, mKey string) bool) *sampleSubscriber {
+
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+
+    if len(ss.subscribers) >= streamMaxSubscribers {
+        return nil
+    }
+    sub := &sampleSubscriber{
+        keep: keep,
+        ch:   make(chan monitorDataRow, streamBufferLength),
+    }
+    ss.subscribers[sub] = struct{}{}
+    return sub
+
+}
+
+func(ss *sampleStream) Unsubscribe(sub *sampleSubscriber) {
+    ss.mu.Lock()
+    delete(ss.subscribers, sub)
+    ss.mu.Unlock()
+}
+
+func(ss *sampleStream) Publish(entries []monitorWalEntry) {
+
+    if len(entries) == 0 {
+        return
+    }
+
+    ss.mu.RLock()
+    defer ss.mu.RUnlock()
+
+    for sub := range ss.subscribers {
+        for _, entry := range entries {
+            if !sub.keep(entry.clId, entry.mKey) {
+                continue
+            }
+            row := monitorDataRow{
+                entry.clId, entry.mKey, entry.datum.Timestamp, entry.datum.Value, entry.datum.Per,
+            }
+            select {
+            case sub.ch <- row:
+            default:
+                sub.mu.Lock()
+                sub.dropped++
+                sub.mu.Unlock()
+            }
+        }
+    }
+
+}
+
+// Returns the number of the samples dropped since the last call
+func(sub *sampleSubscriber) takeDropped() int {
+    sub.mu.Lock()
+    defer sub.mu.Unlock()
+    n := sub.dropped
+    sub.dropped = 0
+    return n
+}
+
+// Writes the samples of the subscriber as Server-Sent Events until the request
+// is done
+func(sub *sampleSubscriber) serveEvents(w http.ResponseWriter, r *http.Request) error {
+
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        return fmt.Errorf("The response writer cannot flush")
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(200)
+    flusher.Flush()
+
+    heartbeat := time.NewTicker(streamHeartbeatPeriod)
+    defer heartbeat.Stop()
+
+    for {
+        var err error
+        select {
+        case <-r.Context().Done():
+            return nil
+        case <-heartbeat.C:
+            _, err = fmt.Fprint(w, ": heartbeat\n\n")
+        case row := <-sub.ch:
+            if n := sub.takeDropped(); n > 0 {
+                _, err = fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", n)
+            }
+            if err == nil && !math.IsNaN(row.Value) && !math.IsInf(row.Value, 0) {
+                p, _  := json.Marshal(row)
+                _, err = fmt.Fprintf(w, "event: sample\ndata: %s\n\n", p)
+            }
+        }
+        if err != nil {
+            return err
+        }
+        flusher.Flush()
+    }
+
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "./log"
+)
+
+func TestSampleStreamDrop(t *testing.T) {
+
+    ss  := newSampleStream()
+    sub := ss.Subscribe(func(clId, mKey string) bool { return mKey == "load" })
+    for i := 0; i < streamBufferLength + 10; i++ {
+        ss.Publish([]monitorWalEntry{
+            {"cl-0", "load", MonitorDatum{int64(i), 1, 60}},
+            {"cl-0", "cpu-usage", MonitorDatum{int64(i), 1, 60}},
+        })
+    }
+    if len(sub.ch) != streamBufferLength || sub.takeDropped() != 10 || sub.takeDropped() != 0 {
+        t.Errorf("unexpected buffer %d", len(sub.ch))
+    }
+
+    ss.Unsubscribe(sub)
+    ss.Publish([]monitorWalEntry{{"cl-0", "load", MonitorDatum{0, 1, 60}}})
+    if sub.takeDropped() != 0 {
+        t.Error("unexpected publish after unsubscribing")
+    }
+
+}
+
+func TestSampleStreamThroughMainListener(t *testing.T) {
+
+    srv, cleanup := t_newStoreTestServer(t)
+    defer cleanup()
+    AccessLogger = &log.Logger{}
+
+    srv.config.HttpUsers = []HttpUser{{
+        Name:        "user",
+        Password:    fmt.Sprintf("%x", Sha256Sum([]byte("password"))),
+        Permissions: []string{"api/v1.get.stream.cl-0.*"},
+    }}
+
+    // The main listener and the HTTP server
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    srv.httpListener = newConnListener(ln.Addr())
+    defer srv.httpListener.Close()
+    srv.connThrottle = newHostThrottle(time.Second / time.Duration(srv.config.Tickrate))
+    srv.populateHttpRouter()
+    go http.Serve(srv.httpListener, srv)
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go srv.serveConn(conn)
+        }
+    }()
+
+    // Subscribe
+    req, _ := http.NewRequest("GET", "http://" + ln.Addr().String() + "/api/v1/stream?key=lo*", nil)
+    req.SetBasicAuth("user", "password")
+    rsp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rsp.StatusCode != 200 || rsp.Header.Get("Content-Type") != "text/event-stream" {
+        t.Fatalf("unexpected response %d", rsp.StatusCode)
+    }
+
+    lines := make(chan string)
+    go func() {
+        rd := bufio.NewReader(rsp.Body)
+        for {
+            line, err := rd.ReadString('\n')
+            if err != nil {
+                close(lines)
+                return
+            }
+            if line = strings.TrimSpace(line); strings.HasPrefix(line, "data: ") {
+                lines <- line
+            }
+        }
+    }()
+
+    srv.RecordValueMap("cl-1", 100, map[string] interface{}{"load": 0.5}, 60) // Not permitted
+    srv.RecordValueMap("cl-0", 100, map[string] interface{}{"load": 1.5, "cpu-usage": 10.0}, 60)
+    srv.RecordValueMap("cl-0", 100, map[string] interface{}{"load": 1.5}, 60) // Already recorded
+    srv.RecordValueMap("cl-0", 160, map[string] interface{}{"load": 2.5}, 60)
+
+    for _, expected := range []string{
+        `data: {"client":"cl-0","key":"load","timestamp":100,"value":1.5,"per":60}`,
+        `data: {"client":"cl-0","key":"load","timestamp":160,"value":2.5,"per":60}`,
+    } {
+        select {
+        case line := <-lines:
+            if line != expected {
+                t.Errorf("expected %s, got %s", expected, line)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatal("timed out")
+        }
+    }
+
+    // Unsubscribed when the client is gone
+    rsp.Body.Close()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        srv.sampleStream.mu.RLock()
+        n := len(srv.sampleStream.subscribers)
+        srv.sampleStream.mu.RUnlock()
+        if n == 0 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("the subscriber was not released")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+}
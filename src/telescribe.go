@@ -8,6 +8,7 @@ import (
     "os/signal"
     "path/filepath"
     "strconv"
+    "strings"
     "syscall"
     "time"
     "./log"
@@ -24,11 +25,25 @@ const (
 var (
     flServer bool
     flServerConfigPath string
+    flServerMigrateStore bool
+    flServerRetentionDryRun bool
+    flServerFsck bool
+    flServerFsckRepair bool
+    flServerExport string
+    flServerImport string
+    flServerDataFormat string
+    flServerExportClients string
+    flServerExportFrom int64
+    flServerExportTo int64
+    flServerSnapshot string
+    flServerSnapshotAuthKey bool
+    flServerRestore string
 
     flClientHostname string
     flClientAlias string
     flClientPort int
     flClientKnownHostsPath string
+    flClientSpoolDir string
     flClientDaemon bool
 
     flDebug bool
@@ -48,6 +63,58 @@ func setFlags() (err error) {
         &flServerConfigPath, "server_config_path", "./serverConfig.json",
         "(Server) The path to the server config file. The server configuration must be done in a file rather than in a command.",
     )
+    flag.BoolVar(
+        &flServerMigrateStore, "migrate_store", false,
+        "(Server) Rewrite the stored monitor data of older formats in the current format and exit",
+    )
+    flag.BoolVar(
+        &flServerRetentionDryRun, "retention_dry_run", false,
+        "(Server) Print what the retention policies would remove from the stored monitor data and exit",
+    )
+    flag.BoolVar(
+        &flServerFsck, "fsck", false,
+        "(Server) Check the integrity of the stored monitor data and the indexes and exit",
+    )
+    flag.BoolVar(
+        &flServerFsckRepair, "fsck_repair", false,
+        "(Server) Check the stored monitor data, rebuild the indexes from the chunks if there is any problem, and exit",
+    )
+    flag.StringVar(
+        &flServerExport, "export", "",
+        "(Server) Export the stored monitor data to the file, or to the standard output if it is -, and exit",
+    )
+    flag.StringVar(
+        &flServerImport, "import", "",
+        "(Server) Import monitor data from the file, or from the standard input if it is -, and exit",
+    )
+    flag.StringVar(
+        &flServerDataFormat, "data_format", "",
+        "(Server) The format for -export and -import: csv, jsonl, or openmetrics. It is guessed from the file extension if omitted.",
+    )
+    flag.StringVar(
+        &flServerExportClients, "export_clients", "",
+        "(Server) The comma-separated client ids to export; every client is exported if omitted",
+    )
+    flag.Int64Var(
+        &flServerExportFrom, "export_from", 0,
+        "(Server) The unix timestamp from which the monitor data are exported",
+    )
+    flag.Int64Var(
+        &flServerExportTo, "export_to", 0,
+        "(Server) The unix timestamp until which the monitor data are exported; no limit if 0",
+    )
+    flag.StringVar(
+        &flServerSnapshot, "snapshot", "",
+        "(Server) Write a snapshot of the server to the file, or to the standard output if it is -, and exit. Use the snapshot endpoint of the API for a running server.",
+    )
+    flag.BoolVar(
+        &flServerSnapshotAuthKey, "snapshot_auth_key", false,
+        "(Server) Include the private key of the server in the snapshot of -snapshot, so that the clients keep trusting the restored server. The snapshots of the API never include it.",
+    )
+    flag.StringVar(
+        &flServerRestore, "restore", "",
+        "(Server) Check the snapshot file and restore it to the paths of the server config in it, and exit",
+    )
 
     // Client flags
     flag.StringVar(
@@ -66,6 +133,10 @@ func setFlags() (err error) {
         &flClientKnownHostsPath, "known_hosts_path", "./clientKnownHosts",
         "(Client) The file that contains all the public key fingerprints of the accepted servers. Crucial for preventing MITM attacks that may exploit the auto update procedure.",
     )
+    flag.StringVar(
+        &flClientSpoolDir, "spool_dir", "./clientSpool.d",
+        "(Client) The directory in which the records that could not be sent to the server are kept until they are sent.",
+    )
     flag.BoolVar(
         &flClientDaemon, "daemon", false, 
         "(Client) Whether to run the client as daemon.",
@@ -115,6 +186,7 @@ func setFlags() (err error) {
 
 const (
     threadMain = iota
+    threadSnapshot
 )
 var railSwitch *together.RailSwitch
 func registerSignalHandler() {
@@ -236,6 +308,40 @@ func main() {
         AccessLogger.AddWriter(AccessLogFile, nil)
 
         srv := NewServer()
+        if flServerMigrateStore {
+            Try(srv.MigrateMonitorDataStore())
+            return
+        }
+        if flServerRetentionDryRun {
+            Try(srv.ReportMonitorDataRetention(os.Stdout))
+            return
+        }
+        if flServerFsck || flServerFsckRepair {
+            Try(srv.Fsck(os.Stdout, flServerFsckRepair))
+            return
+        }
+        if flServerExport != "" {
+            filter := MonitorExportFilter{From: flServerExportFrom, To: flServerExportTo}
+            if flServerExportClients != "" {
+                filter.ClientIds = strings.Split(flServerExportClients, ",")
+            }
+            Try(srv.ExportMonitorDataFile(flServerExport, flServerDataFormat, filter))
+            return
+        }
+        if flServerSnapshot != "" {
+            Try(srv.SnapshotFile(flServerSnapshot, flServerSnapshotAuthKey))
+            return
+        }
+        if flServerRestore != "" {
+            Try(srv.RestoreSnapshot(flServerRestore))
+            return
+        }
+        if flServerImport != "" {
+            report, err := srv.ImportMonitorDataFile(flServerImport, flServerDataFormat)
+            Try(err)
+            EventLogger.Infoln("Imported", report.Imported, "data and skipped", report.Skipped)
+            return
+        }
         Try(srv.Start())
 
     }
@@ -1,9 +1,11 @@
 package main
 
 import (
+    "fmt"
     "math"
     "strconv"
     "strings"
+    "sync"
 )
 
 //
@@ -11,9 +13,51 @@ import (
 //
 type Range string
 var parsedRanges = make(map[Range] func(float64) bool)
+var parsedRangesMu sync.RWMutex
 
 func (r Range) Parse() {
 
+    parsedRangesMu.Lock()
+    defer parsedRangesMu.Unlock()
+
+    numSplits, err := r.splits()
+    if err != nil {
+        parsedRanges[r] = func(val float64) bool {
+            EventLogger.Warnln(r, "is a malformed range!")
+            return false
+        }
+        return
+    }
+
+    // Assign
+    parsedRanges[r] = func(val float64) bool {
+        //
+        for _, split := range numSplits {
+            if len(split) == 1 {
+                if val == split[0] {
+                    return true
+                }
+            } else {
+                if val >= split[0] && val <= split[1] {
+                    return true
+                }
+            }
+        }
+        return false
+    }
+
+}
+
+// Returns an error when the range is malformed
+func (r Range) Validate() error {
+    if _, err := r.splits(); err != nil {
+        return fmt.Errorf("%s is a malformed range", r)
+    }
+    return nil
+}
+
+func (r Range) splits() ([][]float64, error) {
+
     // Prepare Splits
     commaSplits := SplitComma(string(r))
     numSplits   := make([][]float64, len(commaSplits))
@@ -41,41 +85,61 @@ func (r Range) Parse() {
                 // If not empty
                 num, err = strconv.ParseFloat(splits[j], 64)
                 if err != nil {
-                    parsedRanges[r] = func(val float64) bool {
-                        EventLogger.Warnln(r, "is a malformed range!")
-                        return false
-                    }
-                    return
+                    return nil, err
                 }
             }
             numSplits[i][j] = num
         }
     }
-
-    // Assign
-    parsedRanges[r] = func(val float64) bool {
-        //
-        for _, split := range numSplits {
-            if len(split) == 1 {
-                if val == split[0] {
-                    return true
-                }
-            } else {
-                if val >= split[0] && val <= split[1] {
-                    return true
-                }
-            }
-        }
-        return false
-    }
+    return numSplits, nil
 
 }
 
 func (r Range) Includes(val float64) bool {
+    parsedRangesMu.RLock()
     pr, ok := parsedRanges[r]
+    parsedRangesMu.RUnlock()
     if !ok || pr == nil {
         r.Parse()
+        parsedRangesMu.RLock()
         pr = parsedRanges[r]
+        parsedRangesMu.RUnlock()
     }
     return pr(val)
 }
+
+//
+// RETENTION
+//
+type Retention string
+
+var retentionUnits = map[byte] int64{
+    's': 1,
+    'm': 60,
+    'h': 60 * 60,
+    'd': 60 * 60 * 24,
+    'w': 60 * 60 * 24 * 7,
+    'y': 60 * 60 * 24 * 365,
+}
+
+// Returns the retention period in seconds, e.g., 90d, 12h, 1y; empty string
+// stands for keeping data forever and yields 0
+func (rt Retention) Seconds() (int64, error) {
+
+    str := strings.TrimSpace(string(rt))
+    if str == "" {
+        return 0, nil
+    }
+
+    unit, ok := retentionUnits[str[len(str) - 1]]
+    if !ok {
+        return 0, fmt.Errorf("Retention %q must end with one of s, m, h, d, w, and y", str)
+    }
+    num, err := strconv.ParseInt(str[:len(str) - 1], 10, 64)
+    if err != nil || num <= 0 {
+        return 0, fmt.Errorf("Retention %q must be a positive integer followed by a unit", str)
+    }
+
+    return num * unit, nil
+
+}
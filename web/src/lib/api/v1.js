@@ -80,6 +80,22 @@ export default {
     );
   },
 
+  keyMdCols: "monitorDataColumns",
+  async getMonitorDataColumns(patterns, filter) {
+    return await apiFetch(
+      "POST", "json", {patterns, filter}, this.keyMdCols
+    );
+  },
+
+  keyStream: "stream",
+  // query is an object or an array of pairs of client, tag, and key patterns
+  streamSamples(query, onSample) {
+    let params = new URLSearchParams(query);
+    let source = new EventSource(`${formatURI(this.keyStream)}?${params}`);
+    source.addEventListener("sample", ev => onSample(JSON.parse(ev.data)));
+    return source;
+  },
+
   keyWebCfg: "webConfig",
   async getWebConfig() {
     return await apiFetch(